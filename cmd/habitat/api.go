@@ -27,12 +27,26 @@ func getRouter(n *node.Node, cm *community.Manager) *mux.Router {
 	router.HandleFunc(ctl.GetRoute(ctl.CommandCommunityCreate), cm.CommunityCreateHandler)
 	router.HandleFunc(ctl.GetRoute(ctl.CommandCommunityJoin), cm.CommunityJoinHandler)
 	router.HandleFunc(ctl.GetRoute(ctl.CommandCommunityAddMember), cm.CommunityAddMemberHandler)
+	router.HandleFunc(ctl.GetRoute(ctl.CommandCommunityRemoveNode), cm.CommunityRemoveNodeHandler)
+	router.HandleFunc(ctl.GetRoute(ctl.CommandCommunitySetNodeLabels), cm.CommunitySetNodeLabelsHandler)
+	router.HandleFunc(ctl.GetRoute(ctl.CommandCommunityRemoveMember), cm.CommunityRemoveMemberHandler)
+	router.HandleFunc(ctl.GetRoute(ctl.CommandCommunityLeave), cm.CommunityLeaveHandler)
 	router.HandleFunc(ctl.GetRoute(ctl.CommandCommunityPropose), cm.CommunityProposeHandler)
 	router.HandleFunc(ctl.GetRoute(ctl.CommandCommunityState), cm.CommunityStateHandler)
+	router.HandleFunc(ctl.GetRoute(ctl.CommandCommunityHistory), cm.CommunityHistoryHandler)
+	router.HandleFunc(ctl.GetRoute(ctl.CommandCommunityWatch), cm.CommunityWatchHandler)
+	router.HandleFunc(ctl.GetRoute(ctl.CommandCommunitySnapshotExport), cm.CommunitySnapshotExportHandler)
+	router.HandleFunc(ctl.GetRoute(ctl.CommandCommunitySnapshotImport), cm.CommunitySnapshotImportHandler)
+	router.HandleFunc(ctl.GetRoute(ctl.CommandCommunityBackup), cm.CommunityBackupHandler)
+	router.HandleFunc(ctl.GetRoute(ctl.CommandCommunityRestore), cm.CommunityRestoreHandler)
+	router.HandleFunc(ctl.GetRoute(ctl.CommandCommunityClusterStatus), cm.CommunityClusterStatusHandler)
+	router.HandleFunc(ctl.GetRoute(ctl.CommandCommunityTransferLeadership), cm.CommunityTransferLeadershipHandler)
+	router.HandleFunc(ctl.GetRoute(ctl.CommandCommunityRaftConfig), cm.CommunityRaftConfigHandler)
 	router.HandleFunc(ctl.GetRoute(ctl.CommandCommunityList), cm.CommunityListHandler)
 	router.HandleFunc(ctl.GetRoute(ctl.CommandCommunityPS), cm.CommunityPSHandler)
 	router.HandleFunc(ctl.GetRoute(ctl.CommandCommunityStartProcess), cm.CommunityStartProcessHandler)
 	router.HandleFunc(ctl.GetRoute(ctl.CommandCommunityStopProcess), cm.CommunityStopProcessHandler)
+	router.HandleFunc(ctl.GetRoute(ctl.CommandCommunityUpdateProcess), cm.CommunityUpdateProcessHandler)
 	router.HandleFunc(ctl.GetRoute(ctl.CommandDataServerRead), n.DataProxy.ReadHandler)
 	router.HandleFunc(ctl.GetRoute(ctl.CommandDataServerWrite), n.DataProxy.WriteHandler)
 
@@ -0,0 +1,336 @@
+package community
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/eagraf/habitat/cmd/habitat/community/state"
+	"github.com/eagraf/habitat/pkg/compass"
+	"github.com/eagraf/habitat/pkg/identity"
+	"github.com/eagraf/habitat/structs/community"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	backupFormatVersion = 1
+
+	backupManifestFile   = "manifest.json"
+	backupSnapshotFile   = "snapshot"
+	backupMemberCertsDir = "certificates/members"
+	backupNodeCertsDir   = "certificates/nodes"
+	backupIPFSConfigFile = "ipfs/config"
+	backupSwarmKeyFile   = "ipfs/swarm.key"
+	backupPinsFile       = "ipfs/pins"
+)
+
+// BackupManifest describes the contents of a community backup archive
+type BackupManifest struct {
+	FormatVersion int       `json:"format_version"`
+	CommunityID   string    `json:"community_id"`
+	CreatedAt     time.Time `json:"created_at"`
+	NodeID        string    `json:"node_id"` // node the backup was made on
+	SchemaVersion int       `json:"schema_version"`
+	Index         uint64    `json:"index"` // Raft index of the snapshot
+}
+
+// communityBackup holds everything needed to bring a community back after all of its nodes were
+// lost. The certificates are also part of the snapshot, but are stored separately so that they
+// can be recovered without decoding it.
+type communityBackup struct {
+	manifest    *BackupManifest
+	snapshot    []byte
+	memberCerts map[string][]byte
+	nodeCerts   map[string][]byte
+	ipfsConfig  []byte // config file of the community's IPFS repo, if this node has one
+	swarmKey    []byte
+	pins        []string
+}
+
+// encode bundles the backup into a compressed tar archive, encrypted with password
+func (b *communityBackup) encode(password []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(zw)
+
+	manifest, err := json.Marshal(b.manifest)
+	if err != nil {
+		return nil, err
+	}
+
+	files := map[string][]byte{
+		backupManifestFile: manifest,
+		backupSnapshotFile: b.snapshot,
+	}
+	for id, cert := range b.memberCerts {
+		files[path.Join(backupMemberCertsDir, id+".pem")] = cert
+	}
+	for id, cert := range b.nodeCerts {
+		files[path.Join(backupNodeCertsDir, id+".pem")] = cert
+	}
+	if b.ipfsConfig != nil {
+		files[backupIPFSConfigFile] = b.ipfsConfig
+	}
+	if b.swarmKey != nil {
+		files[backupSwarmKeyFile] = b.swarmKey
+	}
+	if b.pins != nil {
+		files[backupPinsFile] = []byte(strings.Join(b.pins, "\n"))
+	}
+
+	for name, data := range files {
+		err = tw.WriteHeader(&tar.Header{
+			Name:    name,
+			Mode:    0600,
+			Size:    int64(len(data)),
+			ModTime: b.manifest.CreatedAt,
+		})
+		if err != nil {
+			return nil, err
+		}
+		_, err = tw.Write(data)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err = tw.Close()
+	if err != nil {
+		return nil, err
+	}
+	err = zw.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	return identity.EncryptWithPassword(buf.Bytes(), password)
+}
+
+// decodeBackup decrypts and unpacks an archive created by encode
+func decodeBackup(archive, password []byte) (*communityBackup, error) {
+	plaintext, err := identity.DecryptWithPassword(archive, password)
+	if err != nil {
+		return nil, fmt.Errorf("error decrypting backup, the password may be wrong: %s", err)
+	}
+
+	zr, err := gzip.NewReader(bytes.NewReader(plaintext))
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+
+	b := &communityBackup{
+		memberCerts: make(map[string][]byte),
+		nodeCerts:   make(map[string][]byte),
+	}
+
+	tr := tar.NewReader(zr)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+
+		data, err := ioutil.ReadAll(tr)
+		if err != nil {
+			return nil, err
+		}
+
+		dir, file := path.Split(header.Name)
+		switch {
+		case header.Name == backupManifestFile:
+			err = json.Unmarshal(data, &b.manifest)
+			if err != nil {
+				return nil, fmt.Errorf("invalid backup manifest: %s", err)
+			}
+		case header.Name == backupSnapshotFile:
+			b.snapshot = data
+		case dir == backupMemberCertsDir+"/":
+			b.memberCerts[strings.TrimSuffix(file, ".pem")] = data
+		case dir == backupNodeCertsDir+"/":
+			b.nodeCerts[strings.TrimSuffix(file, ".pem")] = data
+		case header.Name == backupIPFSConfigFile:
+			b.ipfsConfig = data
+		case header.Name == backupSwarmKeyFile:
+			b.swarmKey = data
+		case header.Name == backupPinsFile:
+			b.pins = strings.Fields(string(data))
+		default:
+			log.Warn().Msgf("ignoring unknown file %s in community backup", header.Name)
+		}
+	}
+
+	if b.manifest == nil || b.snapshot == nil {
+		return nil, errors.New("backup is missing its manifest or snapshot")
+	}
+	if b.manifest.FormatVersion > backupFormatVersion {
+		return nil, fmt.Errorf("backup format version %d is not supported", b.manifest.FormatVersion)
+	}
+
+	return b, nil
+}
+
+// BackupCommunity bundles the latest snapshot of a community's state together with its
+// certificates, IPFS configuration and pinned content into an archive encrypted with password.
+func (m *Manager) BackupCommunity(communityID string, password []byte) ([]byte, error) {
+	if !m.checkCommunityExists(communityID) {
+		return nil, fmt.Errorf("community %s does not exist in communities directory", communityID)
+	}
+
+	snapshot, err := m.clusterManager.ExportSnapshot(communityID)
+	if err != nil {
+		return nil, err
+	}
+
+	header, commStateBytes, err := state.ReadSnapshot(bytes.NewReader(snapshot))
+	if err != nil {
+		return nil, err
+	}
+	var commState community.CommunityState
+	err = json.Unmarshal(commStateBytes, &commState)
+	if err != nil {
+		return nil, err
+	}
+
+	backup := &communityBackup{
+		manifest: &BackupManifest{
+			FormatVersion: backupFormatVersion,
+			CommunityID:   communityID,
+			CreatedAt:     time.Now().UTC(),
+			NodeID:        m.node.ID,
+			SchemaVersion: header.SchemaVersion,
+			Index:         header.Index,
+		},
+		snapshot:    snapshot,
+		memberCerts: make(map[string][]byte),
+		nodeCerts:   make(map[string][]byte),
+	}
+	for _, member := range commState.Members {
+		backup.memberCerts[member.ID] = member.Certificate
+	}
+	for _, node := range commState.Nodes {
+		backup.nodeCerts[node.ID] = node.Certificate
+	}
+
+	if commState.IPFSConfig != nil {
+		backup.swarmKey = []byte(commState.IPFSConfig.SwarmKey)
+
+		backup.ipfsConfig, err = ioutil.ReadFile(filepath.Join(compass.CommunitiesPath(), communityID, "ipfs", "config"))
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return nil, fmt.Errorf("error reading IPFS config: %s", err)
+		}
+
+		backup.pins, err = m.node.IPFSClient.ListPins()
+		if err != nil {
+			return nil, fmt.Errorf("error listing pinned content: %s", err)
+		}
+	}
+
+	return backup.encode(password)
+}
+
+// RestoreCommunity brings back a community from a backup made with BackupCommunity, after all
+// of its nodes were lost. This node becomes the only node in the community's Raft cluster, and
+// must be one of the nodes in the backed up state so that it can keep proposing transitions.
+// Pinned content is fetched again in the background.
+func (m *Manager) RestoreCommunity(archive []byte, password []byte) (*community.CommunityState, error) {
+	backup, err := decodeBackup(archive, password)
+	if err != nil {
+		return nil, err
+	}
+
+	_, commStateBytes, err := state.ReadSnapshot(bytes.NewReader(backup.snapshot))
+	if err != nil {
+		return nil, fmt.Errorf("invalid snapshot in backup: %s", err)
+	}
+	var commState community.CommunityState
+	err = json.Unmarshal(commStateBytes, &commState)
+	if err != nil {
+		return nil, fmt.Errorf("invalid snapshot in backup: %s", err)
+	}
+
+	communityID := backup.manifest.CommunityID
+	if commState.CommunityID != communityID {
+		return nil, fmt.Errorf("backup manifest is for community %s, but its snapshot is of community %s", communityID, commState.CommunityID)
+	}
+	if commState.GetNode(m.node.ID) == nil {
+		return nil, fmt.Errorf("node %s is not part of community %s, restore the backup on one of its nodes", m.node.ID, communityID)
+	}
+
+	commExists, err := m.setupCommunity(communityID)
+	if commExists {
+		return nil, fmt.Errorf("can't restore community %s, it is already on this node", communityID)
+	} else if err != nil {
+		return nil, err
+	}
+
+	if backup.ipfsConfig != nil || backup.swarmKey != nil {
+		err = restoreIPFSFiles(communityID, backup)
+		if err != nil {
+			return nil, fmt.Errorf("error restoring IPFS config: %s", err)
+		}
+	}
+
+	updateChan, err := m.clusterManager.RecoverCluster(communityID, backup.snapshot)
+	if err != nil {
+		return nil, err
+	}
+
+	stateMachine, err := state.NewCommunityStateMachine(&commState, updateChan, &ClusterDispatcher{
+		communityID:    communityID,
+		clusterManager: m.clusterManager,
+	}, m.executors, m.nodeIdentity)
+	if err != nil {
+		return nil, err
+	}
+
+	err = m.addCommunity(communityID, stateMachine)
+	if err != nil {
+		return nil, err
+	}
+
+	go func() {
+		for _, cid := range backup.pins {
+			_, err := m.node.IPFSClient.AddPin(cid)
+			if err != nil {
+				log.Error().Err(err).Msgf("error pinning %s while restoring community %s", cid, communityID)
+			}
+		}
+	}()
+
+	return m.migrateRestoredCommunity(stateMachine, &commState), nil
+}
+
+func restoreIPFSFiles(communityID string, backup *communityBackup) error {
+	ipfsPath := filepath.Join(compass.CommunitiesPath(), communityID, "ipfs")
+	err := os.MkdirAll(ipfsPath, 0700)
+	if err != nil {
+		return err
+	}
+
+	if backup.ipfsConfig != nil {
+		err = ioutil.WriteFile(filepath.Join(ipfsPath, "config"), backup.ipfsConfig, 0600)
+		if err != nil {
+			return err
+		}
+	}
+	if backup.swarmKey != nil {
+		err = ioutil.WriteFile(filepath.Join(ipfsPath, "swarm.key"), backup.swarmKey, 0600)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
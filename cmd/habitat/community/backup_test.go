@@ -0,0 +1,44 @@
+package community
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBackupArchive(t *testing.T) {
+	backup := &communityBackup{
+		manifest: &BackupManifest{
+			FormatVersion: backupFormatVersion,
+			CommunityID:   "abc",
+			CreatedAt:     time.Now().UTC().Truncate(time.Second),
+			NodeID:        "node1",
+			SchemaVersion: 2,
+			Index:         12,
+		},
+		snapshot: []byte("snapshot"),
+		memberCerts: map[string][]byte{
+			"member1": []byte("member cert"),
+		},
+		nodeCerts: map[string][]byte{
+			"node1": []byte("node1 cert"),
+			"node2": []byte("node2 cert"),
+		},
+		swarmKey: []byte("/key/swarm/psk/1.0.0/\n/base16/\nabc\n"),
+		pins:     []string{"QmA", "QmB"},
+	}
+
+	archive, err := backup.encode([]byte("hunter2"))
+	require.Nil(t, err)
+
+	decoded, err := decodeBackup(archive, []byte("hunter2"))
+	require.Nil(t, err)
+	assert.Equal(t, backup.manifest.CreatedAt, decoded.manifest.CreatedAt)
+	decoded.manifest.CreatedAt = backup.manifest.CreatedAt
+	assert.Equal(t, backup, decoded)
+
+	_, err = decodeBackup(archive, []byte("hunter3"))
+	assert.NotNil(t, err)
+}
@@ -1,100 +1,311 @@
 package cluster
 
 import (
+	"fmt"
 	"net/url"
+	"sync"
 
+	"github.com/eagraf/habitat/cmd/habitat/community/consensus/local"
 	"github.com/eagraf/habitat/cmd/habitat/community/consensus/raft"
 	"github.com/eagraf/habitat/cmd/habitat/community/state"
 	"github.com/eagraf/habitat/cmd/habitat/proxy"
+	"github.com/eagraf/habitat/pkg/compass"
 	"github.com/eagraf/habitat/structs/community"
 	"github.com/libp2p/go-libp2p/core/host"
 )
 
+const (
+	// BackendRaft replicates a community's state across its nodes with Raft
+	BackendRaft = "raft"
+	// BackendLocal runs a community on a single node, without any replication
+	BackendLocal = "local"
+)
+
 type ClusterService interface {
 	Start() error
 
+	// HasCluster returns true if the service has stored data for the community, which means the
+	// community was running on it before this node restarted
+	HasCluster(communityID string) bool
+
 	CreateCluster(communityID string) (<-chan state.StateUpdate, error)
 	RemoveCluster(communityID string) error
 	JoinCluster(communityID string, address string) (<-chan state.StateUpdate, error)
 	RestoreNode(communityID string) (<-chan state.StateUpdate, error)
+	ImportSnapshot(communityID string, snapshot []byte, standalone bool) (<-chan state.StateUpdate, error)
+	RecoverCluster(communityID string, snapshot []byte) (<-chan state.StateUpdate, error)
 
 	// These methods should not be called directly, but rather be accessed via the state machine API
 	// They remain exposed for debugging and using the cli
 	ProposeTransitions(communityID string, transition []byte) (*community.CommunityState, error) // Note that ProposeTransitions should be blocking
 	GetState(communityID string) ([]byte, error)
+	GetHistory(communityID string, before uint64, limit int, transitionType string) ([]*state.HistoryEntry, uint64, error)
+	ExportSnapshot(communityID string) ([]byte, error)
+	ClusterStatus(communityID string) (*state.ClusterStatus, error)
+	TransferLeadership(communityID string, nodeID string) error
+
+	// ReloadConfig applies the community's Raft settings, on backends that run Raft
+	ReloadConfig(communityID string, config *community.RaftConfig) error
 
 	AddNode(communityID string, nodeID string, address string) error
 	RemoveNode(communityID string, nodeID string) error
 }
 
 // ClusterManager is a layer of abstraction that allows multiple Cluster Services to share
-// a common interface.
-// TODO Right now, the only cluster service implementation is Raft, so the switching implementation
-// needs to be implemented in the future.
+// a common interface. Each community runs on one of the manager's backends, which is picked
+// when the community is created.
 type ClusterManager struct {
-	raftClusterService *raft.ClusterService
+	backends       map[string]ClusterService
+	defaultBackend string
+
+	communities     map[string]ClusterService
+	communitiesLock *sync.Mutex
 }
 
 func NewClusterManager(host host.Host) *ClusterManager {
-	raft := raft.NewClusterService(host)
+	return NewClusterManagerWithBackends(BackendRaft, map[string]ClusterService{
+		BackendRaft:  raft.NewClusterService(host),
+		BackendLocal: local.NewClusterService(compass.CommunitiesPath()),
+	})
+}
+
+// NewLocalClusterManager returns a manager that runs every community on the local backend, which
+// doesn't need any networking. Community state is persisted under path if it is set.
+func NewLocalClusterManager(path string) *ClusterManager {
+	return NewClusterManagerWithBackends(BackendLocal, map[string]ClusterService{
+		BackendLocal: local.NewClusterService(path),
+	})
+}
+
+// NewClusterManagerWithBackends returns a manager running communities on the given backends, keyed
+// by name. Communities are created on defaultBackend unless another one is asked for.
+func NewClusterManagerWithBackends(defaultBackend string, backends map[string]ClusterService) *ClusterManager {
 	return &ClusterManager{
-		raftClusterService: raft,
+		backends:        backends,
+		defaultBackend:  defaultBackend,
+		communities:     make(map[string]ClusterService),
+		communitiesLock: &sync.Mutex{},
 	}
 }
 
 func (cm *ClusterManager) Start(proxyRules *proxy.RuleSet) error {
-	// TODO fix this when centralized port management is implemented
-	url, err := url.Parse("http://0.0.0.0:6000/raft/msg")
+	if _, ok := cm.backends[BackendRaft]; ok {
+		// TODO fix this when centralized port management is implemented
+		url, err := url.Parse("http://0.0.0.0:6000/raft/msg")
+		if err != nil {
+			return err
+		}
+
+		err = proxyRules.Add("raft-service", &proxy.RedirectRule{
+			Matcher:         "/raft/msg",
+			ForwardLocation: url,
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	for name, backend := range cm.backends {
+		err := backend.Start()
+		if err != nil {
+			return fmt.Errorf("error starting %s cluster backend: %s", name, err)
+		}
+	}
+
+	return nil
+}
+
+// getBackend returns the backend with the given name, or the default backend if name is empty
+func (cm *ClusterManager) getBackend(name string) (ClusterService, error) {
+	if name == "" {
+		name = cm.defaultBackend
+	}
+
+	backend, ok := cm.backends[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown cluster backend %s", name)
+	}
+	return backend, nil
+}
+
+// communityBackend returns the backend a community is running on
+func (cm *ClusterManager) communityBackend(communityID string) (ClusterService, error) {
+	cm.communitiesLock.Lock()
+	defer cm.communitiesLock.Unlock()
+
+	backend, ok := cm.communities[communityID]
+	if !ok {
+		return nil, fmt.Errorf("community %s is not running on any cluster backend", communityID)
+	}
+	return backend, nil
+}
+
+// startCommunity runs fn to start a community on a backend, and keeps track of the backend if it succeeds
+func (cm *ClusterManager) startCommunity(communityID string, backend ClusterService, fn func() (<-chan state.StateUpdate, error)) (<-chan state.StateUpdate, error) {
+	updateChan, err := fn()
 	if err != nil {
-		return err
+		return nil, err
+	}
+
+	cm.communitiesLock.Lock()
+	defer cm.communitiesLock.Unlock()
+	cm.communities[communityID] = backend
+
+	return updateChan, nil
+}
+
+// CreateCluster starts a new community on the named backend, or on the default backend if
+// backendName is empty
+func (cm *ClusterManager) CreateCluster(communityID string, backendName string) (<-chan state.StateUpdate, error) {
+	backend, err := cm.getBackend(backendName)
+	if err != nil {
+		return nil, err
 	}
 
-	// TODO switch between implementations of cluster services
-	err = proxyRules.Add("raft-service", &proxy.RedirectRule{
-		Matcher:         "/raft/msg",
-		ForwardLocation: url,
+	return cm.startCommunity(communityID, backend, func() (<-chan state.StateUpdate, error) {
+		return backend.CreateCluster(communityID)
 	})
+}
+
+func (cm *ClusterManager) RemoveCluster(communityID string) error {
+	backend, err := cm.communityBackend(communityID)
 	if err != nil {
 		return err
 	}
 
-	err = cm.raftClusterService.Start()
+	err = backend.RemoveCluster(communityID)
 	if err != nil {
 		return err
 	}
 
+	cm.communitiesLock.Lock()
+	defer cm.communitiesLock.Unlock()
+	delete(cm.communities, communityID)
+
 	return nil
 }
 
-func (cm *ClusterManager) CreateCluster(communityID string) (<-chan state.StateUpdate, error) {
-	return cm.raftClusterService.CreateCluster(communityID)
+// JoinCluster joins a community running on another node, which is only possible on the default backend
+func (cm *ClusterManager) JoinCluster(communityID string, address string) (<-chan state.StateUpdate, error) {
+	backend, err := cm.getBackend("")
+	if err != nil {
+		return nil, err
+	}
+
+	return cm.startCommunity(communityID, backend, func() (<-chan state.StateUpdate, error) {
+		return backend.JoinCluster(communityID, address)
+	})
 }
 
-func (cm *ClusterManager) RemoveCluster(communityID string) error {
-	return cm.raftClusterService.RemoveCluster(communityID)
+// RestoreNode restarts a community on the backend that has data for it. Communities created before
+// there were multiple backends only have Raft data, so the default backend is used if none do.
+func (cm *ClusterManager) RestoreNode(communityID string) (<-chan state.StateUpdate, error) {
+	backend, err := cm.getBackend("")
+	if err != nil {
+		return nil, err
+	}
+	for _, b := range cm.backends {
+		if b.HasCluster(communityID) {
+			backend = b
+			break
+		}
+	}
 
+	return cm.startCommunity(communityID, backend, func() (<-chan state.StateUpdate, error) {
+		return backend.RestoreNode(communityID)
+	})
 }
 
-func (cm *ClusterManager) JoinCluster(communityID string, address string) (<-chan state.StateUpdate, error) {
-	return cm.raftClusterService.JoinCluster(communityID, address)
+func (cm *ClusterManager) ImportSnapshot(communityID string, snapshot []byte, standalone bool) (<-chan state.StateUpdate, error) {
+	backend, err := cm.getBackend("")
+	if err != nil {
+		return nil, err
+	}
+
+	return cm.startCommunity(communityID, backend, func() (<-chan state.StateUpdate, error) {
+		return backend.ImportSnapshot(communityID, snapshot, standalone)
+	})
 }
 
-func (cm *ClusterManager) RestoreNode(communityID string) (<-chan state.StateUpdate, error) {
-	return cm.raftClusterService.RestoreNode(communityID)
+func (cm *ClusterManager) RecoverCluster(communityID string, snapshot []byte) (<-chan state.StateUpdate, error) {
+	backend, err := cm.getBackend("")
+	if err != nil {
+		return nil, err
+	}
+
+	return cm.startCommunity(communityID, backend, func() (<-chan state.StateUpdate, error) {
+		return backend.RecoverCluster(communityID, snapshot)
+	})
 }
 
 func (cm *ClusterManager) ProposeTransitions(communityID string, transitions []byte) (*community.CommunityState, error) {
-	return cm.raftClusterService.ProposeTransitions(communityID, transitions)
+	backend, err := cm.communityBackend(communityID)
+	if err != nil {
+		return nil, err
+	}
+	return backend.ProposeTransitions(communityID, transitions)
 }
 
 func (cm *ClusterManager) GetState(communityID string) ([]byte, error) {
-	return cm.raftClusterService.GetState(communityID)
+	backend, err := cm.communityBackend(communityID)
+	if err != nil {
+		return nil, err
+	}
+	return backend.GetState(communityID)
+}
+
+func (cm *ClusterManager) GetHistory(communityID string, before uint64, limit int, transitionType string) ([]*state.HistoryEntry, uint64, error) {
+	backend, err := cm.communityBackend(communityID)
+	if err != nil {
+		return nil, 0, err
+	}
+	return backend.GetHistory(communityID, before, limit, transitionType)
+}
+
+func (cm *ClusterManager) ExportSnapshot(communityID string) ([]byte, error) {
+	backend, err := cm.communityBackend(communityID)
+	if err != nil {
+		return nil, err
+	}
+	return backend.ExportSnapshot(communityID)
+}
+
+func (cm *ClusterManager) ClusterStatus(communityID string) (*state.ClusterStatus, error) {
+	backend, err := cm.communityBackend(communityID)
+	if err != nil {
+		return nil, err
+	}
+	return backend.ClusterStatus(communityID)
+}
+
+func (cm *ClusterManager) TransferLeadership(communityID string, nodeID string) error {
+	backend, err := cm.communityBackend(communityID)
+	if err != nil {
+		return err
+	}
+	return backend.TransferLeadership(communityID, nodeID)
 }
 
 func (cm *ClusterManager) AddNode(communityID string, nodeID string, address string) error {
-	return cm.raftClusterService.AddNode(communityID, nodeID, address)
+	backend, err := cm.communityBackend(communityID)
+	if err != nil {
+		return err
+	}
+	return backend.AddNode(communityID, nodeID, address)
 }
 
 func (cm *ClusterManager) RemoveNode(communityID string, nodeID string) error {
-	return cm.raftClusterService.RemoveNode(communityID, nodeID)
+	backend, err := cm.communityBackend(communityID)
+	if err != nil {
+		return err
+	}
+	return backend.RemoveNode(communityID, nodeID)
+}
+
+func (cm *ClusterManager) ReloadConfig(communityID string, config *community.RaftConfig) error {
+	backend, err := cm.communityBackend(communityID)
+	if err != nil {
+		return err
+	}
+	return backend.ReloadConfig(communityID, config)
 }
@@ -0,0 +1,410 @@
+package local
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/eagraf/habitat/cmd/habitat/community/state"
+	"github.com/eagraf/habitat/structs/community"
+	"github.com/hashicorp/raft"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// term is the Raft term reported for every entry. There are never any elections.
+	term = 1
+
+	stateFileName = "state"
+)
+
+var errSingleNode = errors.New("community uses the local cluster backend, which only supports a single node")
+
+// ClusterService is an implementation of cluster.ClusterService for communities that only ever
+// have a single node. Transitions are applied synchronously as they are proposed, without
+// replicating them to other nodes. If path is set, each community's latest state is persisted
+// in a snapshot under it, and otherwise communities only live in memory.
+type ClusterService struct {
+	path      string
+	instances map[string]*localClusterInstance
+
+	*sync.Mutex
+}
+
+type localClusterInstance struct {
+	communityID  string
+	stateMachine *state.RaftFSMAdapter
+	dir          string // empty if the community is only kept in memory
+
+	// index is the index of the last applied entry, and startIndex is the index of the state the
+	// instance was started from. Entries are only kept in memory, so history starts there.
+	index      uint64
+	startIndex uint64
+	entries    []*raft.Log
+
+	*sync.Mutex
+}
+
+func NewClusterService(path string) *ClusterService {
+	return &ClusterService{
+		path:      path,
+		instances: make(map[string]*localClusterInstance),
+		Mutex:     &sync.Mutex{},
+	}
+}
+
+func (cs *ClusterService) Start() error {
+	return nil
+}
+
+func (cs *ClusterService) getInstance(communityID string) (*localClusterInstance, error) {
+	cs.Lock()
+	defer cs.Unlock()
+
+	instance, ok := cs.instances[communityID]
+	if !ok {
+		return nil, fmt.Errorf("community %s local cluster instance does not exist", communityID)
+	}
+	return instance, nil
+}
+
+func (cs *ClusterService) communityDir(communityID string) string {
+	if cs.path == "" {
+		return ""
+	}
+	return filepath.Join(cs.path, communityID, "local")
+}
+
+// startInstance starts running a community from the given state. The header of the snapshot the
+// state was read from may be nil for a new community.
+func (cs *ClusterService) startInstance(communityID string, header *state.SnapshotHeader, commState []byte) (<-chan state.StateUpdate, error) {
+	cs.Lock()
+	defer cs.Unlock()
+
+	if _, ok := cs.instances[communityID]; ok {
+		return nil, fmt.Errorf("local cluster instance for community %s already initialized", communityID)
+	}
+
+	fsm, err := state.NewRaftFSMAdapterFromSnapshot(header, commState)
+	if err != nil {
+		return nil, err
+	}
+
+	header, err = fsm.SnapshotHeader()
+	if err != nil {
+		return nil, err
+	}
+
+	instance := &localClusterInstance{
+		communityID:  communityID,
+		stateMachine: fsm,
+		dir:          cs.communityDir(communityID),
+		index:        header.Index,
+		startIndex:   header.Index,
+		entries:      make([]*raft.Log, 0),
+		Mutex:        &sync.Mutex{},
+	}
+
+	if instance.dir != "" {
+		err = os.MkdirAll(instance.dir, 0700)
+		if err != nil {
+			return nil, fmt.Errorf("error creating directory for community %s: %s", communityID, err)
+		}
+		err = instance.persist()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	cs.instances[communityID] = instance
+
+	return fsm.UpdateChan(), nil
+}
+
+// HasCluster returns true if this backend has persisted data for the community
+func (cs *ClusterService) HasCluster(communityID string) bool {
+	dir := cs.communityDir(communityID)
+	if dir == "" {
+		return false
+	}
+
+	_, err := os.Stat(filepath.Join(dir, stateFileName))
+	return err == nil
+}
+
+// CreateCluster starts running a new community on this node
+func (cs *ClusterService) CreateCluster(communityID string) (<-chan state.StateUpdate, error) {
+	return cs.startInstance(communityID, nil, community.NewCommunityStateBytes())
+}
+
+// RemoveCluster stops running a community on this node. Its data is left in place.
+func (cs *ClusterService) RemoveCluster(communityID string) error {
+	cs.Lock()
+	defer cs.Unlock()
+
+	if _, ok := cs.instances[communityID]; !ok {
+		return fmt.Errorf("community %s local cluster instance does not exist", communityID)
+	}
+	delete(cs.instances, communityID)
+
+	return nil
+}
+
+func (cs *ClusterService) JoinCluster(communityID string, address string) (<-chan state.StateUpdate, error) {
+	return nil, errSingleNode
+}
+
+// RestoreNode restarts a community from the state persisted by an earlier run
+func (cs *ClusterService) RestoreNode(communityID string) (<-chan state.StateUpdate, error) {
+	dir := cs.communityDir(communityID)
+	if dir == "" {
+		return nil, fmt.Errorf("community %s has no persisted state to restore", communityID)
+	}
+
+	snapshot, err := os.Open(filepath.Join(dir, stateFileName))
+	if err != nil {
+		return nil, fmt.Errorf("error opening persisted state for community %s: %s", communityID, err)
+	}
+	defer snapshot.Close()
+
+	header, commState, err := state.ReadSnapshot(snapshot)
+	if err != nil {
+		return nil, fmt.Errorf("error reading persisted state for community %s: %s", communityID, err)
+	}
+
+	return cs.startInstance(communityID, header, commState)
+}
+
+// ImportSnapshot starts running a community from an exported snapshot. There is no cluster
+// configuration to keep, so standalone has no effect.
+func (cs *ClusterService) ImportSnapshot(communityID string, snapshot []byte, standalone bool) (<-chan state.StateUpdate, error) {
+	header, commState, err := state.ReadSnapshot(bytes.NewReader(snapshot))
+	if err != nil {
+		return nil, fmt.Errorf("invalid snapshot: %s", err)
+	}
+
+	return cs.startInstance(communityID, header, commState)
+}
+
+// RecoverCluster is the same as ImportSnapshot, since a community on this backend never has
+// any other nodes to recover from
+func (cs *ClusterService) RecoverCluster(communityID string, snapshot []byte) (<-chan state.StateUpdate, error) {
+	return cs.ImportSnapshot(communityID, snapshot, true)
+}
+
+// ProposeTransitions applies the transitions straight away. The call returns once every state
+// update the transitions produced has been handed to the community's state machine.
+func (cs *ClusterService) ProposeTransitions(communityID string, transitions []byte) (*community.CommunityState, error) {
+	instance, err := cs.getInstance(communityID)
+	if err != nil {
+		return nil, err
+	}
+
+	instance.Lock()
+	defer instance.Unlock()
+
+	// rejected entries still take up an index, as they would in a Raft log, but are left out of
+	// the history
+	instance.index++
+	entry := &raft.Log{
+		Index:      instance.index,
+		Term:       term,
+		Type:       raft.LogCommand,
+		Data:       transitions,
+		AppendedAt: time.Now(),
+	}
+
+	res := instance.stateMachine.Apply(entry)
+	if err, ok := res.(error); ok {
+		return nil, fmt.Errorf("community %s rejected state transition: %w", communityID, err)
+	}
+	instance.entries = append(instance.entries, entry)
+
+	newState, ok := res.(*community.CommunityState)
+	if !ok {
+		return nil, errors.New("state returned by state machine is not *community.CommunityState")
+	}
+
+	if instance.dir != "" {
+		err = instance.persist()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return newState, nil
+}
+
+// persist writes the instance's state to disk, replacing the previous file atomically
+func (ci *localClusterInstance) persist() error {
+	commState, err := ci.stateMachine.State()
+	if err != nil {
+		return err
+	}
+
+	header, err := ci.stateMachine.SnapshotHeader()
+	if err != nil {
+		return err
+	}
+
+	var buf bytes.Buffer
+	err = state.WriteSnapshot(&buf, header, commState)
+	if err != nil {
+		return err
+	}
+
+	tmpPath := filepath.Join(ci.dir, stateFileName+".tmp")
+	err = ioutil.WriteFile(tmpPath, buf.Bytes(), 0600)
+	if err != nil {
+		return fmt.Errorf("error persisting state for community %s: %s", ci.communityID, err)
+	}
+	err = os.Rename(tmpPath, filepath.Join(ci.dir, stateFileName))
+	if err != nil {
+		return fmt.Errorf("error persisting state for community %s: %s", ci.communityID, err)
+	}
+
+	return nil
+}
+
+func (cs *ClusterService) GetState(communityID string) ([]byte, error) {
+	instance, err := cs.getInstance(communityID)
+	if err != nil {
+		return nil, err
+	}
+
+	return instance.stateMachine.State()
+}
+
+// GetHistory pages backwards through the transitions applied since the community was started on
+// this node, following the same rules as the Raft backend. Anything older is reported as a snapshot.
+func (cs *ClusterService) GetHistory(communityID string, before uint64, limit int, transitionType string) ([]*state.HistoryEntry, uint64, error) {
+	instance, err := cs.getInstance(communityID)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	instance.Lock()
+	defer instance.Unlock()
+
+	if limit <= 0 {
+		limit = state.DefaultHistoryLimit
+	}
+
+	res := make([]*state.HistoryEntry, 0)
+	for i := len(instance.entries) - 1; i >= 0; i-- {
+		entry := instance.entries[i]
+		if before != 0 && entry.Index >= before {
+			continue
+		}
+
+		batch, err := state.HistoryEntriesFromLog(entry)
+		if err != nil {
+			log.Error().Err(err).Msgf("skipping undecodable entry in community %s history", communityID)
+			continue
+		}
+
+		matching := make([]*state.HistoryEntry, 0, len(batch))
+		for j := len(batch) - 1; j >= 0; j-- {
+			if transitionType == "" || batch[j].Type == transitionType {
+				matching = append(matching, batch[j])
+			}
+		}
+
+		if len(res) > 0 && len(res)+len(matching) > limit {
+			return res, entry.Index + 1, nil
+		}
+		res = append(res, matching...)
+		if len(res) >= limit && i > 0 {
+			return res, entry.Index, nil
+		}
+	}
+
+	if instance.startIndex > 0 && (transitionType == "" || transitionType == state.HistoryTypeSnapshot) {
+		res = append(res, &state.HistoryEntry{
+			Index: instance.startIndex,
+			Term:  term,
+			Type:  state.HistoryTypeSnapshot,
+		})
+	}
+
+	return res, 0, nil
+}
+
+func (cs *ClusterService) ExportSnapshot(communityID string) ([]byte, error) {
+	instance, err := cs.getInstance(communityID)
+	if err != nil {
+		return nil, err
+	}
+
+	instance.Lock()
+	commState, err := instance.stateMachine.State()
+	if err != nil {
+		instance.Unlock()
+		return nil, err
+	}
+	header, err := instance.stateMachine.SnapshotHeader()
+	instance.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	header.Term = term
+
+	var buf bytes.Buffer
+	err = state.WriteSnapshot(&buf, header, commState)
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// ClusterStatus reports this node as the leader and only voter of the community
+func (cs *ClusterService) ClusterStatus(communityID string) (*state.ClusterStatus, error) {
+	instance, err := cs.getInstance(communityID)
+	if err != nil {
+		return nil, err
+	}
+
+	instance.Lock()
+	defer instance.Unlock()
+
+	index := strconv.FormatUint(instance.index, 10)
+	return &state.ClusterStatus{
+		CommunityID:  communityID,
+		State:        raft.Leader.String(),
+		Term:         term,
+		CommitIndex:  instance.index,
+		AppliedIndex: instance.index,
+		LastLogIndex: instance.index,
+		Servers:      []*state.ServerStatus{},
+		Stats: map[string]string{
+			"backend":        "local",
+			"commit_index":   index,
+			"applied_index":  index,
+			"last_log_index": index,
+		},
+	}, nil
+}
+
+func (cs *ClusterService) TransferLeadership(communityID string, nodeID string) error {
+	return errSingleNode
+}
+
+// ReloadConfig is a no-op, since communities on this backend don't run Raft
+func (cs *ClusterService) ReloadConfig(communityID string, config *community.RaftConfig) error {
+	return nil
+}
+
+func (cs *ClusterService) AddNode(communityID string, nodeID string, address string) error {
+	return errSingleNode
+}
+
+// RemoveNode is a no-op, since the only node a community on this backend has is this one
+func (cs *ClusterService) RemoveNode(communityID string, nodeID string) error {
+	return nil
+}
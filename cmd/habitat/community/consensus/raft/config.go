@@ -0,0 +1,73 @@
+package raft
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/eagraf/habitat/cmd/habitat/community/state"
+	"github.com/eagraf/habitat/structs/community"
+	"github.com/hashicorp/raft"
+	"github.com/rs/zerolog/log"
+)
+
+// ReloadConfig applies a community's Raft settings to this node's running Raft instance. The
+// commit timeout can't be changed while Raft is running, so it only takes effect on restart.
+func (cs *ClusterService) ReloadConfig(communityID string, settings *community.RaftConfig) error {
+	raftInstance, ok := cs.instances[communityID]
+	if !ok || raftInstance.instance == nil {
+		return fmt.Errorf("community %s raft instance does not exist", communityID)
+	}
+
+	err := raftInstance.instance.ReloadConfig(state.NewReloadableRaftConfig(settings))
+	if err != nil {
+		return fmt.Errorf("error reloading raft config for community %s: %s", communityID, err)
+	}
+
+	log.Info().Msgf("reloaded raft config for community %s", communityID)
+	return nil
+}
+
+// reloadFromState applies the Raft settings in a JSON encoded community state
+func reloadFromState(communityID string, ra *raft.Raft, commState []byte) {
+	var s community.CommunityState
+	err := json.Unmarshal(commState, &s)
+	if err != nil {
+		log.Error().Err(err).Msgf("error reading raft config of community %s", communityID)
+		return
+	}
+
+	err = ra.ReloadConfig(state.NewReloadableRaftConfig(s.RaftConfig))
+	if err != nil {
+		log.Error().Err(err).Msgf("error reloading raft config for community %s", communityID)
+	}
+}
+
+// persistedRaftConfig returns the Raft settings in a community's latest snapshot. A community
+// without any snapshots yet uses the default settings, as does one whose snapshot can't be read.
+func persistedRaftConfig(communityID string, snapshots raft.SnapshotStore) *community.RaftConfig {
+	metas, err := snapshots.List()
+	if err != nil || len(metas) == 0 {
+		return nil
+	}
+
+	_, reader, err := snapshots.Open(metas[0].ID)
+	if err != nil {
+		log.Error().Err(err).Msgf("error opening latest snapshot of community %s", communityID)
+		return nil
+	}
+	defer reader.Close()
+
+	_, commState, err := state.ReadSnapshot(reader)
+	if err != nil {
+		log.Error().Err(err).Msgf("error reading latest snapshot of community %s", communityID)
+		return nil
+	}
+
+	var s community.CommunityState
+	err = json.Unmarshal(commState, &s)
+	if err != nil {
+		log.Error().Err(err).Msgf("error reading raft config of community %s", communityID)
+		return nil
+	}
+	return s.RaftConfig
+}
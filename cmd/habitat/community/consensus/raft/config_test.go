@@ -0,0 +1,113 @@
+package raft
+
+import (
+	"bytes"
+	"io"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/eagraf/habitat/cmd/habitat/community/state"
+	"github.com/eagraf/habitat/structs/community"
+	"github.com/hashicorp/raft"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReloadConfig(t *testing.T) {
+	fsm, err := state.NewRaftFSMAdapter(community.NewCommunityStateBytes())
+	require.Nil(t, err)
+
+	addr, trans := raft.NewInmemTransport("")
+	config := raft.DefaultConfig()
+	config.LocalID = "local"
+
+	store := raft.NewInmemStore()
+	ra, err := raft.NewRaft(config, fsm, store, store, raft.NewInmemSnapshotStore(), trans)
+	require.Nil(t, err)
+	defer ra.Shutdown()
+
+	err = ra.BootstrapCluster(raft.Configuration{
+		Servers: []raft.Server{
+			{ID: "local", Address: addr},
+		},
+	}).Error()
+	require.Nil(t, err)
+
+	cs := &ClusterService{
+		instances: map[string]*raftClusterInstance{
+			"abc": {
+				communityID: "abc",
+				instance:    ra,
+			},
+		},
+	}
+
+	err = cs.ReloadConfig("abc", &community.RaftConfig{
+		HeartbeatTimeoutMs: 2000,
+		ElectionTimeoutMs:  3000,
+		SnapshotThreshold:  100,
+		TrailingLogs:       50,
+	})
+	require.Nil(t, err)
+
+	reloaded := ra.ReloadableConfig()
+	assert.Equal(t, 2*time.Second, reloaded.HeartbeatTimeout)
+	assert.Equal(t, 3*time.Second, reloaded.ElectionTimeout)
+	assert.Equal(t, uint64(100), reloaded.SnapshotThreshold)
+	assert.Equal(t, uint64(50), reloaded.TrailingLogs)
+	assert.Equal(t, config.SnapshotInterval, reloaded.SnapshotInterval)
+
+	// the heartbeat timeout can't be lower than the leader lease timeout
+	assert.NotNil(t, cs.ReloadConfig("abc", &community.RaftConfig{HeartbeatTimeoutMs: 100}))
+	assert.Equal(t, 2*time.Second, ra.ReloadableConfig().HeartbeatTimeout)
+	assert.NotNil(t, cs.ReloadConfig("missing", &community.RaftConfig{}))
+
+	// restoring a snapshot applies the settings it carries, and resets the rest to their defaults
+	fsm.SetRestoreHook(func(commState []byte) {
+		reloadFromState("abc", ra, commState)
+	})
+
+	commState := []byte(`{"community_id":"abc","version":7,"raft_config":{"snapshot_threshold":7},"members":[],"nodes":[],"processes":[],"process_instances":[]}`)
+	header, err := state.NewSnapshotHeader(commState)
+	require.Nil(t, err)
+	var snapshot bytes.Buffer
+	require.Nil(t, state.WriteSnapshot(&snapshot, header, commState))
+
+	require.Nil(t, fsm.Restore(io.NopCloser(&snapshot)))
+	reloaded = ra.ReloadableConfig()
+	assert.Equal(t, uint64(7), reloaded.SnapshotThreshold)
+	assert.Equal(t, config.HeartbeatTimeout, reloaded.HeartbeatTimeout)
+}
+
+func TestPersistedRaftConfig(t *testing.T) {
+	raftDir := filepath.Join(t.TempDir(), "raft")
+	localServer := raft.Server{
+		Suffrage: raft.Voter,
+		ID:       "local",
+		Address:  "/ip4/127.0.0.1/tcp/6000",
+	}
+
+	commState := []byte(`{"community_id":"abc","version":7,"raft_config":{"heartbeat_timeout_ms":800,"commit_timeout_ms":20},"members":[],"nodes":[],"processes":[],"process_instances":[]}`)
+	header, err := state.NewSnapshotHeader(commState)
+	require.Nil(t, err)
+	header.Term = 1
+	require.Nil(t, seedRaftDirectory(raftDir, header, commState, localServer, true))
+
+	snapshots, err := raft.NewFileSnapshotStore(raftDir, RetainSnapshotCount, nil)
+	require.Nil(t, err)
+
+	settings := persistedRaftConfig("abc", snapshots)
+	require.NotNil(t, settings)
+	assert.Equal(t, int64(800), settings.HeartbeatTimeoutMs)
+
+	config := state.NewRaftConfig(settings)
+	assert.Equal(t, 800*time.Millisecond, config.HeartbeatTimeout)
+	assert.Equal(t, 20*time.Millisecond, config.CommitTimeout)
+	assert.Equal(t, raft.DefaultConfig().ElectionTimeout, config.ElectionTimeout)
+
+	// a community without snapshots uses the defaults
+	empty, err := raft.NewFileSnapshotStore(t.TempDir(), RetainSnapshotCount, nil)
+	require.Nil(t, err)
+	assert.Nil(t, persistedRaftConfig("abc", empty))
+}
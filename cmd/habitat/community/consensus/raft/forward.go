@@ -0,0 +1,300 @@
+package raft
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/eagraf/habitat/cmd/habitat/community/state"
+	"github.com/eagraf/habitat/structs/community"
+	"github.com/hashicorp/raft"
+	"github.com/libp2p/go-libp2p/core/network"
+	peer "github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// ForwardProtocol is used by followers to hand proposed transitions to the leader
+	ForwardProtocol = protocol.ID("/habitat-raft-forward/0.0.1")
+
+	// MaxForwardHops bounds how many times a proposal can be passed along before giving up.
+	// A proposal normally takes one hop, but it can take more if leadership changes while
+	// it is in flight.
+	MaxForwardHops = 3
+
+	ForwardRetries       = 5
+	ForwardRetryInterval = 500 * time.Millisecond
+)
+
+var errNoLeader = errors.New("no known leader")
+
+// forwardRequest is sent from a follower to the node it believes is the leader
+type forwardRequest struct {
+	CommunityID string `json:"community_id"`
+	Transitions []byte `json:"transitions"`
+	Hops        int    `json:"hops"`
+}
+
+type forwardResponse struct {
+	State *community.CommunityState `json:"state"`
+	Error string                    `json:"error"`
+
+	// NotLeader is set if the receiving node was unable to apply or forward the transitions
+	// because it is no longer the leader, and does not know who is. The sender should retry.
+	NotLeader bool `json:"not_leader"`
+
+	// Conflict is set if the transitions were rejected because they were proposed against an
+	// outdated version of the state
+	Conflict bool `json:"conflict"`
+}
+
+// remoteError carries an error returned by the leader back to the proposing node, keeping track
+// of whether it was a version conflict
+type remoteError struct {
+	msg   string
+	cause error
+}
+
+func (e *remoteError) Error() string {
+	return e.msg
+}
+
+func (e *remoteError) Unwrap() error {
+	return e.cause
+}
+
+// proposeTransitions applies the transitions if this node is the leader, and otherwise forwards
+// them to the leader. hops counts how many times the proposal has already been forwarded. Only
+// the node the proposal originated on retries, so that retries along the way can't outlast the
+// origin's wait for a response.
+func (cs *ClusterService) proposeTransitions(communityID string, transitions []byte, hops int) (*community.CommunityState, error) {
+	raftInstance, ok := cs.instances[communityID]
+	if !ok {
+		return nil, fmt.Errorf("community %s raft instance does not exist", communityID)
+	}
+
+	attempts := ForwardRetries
+	if hops > 0 {
+		attempts = 1
+	}
+
+	var lastErr error
+	for attempt := 0; attempt < attempts; attempt++ {
+		if attempt > 0 {
+			time.Sleep(ForwardRetryInterval)
+		}
+
+		if raftInstance.instance.State() == raft.Leader {
+			state, err := applyTransitions(raftInstance, transitions)
+			if errors.Is(err, raft.ErrNotLeader) || errors.Is(err, raft.ErrLeadershipLost) {
+				// leadership changed underneath us, try again with the new leader
+				lastErr = err
+				continue
+			}
+			return state, err
+		}
+
+		if hops >= MaxForwardHops {
+			return nil, fmt.Errorf("proposal for community %s was forwarded more than %d times", communityID, MaxForwardHops)
+		}
+
+		leaderID, err := getLeaderID(raftInstance)
+		if err != nil {
+			// there may be an election in progress
+			lastErr = err
+			continue
+		}
+
+		state, err := cs.forwardTransitions(leaderID, communityID, transitions, hops+1)
+		if errors.Is(err, raft.ErrNotLeader) {
+			lastErr = err
+			continue
+		}
+		return state, err
+	}
+
+	return nil, fmt.Errorf("unable to reach a leader for community %s: %w", communityID, lastErr)
+}
+
+// applyTransitions submits the transitions to the Raft log. This must be done on the leader.
+func applyTransitions(raftInstance *raftClusterInstance, transitions []byte) (*community.CommunityState, error) {
+	future := raftInstance.instance.Apply(transitions, RaftTimeout)
+
+	// future.Error() blocks until the cluster finishes processing this attempted entry
+	err := future.Error()
+	if err != nil {
+		return nil, fmt.Errorf("error applying state transition to community %s: %w", raftInstance.communityID, err)
+	}
+
+	state := future.Response()
+	if state == nil {
+		return nil, errors.New("got nil state back from Raft apply future")
+	}
+
+	if err, ok := state.(error); ok {
+		return nil, fmt.Errorf("community %s rejected state transition: %w", raftInstance.communityID, err)
+	}
+
+	if _, ok := state.(*community.CommunityState); !ok {
+		return nil, errors.New("state returned by Raft apply future is not *community.CommunityState")
+	}
+
+	return state.(*community.CommunityState), nil
+}
+
+// getLeaderID looks up the server ID of the current leader, which is the leader's libp2p peer ID
+func getLeaderID(raftInstance *raftClusterInstance) (raft.ServerID, error) {
+	leaderAddr := raftInstance.instance.Leader()
+	if leaderAddr == "" {
+		return "", errNoLeader
+	}
+
+	configFuture := raftInstance.instance.GetConfiguration()
+	if err := configFuture.Error(); err != nil {
+		return "", err
+	}
+
+	for _, srv := range configFuture.Configuration().Servers {
+		if srv.Address == leaderAddr {
+			return srv.ID, nil
+		}
+	}
+
+	return "", fmt.Errorf("leader at %s is not in the cluster configuration", leaderAddr)
+}
+
+// forwardTransitions sends the transitions to the leader over the libp2p host, and waits for the
+// resulting state.
+func (cs *ClusterService) forwardTransitions(leaderID raft.ServerID, communityID string, transitions []byte, hops int) (*community.CommunityState, error) {
+	log.Info().Msgf("forwarding transitions for %s to leader %s", communityID, leaderID)
+
+	peerID, err := peer.Decode(string(leaderID))
+	if err != nil {
+		return nil, err
+	}
+
+	if peerID == cs.host.ID() {
+		// our own configuration thinks we are leader, but raft disagrees. wait for things to settle.
+		return nil, raft.ErrNotLeader
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), RaftTimeout)
+	defer cancel()
+
+	stream, err := cs.host.NewStream(ctx, peerID, ForwardProtocol)
+	if err != nil {
+		return nil, fmt.Errorf("error opening stream to leader %s: %s", leaderID, err)
+	}
+	defer stream.Close()
+
+	// Not every stream supports deadlines, so if this one doesn't, reset it once the timeout passes
+	err = stream.SetDeadline(time.Now().Add(RaftTimeout))
+	if err != nil {
+		done := make(chan struct{})
+		defer close(done)
+		go func() {
+			select {
+			case <-ctx.Done():
+				stream.Reset()
+			case <-done:
+			}
+		}()
+	}
+
+	req := &forwardRequest{
+		CommunityID: communityID,
+		Transitions: transitions,
+		Hops:        hops,
+	}
+	err = json.NewEncoder(stream).Encode(req)
+	if err != nil {
+		stream.Reset()
+		return nil, err
+	}
+
+	var res forwardResponse
+	err = json.NewDecoder(stream).Decode(&res)
+	if err != nil {
+		return nil, fmt.Errorf("error reading response from leader %s: %s", leaderID, err)
+	}
+
+	if res.NotLeader {
+		return nil, raft.ErrNotLeader
+	} else if res.Conflict {
+		return nil, &remoteError{
+			msg:   res.Error,
+			cause: state.ErrVersionConflict,
+		}
+	} else if res.Error != "" {
+		return nil, errors.New(res.Error)
+	}
+
+	return res.State, nil
+}
+
+// forwardHandler receives transitions forwarded by followers. Only servers in the community's
+// cluster may forward to it.
+func (cs *ClusterService) forwardHandler(s network.Stream) {
+	defer s.Close()
+
+	var req forwardRequest
+	err := json.NewDecoder(s).Decode(&req)
+	if err != nil {
+		log.Error().Err(err).Msg("error decoding forwarded transitions")
+		s.Reset()
+		return
+	}
+
+	res := &forwardResponse{}
+	remotePeer := s.Conn().RemotePeer()
+	err = cs.checkClusterServer(req.CommunityID, remotePeer)
+	if err != nil {
+		log.Error().Err(err).Msgf("rejecting transitions forwarded by %s", remotePeer)
+		res.Error = err.Error()
+		err = json.NewEncoder(s).Encode(res)
+		if err != nil {
+			s.Reset()
+		}
+		return
+	}
+
+	newState, err := cs.proposeTransitions(req.CommunityID, req.Transitions, req.Hops)
+	if errors.Is(err, raft.ErrNotLeader) || errors.Is(err, raft.ErrLeadershipLost) || errors.Is(err, errNoLeader) {
+		res.NotLeader = true
+	} else if err != nil {
+		res.Error = err.Error()
+		res.Conflict = errors.Is(err, state.ErrVersionConflict)
+	} else {
+		res.State = newState
+	}
+
+	err = json.NewEncoder(s).Encode(res)
+	if err != nil {
+		log.Error().Err(err).Msg("error responding to forwarded transitions")
+		s.Reset()
+	}
+}
+
+// checkClusterServer returns an error unless the peer is a server in the community's Raft
+// configuration
+func (cs *ClusterService) checkClusterServer(communityID string, peerID peer.ID) error {
+	raftInstance, ok := cs.instances[communityID]
+	if !ok || raftInstance.instance == nil {
+		return fmt.Errorf("community %s raft instance does not exist", communityID)
+	}
+
+	configFuture := raftInstance.instance.GetConfiguration()
+	if err := configFuture.Error(); err != nil {
+		return err
+	}
+
+	for _, srv := range configFuture.Configuration().Servers {
+		if srv.ID == raft.ServerID(peerID.Pretty()) {
+			return nil
+		}
+	}
+	return fmt.Errorf("peer %s is not in the cluster for community %s", peerID, communityID)
+}
@@ -7,7 +7,6 @@ import (
 	"github.com/eagraf/habitat/pkg/compass"
 	"github.com/libp2p/go-libp2p/core/protocol"
 	ma "github.com/multiformats/go-multiaddr"
-	"github.com/rs/zerolog/log"
 )
 
 const (
@@ -20,32 +19,11 @@ const (
 	P2PPort         = "6000"
 )
 
-func getMultiplexerAddress() string {
-	ip, err := compass.LocalIPv4()
-	if err != nil {
-		log.Fatal().Msgf("error getting local IP address: %s", err)
-	}
-
-	return fmt.Sprintf("%s:%s", ip.String(), MultiplexerPort)
-}
-
-// Used by Raft to identify this node in the cluster.
-func getServerID(communityID string) string {
-	nodeID := compass.NodeID()
-	return fmt.Sprintf("%s#%s", nodeID, communityID)
-}
-
-// Get the address for a specific Raft instance inside a cluster.
-func getCommunityAddress(communityID string) string {
-	return fmt.Sprintf("%s://%s/%s", Protocol, getMultiplexerAddress(), communityID)
-}
-
-func getCommunityRaftDirectory(communityID string) string {
-	return filepath.Join(compass.CommunitiesPath(), communityID, "raft")
-}
-
+// getClusterProtocol returns the stream protocol a community's Raft RPCs are sent over. Version
+// 0.0.2 encodes RPCs with msgpack and streams snapshots, which 0.0.1 nodes can't read, so the
+// two fail to negotiate a stream rather than failing to decode each other's RPCs.
 func getClusterProtocol(communityID string) protocol.ID {
-	return protocol.ID(filepath.Join("/habitat-raft", "0.0.1", communityID))
+	return protocol.ID(filepath.Join("/habitat-raft", "0.0.2", communityID))
 }
 
 func getPublicMultiaddr() (ma.Multiaddr, error) {
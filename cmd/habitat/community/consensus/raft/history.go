@@ -0,0 +1,104 @@
+package raft
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/eagraf/habitat/cmd/habitat/community/state"
+	"github.com/hashicorp/raft"
+	raftboltdb "github.com/hashicorp/raft-boltdb"
+	"github.com/rs/zerolog/log"
+)
+
+// GetHistory pages backwards through the transitions committed to a community's Raft log, newest
+// first. Only entries with an index lower than before are returned, or all entries if before is 0.
+// Up to limit transitions matching transitionType are returned, or of any type if it is empty.
+// Transitions committed together are never split across pages. The returned index should be passed
+// as before to get the next page, and is 0 once there is nothing left.
+func (cs *ClusterService) GetHistory(communityID string, before uint64, limit int, transitionType string) ([]*state.HistoryEntry, uint64, error) {
+	raftInstance, ok := cs.instances[communityID]
+	if !ok || raftInstance.boltStore == nil {
+		return nil, 0, fmt.Errorf("community %s raft instance does not exist", communityID)
+	}
+
+	if limit <= 0 {
+		limit = state.DefaultHistoryLimit
+	}
+
+	firstIndex, err := raftInstance.boltStore.FirstIndex()
+	if err != nil {
+		return nil, 0, err
+	}
+	lastIndex, err := raftInstance.boltStore.LastIndex()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if before == 0 || before > lastIndex+1 {
+		before = lastIndex + 1
+	}
+
+	entries := make([]*state.HistoryEntry, 0)
+	index := before - 1
+	for ; index >= firstIndex && index > 0; index-- {
+		var entry raft.Log
+		err = raftInstance.boltStore.GetLog(index, &entry)
+		if errors.Is(err, raft.ErrLogNotFound) {
+			continue
+		} else if err != nil {
+			return nil, 0, err
+		}
+
+		if entry.Type != raft.LogCommand {
+			continue
+		}
+
+		_, err = raftInstance.boltStore.GetUint64(state.RejectedEntryKey(index))
+		if err == nil {
+			continue
+		} else if !errors.Is(err, raftboltdb.ErrKeyNotFound) {
+			return nil, 0, err
+		}
+
+		batch, err := state.HistoryEntriesFromLog(&entry)
+		if err != nil {
+			log.Error().Err(err).Msgf("skipping undecodable entry in community %s history", communityID)
+			continue
+		}
+
+		matching := make([]*state.HistoryEntry, 0, len(batch))
+		for i := len(batch) - 1; i >= 0; i-- {
+			if transitionType == "" || batch[i].Type == transitionType {
+				matching = append(matching, batch[i])
+			}
+		}
+
+		if len(entries) > 0 && len(entries)+len(matching) > limit {
+			return entries, index + 1, nil
+		}
+		entries = append(entries, matching...)
+		if len(entries) >= limit && index > firstIndex {
+			return entries, index, nil
+		}
+	}
+
+	// Entries before the first index have been compacted into a snapshot. Let the caller know
+	// where the available history starts.
+	if firstIndex != 1 && raftInstance.snapshots != nil && (transitionType == "" || transitionType == state.HistoryTypeSnapshot) {
+		snapshots, err := raftInstance.snapshots.List()
+		if err != nil {
+			return nil, 0, err
+		}
+		if len(snapshots) > 0 {
+			// snapshots are listed newest first, and the oldest one covers the most history
+			oldest := snapshots[len(snapshots)-1]
+			entries = append(entries, &state.HistoryEntry{
+				Index: oldest.Index,
+				Term:  oldest.Term,
+				Type:  state.HistoryTypeSnapshot,
+			})
+		}
+	}
+
+	return entries, 0, nil
+}
@@ -0,0 +1,117 @@
+package raft
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"testing"
+
+	"github.com/eagraf/habitat/cmd/habitat/community/state"
+	"github.com/hashicorp/raft"
+	raftboltdb "github.com/hashicorp/raft-boltdb"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testHistoryLog(t *testing.T, index uint64, transitionTypes ...string) *raft.Log {
+	wrappers := make([]*state.TransitionWrapper, len(transitionTypes))
+	for i, transitionType := range transitionTypes {
+		wrappers[i] = &state.TransitionWrapper{
+			Type:       transitionType,
+			Transition: []byte(fmt.Sprintf(`{"n": %d}`, i)),
+			NodeID:     "node1",
+		}
+	}
+	marshaled, err := json.Marshal(&state.TransitionBatch{
+		Transitions: wrappers,
+	})
+	require.Nil(t, err)
+
+	return &raft.Log{
+		Index: index,
+		Term:  1,
+		Type:  raft.LogCommand,
+		Data:  []byte(base64.StdEncoding.EncodeToString(marshaled)),
+	}
+}
+
+func TestGetHistory(t *testing.T) {
+	boltStore, err := raftboltdb.NewBoltStore(filepath.Join(t.TempDir(), "raft.db"))
+	require.Nil(t, err)
+	defer boltStore.Close()
+
+	err = boltStore.StoreLogs([]*raft.Log{
+		{
+			Index: 1,
+			Term:  1,
+			Type:  raft.LogConfiguration,
+		},
+		testHistoryLog(t, 2, state.TransitionTypeInitializeCommunity, state.TransitionTypeAddMember, state.TransitionTypeAddNode),
+		testHistoryLog(t, 3, state.TransitionTypeStartProcess, state.TransitionTypeStartProcessInstance),
+		testHistoryLog(t, 4, state.TransitionTypeStopProcessInstance),
+		testHistoryLog(t, 5, state.TransitionTypeStopProcess),
+	})
+	require.Nil(t, err)
+
+	cs := &ClusterService{
+		instances: map[string]*raftClusterInstance{
+			"abc": {
+				communityID: "abc",
+				boltStore:   boltStore,
+			},
+		},
+	}
+
+	// everything, newest first
+	entries, next, err := cs.GetHistory("abc", 0, 0, "")
+	require.Nil(t, err)
+	assert.Equal(t, uint64(0), next)
+	require.Equal(t, 7, len(entries))
+	assert.Equal(t, state.TransitionTypeStopProcess, entries[0].Type)
+	assert.Equal(t, state.TransitionTypeStartProcessInstance, entries[2].Type)
+	assert.Equal(t, state.TransitionTypeInitializeCommunity, entries[6].Type)
+	assert.Equal(t, uint64(2), entries[6].Index)
+	assert.Equal(t, "node1", entries[6].Proposer)
+
+	// pages never split a batch
+	entries, next, err = cs.GetHistory("abc", 0, 3, "")
+	require.Nil(t, err)
+	require.Equal(t, 2, len(entries))
+	assert.Equal(t, uint64(4), next)
+
+	entries, next, err = cs.GetHistory("abc", next, 3, "")
+	require.Nil(t, err)
+	require.Equal(t, 2, len(entries))
+	assert.Equal(t, uint64(3), next)
+
+	entries, next, err = cs.GetHistory("abc", next, 3, "")
+	require.Nil(t, err)
+	require.Equal(t, 3, len(entries))
+	assert.Equal(t, uint64(2), next)
+
+	// only the configuration entry is left
+	entries, next, err = cs.GetHistory("abc", next, 3, "")
+	require.Nil(t, err)
+	assert.Equal(t, 0, len(entries))
+	assert.Equal(t, uint64(0), next)
+
+	// filter by type
+	entries, _, err = cs.GetHistory("abc", 0, 0, state.TransitionTypeStartProcess)
+	require.Nil(t, err)
+	require.Equal(t, 1, len(entries))
+	assert.Equal(t, uint64(3), entries[0].Index)
+
+	// entries the state machine rejected are left out
+	err = boltStore.SetUint64(state.RejectedEntryKey(4), 4)
+	require.Nil(t, err)
+	entries, _, err = cs.GetHistory("abc", 0, 0, "")
+	require.Nil(t, err)
+	require.Equal(t, 6, len(entries))
+	for _, e := range entries {
+		assert.NotEqual(t, uint64(4), e.Index)
+	}
+
+	_, _, err = cs.GetHistory("def", 0, 0, "")
+	assert.NotNil(t, err)
+}
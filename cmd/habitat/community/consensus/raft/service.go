@@ -21,7 +21,9 @@ import (
 )
 
 const (
-	RetainSnapshotCount = 1000
+	// RetainSnapshotCount is how many snapshots are kept on disk. Raft only ever restores the
+	// latest, so the older ones are just there to fall back on if it is damaged.
+	RetainSnapshotCount = 3
 	RaftTimeout         = 10 * time.Second
 )
 
@@ -31,32 +33,69 @@ type ClusterService struct {
 
 	host host.Host
 
-	nodeID string
+	nodeID          string
+	communitiesPath string
+
+	// publicAddr is the address other nodes reach this node at. If it is nil, it is looked up
+	// from this node's public IP address.
+	publicAddr ma.Multiaddr
 }
 
 type raftClusterInstance struct {
 	communityID  string
 	serverID     string
-	address      string
 	instance     *raft.Raft
+	boltStore    *raftboltdb.BoltStore
+	snapshots    *raft.FileSnapshotStore
+	transport    *transport.LibP2PTransport
 	stateMachine *state.RaftFSMAdapter
+
+	maxVoters int
+	health    *serverHealth
+	done      chan struct{}
 }
 
-func NewClusterService(host host.Host) *ClusterService {
+// ClusterServiceConfig encapsulates configuration for the Raft cluster service
+type ClusterServiceConfig struct {
+	Host            host.Host
+	NodeID          string
+	CommunitiesPath string
+	PublicAddr      ma.Multiaddr
+}
+
+// NewClusterServiceWithConfig creates a new cluster service with the given config struct
+func NewClusterServiceWithConfig(config *ClusterServiceConfig) *ClusterService {
 	cs := &ClusterService{
 		instances: make(map[string]*raftClusterInstance),
-		host:      host,
+		host:      config.Host,
 
-		nodeID: compass.NodeID(),
+		nodeID:          config.NodeID,
+		communitiesPath: config.CommunitiesPath,
+		publicAddr:      config.PublicAddr,
 	}
 
 	return cs
 }
 
+func NewClusterService(host host.Host) *ClusterService {
+	return NewClusterServiceWithConfig(&ClusterServiceConfig{
+		Host:            host,
+		NodeID:          compass.NodeID(),
+		CommunitiesPath: compass.CommunitiesPath(),
+	})
+}
+
 func (cs *ClusterService) Start() error {
+	cs.host.SetStreamHandler(ForwardProtocol, cs.forwardHandler)
 	return nil
 }
 
+// HasCluster returns true if this node has Raft data for the community
+func (cs *ClusterService) HasCluster(communityID string) bool {
+	_, err := os.Stat(filepath.Join(cs.raftDirectory(communityID), "raft.db"))
+	return err == nil
+}
+
 // CreateCluster initializes a new Raft cluster, and bootstraps it with this nodes address
 func (cs *ClusterService) CreateCluster(communityID string) (<-chan state.StateUpdate, error) {
 	if _, ok := cs.instances[communityID]; ok {
@@ -68,31 +107,75 @@ func (cs *ClusterService) CreateCluster(communityID string) (<-chan state.StateU
 		return nil, err
 	}
 
-	ra, err := setupRaftInstance(communityID, raftFSM, true, cs.host)
+	ra, boltStore, snapshots, trans, err := cs.setupRaftInstance(communityID, raftFSM, true, false)
 	if err != nil {
 		return nil, fmt.Errorf("failed to setup raft instance: %s", err.Error())
 	}
 
+	cs.addInstance(communityID, ra, boltStore, snapshots, trans, raftFSM)
+
+	// block until we receive leadership
+	leaderCh := ra.LeaderCh()
+	if !<-leaderCh {
+		return nil, errors.New("did not receive leadership")
+	}
+
+	return raftFSM.UpdateChan(), nil
+}
+
+// addInstance keeps track of a community's Raft instance, and starts maintaining its voters
+func (cs *ClusterService) addInstance(communityID string, ra *raft.Raft, boltStore *raftboltdb.BoltStore, snapshots *raft.FileSnapshotStore, trans *transport.LibP2PTransport, raftFSM *state.RaftFSMAdapter) *raftClusterInstance {
 	raftInstance := &raftClusterInstance{
 		communityID:  communityID,
-		serverID:     getServerID(communityID),
-		address:      getCommunityAddress(communityID),
+		serverID:     cs.host.ID().Pretty(),
 		instance:     ra,
+		boltStore:    boltStore,
+		snapshots:    snapshots,
+		transport:    trans,
 		stateMachine: raftFSM,
+		maxVoters:    DefaultMaxVoters,
+		health:       newServerHealth(),
+		done:         make(chan struct{}),
 	}
 	cs.instances[communityID] = raftInstance
 
-	// block until we receive leadership
-	leaderCh := ra.LeaderCh()
-	if !<-leaderCh {
-		return nil, errors.New("did not receive leadership")
+	// RestoreNode keeps track of instances even if they failed to start
+	if ra != nil {
+		go raftInstance.runVoterPolicy()
 	}
 
-	return raftFSM.UpdateChan(), nil
+	return raftInstance
 }
 
+// RemoveCluster shuts down this node's Raft instance for a community and releases its
+// storage. It does not change the cluster's configuration, so this node should already
+// have been removed from the cluster by the leader.
 func (cs *ClusterService) RemoveCluster(communityID string) error {
-	// TODO
+	raftInstance, ok := cs.instances[communityID]
+	if !ok {
+		return fmt.Errorf("community %s raft instance does not exist", communityID)
+	}
+
+	// RestoreNode keeps track of instances even if they failed to start
+	if raftInstance.instance != nil {
+		close(raftInstance.done)
+
+		err := raftInstance.instance.Shutdown().Error()
+		if err != nil {
+			return fmt.Errorf("error shutting down raft instance for community %s: %s", communityID, err)
+		}
+
+		// The libp2p host is shared with the rest of the node, so only stop handling this cluster's protocol
+		cs.host.RemoveStreamHandler(getClusterProtocol(communityID))
+
+		err = raftInstance.boltStore.Close()
+		if err != nil {
+			return fmt.Errorf("error closing raft bolt store for community %s: %s", communityID, err)
+		}
+	}
+
+	delete(cs.instances, communityID)
+
 	return nil
 }
 
@@ -109,19 +192,12 @@ func (cs *ClusterService) JoinCluster(communityID string, address string) (<-cha
 		return nil, err
 	}
 
-	ra, err := setupRaftInstance(communityID, raftFSM, false, cs.host)
+	ra, boltStore, snapshots, trans, err := cs.setupRaftInstance(communityID, raftFSM, false, false)
 	if err != nil {
 		return nil, fmt.Errorf("failed to setup raft instance: %s", err.Error())
 	}
 
-	raftInstance := &raftClusterInstance{
-		communityID:  communityID,
-		serverID:     getServerID(communityID),
-		address:      getCommunityAddress(communityID),
-		instance:     ra,
-		stateMachine: raftFSM,
-	}
-	cs.instances[communityID] = raftInstance
+	cs.addInstance(communityID, ra, boltStore, snapshots, trans, raftFSM)
 
 	return raftFSM.UpdateChan(), nil
 }
@@ -138,52 +214,24 @@ func (cs *ClusterService) RestoreNode(communityID string) (<-chan state.StateUpd
 		return nil, err
 	}
 
-	ra, err := setupRaftInstance(communityID, raftFSM, false, cs.host)
+	ra, boltStore, snapshots, trans, err := cs.setupRaftInstance(communityID, raftFSM, false, false)
 	if err != nil {
 		log.Error().Msgf("failed to setup raft instance: %s", err.Error())
 	}
 
-	raftInstance := &raftClusterInstance{
-		communityID:  communityID,
-		serverID:     getServerID(communityID),
-		address:      getCommunityAddress(communityID),
-		instance:     ra,
-		stateMachine: raftFSM,
-	}
-	cs.instances[communityID] = raftInstance
+	cs.addInstance(communityID, ra, boltStore, snapshots, trans, raftFSM)
 
 	return raftFSM.UpdateChan(), nil
 }
 
 // ProposeTransitions takes a proposed update to community state in the form of a JSON patch,
 // and attempts to get other nodes to agree to apply the transition to the state machine.
+// If this node is not the leader, the transitions are forwarded to the leader.
 // If succesfully commited, the updated state should be available via the GetState() call.
 func (cs *ClusterService) ProposeTransitions(communityID string, transitions []byte) (*community.CommunityState, error) {
 	log.Info().Msgf("applying transition to %s", communityID)
 
-	raftInstance, ok := cs.instances[communityID]
-	if !ok {
-		return nil, fmt.Errorf("community %s raft instance does not exist", communityID)
-	}
-
-	future := raftInstance.instance.Apply(transitions, RaftTimeout)
-
-	// future.Error() blocks until the cluster finishes processing this attempted entry
-	err := future.Error()
-	if err != nil {
-		return nil, fmt.Errorf("error applying state transition to community %s: %s", communityID, err)
-	}
-
-	state := future.Response()
-	if state == nil {
-		return nil, errors.New("got nil state back from Raft apply future")
-	}
-
-	if _, ok := state.(*community.CommunityState); !ok {
-		return nil, errors.New("state returned by Raft apply future is not *community.CommunityState")
-	}
-
-	return state.(*community.CommunityState), nil
+	return cs.proposeTransitions(communityID, transitions, 0)
 }
 
 // GetState returns the state tracked by the Raft instance's state machine. It returns
@@ -204,7 +252,8 @@ func (cs *ClusterService) GetState(communityID string) ([]byte, error) {
 	return state, nil
 }
 
-// AddNode adds a new node to a cluster. After a node has been added, it must execute
+// AddNode adds a new node to a cluster as a non-voter. Non-voters receive every log entry, and so
+// every state update, but only DefaultMaxVoters servers take part in elections and commits. After a node has been added, it must execute
 // the JoinCluster routine to begin listening for state updates.
 // nodeID represents a libp2p peer id base58 encoded in this instance
 func (cs *ClusterService) AddNode(communityID string, nodeID string, address string) error {
@@ -216,6 +265,14 @@ func (cs *ClusterService) AddNode(communityID string, nodeID string, address str
 		return err
 	}
 
+	// Each node's transport reports its address without the peer ID, which is already the
+	// server ID, so the configuration has to use the same form for the leader to be found by address.
+	addr, _ = peer.SplitAddr(addr)
+	if addr == nil {
+		return fmt.Errorf("no transport address in %s", address)
+	}
+	address = addr.String()
+
 	// decode base58 encoded peer id for setting addresses
 	peerID, err := peer.Decode(nodeID)
 	if err != nil {
@@ -250,89 +307,154 @@ func (cs *ClusterService) AddNode(communityID string, nodeID string, address str
 		}
 	}
 
-	f := raftInstance.instance.AddVoter(raft.ServerID(nodeID), raft.ServerAddress(address), 0, 0)
+	// New nodes join as non-voters, and are only promoted if the cluster needs more voters
+	f := raftInstance.instance.AddNonvoter(raft.ServerID(nodeID), raft.ServerAddress(address), 0, 0)
 	if f.Error() != nil {
 		return f.Error()
 	}
 
-	return nil
+	return raftInstance.balanceVoters()
 }
 
+// RemoveNode removes a node from a cluster's Raft configuration. Only the leader is able to
+// change the configuration, so on every other node this is a no-op. Each node runs this when
+// it executes a remove_node transition, which ensures the leader at that point carries it out.
+// nodeID represents a libp2p peer id base58 encoded in this instance
 func (cs *ClusterService) RemoveNode(communityID string, nodeID string) error {
-	// TODO
-	return nil
+	log.Info().Msgf("received request to remove %s from %s", nodeID, communityID)
+
+	raftInstance, ok := cs.instances[communityID]
+	if !ok {
+		return fmt.Errorf("community %s raft instance does not exist", communityID)
+	}
+
+	if raftInstance.instance.State() != raft.Leader {
+		return nil
+	}
+
+	future := raftInstance.instance.RemoveServer(raft.ServerID(nodeID), 0, 0)
+	if err := future.Error(); err != nil {
+		return fmt.Errorf("error removing node %s from community %s: %s", nodeID, communityID, err)
+	}
+
+	// a leader that removed itself is stepping down, so the next leader balances the voters
+	if nodeID == raftInstance.serverID {
+		return nil
+	}
+
+	return raftInstance.balanceVoters()
 }
 
-// Internal wrapper of Hashicorp raft stuff
-func setupRaftInstance(communityID string, stateMachine *state.RaftFSMAdapter, newCommunity bool, host host.Host) (*raft.Raft, error) {
-	log.Info().Msgf("setting up raft instance for node %s at %s", getServerID(communityID), getCommunityAddress(communityID))
+// raftDirectory is where this node keeps a community's Raft data
+func (cs *ClusterService) raftDirectory(communityID string) string {
+	return filepath.Join(cs.communitiesPath, communityID, "raft")
+}
+
+// getPublicAddr returns the address other nodes in a cluster reach this node at
+func (cs *ClusterService) getPublicAddr() (ma.Multiaddr, error) {
+	if cs.publicAddr != nil {
+		return cs.publicAddr, nil
+	}
+	return getPublicMultiaddr()
+}
+
+// Internal wrapper of Hashicorp raft stuff. If newCommunity is set, a new cluster is bootstrapped. If
+// recoverCluster is set, the existing cluster's configuration is replaced with one where this node
+// is the only voter, which lets the cluster make progress after losing quorum for good.
+func (cs *ClusterService) setupRaftInstance(communityID string, stateMachine *state.RaftFSMAdapter, newCommunity, recoverCluster bool) (*raft.Raft, *raftboltdb.BoltStore, *raft.FileSnapshotStore, *transport.LibP2PTransport, error) {
+	pubAddr, err := cs.getPublicAddr()
+	if err != nil {
+		return nil, nil, nil, nil, err
+	}
+
+	log.Info().Msgf("setting up raft instance for node %s#%s at %s", cs.nodeID, communityID, pubAddr)
 
 	// setup raft folder
-	raftDirPath := filepath.Join(compass.CommunitiesPath(), communityID, "raft")
+	raftDirPath := cs.raftDirectory(communityID)
 	raftDBPath := filepath.Join(raftDirPath, "raft.db")
 
-	_, err := os.Stat(raftDBPath)
+	_, err = os.Stat(raftDBPath)
 	if errors.Is(err, os.ErrNotExist) {
 		err := os.Mkdir(raftDirPath, 0700)
 		if err != nil {
-			return nil, fmt.Errorf("error creating raft directory for new community: %s", err)
+			return nil, nil, nil, nil, fmt.Errorf("error creating raft directory for new community: %s", err)
 		}
 
 		raftDBFile, err := os.OpenFile(raftDBPath, os.O_CREATE|os.O_RDONLY, 0600)
 		if err != nil {
-			return nil, fmt.Errorf("error creating raft bolt db file: %s", err)
+			return nil, nil, nil, nil, fmt.Errorf("error creating raft bolt db file: %s", err)
 		}
 		defer raftDBFile.Close()
 	} else if err != nil {
-		return nil, err
+		return nil, nil, nil, nil, err
 	}
 
-	// Setup Raft configuration.
-	config := raft.DefaultConfig()
-	config.LocalID = raft.ServerID(host.ID().Pretty())
-
-	pubAddr, err := getPublicMultiaddr()
+	// Create the snapshot store. This allows the Raft to truncate the log.
+	snapshots, err := raft.NewFileSnapshotStore(raftDirPath, RetainSnapshotCount, os.Stderr)
 	if err != nil {
-		return nil, err
+		return nil, nil, nil, nil, fmt.Errorf("file snapshot store: %s", err)
 	}
+
+	// Setup Raft configuration, with the community's own settings as of its latest snapshot.
+	// Settings changed after the snapshot are reloaded as their transitions are replayed.
+	config := state.NewRaftConfig(persistedRaftConfig(communityID, snapshots))
+	config.LocalID = raft.ServerID(cs.host.ID().Pretty())
+
 	// Setup Raft communication.
 	protocol := getClusterProtocol(communityID)
-	libP2PTransport := transport.NewLibP2PTransport(host, protocol, raft.ServerAddress(pubAddr.String()))
-
-	// Create the snapshot store. This allows the Raft to truncate the log.
-	snapshots, err := raft.NewFileSnapshotStore(getCommunityRaftDirectory(communityID), RetainSnapshotCount, os.Stderr)
-	if err != nil {
-		return nil, fmt.Errorf("file snapshot store: %s", err)
-	}
+	libP2PTransport := transport.NewLibP2PTransport(cs.host, protocol, raft.ServerAddress(pubAddr.String()))
 
 	// Create the log store and stable store.
 	var logStore raft.LogStore
 	var stableStore raft.StableStore
-	boltDB, err := raftboltdb.NewBoltStore(filepath.Join(getCommunityRaftDirectory(communityID), "raft.db"))
+	boltDB, err := raftboltdb.NewBoltStore(raftDBPath)
 	if err != nil {
-		return nil, fmt.Errorf("new bolt store: %s", err)
+		return nil, nil, nil, nil, fmt.Errorf("new bolt store: %s", err)
 	}
 	logStore = boltDB
 	stableStore = boltDB
 
+	localConfiguration := raft.Configuration{
+		Servers: []raft.Server{
+			{
+				ID:      config.LocalID,
+				Address: raft.ServerAddress(pubAddr.String()),
+			},
+		},
+	}
+
+	// rejected entries are recorded next to the log, so that history can leave them out
+	stateMachine.SetRejectionStore(stableStore)
+
+	if recoverCluster {
+		recoveryFSM, err := state.NewRecoveryFSM()
+		if err != nil {
+			return nil, nil, nil, nil, err
+		}
+		recoveryFSM.SetRejectionStore(stableStore)
+
+		err = raft.RecoverCluster(config, recoveryFSM, logStore, stableStore, snapshots, libP2PTransport, localConfiguration)
+		if err != nil {
+			boltDB.Close()
+			return nil, nil, nil, nil, fmt.Errorf("recover cluster: %s", err)
+		}
+	}
+
 	// Instantiate the Raft systems.
 	ra, err := raft.NewRaft(config, stateMachine, logStore, stableStore, snapshots, libP2PTransport)
 	if err != nil {
-		return nil, fmt.Errorf("new raft: %s", err)
+		return nil, nil, nil, nil, fmt.Errorf("new raft: %s", err)
 	}
 
+	// Snapshots installed by the leader may carry different settings
+	stateMachine.SetRestoreHook(func(commState []byte) {
+		reloadFromState(communityID, ra, commState)
+	})
+
 	// If this node is creating the community, bootstrap the raft cluster as well
 	if newCommunity {
-		configuration := raft.Configuration{
-			Servers: []raft.Server{
-				{
-					ID:      config.LocalID,
-					Address: raft.ServerAddress(pubAddr.String()),
-				},
-			},
-		}
-		ra.BootstrapCluster(configuration)
+		ra.BootstrapCluster(localConfiguration)
 	}
 
-	return ra, nil
+	return ra, boltDB, snapshots, libP2PTransport, nil
 }
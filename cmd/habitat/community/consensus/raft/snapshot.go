@@ -0,0 +1,290 @@
+package raft
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/eagraf/habitat/cmd/habitat/community/state"
+	"github.com/hashicorp/raft"
+	raftboltdb "github.com/hashicorp/raft-boltdb"
+	"github.com/rs/zerolog/log"
+)
+
+// keyCurrentTerm is the key hashicorp/raft stores the current term under in the stable store
+var keyCurrentTerm = []byte("CurrentTerm")
+
+// ExportSnapshot snapshots a community's state, and returns it along with the Raft metadata
+// needed to install it on another node with ImportSnapshot.
+func (cs *ClusterService) ExportSnapshot(communityID string) ([]byte, error) {
+	raftInstance, ok := cs.instances[communityID]
+	if !ok || raftInstance.instance == nil {
+		return nil, fmt.Errorf("community %s raft instance does not exist", communityID)
+	}
+
+	var meta *raft.SnapshotMeta
+	var reader io.ReadCloser
+
+	future := raftInstance.instance.Snapshot()
+	err := future.Error()
+	if err == nil {
+		meta, reader, err = future.Open()
+	} else if errors.Is(err, raft.ErrNothingNewToSnapshot) {
+		// nothing was applied since the last snapshot, so that one is still current
+		meta, reader, err = openLatestSnapshot(raftInstance.snapshots)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error taking snapshot of community %s: %s", communityID, err)
+	}
+	defer reader.Close()
+
+	return exportSnapshot(meta, reader)
+}
+
+func openLatestSnapshot(snapshots raft.SnapshotStore) (*raft.SnapshotMeta, io.ReadCloser, error) {
+	metas, err := snapshots.List()
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(metas) == 0 {
+		return nil, nil, errors.New("no snapshots found")
+	}
+
+	// snapshots are listed newest first
+	return snapshots.Open(metas[0].ID)
+}
+
+// exportSnapshot adds the Raft metadata of a persisted snapshot to its header
+func exportSnapshot(meta *raft.SnapshotMeta, reader io.Reader) ([]byte, error) {
+	header, commState, err := state.ReadSnapshot(reader)
+	if err != nil {
+		return nil, err
+	}
+
+	header.Index = meta.Index
+	header.Term = meta.Term
+	header.Configuration = &meta.Configuration
+	header.ConfigurationIndex = meta.ConfigurationIndex
+
+	var buf bytes.Buffer
+	err = state.WriteSnapshot(&buf, header, commState)
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// ImportSnapshot starts this node's Raft instance for a community from an exported snapshot,
+// instead of replaying the community's log. This node must not have any Raft data for the
+// community yet. The snapshot's cluster configuration is kept, so that the node can be added back
+// to the cluster it was exported from. If standalone is set, the configuration is replaced with one
+// containing only this node, which recovers the community when no other node is left.
+func (cs *ClusterService) ImportSnapshot(communityID string, snapshot []byte, standalone bool) (<-chan state.StateUpdate, error) {
+	if _, ok := cs.instances[communityID]; ok {
+		return nil, fmt.Errorf("raft instance for community %s already initialized", communityID)
+	}
+
+	header, commState, err := state.ReadSnapshot(bytes.NewReader(snapshot))
+	if err != nil {
+		return nil, fmt.Errorf("invalid snapshot: %s", err)
+	}
+
+	// fail before touching storage if this node can't run the snapshot's schema version
+	_, err = state.NewCommunityJSONState(commState)
+	if err != nil {
+		return nil, fmt.Errorf("invalid snapshot: %s", err)
+	}
+
+	localServer, err := cs.localServer()
+	if err != nil {
+		return nil, err
+	}
+
+	err = seedRaftDirectory(cs.raftDirectory(communityID), header, commState, localServer, standalone)
+	if err != nil {
+		return nil, fmt.Errorf("error importing snapshot for community %s: %s", communityID, err)
+	}
+
+	raftFSM, err := state.NewRaftFSMAdapter(commState)
+	if err != nil {
+		return nil, err
+	}
+
+	ra, boltStore, snapshots, trans, err := cs.setupRaftInstance(communityID, raftFSM, false, false)
+	if err != nil {
+		return nil, fmt.Errorf("failed to setup raft instance: %s", err.Error())
+	}
+
+	cs.addInstance(communityID, ra, boltStore, snapshots, trans, raftFSM)
+
+	return raftFSM.UpdateChan(), nil
+}
+
+// RecoverCluster restores a community from a snapshot after every other node in its cluster was
+// lost. The snapshot is installed as in ImportSnapshot, and the cluster is then recovered with this
+// node as its only voter. Other nodes can be added back once this node has been elected leader.
+func (cs *ClusterService) RecoverCluster(communityID string, snapshot []byte) (<-chan state.StateUpdate, error) {
+	if _, ok := cs.instances[communityID]; ok {
+		return nil, fmt.Errorf("raft instance for community %s already initialized", communityID)
+	}
+
+	header, commState, err := state.ReadSnapshot(bytes.NewReader(snapshot))
+	if err != nil {
+		return nil, fmt.Errorf("invalid snapshot: %s", err)
+	}
+
+	_, err = state.NewCommunityJSONState(commState)
+	if err != nil {
+		return nil, fmt.Errorf("invalid snapshot: %s", err)
+	}
+
+	localServer, err := cs.localServer()
+	if err != nil {
+		return nil, err
+	}
+
+	// restore the Raft data as it was when the snapshot was taken, and then recover from there
+	raftDir := cs.raftDirectory(communityID)
+	err = seedRaftDirectory(raftDir, header, commState, localServer, false)
+	if err != nil {
+		return nil, fmt.Errorf("error restoring snapshot for community %s: %s", communityID, err)
+	}
+
+	raftFSM, err := state.NewRaftFSMAdapter(commState)
+	if err != nil {
+		os.RemoveAll(raftDir)
+		return nil, err
+	}
+
+	ra, boltStore, snapshots, trans, err := cs.setupRaftInstance(communityID, raftFSM, false, true)
+	if err != nil {
+		os.RemoveAll(raftDir)
+		return nil, fmt.Errorf("failed to setup raft instance: %s", err.Error())
+	}
+
+	cs.addInstance(communityID, ra, boltStore, snapshots, trans, raftFSM)
+
+	// this node is the only voter, so it should be elected straight away
+	err = waitForLeadership(ra, RaftTimeout)
+	if err != nil {
+		// leave nothing behind, so that the restore can be tried again
+		cleanupErr := cs.RemoveCluster(communityID)
+		if cleanupErr != nil {
+			log.Error().Err(cleanupErr).Msgf("error removing raft instance for community %s after failed recovery", communityID)
+		}
+		os.RemoveAll(raftDir)
+		return nil, fmt.Errorf("error recovering community %s: %s", communityID, err)
+	}
+
+	return raftFSM.UpdateChan(), nil
+}
+
+// waitForLeadership blocks until the Raft instance becomes leader, or the timeout passes
+func waitForLeadership(ra *raft.Raft, timeout time.Duration) error {
+	if ra.State() == raft.Leader {
+		return nil
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	for {
+		select {
+		case isLeader := <-ra.LeaderCh():
+			if isLeader {
+				return nil
+			}
+		case <-timer.C:
+			return fmt.Errorf("not elected leader within %s", timeout)
+		}
+	}
+}
+
+// localServer describes this node as a voter in a Raft configuration
+func (cs *ClusterService) localServer() (raft.Server, error) {
+	pubAddr, err := cs.getPublicAddr()
+	if err != nil {
+		return raft.Server{}, err
+	}
+
+	return raft.Server{
+		Suffrage: raft.Voter,
+		ID:       raft.ServerID(cs.host.ID().Pretty()),
+		Address:  raft.ServerAddress(pubAddr.String()),
+	}, nil
+}
+
+// seedRaftDirectory installs a snapshot into a new Raft directory, so that Raft restores it on startup
+func seedRaftDirectory(raftDirPath string, header *state.SnapshotHeader, commState []byte, localServer raft.Server, standalone bool) error {
+	raftDBPath := filepath.Join(raftDirPath, "raft.db")
+	_, err := os.Stat(raftDBPath)
+	if err == nil {
+		return errors.New("raft data already exists")
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	err = os.MkdirAll(raftDirPath, 0700)
+	if err != nil {
+		return err
+	}
+
+	index := header.Index
+	term := header.Term
+	if term == 0 {
+		// the snapshot wasn't exported from a Raft snapshot, so there is no term to continue from
+		term = 1
+	}
+
+	configuration := header.Configuration
+	configurationIndex := header.ConfigurationIndex
+	if standalone || configuration == nil {
+		configuration = &raft.Configuration{
+			Servers: []raft.Server{localServer},
+		}
+		configurationIndex = index
+	}
+
+	snapshots, err := raft.NewFileSnapshotStore(raftDirPath, RetainSnapshotCount, os.Stderr)
+	if err != nil {
+		return fmt.Errorf("file snapshot store: %s", err)
+	}
+
+	// The store uses the transport to encode the deprecated peers field of the snapshot metadata. The
+	// libp2p transport isn't running yet, but encodes peers as their address just like this one.
+	_, trans := raft.NewInmemTransport(localServer.Address)
+	defer trans.Close()
+
+	sink, err := snapshots.Create(raft.SnapshotVersionMax, index, term, *configuration, configurationIndex, trans)
+	if err != nil {
+		return fmt.Errorf("error creating snapshot: %s", err)
+	}
+	err = state.WriteSnapshot(sink, header, commState)
+	if err != nil {
+		sink.Cancel()
+		return fmt.Errorf("error writing snapshot: %s", err)
+	}
+	err = sink.Close()
+	if err != nil {
+		return fmt.Errorf("error writing snapshot: %s", err)
+	}
+
+	// Raft would otherwise start from term 0, and append entries with terms older than the snapshot's
+	boltDB, err := raftboltdb.NewBoltStore(raftDBPath)
+	if err != nil {
+		return fmt.Errorf("new bolt store: %s", err)
+	}
+	defer boltDB.Close()
+
+	err = boltDB.SetUint64(keyCurrentTerm, term)
+	if err != nil {
+		return fmt.Errorf("error setting current term: %s", err)
+	}
+
+	log.Info().Msgf("seeded raft directory %s with snapshot at index %d, term %d", raftDirPath, index, term)
+	return nil
+}
@@ -0,0 +1,176 @@
+package raft
+
+import (
+	"bytes"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/eagraf/habitat/cmd/habitat/community/state"
+	"github.com/eagraf/habitat/structs/community"
+	"github.com/hashicorp/raft"
+	raftboltdb "github.com/hashicorp/raft-boltdb"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSeedRaftDirectory(t *testing.T) {
+	commState := []byte(`{"community_id":"abc","version":7,"members":[],"nodes":[],"processes":[],"process_instances":[]}`)
+	header, err := state.NewSnapshotHeader(commState)
+	require.Nil(t, err)
+
+	localServer := raft.Server{
+		Suffrage: raft.Voter,
+		ID:       "local",
+		Address:  "/ip4/127.0.0.1/tcp/6000",
+	}
+	remoteServer := raft.Server{
+		Suffrage: raft.Voter,
+		ID:       "remote",
+		Address:  "/ip4/10.0.0.1/tcp/6000",
+	}
+
+	// export a snapshot persisted by the FSM, as ExportSnapshot does
+	var persisted bytes.Buffer
+	err = state.WriteSnapshot(&persisted, header, commState)
+	require.Nil(t, err)
+	exported, err := exportSnapshot(&raft.SnapshotMeta{
+		Index: 9,
+		Term:  4,
+		Configuration: raft.Configuration{
+			Servers: []raft.Server{remoteServer},
+		},
+		ConfigurationIndex: 1,
+	}, &persisted)
+	require.Nil(t, err)
+
+	exportedHeader, exportedState, err := state.ReadSnapshot(bytes.NewReader(exported))
+	require.Nil(t, err)
+	assert.Equal(t, commState, exportedState)
+	assert.Equal(t, uint64(9), exportedHeader.Index)
+	assert.Equal(t, uint64(4), exportedHeader.Term)
+
+	// the exported configuration is kept by default
+	raftDir := filepath.Join(t.TempDir(), "raft")
+	err = seedRaftDirectory(raftDir, exportedHeader, exportedState, localServer, false)
+	require.Nil(t, err)
+
+	snapshots, err := raft.NewFileSnapshotStore(raftDir, RetainSnapshotCount, nil)
+	require.Nil(t, err)
+	meta, reader, err := openLatestSnapshot(snapshots)
+	require.Nil(t, err)
+	_, restoredState, err := state.ReadSnapshot(reader)
+	reader.Close()
+	require.Nil(t, err)
+	assert.Equal(t, commState, restoredState)
+	assert.Equal(t, uint64(9), meta.Index)
+	assert.Equal(t, uint64(4), meta.Term)
+	assert.Equal(t, []raft.Server{remoteServer}, meta.Configuration.Servers)
+
+	boltStore, err := raftboltdb.NewBoltStore(filepath.Join(raftDir, "raft.db"))
+	require.Nil(t, err)
+	term, err := boltStore.GetUint64(keyCurrentTerm)
+	boltStore.Close()
+	require.Nil(t, err)
+	assert.Equal(t, uint64(4), term)
+
+	// existing raft data is never overwritten
+	err = seedRaftDirectory(raftDir, exportedHeader, exportedState, localServer, false)
+	assert.NotNil(t, err)
+
+	// standalone imports only contain this node
+	raftDir = filepath.Join(t.TempDir(), "raft")
+	err = seedRaftDirectory(raftDir, exportedHeader, exportedState, localServer, true)
+	require.Nil(t, err)
+
+	snapshots, err = raft.NewFileSnapshotStore(raftDir, RetainSnapshotCount, nil)
+	require.Nil(t, err)
+	meta, reader, err = openLatestSnapshot(snapshots)
+	require.Nil(t, err)
+	reader.Close()
+	assert.Equal(t, []raft.Server{localServer}, meta.Configuration.Servers)
+	assert.Equal(t, uint64(9), meta.ConfigurationIndex)
+}
+
+func TestRecoverSeededRaftDirectory(t *testing.T) {
+	commState := []byte(`{"community_id":"abc","version":7,"members":[],"nodes":[],"processes":[],"process_instances":[]}`)
+	header, err := state.NewSnapshotHeader(commState)
+	require.Nil(t, err)
+	header.Term = 3
+	header.Configuration = &raft.Configuration{
+		Servers: []raft.Server{
+			{Suffrage: raft.Voter, ID: "dead1", Address: "/ip4/10.0.0.1/tcp/6000"},
+			{Suffrage: raft.Voter, ID: "dead2", Address: "/ip4/10.0.0.2/tcp/6000"},
+		},
+	}
+
+	localServer := raft.Server{
+		Suffrage: raft.Voter,
+		ID:       "local",
+		Address:  "/ip4/127.0.0.1/tcp/6000",
+	}
+
+	raftDir := filepath.Join(t.TempDir(), "raft")
+	err = seedRaftDirectory(raftDir, header, commState, localServer, false)
+	require.Nil(t, err)
+
+	snapshots, err := raft.NewFileSnapshotStore(raftDir, RetainSnapshotCount, nil)
+	require.Nil(t, err)
+	boltStore, err := raftboltdb.NewBoltStore(filepath.Join(raftDir, "raft.db"))
+	require.Nil(t, err)
+	defer boltStore.Close()
+	_, trans := raft.NewInmemTransport(localServer.Address)
+	defer trans.Close()
+
+	recoveryFSM, err := state.NewRecoveryFSM()
+	require.Nil(t, err)
+
+	config := raft.DefaultConfig()
+	config.LocalID = localServer.ID
+	err = raft.RecoverCluster(config, recoveryFSM, boltStore, boltStore, snapshots, trans, raft.Configuration{
+		Servers: []raft.Server{localServer},
+	})
+	require.Nil(t, err)
+	assert.Equal(t, commState, recoveryFSM.JSONState().Bytes())
+
+	// the recovered configuration only holds this node
+	meta, reader, err := openLatestSnapshot(snapshots)
+	require.Nil(t, err)
+	_, recoveredState, err := state.ReadSnapshot(reader)
+	reader.Close()
+	require.Nil(t, err)
+	assert.Equal(t, commState, recoveredState)
+	assert.Equal(t, []raft.Server{localServer}, meta.Configuration.Servers)
+}
+
+func TestWaitForLeadership(t *testing.T) {
+	newRaft := func(bootstrap bool) *raft.Raft {
+		config := raft.DefaultConfig()
+		config.LocalID = "local"
+		config.HeartbeatTimeout = 50 * time.Millisecond
+		config.ElectionTimeout = 50 * time.Millisecond
+		config.LeaderLeaseTimeout = 50 * time.Millisecond
+
+		store := raft.NewInmemStore()
+		snapshots := raft.NewInmemSnapshotStore()
+		addr, trans := raft.NewInmemTransport("")
+		if bootstrap {
+			err := raft.BootstrapCluster(config, store, store, snapshots, trans, raft.Configuration{
+				Servers: []raft.Server{{ID: config.LocalID, Address: addr}},
+			})
+			require.Nil(t, err)
+		}
+
+		fsm, err := state.NewRaftFSMAdapter(community.NewCommunityStateBytes())
+		require.Nil(t, err)
+		ra, err := raft.NewRaft(config, fsm, store, store, snapshots, trans)
+		require.Nil(t, err)
+		t.Cleanup(func() { ra.Shutdown() })
+		return ra
+	}
+
+	assert.Nil(t, waitForLeadership(newRaft(true), 5*time.Second))
+
+	// a node without a configuration is never elected
+	assert.NotNil(t, waitForLeadership(newRaft(false), 200*time.Millisecond))
+}
@@ -0,0 +1,115 @@
+package raft
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/eagraf/habitat/cmd/habitat/community/state"
+	"github.com/hashicorp/raft"
+	"github.com/rs/zerolog/log"
+)
+
+// ClusterStatus returns the status of this node's Raft instance for a community
+func (cs *ClusterService) ClusterStatus(communityID string) (*state.ClusterStatus, error) {
+	raftInstance, ok := cs.instances[communityID]
+	if !ok || raftInstance.instance == nil {
+		return nil, fmt.Errorf("community %s raft instance does not exist", communityID)
+	}
+	ra := raftInstance.instance
+
+	configFuture := ra.GetConfiguration()
+	if err := configFuture.Error(); err != nil {
+		return nil, fmt.Errorf("error getting raft configuration for community %s: %s", communityID, err)
+	}
+
+	stats := ra.Stats()
+	status := &state.ClusterStatus{
+		CommunityID:   communityID,
+		State:         ra.State().String(),
+		Term:          parseStat(stats, "term"),
+		LeaderAddress: string(ra.Leader()),
+		CommitIndex:   parseStat(stats, "commit_index"),
+		AppliedIndex:  parseStat(stats, "applied_index"),
+		LastLogIndex:  parseStat(stats, "last_log_index"),
+		Servers:       make([]*state.ServerStatus, 0),
+		Stats:         stats,
+	}
+
+	isLeader := ra.State() == raft.Leader
+	for _, srv := range configFuture.Configuration().Servers {
+		srvStatus := &state.ServerStatus{
+			ID:       string(srv.ID),
+			Address:  string(srv.Address),
+			Suffrage: srv.Suffrage.String(),
+			Leader:   srv.Address == ra.Leader(),
+		}
+
+		if srvStatus.Leader {
+			status.LeaderID = srvStatus.ID
+			if isLeader {
+				srvStatus.LastContact = time.Now()
+			} else {
+				srvStatus.LastContact = ra.LastContact()
+			}
+		} else if isLeader && raftInstance.transport != nil {
+			srvStatus.LastContact = raftInstance.transport.LastContact(srv.ID)
+		}
+
+		status.Servers = append(status.Servers, srvStatus)
+	}
+
+	return status, nil
+}
+
+// TransferLeadership hands leadership of a community's cluster to another voter. If nodeID is
+// empty, Raft picks the most up to date voter. This node must be the current leader.
+// nodeID represents a libp2p peer id base58 encoded in this instance
+func (cs *ClusterService) TransferLeadership(communityID string, nodeID string) error {
+	raftInstance, ok := cs.instances[communityID]
+	if !ok || raftInstance.instance == nil {
+		return fmt.Errorf("community %s raft instance does not exist", communityID)
+	}
+	ra := raftInstance.instance
+
+	if ra.State() != raft.Leader {
+		leader := ra.Leader()
+		if leader == "" {
+			return errors.New("this node is not the leader, and there is no known leader")
+		}
+		return fmt.Errorf("this node is not the leader, leadership can only be transferred by the leader at %s", leader)
+	}
+
+	if nodeID == "" {
+		log.Info().Msgf("transferring leadership of community %s", communityID)
+		return ra.LeadershipTransfer().Error()
+	}
+
+	configFuture := ra.GetConfiguration()
+	if err := configFuture.Error(); err != nil {
+		return err
+	}
+	for _, srv := range configFuture.Configuration().Servers {
+		if srv.ID != raft.ServerID(nodeID) {
+			continue
+		}
+		if srv.Suffrage != raft.Voter {
+			return fmt.Errorf("node %s is not a voter in community %s", nodeID, communityID)
+		}
+
+		log.Info().Msgf("transferring leadership of community %s to %s", communityID, nodeID)
+		return ra.LeadershipTransferToServer(srv.ID, srv.Address).Error()
+	}
+
+	return fmt.Errorf("node %s is not part of community %s's cluster", nodeID, communityID)
+}
+
+// parseStat reads a numeric value out of raft.Stats(), which reports everything as strings
+func parseStat(stats map[string]string, key string) uint64 {
+	val, err := strconv.ParseUint(stats[key], 10, 64)
+	if err != nil {
+		return 0
+	}
+	return val
+}
@@ -0,0 +1,65 @@
+package raft
+
+import (
+	"testing"
+	"time"
+
+	"github.com/eagraf/habitat/cmd/habitat/community/state"
+	"github.com/eagraf/habitat/structs/community"
+	"github.com/hashicorp/raft"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestClusterStatus(t *testing.T) {
+	fsm, err := state.NewRaftFSMAdapter(community.NewCommunityStateBytes())
+	require.Nil(t, err)
+
+	addr, trans := raft.NewInmemTransport("")
+	config := raft.DefaultConfig()
+	config.LocalID = "local"
+
+	store := raft.NewInmemStore()
+	ra, err := raft.NewRaft(config, fsm, store, store, raft.NewInmemSnapshotStore(), trans)
+	require.Nil(t, err)
+	defer ra.Shutdown()
+
+	err = ra.BootstrapCluster(raft.Configuration{
+		Servers: []raft.Server{
+			{ID: "local", Address: addr},
+		},
+	}).Error()
+	require.Nil(t, err)
+
+	select {
+	case <-ra.LeaderCh():
+	case <-time.After(5 * time.Second):
+		t.Fatal("did not receive leadership")
+	}
+
+	cs := &ClusterService{
+		instances: map[string]*raftClusterInstance{
+			"abc": {
+				communityID: "abc",
+				instance:    ra,
+			},
+		},
+	}
+
+	status, err := cs.ClusterStatus("abc")
+	require.Nil(t, err)
+	assert.Equal(t, "Leader", status.State)
+	assert.Equal(t, "local", status.LeaderID)
+	assert.Equal(t, string(addr), status.LeaderAddress)
+	assert.Equal(t, status.Stats["commit_index"] != "0", status.CommitIndex > 0)
+	require.Equal(t, 1, len(status.Servers))
+	assert.Equal(t, "Voter", status.Servers[0].Suffrage)
+	assert.True(t, status.Servers[0].Leader)
+
+	// the only voter is already the leader
+	assert.NotNil(t, cs.TransferLeadership("abc", "local"))
+	assert.NotNil(t, cs.TransferLeadership("abc", "missing"))
+
+	_, err = cs.ClusterStatus("missing")
+	assert.NotNil(t, err)
+}
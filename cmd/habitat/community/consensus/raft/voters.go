@@ -0,0 +1,178 @@
+package raft
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/raft"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// DefaultMaxVoters is the most servers a community's Raft cluster lets vote. Every other
+	// server is a non-voter, which still receives the full log but isn't part of the quorum.
+	DefaultMaxVoters = 5
+
+	// UnhealthyAfter is how long a server can fail to heartbeat with the leader before it is
+	// demoted to a non-voter
+	UnhealthyAfter = 30 * time.Second
+
+	// voterPolicyInterval is how often the leader checks that the right servers are voting
+	voterPolicyInterval = 10 * time.Second
+)
+
+// serverHealth tracks which servers are failing to heartbeat with the leader
+type serverHealth struct {
+	failingSince map[raft.ServerID]time.Time
+
+	*sync.Mutex
+}
+
+func newServerHealth() *serverHealth {
+	return &serverHealth{
+		failingSince: make(map[raft.ServerID]time.Time),
+		Mutex:        &sync.Mutex{},
+	}
+}
+
+func (h *serverHealth) observe(observation raft.Observation) {
+	h.Lock()
+	defer h.Unlock()
+
+	switch o := observation.Data.(type) {
+	case raft.FailedHeartbeatObservation:
+		if _, ok := h.failingSince[o.PeerID]; !ok {
+			h.failingSince[o.PeerID] = o.LastContact
+		}
+	case raft.ResumedHeartbeatObservation:
+		delete(h.failingSince, o.PeerID)
+	case raft.LeaderObservation:
+		// only the leader sees heartbeats, so anything tracked by a previous leader is stale
+		h.failingSince = make(map[raft.ServerID]time.Time)
+	}
+}
+
+func (h *serverHealth) healthy(id raft.ServerID) bool {
+	h.Lock()
+	defer h.Unlock()
+
+	since, ok := h.failingSince[id]
+	return !ok || time.Since(since) < UnhealthyAfter
+}
+
+// selectVoters picks the servers that should vote. The number of voters is kept odd, since an
+// even number tolerates no more failures than the odd number below it, and is at most maxVoters.
+// The leader always votes, and healthy voters keep voting before any non-voter is promoted, so
+// that the configuration only changes when it has to.
+func selectVoters(servers []raft.Server, leaderID raft.ServerID, maxVoters int, healthy func(raft.ServerID) bool) map[raft.ServerID]bool {
+	var voters, nonvoters []raft.ServerID
+	for _, srv := range servers {
+		if srv.ID == leaderID || !healthy(srv.ID) {
+			continue
+		}
+		if srv.Suffrage == raft.Voter {
+			voters = append(voters, srv.ID)
+		} else {
+			nonvoters = append(nonvoters, srv.ID)
+		}
+	}
+	sort.Slice(voters, func(i, j int) bool { return voters[i] < voters[j] })
+	sort.Slice(nonvoters, func(i, j int) bool { return nonvoters[i] < nonvoters[j] })
+
+	candidates := append([]raft.ServerID{leaderID}, append(voters, nonvoters...)...)
+
+	target := maxVoters
+	if len(candidates) < target {
+		target = len(candidates)
+	}
+	if target%2 == 0 {
+		target--
+	}
+	if target < 1 {
+		target = 1
+	}
+
+	selected := make(map[raft.ServerID]bool)
+	for _, id := range candidates[:target] {
+		selected[id] = true
+	}
+	return selected
+}
+
+// balanceVoters promotes and demotes servers so that the voters match selectVoters. It only
+// has an effect on the leader. Promotions are done before demotions, so that the cluster never
+// has fewer voters than it needs along the way.
+func (ri *raftClusterInstance) balanceVoters() error {
+	if ri.instance == nil || ri.instance.State() != raft.Leader {
+		return nil
+	}
+
+	configFuture := ri.instance.GetConfiguration()
+	if err := configFuture.Error(); err != nil {
+		return err
+	}
+	servers := configFuture.Configuration().Servers
+
+	// this node is the leader
+	var leaderID raft.ServerID
+	for _, srv := range servers {
+		if srv.Address == ri.instance.Leader() {
+			leaderID = srv.ID
+		}
+	}
+	selected := selectVoters(servers, leaderID, ri.maxVoters, ri.health.healthy)
+
+	for _, srv := range servers {
+		if selected[srv.ID] && srv.Suffrage != raft.Voter {
+			log.Info().Msgf("promoting %s to a voter in community %s", srv.ID, ri.communityID)
+			err := ri.instance.AddVoter(srv.ID, srv.Address, 0, 0).Error()
+			if err != nil {
+				return fmt.Errorf("error promoting %s: %s", srv.ID, err)
+			}
+		}
+	}
+	for _, srv := range servers {
+		if !selected[srv.ID] && srv.Suffrage == raft.Voter {
+			log.Info().Msgf("demoting %s to a non-voter in community %s", srv.ID, ri.communityID)
+			err := ri.instance.DemoteVoter(srv.ID, 0, 0).Error()
+			if err != nil {
+				return fmt.Errorf("error demoting %s: %s", srv.ID, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// runVoterPolicy keeps the instance's voters balanced until the instance is shut down
+func (ri *raftClusterInstance) runVoterPolicy() {
+	observations := make(chan raft.Observation, 16)
+	observer := raft.NewObserver(observations, false, func(o *raft.Observation) bool {
+		switch o.Data.(type) {
+		case raft.FailedHeartbeatObservation, raft.ResumedHeartbeatObservation, raft.LeaderObservation:
+			return true
+		}
+		return false
+	})
+	ri.instance.RegisterObserver(observer)
+	defer ri.instance.DeregisterObserver(observer)
+
+	ticker := time.NewTicker(voterPolicyInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case observation := <-observations:
+			ri.health.observe(observation)
+		case <-ticker.C:
+			err := ri.balanceVoters()
+			if err != nil {
+				log.Error().Err(err).Msgf("error balancing voters for community %s", ri.communityID)
+			}
+		case <-ri.done:
+			return
+		}
+	}
+}
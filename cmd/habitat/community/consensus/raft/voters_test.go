@@ -0,0 +1,62 @@
+package raft
+
+import (
+	"testing"
+
+	"github.com/hashicorp/raft"
+	"github.com/stretchr/testify/assert"
+)
+
+func servers(voters []raft.ServerID, nonvoters []raft.ServerID) []raft.Server {
+	res := []raft.Server{}
+	for _, id := range voters {
+		res = append(res, raft.Server{Suffrage: raft.Voter, ID: id})
+	}
+	for _, id := range nonvoters {
+		res = append(res, raft.Server{Suffrage: raft.Nonvoter, ID: id})
+	}
+	return res
+}
+
+func selected(ids ...raft.ServerID) map[raft.ServerID]bool {
+	res := make(map[raft.ServerID]bool)
+	for _, id := range ids {
+		res[id] = true
+	}
+	return res
+}
+
+func TestSelectVoters(t *testing.T) {
+	allHealthy := func(raft.ServerID) bool { return true }
+
+	// a single node votes alone
+	assert.Equal(t, selected("a"), selectVoters(servers([]raft.ServerID{"a"}, nil), "a", 5, allHealthy))
+
+	// a second node isn't promoted, since two voters tolerate no more failures than one
+	assert.Equal(t, selected("a"), selectVoters(servers([]raft.ServerID{"a"}, []raft.ServerID{"b"}), "a", 5, allHealthy))
+
+	// a third node makes it worth promoting both
+	assert.Equal(t, selected("a", "b", "c"), selectVoters(servers([]raft.ServerID{"a"}, []raft.ServerID{"c", "b"}), "a", 5, allHealthy))
+
+	// voters are capped, and current voters keep voting over non-voters
+	assert.Equal(t, selected("a", "x", "y", "z", "b"), selectVoters(
+		servers([]raft.ServerID{"a", "x", "y", "z"}, []raft.ServerID{"b", "c", "d"}),
+		"a", 5, allHealthy,
+	))
+
+	// an unhealthy voter is replaced
+	unhealthyX := func(id raft.ServerID) bool { return id != "x" }
+	assert.Equal(t, selected("a", "b", "y"), selectVoters(
+		servers([]raft.ServerID{"a", "x", "y"}, []raft.ServerID{"b"}),
+		"a", 5, unhealthyX,
+	))
+
+	// if there is no one to replace it with, the voter count drops to stay odd
+	assert.Equal(t, selected("a"), selectVoters(
+		servers([]raft.ServerID{"a", "x", "y"}, nil),
+		"a", 5, unhealthyX,
+	))
+
+	// the leader always votes
+	assert.Equal(t, selected("c"), selectVoters(servers([]raft.ServerID{"a"}, []raft.ServerID{"c"}), "c", 1, allHealthy))
+}
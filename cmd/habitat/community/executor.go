@@ -1,8 +1,13 @@
 package community
 
 import (
-	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
 
+	"github.com/eagraf/habitat/cmd/habitat/community/consensus/cluster"
 	"github.com/eagraf/habitat/cmd/habitat/community/state"
 	"github.com/eagraf/habitat/cmd/habitat/node"
 	"github.com/eagraf/habitat/cmd/habitat/procs"
@@ -10,66 +15,110 @@ import (
 	"github.com/rs/zerolog/log"
 )
 
-type TransitionExecutor func(update *state.StateUpdate) error
+// instanceHealthDelay is how long a restarted process instance has to keep running before it is
+// considered healthy, and the node reports it as updated
+const instanceHealthDelay = 5 * time.Second
 
-// CommunityExecutor implements the state.Executor interface.
-// It receives incoming state transitions from the replicated state machine,
-// and executes the commands on the running node.
+// proposeFunc proposes transitions to a community, as Manager.ProposeTransitions does
+type proposeFunc func(communityID string, transitions []state.CommunityStateTransition, expectedVersion uint64) (*community.CommunityState, error)
+
+// reportFunc reports the status of this node's instance of a process, as
+// Manager.ReportInstanceStatus does
+type reportFunc func(communityID, processID, status string, instanceErr error, restarted bool) error
+
+// CommunityExecutor carries out the transitions that change what this node runs for its
+// communities. Its methods are subscribed to the transition types they handle by Subscribe.
 type CommunityExecutor struct {
-	node *node.Node
+	node           *node.Node
+	clusterManager *cluster.ClusterManager
+	propose        proposeFunc
+	report         reportFunc
+
+	healthDelay time.Duration
+
+	// updating holds the latest revision each local process instance is being updated to
+	updating     map[string]uint64
+	updatingLock *sync.Mutex
+
+	// leaving holds a channel for each community this node is leaving, which is sent the result
+	// of tearing the node down once its removal has been carried out
+	leaving     map[string]chan error
+	leavingLock *sync.Mutex
 }
 
-func NewCommunityExecutor(n *node.Node) *CommunityExecutor {
+func NewCommunityExecutor(n *node.Node, clusterManager *cluster.ClusterManager, propose proposeFunc, report reportFunc) *CommunityExecutor {
 	return &CommunityExecutor{
-		node: n,
-	}
-}
-
-// GetTransitionExecutor maps transition types to executor functions
-// TODO this is pretty silly, lets find a way to do this with reflection or equivalent
-func (e *CommunityExecutor) GetTransitionExecutor(transitionType string) TransitionExecutor {
-	switch transitionType {
-	case state.TransitionTypeStartProcess:
-		return e.StartProcess
-	case state.TransitionTypeStopProcess:
-		return e.StopProcess
-	case state.TransitionTypeStartProcessInstance:
-		return e.StartProcessInstance
-	case state.TransitionTypeStopProcessInstance:
-		return e.StopProcessInstance
-	case state.TransitionTypeAddNode:
-		return e.AddNode
-	default:
-		return nil
+		node:           n,
+		clusterManager: clusterManager,
+		propose:        propose,
+		report:         report,
+		healthDelay:    instanceHealthDelay,
+		updating:       make(map[string]uint64),
+		updatingLock:   &sync.Mutex{},
+		leaving:        make(map[string]chan error),
+		leavingLock:    &sync.Mutex{},
 	}
 }
 
-func (e *CommunityExecutor) Execute(update *state.StateUpdate) {
-	log.Info().Msgf("executing %s state transition", update.TransitionType)
+// awaitRemoval returns a channel that receives the result of tearing this node down once its
+// removal from the community has been carried out. It must be called before the removal is
+// proposed, and cancel must be called once the caller stops waiting.
+func (e *CommunityExecutor) awaitRemoval(communityID string) (<-chan error, func()) {
+	e.leavingLock.Lock()
+	defer e.leavingLock.Unlock()
 
-	transitionExecutor := e.GetTransitionExecutor(update.TransitionType)
-	if transitionExecutor != nil {
-		err := transitionExecutor(update)
-		if err != nil {
-			log.Error().Err(err).Msgf("error executing %s", update.TransitionType)
+	removed := make(chan error, 1)
+	e.leaving[communityID] = removed
+	return removed, func() {
+		e.leavingLock.Lock()
+		defer e.leavingLock.Unlock()
+		if e.leaving[communityID] == removed {
+			delete(e.leaving, communityID)
 		}
 	}
 }
 
-func (e *CommunityExecutor) StartProcess(update *state.StateUpdate) error {
-	return nil
+// removed hands the result of tearing this node down to whoever is waiting on its removal
+func (e *CommunityExecutor) removed(communityID string, err error) {
+	e.leavingLock.Lock()
+	defer e.leavingLock.Unlock()
+
+	if removed, ok := e.leaving[communityID]; ok {
+		removed <- err
+		delete(e.leaving, communityID)
+	}
 }
 
-func (e *CommunityExecutor) StopProcess(update *state.StateUpdate) error {
+// Subscribe registers the executor's methods with executors
+func (e *CommunityExecutor) Subscribe(executors *state.TransitionExecutors) error {
+	subscriptions := map[string]state.TransitionExecutor{
+		state.TransitionTypeStartProcessInstance:  e.StartProcessInstance,
+		state.TransitionTypeStopProcessInstance:   e.StopProcessInstance,
+		state.TransitionTypeUpdateProcess:         e.UpdateProcess,
+		state.TransitionTypeUpdateProcessInstance: e.UpdateProcessInstance,
+		state.TransitionTypeAddNode:               e.AddNode,
+		state.TransitionTypeRemoveNode:            e.RemoveNode,
+		state.TransitionTypeSetRaftConfig:         e.SetRaftConfig,
+	}
+
+	for transitionType, executor := range subscriptions {
+		err := executors.Subscribe(transitionType, executor)
+		if err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
-func (e *CommunityExecutor) StartProcessInstance(update *state.StateUpdate) error {
+// unexpectedTransition is returned by executors that were subscribed to the wrong transition type
+func unexpectedTransition(transition state.CommunityStateTransition) error {
+	return fmt.Errorf("unexpected transition type %T", transition)
+}
 
-	var transition state.StartProcessInstanceTransition
-	err := json.Unmarshal(update.Transition, &transition)
-	if err != nil {
-		return err
+func (e *CommunityExecutor) StartProcessInstance(update *state.StateUpdate, t state.CommunityStateTransition) error {
+	transition, ok := t.(*state.StartProcessInstanceTransition)
+	if !ok {
+		return unexpectedTransition(t)
 	}
 
 	state, err := update.State()
@@ -87,21 +136,48 @@ func (e *CommunityExecutor) StartProcessInstance(update *state.StateUpdate) erro
 	// Hash together the process ID, community ID and node ID to get a process instance ID
 
 	if transition.ProcessInstance.NodeID == e.node.ID {
-		_, err := e.node.ProcessManager.StartProcessInstance(state.CommunityID, process.ID, process.AppName, process.Args, process.Env, process.Flags)
-		if err != nil {
-			return err
-		}
+		return e.startInstance(state.CommunityID, process)
 	}
 
 	return nil
 }
 
-func (e *CommunityExecutor) StopProcessInstance(update *state.StateUpdate) error {
-	var transition state.StopProcessInstanceTransition
-	err := json.Unmarshal(update.Transition, &transition)
+// startInstance starts this node's instance of a process, unless it is already running
+func (e *CommunityExecutor) startInstance(communityID string, process *community.Process) error {
+	// replayed transitions find the instance already running
+	processInstanceID, err := procs.GetProcessInstanceID(communityID, e.node.ID, process.ID)
+	if err != nil {
+		return err
+	}
+	if e.node.ProcessManager.IsRunning(processInstanceID) {
+		return nil
+	}
+
+	_, err = e.node.ProcessManager.StartProcessInstance(communityID, process.ID, process.AppName, process.Args, process.Env, process.Flags, process.Config)
 	if err != nil {
+		e.reportStatus(communityID, process.ID, community.InstanceStatusFailed, err, false)
 		return err
 	}
+	e.reportStatus(communityID, process.ID, community.InstanceStatusRunning, nil, false)
+	return nil
+}
+
+// reportStatus reports the status of this node's instance of a process in the background, since
+// executors can't wait on proposals
+func (e *CommunityExecutor) reportStatus(communityID, processID, status string, instanceErr error, restarted bool) {
+	go func() {
+		err := e.report(communityID, processID, status, instanceErr, restarted)
+		if err != nil {
+			log.Error().Err(err).Msgf("error reporting status of process %s", processID)
+		}
+	}()
+}
+
+func (e *CommunityExecutor) StopProcessInstance(update *state.StateUpdate, t state.CommunityStateTransition) error {
+	transition, ok := t.(*state.StopProcessInstanceTransition)
+	if !ok {
+		return unexpectedTransition(t)
+	}
 
 	state, err := update.State()
 	if err != nil {
@@ -129,20 +205,143 @@ func (e *CommunityExecutor) StopProcessInstance(update *state.StateUpdate) error
 	return nil
 }
 
-func (e *CommunityExecutor) AddNode(update *state.StateUpdate) error {
-	var transition state.AddNodeTransition
-	err := json.Unmarshal(update.Transition, &transition)
+// UpdateProcess restarts this node's instance of an updated process, if it is this node's turn
+func (e *CommunityExecutor) UpdateProcess(update *state.StateUpdate, t state.CommunityStateTransition) error {
+	transition, ok := t.(*state.UpdateProcessTransition)
+	if !ok {
+		return unexpectedTransition(t)
+	}
+
+	state, err := update.State()
+	if err != nil {
+		return err
+	}
+
+	return e.rollOut(state, transition.Process.ID)
+}
+
+// UpdateProcessInstance moves a rolling update on to the next node once an instance is updated
+func (e *CommunityExecutor) UpdateProcessInstance(update *state.StateUpdate, t state.CommunityStateTransition) error {
+	transition, ok := t.(*state.UpdateProcessInstanceTransition)
+	if !ok {
+		return unexpectedTransition(t)
+	}
+
+	state, err := update.State()
+	if err != nil {
+		return err
+	}
+
+	return e.rollOut(state, transition.ProcessID)
+}
+
+// rollOut updates this node's instance of a process with the process's latest settings, if the
+// instance is behind and it is this node's turn. Updating the instance and waiting for it to
+// become healthy happens in the background, and the node then proposes that its instance is
+// updated. An instance that doesn't become healthy holds up a rolling update until the process
+// is updated again.
+func (e *CommunityExecutor) rollOut(s *community.CommunityState, processID string) error {
+	process := s.GetProcess(processID)
+	if process == nil {
+		return nil
+	}
+
+	instance := s.GetProcessInstance(processID, e.node.ID)
+	if instance == nil || instance.Revision >= process.Revision {
+		return nil
+	}
+
+	if process.RollingUpdate {
+		next := nextRollingUpdate(s, process)
+		if next == nil || next.NodeID != e.node.ID {
+			return nil
+		}
+	}
+
+	processInstanceID, err := procs.GetProcessInstanceID(s.CommunityID, e.node.ID, process.ID)
 	if err != nil {
 		return err
 	}
 
+	e.updatingLock.Lock()
+	if e.updating[processInstanceID] >= process.Revision {
+		e.updatingLock.Unlock()
+		return nil
+	}
+	e.updating[processInstanceID] = process.Revision
+	e.updatingLock.Unlock()
+
+	go func() {
+		err := e.updateInstance(s.CommunityID, process)
+		if err != nil {
+			log.Error().Err(err).Msgf("error updating instance of process %s to revision %d", process.ID, process.Revision)
+			e.reportStatus(s.CommunityID, process.ID, community.InstanceStatusFailed, err, false)
+			return
+		}
+		e.reportStatus(s.CommunityID, process.ID, community.InstanceStatusRunning, nil, false)
+	}()
+
+	return nil
+}
+
+// updateInstance applies a process's latest settings to this node's instance of it, and proposes
+// that the instance is updated once it has stayed up for the health delay. Instances whose config
+// is the only thing that changed reload it instead of restarting.
+func (e *CommunityExecutor) updateInstance(communityID string, process *community.Process) error {
+	processInstanceID, err := e.node.ProcessManager.UpdateProcessInstance(communityID, process.ID, process.AppName, process.Args, process.Env, process.Flags, process.Config)
+	if err != nil {
+		return err
+	}
+
+	time.Sleep(e.healthDelay)
+	if !e.node.ProcessManager.IsRunning(processInstanceID) {
+		return fmt.Errorf("process instance %s exited after being restarted", processInstanceID)
+	}
+
+	_, err = e.propose(communityID, []state.CommunityStateTransition{
+		&state.UpdateProcessInstanceTransition{
+			ProcessID: process.ID,
+			NodeID:    e.node.ID,
+			Revision:  process.Revision,
+		},
+	}, 0)
+	return err
+}
+
+// nextRollingUpdate returns the instance of a process that should be updated next in a rolling
+// update. Instances are updated in order of node ID.
+func nextRollingUpdate(s *community.CommunityState, process *community.Process) *community.ProcessInstance {
+	instances := make([]*community.ProcessInstance, 0)
+	for _, i := range s.ProcessInstances {
+		if i.ProcessID == process.ID {
+			instances = append(instances, i)
+		}
+	}
+	sort.Slice(instances, func(i, j int) bool {
+		return instances[i].NodeID < instances[j].NodeID
+	})
+
+	for _, i := range instances {
+		if i.Revision < process.Revision {
+			return i
+		}
+	}
+	return nil
+}
+
+func (e *CommunityExecutor) AddNode(update *state.StateUpdate, t state.CommunityStateTransition) error {
+	transition, ok := t.(*state.AddNodeTransition)
+	if !ok {
+		return unexpectedTransition(t)
+	}
+
 	// Check if the node is this instance
 	if transition.Node.ID == e.node.ID {
 		return nil
 	}
 
 	// HAX: req IPFS to add node as peer
-	_, err = e.node.IPFSClient.AddPeer(transition.Node.IPFSSwarmAddress)
+	_, err := e.node.IPFSClient.AddPeer(transition.Node.IPFSSwarmAddress)
 	if err != nil {
 		return err
 	}
@@ -155,3 +354,76 @@ func (e *CommunityExecutor) AddNode(update *state.StateUpdate) error {
 
 	return nil
 }
+
+func (e *CommunityExecutor) RemoveNode(update *state.StateUpdate, t state.CommunityStateTransition) error {
+	transition, ok := t.(*state.RemoveNodeTransition)
+	if !ok {
+		return unexpectedTransition(t)
+	}
+
+	state, err := update.State()
+	if err != nil {
+		return err
+	}
+
+	// Take the node out of the Raft cluster. This only has an effect on the leader, which may be
+	// the removed node itself. A leader that removes itself steps down once the removal commits.
+	err = e.clusterManager.RemoveNode(state.CommunityID, transition.Node.P2PID)
+
+	// If this instance was removed, stop everything it was running for the community
+	if transition.Node.ID == e.node.ID {
+		if err == nil {
+			err = e.node.ProcessManager.StopCommunityProcessInstances(state.CommunityID)
+		}
+		e.removed(state.CommunityID, err)
+		return err
+	}
+
+	// Every step is attempted even if an earlier one fails, so that cleaning up after the removed
+	// node can't keep the instances moved onto this node from starting
+	failures := make([]string, 0)
+	if err != nil {
+		failures = append(failures, fmt.Sprintf("error removing node from the cluster: %s", err))
+	}
+
+	// the removal may have moved instances of scheduled processes onto this node
+	for _, i := range state.ProcessInstances {
+		if i.NodeID != e.node.ID {
+			continue
+		}
+		process := state.GetProcess(i.ProcessID)
+		if process == nil || process.Placement == nil {
+			continue
+		}
+		err = e.startInstance(state.CommunityID, process)
+		if err != nil {
+			failures = append(failures, fmt.Sprintf("error starting instance of process %s: %s", process.ID, err))
+		}
+	}
+
+	// Remove node from list of data proxy peer nodes
+	err = e.node.DataProxy.RemovePeerNode(transition.Node.Address)
+	if err != nil {
+		failures = append(failures, fmt.Sprintf("error removing data proxy peer: %s", err))
+	}
+
+	_, err = e.node.IPFSClient.RemovePeer(transition.Node.IPFSSwarmAddress)
+	if err != nil {
+		failures = append(failures, fmt.Sprintf("error removing IPFS peer: %s", err))
+	}
+
+	if len(failures) != 0 {
+		return fmt.Errorf("error carrying out removal of node %s: %s", transition.Node.ID, strings.Join(failures, "; "))
+	}
+	return nil
+}
+
+// SetRaftConfig reloads this node's Raft instance for the community with its new settings
+func (e *CommunityExecutor) SetRaftConfig(update *state.StateUpdate, t state.CommunityStateTransition) error {
+	state, err := update.State()
+	if err != nil {
+		return err
+	}
+
+	return e.clusterManager.ReloadConfig(state.CommunityID, state.RaftConfig)
+}
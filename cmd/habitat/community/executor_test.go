@@ -0,0 +1,61 @@
+package community
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/eagraf/habitat/structs/community"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNextRollingUpdate(t *testing.T) {
+	process := &community.Process{
+		ID:            "proc1",
+		Revision:      2,
+		RollingUpdate: true,
+	}
+	s := &community.CommunityState{
+		Processes: []*community.Process{process},
+		ProcessInstances: []*community.ProcessInstance{
+			{ProcessID: "proc1", NodeID: "node3", Revision: 1},
+			{ProcessID: "proc2", NodeID: "node0", Revision: 0},
+			{ProcessID: "proc1", NodeID: "node2", Revision: 1},
+			{ProcessID: "proc1", NodeID: "node1", Revision: 2},
+		},
+	}
+
+	// instances are updated in order of node ID, skipping those that are up to date
+	next := nextRollingUpdate(s, process)
+	require.NotNil(t, next)
+	assert.Equal(t, "node2", next.NodeID)
+
+	s.GetProcessInstance("proc1", "node2").Revision = 2
+	next = nextRollingUpdate(s, process)
+	require.NotNil(t, next)
+	assert.Equal(t, "node3", next.NodeID)
+
+	s.GetProcessInstance("proc1", "node3").Revision = 2
+	assert.Nil(t, nextRollingUpdate(s, process))
+}
+
+func TestAwaitRemoval(t *testing.T) {
+	e := NewCommunityExecutor(nil, nil, nil, nil)
+
+	removed, cancel := e.awaitRemoval("abc")
+	e.removed("other", errors.New("not this one"))
+	e.removed("abc", nil)
+	select {
+	case err := <-removed:
+		assert.Nil(t, err)
+	default:
+		t.Fatal("expected the removal to be handed over")
+	}
+	cancel()
+
+	// nobody is waiting once the caller has given up
+	_, cancel = e.awaitRemoval("abc")
+	cancel()
+	e.removed("abc", errors.New("too late"))
+	assert.Empty(t, e.leaving)
+}
@@ -21,21 +21,16 @@ import (
 	"github.com/rs/zerolog/log"
 )
 
-func signKeyExchange(conn *websocket.Conn, finalMsg ctl.WebsocketMessage, nodeID string) (*community.Member, *community.Node, error) {
+func signKeyExchange(conn *websocket.Conn, finalMsg ctl.WebsocketMessage, nodeIdentity *identity.MemberNodeIdentity) (*community.Member, *community.Node, error) {
 	pubMsg := &ctl.SigningPublicKeyMsg{}
+	nodeID := nodeIdentity.NodeID
 
-	// Generate the private key first
-	pub, _, err := identity.GenerateMemberNodeKeypair()
-	if err != nil {
-		api.WriteWebsocketError(conn, err, pubMsg)
-		return nil, nil, err
-	}
-
-	// Send public key to client to be signed by user private key
-	pubMsg.PublicKey = pub
+	// Send public key to client to be signed by user private key. The node's private key is
+	// kept so that it can sign the community transitions this node proposes.
+	pubMsg.PublicKey = nodeIdentity.PublicKeyBytes()
 	pubMsg.NodeID = nodeID
 
-	err = conn.WriteJSON(pubMsg)
+	err := conn.WriteJSON(pubMsg)
 	if err != nil {
 		api.WriteWebsocketError(conn, err, pubMsg)
 		return nil, nil, err
@@ -100,7 +95,7 @@ func (m *Manager) CommunityCreateHandler(w http.ResponseWriter, r *http.Request)
 	defer api.WriteWebsocketClose(conn)
 
 	var commRes ctl.CommunityCreateResponse
-	member, node, err := signKeyExchange(conn, &commRes, compass.NodeID())
+	member, node, err := signKeyExchange(conn, &commRes, m.nodeIdentity)
 	if err != nil {
 		// signKeyExchange should have already sent an error back
 		return
@@ -127,7 +122,7 @@ func (m *Manager) CommunityCreateHandler(w http.ResponseWriter, r *http.Request)
 
 	node.Address = publicMa.String()
 	node.IPFSSwarmAddress = ipfsSwarmMa.String()
-	community, err := m.CreateCommunity(commReq.CommunityName, commReq.CreateIPFSCluster, member, node)
+	community, err := m.CreateCommunity(commReq.CommunityName, commReq.CreateIPFSCluster, commReq.Backend, member, node)
 	if err != nil {
 		api.WriteWebsocketError(conn, err, &commRes)
 		return
@@ -170,7 +165,7 @@ func (m *Manager) CommunityJoinHandler(w http.ResponseWriter, r *http.Request) {
 	defer api.WriteWebsocketClose(conn)
 
 	var commRes ctl.CommunityJoinResponse
-	newMember, newNode, err := signKeyExchange(conn, &commRes, compass.NodeID())
+	newMember, newNode, err := signKeyExchange(conn, &commRes, m.nodeIdentity)
 	if err != nil {
 		// signKeyExchange should have already sent an error back
 		return
@@ -242,6 +237,79 @@ func (m *Manager) CommunityJoinHandler(w http.ResponseWriter, r *http.Request) {
 
 }
 
+// CommunityWatchHandler streams updates to a community's state over a websocket until the
+// client disconnects
+func (m *Manager) CommunityWatchHandler(w http.ResponseWriter, r *http.Request) {
+	upgrader := websocket.Upgrader{}
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		api.WriteError(w, http.StatusInternalServerError, err)
+		return
+	}
+	defer api.WriteWebsocketClose(conn)
+
+	var watchMsg ctl.CommunityWatchMessage
+	var commReq ctl.CommunityWatchRequest
+	err = conn.ReadJSON(&commReq)
+	if err != nil {
+		api.WriteWebsocketError(conn, err, &watchMsg)
+		return
+	}
+
+	stateMachine, ok := m.communities[commReq.CommunityID]
+	if !ok {
+		api.WriteWebsocketError(conn, fmt.Errorf("community %s is not on this instance", commReq.CommunityID), &watchMsg)
+		return
+	}
+
+	updates, cancel, err := stateMachine.Watch(commReq.FromIndex)
+	if err != nil {
+		api.WriteWebsocketError(conn, err, &watchMsg)
+		return
+	}
+	defer cancel()
+
+	// The client doesn't send anything else, but reading is needed to notice it going away
+	disconnected := make(chan bool)
+	go func() {
+		for {
+			if _, _, err := conn.NextReader(); err != nil {
+				close(disconnected)
+				cancel()
+				return
+			}
+		}
+	}()
+
+	lastIndex := commReq.FromIndex
+	for update := range updates {
+		lastIndex = update.Index
+		watchMsg = ctl.CommunityWatchMessage{
+			Index:          update.Index,
+			TransitionType: update.TransitionType,
+			Transition:     update.Transition,
+			Proposer:       update.Proposer,
+		}
+		if commReq.IncludeState {
+			watchMsg.State = update.NewState
+		}
+
+		err = conn.WriteJSON(&watchMsg)
+		if err != nil {
+			log.Error().Err(err).Msgf("error writing update to community %s watcher", commReq.CommunityID)
+			return
+		}
+	}
+
+	select {
+	case <-disconnected:
+		return
+	default:
+		// The watcher fell behind, or the community was stopped. The client may be able to resume.
+		api.WriteWebsocketError(conn, fmt.Errorf("watch ended, resume from index %d", lastIndex), &ctl.CommunityWatchMessage{})
+	}
+}
+
 func (m *Manager) CommunityStateHandler(w http.ResponseWriter, r *http.Request) {
 	var commReq ctl.CommunityStateRequest
 	err := api.BindPostRequest(r, &commReq)
@@ -264,31 +332,211 @@ func (m *Manager) CommunityStateHandler(w http.ResponseWriter, r *http.Request)
 		return
 	}
 	commRes := &ctl.CommunityStateResponse{
-		State: marshaled,
+		State:   marshaled,
+		Version: state.Version,
 	}
 
 	api.WriteResponse(w, commRes)
 }
 
-func (m *Manager) CommunityAddMemberHandler(w http.ResponseWriter, r *http.Request) {
-	var commReq ctl.CommunityAddMemberRequest
+func (m *Manager) CommunityHistoryHandler(w http.ResponseWriter, r *http.Request) {
+	var commReq ctl.CommunityHistoryRequest
 	err := api.BindPostRequest(r, &commReq)
 	if err != nil {
 		api.WriteError(w, http.StatusInternalServerError, err)
 		return
 	}
 
-	communityID := commReq.CommunityID
-	nodeID := commReq.NodeID
-	address := commReq.JoiningNodeAddress
+	entries, nextBefore, err := m.GetHistory(commReq.CommunityID, commReq.Before, commReq.Limit, commReq.Type)
+	if err != nil {
+		api.WriteError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	commRes := &ctl.CommunityHistoryResponse{
+		Entries:    make([]*ctl.CommunityHistoryEntry, len(entries)),
+		NextBefore: nextBefore,
+	}
+	for i, e := range entries {
+		commRes.Entries[i] = &ctl.CommunityHistoryEntry{
+			Index:      e.Index,
+			Term:       e.Term,
+			AppendedAt: e.AppendedAt,
+			Type:       e.Type,
+			Transition: e.Transition,
+			Proposer:   e.Proposer,
+		}
+	}
+
+	api.WriteResponse(w, commRes)
+}
+
+func (m *Manager) CommunitySnapshotExportHandler(w http.ResponseWriter, r *http.Request) {
+	var commReq ctl.CommunitySnapshotExportRequest
+	err := api.BindPostRequest(r, &commReq)
+	if err != nil {
+		api.WriteError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	snapshot, err := m.ExportSnapshot(commReq.CommunityID)
+	if err != nil {
+		api.WriteError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	api.WriteResponse(w, &ctl.CommunitySnapshotExportResponse{
+		Snapshot: snapshot,
+	})
+}
+
+func (m *Manager) CommunitySnapshotImportHandler(w http.ResponseWriter, r *http.Request) {
+	var commReq ctl.CommunitySnapshotImportRequest
+	err := api.BindPostRequest(r, &commReq)
+	if err != nil {
+		api.WriteError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	state, err := m.ImportSnapshot(commReq.Snapshot, commReq.Standalone)
+	if err != nil {
+		api.WriteError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	api.WriteResponse(w, &ctl.CommunitySnapshotImportResponse{
+		CommunityID: state.CommunityID,
+		Version:     state.Version,
+	})
+}
+
+func (m *Manager) CommunityBackupHandler(w http.ResponseWriter, r *http.Request) {
+	var commReq ctl.CommunityBackupRequest
+	err := api.BindPostRequest(r, &commReq)
+	if err != nil {
+		api.WriteError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	if commReq.Password == "" {
+		api.WriteError(w, http.StatusBadRequest, errors.New("a password is required to encrypt the backup"))
+		return
+	}
+
+	archive, err := m.BackupCommunity(commReq.CommunityID, []byte(commReq.Password))
+	if err != nil {
+		api.WriteError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	api.WriteResponse(w, &ctl.CommunityBackupResponse{
+		Archive: archive,
+	})
+}
+
+func (m *Manager) CommunityRestoreHandler(w http.ResponseWriter, r *http.Request) {
+	var commReq ctl.CommunityRestoreRequest
+	err := api.BindPostRequest(r, &commReq)
+	if err != nil {
+		api.WriteError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	state, err := m.RestoreCommunity(commReq.Archive, []byte(commReq.Password))
+	if err != nil {
+		api.WriteError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	api.WriteResponse(w, &ctl.CommunityRestoreResponse{
+		CommunityID: state.CommunityID,
+		Version:     state.Version,
+	})
+}
+
+func (m *Manager) CommunityClusterStatusHandler(w http.ResponseWriter, r *http.Request) {
+	var commReq ctl.CommunityClusterStatusRequest
+	err := api.BindPostRequest(r, &commReq)
+	if err != nil {
+		api.WriteError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	status, err := m.ClusterStatus(commReq.CommunityID)
+	if err != nil {
+		api.WriteError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	commRes := &ctl.CommunityClusterStatusResponse{
+		State:         status.State,
+		Term:          status.Term,
+		LeaderID:      status.LeaderID,
+		LeaderAddress: status.LeaderAddress,
+		CommitIndex:   status.CommitIndex,
+		AppliedIndex:  status.AppliedIndex,
+		LastLogIndex:  status.LastLogIndex,
+		Servers:       make([]*ctl.CommunityClusterServer, len(status.Servers)),
+		Stats:         status.Stats,
+	}
+	for i, srv := range status.Servers {
+		commRes.Servers[i] = &ctl.CommunityClusterServer{
+			ID:          srv.ID,
+			Address:     srv.Address,
+			Suffrage:    srv.Suffrage,
+			Leader:      srv.Leader,
+			LastContact: srv.LastContact,
+		}
+	}
+
+	api.WriteResponse(w, commRes)
+}
+
+func (m *Manager) CommunityTransferLeadershipHandler(w http.ResponseWriter, r *http.Request) {
+	var commReq ctl.CommunityTransferLeadershipRequest
+	err := api.BindPostRequest(r, &commReq)
+	if err != nil {
+		api.WriteError(w, http.StatusInternalServerError, err)
+		return
+	}
 
-	err = m.clusterManager.AddNode(communityID, nodeID, address)
+	err = m.TransferLeadership(commReq.CommunityID, commReq.NodeID)
+	if err != nil {
+		api.WriteError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	api.WriteResponse(w, &ctl.CommunityTransferLeadershipResponse{})
+}
+
+func (m *Manager) CommunityRaftConfigHandler(w http.ResponseWriter, r *http.Request) {
+	var commReq ctl.CommunityRaftConfigRequest
+	err := api.BindPostRequest(r, &commReq)
 	if err != nil {
 		api.WriteError(w, http.StatusInternalServerError, err)
 		return
 	}
 
-	_, err = m.AddMemberNode(communityID, commReq.Member, commReq.Node)
+	newState, err := m.SetRaftConfig(commReq.CommunityID, commReq.RaftConfig)
+	if err != nil {
+		api.WriteError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	api.WriteResponse(w, &ctl.CommunityRaftConfigResponse{
+		Version: newState.Version,
+	})
+}
+
+func (m *Manager) CommunityAddMemberHandler(w http.ResponseWriter, r *http.Request) {
+	var commReq ctl.CommunityAddMemberRequest
+	err := api.BindPostRequest(r, &commReq)
+	if err != nil {
+		api.WriteError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	_, err = m.AddJoiningNode(commReq.CommunityID, commReq.NodeID, commReq.JoiningNodeAddress, commReq.Member, commReq.Node)
 	if err != nil {
 		api.WriteError(w, http.StatusInternalServerError, err)
 		return
@@ -298,21 +546,112 @@ func (m *Manager) CommunityAddMemberHandler(w http.ResponseWriter, r *http.Reque
 	api.WriteResponse(w, commRes)
 }
 
-func (m *Manager) CommunityProposeHandler(w http.ResponseWriter, r *http.Request) {
-	var commReq ctl.CommunityProposeRequest
+func (m *Manager) CommunityRemoveNodeHandler(w http.ResponseWriter, r *http.Request) {
+	var commReq ctl.CommunityRemoveNodeRequest
+	err := api.BindPostRequest(r, &commReq)
+	if err != nil {
+		api.WriteError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	_, err = m.RemoveNode(commReq.CommunityID, commReq.NodeID)
+	if err != nil {
+		api.WriteError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	api.WriteResponse(w, &ctl.CommunityRemoveNodeResponse{})
+}
+
+func (m *Manager) CommunitySetNodeLabelsHandler(w http.ResponseWriter, r *http.Request) {
+	var commReq ctl.CommunitySetNodeLabelsRequest
+	err := api.BindPostRequest(r, &commReq)
+	if err != nil {
+		api.WriteError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	_, err = m.SetNodeLabels(commReq.CommunityID, commReq.NodeID, commReq.Labels)
+	if err != nil {
+		api.WriteError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	api.WriteResponse(w, &ctl.CommunitySetNodeLabelsResponse{})
+}
+
+func (m *Manager) CommunityRemoveMemberHandler(w http.ResponseWriter, r *http.Request) {
+	var commReq ctl.CommunityRemoveMemberRequest
+	err := api.BindPostRequest(r, &commReq)
+	if err != nil {
+		api.WriteError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	_, err = m.RemoveMember(commReq.CommunityID, commReq.MemberID)
+	if err != nil {
+		api.WriteError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	api.WriteResponse(w, &ctl.CommunityRemoveMemberResponse{})
+}
+
+func (m *Manager) CommunityLeaveHandler(w http.ResponseWriter, r *http.Request) {
+	var commReq ctl.CommunityLeaveRequest
 	err := api.BindPostRequest(r, &commReq)
 	if err != nil {
 		api.WriteError(w, http.StatusInternalServerError, err)
 		return
 	}
 
-	err = m.ProposeTransitions(commReq.CommunityID, commReq.StateTransition)
+	err = m.LeaveCommunity(commReq.CommunityID, commReq.Delete)
 	if err != nil {
 		api.WriteError(w, http.StatusInternalServerError, err)
 		return
 	}
 
+	api.WriteResponse(w, &ctl.CommunityLeaveResponse{})
+}
+
+func (m *Manager) CommunityProposeHandler(w http.ResponseWriter, r *http.Request) {
+	var commReq ctl.CommunityProposeRequest
+	err := api.BindPostRequest(r, &commReq)
+	if err != nil {
+		api.WriteError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	if len(commReq.Transitions) == 0 {
+		api.WriteError(w, http.StatusBadRequest, errors.New("no transitions supplied"))
+		return
+	}
+
+	transitions := make([]state.CommunityStateTransition, len(commReq.Transitions))
+	for i, proposed := range commReq.Transitions {
+		transitions[i], err = state.ParseTransition(proposed.Type, proposed.Transition)
+		if err != nil {
+			api.WriteError(w, http.StatusBadRequest, err)
+			return
+		}
+	}
+
 	commRes := &ctl.CommunityProposeResponse{}
+	var newState *community.CommunityState
+	if commReq.DryRun {
+		newState, commRes.Diff, err = m.DryRunTransitions(commReq.CommunityID, transitions, commReq.ExpectedVersion)
+	} else {
+		newState, err = m.ProposeTransitions(commReq.CommunityID, transitions, commReq.ExpectedVersion)
+	}
+	if errors.Is(err, state.ErrVersionConflict) {
+		api.WriteError(w, http.StatusConflict, err)
+		return
+	} else if err != nil {
+		api.WriteError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	commRes.Version = newState.Version
 	api.WriteResponse(w, commRes)
 }
 
@@ -404,40 +743,26 @@ func (m *Manager) CommunityStartProcessHandler(w http.ResponseWriter, r *http.Re
 		return
 	}
 
-	communityID := commReq.CommunityID
-
-	stateMachine, ok := m.communities[communityID]
-	if !ok {
-		api.WriteError(w, http.StatusInternalServerError, fmt.Errorf("community %s is not on this instance", communityID))
+	if len(commReq.InstancesNodes) != 0 && commReq.Placement != nil {
+		api.WriteError(w, http.StatusBadRequest, errors.New("instance nodes and a placement can't both be given"))
 		return
 	}
 
-	processID := procs.RandomProcessID()
-
-	transitions := []state.CommunityStateTransition{
-		&state.StartProcessTransition{
-			Process: &community.Process{
-				ID:      processID,
-				AppName: commReq.App,
-				Args:    commReq.Args,
-				Flags:   commReq.Flags,
-				Env:     commReq.Env,
-			},
-		},
-	}
+	process := &community.Process{
+		ID:      procs.RandomProcessID(),
+		AppName: commReq.App,
+		Args:    commReq.Args,
+		Flags:   commReq.Flags,
+		Env:     commReq.Env,
+		Config:  commReq.Config,
 
-	for _, i := range commReq.InstancesNodes {
-		transitions = append(transitions, &state.StartProcessInstanceTransition{
-			ProcessInstance: &community.ProcessInstance{
-				ProcessID: processID,
-				NodeID:    i,
-			},
-		})
+		Placement: commReq.Placement,
 	}
 
-	_, err = stateMachine.ProposeTransitions(transitions)
+	_, err = m.StartProcess(commReq.CommunityID, process, commReq.InstancesNodes)
 	if err != nil {
 		api.WriteError(w, http.StatusInternalServerError, err)
+		return
 	}
 
 	api.WriteResponse(w, &ctl.CommunityStartProcessResponse{})
@@ -495,3 +820,54 @@ func (m *Manager) CommunityStopProcessHandler(w http.ResponseWriter, r *http.Req
 
 	api.WriteResponse(w, &ctl.CommunityStartProcessResponse{})
 }
+
+func (m *Manager) CommunityUpdateProcessHandler(w http.ResponseWriter, r *http.Request) {
+	var commReq ctl.CommunityUpdateProcessRequest
+	err := api.BindPostRequest(r, &commReq)
+	if err != nil {
+		api.WriteError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	curState, err := m.GetState(commReq.CommunityID)
+	if err != nil {
+		api.WriteError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	current := curState.GetProcess(commReq.ProcessID)
+	if current == nil {
+		api.WriteError(w, http.StatusNotFound, fmt.Errorf("process %s not found in community %s", commReq.ProcessID, commReq.CommunityID))
+		return
+	}
+
+	process := *current
+	if commReq.Args != nil {
+		process.Args = commReq.Args
+	}
+	if commReq.Env != nil {
+		process.Env = commReq.Env
+	}
+	if commReq.Flags != nil {
+		process.Flags = commReq.Flags
+	}
+	if commReq.Config != nil {
+		process.Config = commReq.Config
+	}
+
+	newState, err := m.UpdateProcess(commReq.CommunityID, &process, commReq.Rolling)
+	if err != nil {
+		api.WriteError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	updated := newState.GetProcess(process.ID)
+	if updated == nil {
+		api.WriteError(w, http.StatusInternalServerError, fmt.Errorf("process %s was stopped while being updated", process.ID))
+		return
+	}
+
+	api.WriteResponse(w, &ctl.CommunityUpdateProcessResponse{
+		Revision: updated.Revision,
+	})
+}
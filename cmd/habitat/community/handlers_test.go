@@ -1,11 +1,14 @@
 package community
 
 import (
+	"bytes"
+	"encoding/json"
 	"errors"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
 	"testing"
+	"time"
 
 	"github.com/eagraf/habitat/cmd/habitat/api"
 	client "github.com/eagraf/habitat/pkg/habitat_client"
@@ -14,6 +17,7 @@ import (
 	"github.com/eagraf/habitat/structs/ctl"
 	"github.com/gorilla/websocket"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 type testWebsocketResponse struct {
@@ -30,8 +34,16 @@ func TestKeySigningExchangeOverWebsocket(t *testing.T) {
 		}
 		defer api.WriteWebsocketClose(conn)
 
+		_, privKey, err := identity.GenerateMemberNodeKeypair()
+		if err != nil {
+			api.WriteError(w, http.StatusInternalServerError, err)
+		}
+
 		var res testWebsocketResponse
-		member, _, err := signKeyExchange(conn, &res, "xyz")
+		member, _, err := signKeyExchange(conn, &res, &identity.MemberNodeIdentity{
+			NodeID:  "xyz",
+			PrivKey: privKey,
+		})
 		if err != nil {
 			// signKeyExchange should already have sent back response
 			return
@@ -96,3 +108,85 @@ func TestWebsocketError(t *testing.T) {
 	assert.NotNil(t, werr)
 	assert.Equal(t, "abc", werr.Error())
 }
+
+func TestCommunityProposeHandler(t *testing.T) {
+	m, member, commNode := newTestManager(t, t.TempDir())
+
+	created, err := m.CreateCommunity("test", false, "", member, commNode)
+	require.Nil(t, err)
+	communityID := created.CommunityID
+	require.Eventually(t, func() bool {
+		current, err := m.GetState(communityID)
+		return err == nil && current.Version == created.Version
+	}, time.Second, 10*time.Millisecond)
+
+	propose := func(req *ctl.CommunityProposeRequest) (int, *ctl.CommunityProposeResponse) {
+		req.CommunityID = communityID
+		body, err := json.Marshal(req)
+		require.Nil(t, err)
+
+		w := httptest.NewRecorder()
+		m.CommunityProposeHandler(w, httptest.NewRequest(http.MethodPost, "/community_propose", bytes.NewReader(body)))
+		if w.Code != http.StatusOK {
+			return w.Code, nil
+		}
+
+		var res ctl.CommunityProposeResponse
+		require.Nil(t, json.Unmarshal(w.Body.Bytes(), &res))
+		return w.Code, &res
+	}
+
+	startProcess := &ctl.ProposedTransition{
+		Type:       "start_process",
+		Transition: []byte(`{"Process": {"id": "p1", "app_name": "app", "env": [], "flags": [], "args": []}}`),
+	}
+
+	// a dry run reports the changes without committing them
+	code, res := propose(&ctl.CommunityProposeRequest{
+		Transitions: []*ctl.ProposedTransition{startProcess},
+		DryRun:      true,
+	})
+	require.Equal(t, http.StatusOK, code)
+	var diff []map[string]interface{}
+	require.Nil(t, json.Unmarshal(res.Diff, &diff))
+	require.Equal(t, 1, len(diff))
+	assert.Equal(t, "/processes/-", diff[0]["path"])
+
+	current, err := m.GetState(communityID)
+	require.Nil(t, err)
+	assert.Equal(t, 0, len(current.Processes))
+
+	// transitions are checked against their schema, and then validated against the state
+	rejected := [][]*ctl.ProposedTransition{
+		{},
+		{{Type: "launch_rocket", Transition: []byte(`{}`)}},
+		{{Type: "start_process", Transition: []byte(`{"Process": {"id": "p1", "app_name": "app"}}`)}},
+		{{Type: "stop_process", Transition: []byte(`{"ProcessID": "missing"}`)}},
+	}
+	for _, transitions := range rejected {
+		code, _ = propose(&ctl.CommunityProposeRequest{
+			Transitions: transitions,
+			DryRun:      true,
+		})
+		assert.NotEqual(t, http.StatusOK, code)
+	}
+
+	code, res = propose(&ctl.CommunityProposeRequest{
+		Transitions: []*ctl.ProposedTransition{startProcess},
+	})
+	require.Equal(t, http.StatusOK, code)
+	assert.True(t, res.Version > created.Version)
+	assert.Nil(t, res.Diff)
+
+	require.Eventually(t, func() bool {
+		current, err := m.GetState(communityID)
+		return err == nil && len(current.Processes) == 1
+	}, time.Second, 10*time.Millisecond)
+
+	// the version check still applies
+	code, _ = propose(&ctl.CommunityProposeRequest{
+		Transitions:     []*ctl.ProposedTransition{{Type: "stop_process", Transition: []byte(`{"ProcessID": "p1"}`)}},
+		ExpectedVersion: created.Version,
+	})
+	assert.Equal(t, http.StatusConflict, code)
+}
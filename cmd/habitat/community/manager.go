@@ -1,7 +1,9 @@
 package community
 
 import (
+	"bytes"
 	"encoding/base64"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io/ioutil"
@@ -9,11 +11,13 @@ import (
 	"path"
 	"path/filepath"
 	"sync"
+	"time"
 
 	"github.com/eagraf/habitat/cmd/habitat/community/consensus/cluster"
 	"github.com/eagraf/habitat/cmd/habitat/community/state"
 	"github.com/eagraf/habitat/cmd/habitat/node"
 	"github.com/eagraf/habitat/pkg/compass"
+	"github.com/eagraf/habitat/pkg/identity"
 	"github.com/eagraf/habitat/pkg/ipfs"
 	"github.com/eagraf/habitat/structs/community"
 	"github.com/google/uuid"
@@ -26,8 +30,20 @@ type Manager struct {
 	node   *node.Node
 
 	clusterManager  *cluster.ClusterManager
+	executors       *state.TransitionExecutors
+	executor        *CommunityExecutor
 	communities     map[string]*state.CommunityStateMachine
 	communitiesLock *sync.Mutex
+
+	// nodeIdentity holds the key this node uses to sign community transitions
+	nodeIdentity *identity.MemberNodeIdentity
+
+	// stopReconciling is closed to stop the reconciliation loop, if it was started
+	stopReconciling chan struct{}
+
+	// restarts holds the backoff of each process instance the reconciler has restarted
+	restarts     map[string]*restartBackoff
+	restartsLock *sync.Mutex
 }
 
 func NewManager(path string, habitatNode *node.Node) (*Manager, error) {
@@ -38,6 +54,29 @@ func NewManager(path string, habitatNode *node.Node) (*Manager, error) {
 		return nil, fmt.Errorf("error starting cluster manager: %s", err)
 	}
 
+	nodeKey, err := identity.LoadMemberNodeKey(compass.MemberNodeKeyPath())
+	if err != nil {
+		return nil, fmt.Errorf("error loading member node key: %s", err)
+	}
+
+	manager, err := NewManagerWithClusterManager(path, habitatNode, clusterManager, &identity.MemberNodeIdentity{
+		NodeID:  habitatNode.ID,
+		PrivKey: nodeKey,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// restored communities only start process instances for new transitions, so start any
+	// assigned to this node that aren't running
+	manager.StartReconciling(reconcileInterval)
+
+	return manager, nil
+}
+
+// NewManagerWithClusterManager builds a manager around an already started cluster manager, and
+// restarts any communities found in path
+func NewManagerWithClusterManager(path string, habitatNode *node.Node, clusterManager *cluster.ClusterManager, nodeIdentity *identity.MemberNodeIdentity) (*Manager, error) {
 	manager := &Manager{
 		Path: path,
 		config: &ipfs.IPFSConfig{
@@ -47,26 +86,55 @@ func NewManager(path string, habitatNode *node.Node) (*Manager, error) {
 		},
 		node:            habitatNode,
 		clusterManager:  clusterManager,
+		executors:       state.NewTransitionExecutors(),
 		communities:     make(map[string]*state.CommunityStateMachine),
 		communitiesLock: &sync.Mutex{},
+		nodeIdentity:    nodeIdentity,
+		restarts:        make(map[string]*restartBackoff),
+		restartsLock:    &sync.Mutex{},
+	}
+
+	manager.executor = NewCommunityExecutor(habitatNode, clusterManager, manager.ProposeTransitions, manager.ReportInstanceStatus)
+	err := manager.executor.Subscribe(manager.executors)
+	if err != nil {
+		return nil, err
+	}
+
+	if habitatNode.ProcessManager != nil {
+		habitatNode.ProcessManager.SetExitHandler(manager.reportProcessExit)
 	}
 
 	// Restart any existing communities
-	comDirs, err := ioutil.ReadDir(compass.CommunitiesPath())
+	comDirs, err := ioutil.ReadDir(path)
 	if err == nil {
 		for _, dir := range comDirs {
+			if !dir.IsDir() {
+				continue
+			}
+
 			updateChan, err := clusterManager.RestoreNode(dir.Name())
 			if err != nil {
 				log.Error().Err(err).Msgf("error restoring cluster for community %s", dir.Name())
+				continue
 			}
 
+			// Raft restores the latest snapshot when it starts, and only replays the log after it
 			initState := community.NewCommunityState()
+			if restored, err := clusterManager.GetState(dir.Name()); err == nil {
+				err = json.Unmarshal(restored, initState)
+				if err != nil {
+					log.Error().Err(err).Msgf("error decoding restored state for community %s", dir.Name())
+					initState = community.NewCommunityState()
+				}
+			}
+
 			stateMachine, err := state.NewCommunityStateMachine(initState,
 				updateChan, &ClusterDispatcher{
 					communityID:    dir.Name(),
 					clusterManager: manager.clusterManager,
 				},
-				NewCommunityExecutor(manager.node),
+				manager.executors,
+				manager.nodeIdentity,
 			)
 			if err != nil {
 				return nil, err
@@ -110,7 +178,9 @@ func (m *Manager) checkCommunityExists(communityID string) bool {
 
 }
 
-func (m *Manager) CreateCommunity(name string, createIpfs bool, member *community.Member, node *community.Node) (*community.CommunityState, error) {
+// CreateCommunity starts a new community with this node as its only node. The community runs on
+// the named cluster backend, or on the default one if backend is empty.
+func (m *Manager) CreateCommunity(name string, createIpfs bool, backend string, member *community.Member, node *community.Node) (*community.CommunityState, error) {
 	// Generate UUID for now
 	communityID := uuid.New().String()
 
@@ -121,7 +191,7 @@ func (m *Manager) CreateCommunity(name string, createIpfs bool, member *communit
 		return nil, err
 	}
 
-	updateChan, err := m.clusterManager.CreateCluster(communityID)
+	updateChan, err := m.clusterManager.CreateCluster(communityID, backend)
 	if err != nil {
 		return nil, err
 	}
@@ -129,7 +199,7 @@ func (m *Manager) CreateCommunity(name string, createIpfs bool, member *communit
 	stateMachine, err := state.NewCommunityStateMachine(community.NewCommunityState(), updateChan, &ClusterDispatcher{
 		communityID:    communityID,
 		clusterManager: m.clusterManager,
-	}, NewCommunityExecutor(m.node))
+	}, m.executors, m.nodeIdentity)
 	if err != nil {
 		return nil, err
 	}
@@ -139,11 +209,18 @@ func (m *Manager) CreateCommunity(name string, createIpfs bool, member *communit
 		return nil, err
 	}
 
+	// The creator of a community is its first admin
+	member.Role = community.RoleAdmin
+
 	// The first state transition in a new community is alway initialize_community, which sets the community_id
 	transitions := []state.CommunityStateTransition{
 		&state.InitializeCommunityTransition{
 			CommunityID: communityID,
 		},
+		// new communities start at schema version 1 like every other, and are migrated straight away
+		&state.MigrateSchemaTransition{
+			ToVersion: community.LatestSchemaVersion,
+		},
 		&state.AddMemberTransition{
 			Member: member,
 		},
@@ -175,7 +252,7 @@ func (m *Manager) JoinCommunity(name string, swarmkey string, btstps []string, a
 	stateMachine, err := state.NewCommunityStateMachine(community.NewCommunityState(), updateChan, &ClusterDispatcher{
 		communityID:    communityID,
 		clusterManager: m.clusterManager,
-	}, NewCommunityExecutor(m.node))
+	}, m.executors, m.nodeIdentity)
 	if err != nil {
 		return nil, err
 	}
@@ -188,12 +265,27 @@ func (m *Manager) JoinCommunity(name string, swarmkey string, btstps []string, a
 	return stateMachine.State()
 }
 
+// AddJoiningNode lets a node that is joining a community into the community's cluster, and then
+// proposes adding the node and its member to the community. nodeID is the joining node's libp2p
+// peer ID, and address is where the rest of the cluster can reach it.
+func (m *Manager) AddJoiningNode(communityID string, nodeID string, address string, member *community.Member, node *community.Node) (*community.CommunityState, error) {
+	err := m.clusterManager.AddNode(communityID, nodeID, address)
+	if err != nil {
+		return nil, err
+	}
+
+	return m.AddMemberNode(communityID, member, node)
+}
+
 func (m *Manager) AddMemberNode(communityID string, member *community.Member, node *community.Node) (*community.CommunityState, error) {
 	stateMachine, ok := m.communities[communityID]
 	if !ok {
 		return nil, fmt.Errorf("community %s is not on this instance", communityID)
 	}
 
+	// admins are promoted explicitly after joining
+	member.Role = community.RoleMember
+
 	transitions := []state.CommunityStateTransition{
 		&state.AddMemberTransition{
 			Member: member,
@@ -210,19 +302,390 @@ func (m *Manager) AddMemberNode(communityID string, member *community.Member, no
 	return state, nil
 }
 
-func (m *Manager) ProposeTransitions(communityID string, transitions []byte) error {
-	if !m.checkCommunityExists(communityID) {
-		return fmt.Errorf("community %s does not exist in communities directory", communityID)
+// RemoveNode proposes that a node be removed from the community. All process instances
+// assigned to the node are removed with it, and the instances of scheduled processes are
+// replaced elsewhere by the same transition.
+func (m *Manager) RemoveNode(communityID string, nodeID string) (*community.CommunityState, error) {
+	stateMachine, ok := m.communities[communityID]
+	if !ok {
+		return nil, fmt.Errorf("community %s is not on this instance", communityID)
 	}
 
-	_, err := m.clusterManager.ProposeTransitions(communityID, transitions)
+	curState, err := stateMachine.State()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, n := range curState.Nodes {
+		if n.ID == nodeID {
+			transitions := []state.CommunityStateTransition{
+				&state.RemoveNodeTransition{
+					Node: n,
+				},
+			}
+			return stateMachine.ProposeTransitions(transitions)
+		}
+	}
+
+	return nil, fmt.Errorf("node %s is not in community %s", nodeID, communityID)
+}
+
+// SetNodeLabels proposes replacing the labels of a node, which the scheduler places process
+// instances by
+func (m *Manager) SetNodeLabels(communityID string, nodeID string, labels map[string]string) (*community.CommunityState, error) {
+	stateMachine, ok := m.communities[communityID]
+	if !ok {
+		return nil, fmt.Errorf("community %s is not on this instance", communityID)
+	}
+
+	transitions := []state.CommunityStateTransition{
+		&state.SetNodeLabelsTransition{
+			NodeID: nodeID,
+			Labels: labels,
+		},
+	}
+	return stateMachine.ProposeTransitions(transitions)
+}
+
+// RemoveMember proposes that a member be removed from the community, along with all of
+// the member's nodes. Instances on those nodes are rescheduled as RemoveNode does.
+func (m *Manager) RemoveMember(communityID string, memberID string) (*community.CommunityState, error) {
+	stateMachine, ok := m.communities[communityID]
+	if !ok {
+		return nil, fmt.Errorf("community %s is not on this instance", communityID)
+	}
+
+	curState, err := stateMachine.State()
+	if err != nil {
+		return nil, err
+	}
+
+	transitions := []state.CommunityStateTransition{}
+	for _, n := range curState.Nodes {
+		if n.MemberID == memberID {
+			transitions = append(transitions, &state.RemoveNodeTransition{
+				Node: n,
+			})
+		}
+	}
+	transitions = append(transitions, &state.RemoveMemberTransition{
+		MemberID: memberID,
+	})
+
+	return stateMachine.ProposeTransitions(transitions)
+}
+
+// leaveTimeout is how long LeaveCommunity waits for this node's removal to be carried out
+const leaveTimeout = 30 * time.Second
+
+// LeaveCommunity removes this node from a community, and waits for the removal to be carried
+// out, which stops everything the node was running for it. The node's Raft instance is then shut
+// down, and the community's data directory is archived so that it is not restored on restart, or
+// deleted entirely if deleteData is set.
+func (m *Manager) LeaveCommunity(communityID string, deleteData bool) error {
+	stateMachine, ok := m.communities[communityID]
+	if !ok {
+		return fmt.Errorf("community %s is not on this instance", communityID)
+	}
+
+	curState, err := stateMachine.State()
 	if err != nil {
 		return err
 	}
 
+	if curState.GetNode(m.node.ID) != nil {
+		// the remove_node executor takes this node out of the cluster and stops its instances
+		removed, cancel := m.executor.awaitRemoval(communityID)
+		defer cancel()
+
+		_, err := m.RemoveNode(communityID, m.node.ID)
+		if err != nil {
+			return fmt.Errorf("error proposing removal of this node: %s", err)
+		}
+
+		select {
+		case err = <-removed:
+			if err != nil {
+				return fmt.Errorf("error removing this node from community %s: %s", communityID, err)
+			}
+		case <-time.After(leaveTimeout):
+			return fmt.Errorf("timed out waiting for this node's removal from community %s to be carried out", communityID)
+		}
+	} else {
+		// a node that was already removed has nothing left to carry out, but its instances may
+		// still be running if it was down at the time
+		err = m.node.ProcessManager.StopCommunityProcessInstances(communityID)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = m.clusterManager.RemoveCluster(communityID)
+	if err != nil {
+		return err
+	}
+
+	err = m.removeCommunity(communityID)
+	if err != nil {
+		return err
+	}
+	m.forgetCommunityRestarts(communityID, curState)
+
+	communityPath := path.Join(m.Path, communityID)
+	if deleteData {
+		return os.RemoveAll(communityPath)
+	}
+
+	err = os.MkdirAll(compass.ArchivedCommunitiesPath(), 0700)
+	if err != nil {
+		return err
+	}
+
+	archivePath := filepath.Join(compass.ArchivedCommunitiesPath(), fmt.Sprintf("%s-%d", communityID, time.Now().Unix()))
+	return os.Rename(communityPath, archivePath)
+}
+
+// StartProcess proposes starting a process in a community, with an instance of it on each of
+// the given nodes. If no nodes are given, the scheduler places the process's instances according
+// to its placement.
+func (m *Manager) StartProcess(communityID string, process *community.Process, instanceNodes []string) (*community.CommunityState, error) {
+	stateMachine, ok := m.communities[communityID]
+	if !ok {
+		return nil, fmt.Errorf("community %s is not on this instance", communityID)
+	}
+
+	if len(instanceNodes) == 0 && process.Placement != nil {
+		curState, err := stateMachine.State()
+		if err != nil {
+			return nil, err
+		}
+
+		placed, missing := state.Schedule(curState, process)
+		if missing > 0 {
+			return nil, fmt.Errorf("only %d of %d replicas of process %s can be placed", len(placed), process.Placement.Replicas, process.ID)
+		}
+		for _, i := range placed {
+			instanceNodes = append(instanceNodes, i.NodeID)
+		}
+	}
+
+	transitions := []state.CommunityStateTransition{
+		&state.StartProcessTransition{
+			Process: process,
+		},
+	}
+
+	for _, nodeID := range instanceNodes {
+		transitions = append(transitions, &state.StartProcessInstanceTransition{
+			ProcessInstance: &community.ProcessInstance{
+				ProcessID: process.ID,
+				NodeID:    nodeID,
+			},
+		})
+	}
+
+	return stateMachine.ProposeTransitions(transitions)
+}
+
+// UpdateProcess proposes new settings for a running process. Every node running an instance of
+// it restarts the instance with the new settings, one node at a time if rolling is set.
+func (m *Manager) UpdateProcess(communityID string, process *community.Process, rolling bool) (*community.CommunityState, error) {
+	stateMachine, ok := m.communities[communityID]
+	if !ok {
+		return nil, fmt.Errorf("community %s is not on this instance", communityID)
+	}
+
+	transitions := []state.CommunityStateTransition{
+		&state.UpdateProcessTransition{
+			Process: process,
+			Rolling: rolling,
+		},
+	}
+	return stateMachine.ProposeTransitions(transitions)
+}
+
+// Executors runs the executors subscribed to each transition type, for every community on this
+// node. Node services subscribe to it to act on the transitions they care about.
+func (m *Manager) Executors() *state.TransitionExecutors {
+	return m.executors
+}
+
+// SetRaftConfig proposes new settings for the community's Raft cluster, which every node applies
+// without restarting
+func (m *Manager) SetRaftConfig(communityID string, config *community.RaftConfig) (*community.CommunityState, error) {
+	stateMachine, ok := m.communities[communityID]
+	if !ok {
+		return nil, fmt.Errorf("community %s is not on this instance", communityID)
+	}
+
+	transitions := []state.CommunityStateTransition{
+		&state.SetRaftConfigTransition{
+			RaftConfig: config,
+		},
+	}
+	return stateMachine.ProposeTransitions(transitions)
+}
+
+// Stop stops running every community on this node, leaving their data in place so that they
+// are restored the next time a manager is started
+func (m *Manager) Stop() error {
+	m.communitiesLock.Lock()
+	if m.stopReconciling != nil {
+		close(m.stopReconciling)
+		m.stopReconciling = nil
+	}
+	communityIDs := make([]string, 0, len(m.communities))
+	for communityID := range m.communities {
+		communityIDs = append(communityIDs, communityID)
+	}
+	m.communitiesLock.Unlock()
+
+	for _, communityID := range communityIDs {
+		err := m.removeCommunity(communityID)
+		if err != nil {
+			return err
+		}
+
+		err = m.clusterManager.RemoveCluster(communityID)
+		if err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
 
+// ProposeTransitions proposes a batch of transitions to a community. If expectedVersion is not 0,
+// the batch is only applied if the community state is still at that version.
+func (m *Manager) ProposeTransitions(communityID string, transitions []state.CommunityStateTransition, expectedVersion uint64) (*community.CommunityState, error) {
+	stateMachine, ok := m.communities[communityID]
+	if !ok {
+		return nil, fmt.Errorf("community %s is not on this instance", communityID)
+	}
+
+	return stateMachine.ProposeTransitionsAtVersion(transitions, expectedVersion)
+}
+
+// DryRunTransitions checks a batch of transitions as ProposeTransitions would, without committing
+// it. It returns the resulting state, and a JSON patch of the changes the batch would make.
+func (m *Manager) DryRunTransitions(communityID string, transitions []state.CommunityStateTransition, expectedVersion uint64) (*community.CommunityState, []byte, error) {
+	stateMachine, ok := m.communities[communityID]
+	if !ok {
+		return nil, nil, fmt.Errorf("community %s is not on this instance", communityID)
+	}
+
+	return stateMachine.DryRunTransitions(transitions, expectedVersion)
+}
+
+// GetHistory returns a page of the transitions committed to a community, newest first
+func (m *Manager) GetHistory(communityID string, before uint64, limit int, transitionType string) ([]*state.HistoryEntry, uint64, error) {
+	if !m.checkCommunityExists(communityID) {
+		return nil, 0, fmt.Errorf("community %s does not exist in communities directory", communityID)
+	}
+
+	return m.clusterManager.GetHistory(communityID, before, limit, transitionType)
+}
+
+// ClusterStatus returns this node's view of a community's consensus cluster
+func (m *Manager) ClusterStatus(communityID string) (*state.ClusterStatus, error) {
+	if !m.checkCommunityExists(communityID) {
+		return nil, fmt.Errorf("community %s does not exist in communities directory", communityID)
+	}
+
+	return m.clusterManager.ClusterStatus(communityID)
+}
+
+// TransferLeadership hands leadership of a community's cluster to the given node, or to any
+// suitable node if nodeID is empty. It must be called on the current leader.
+func (m *Manager) TransferLeadership(communityID string, nodeID string) error {
+	if !m.checkCommunityExists(communityID) {
+		return fmt.Errorf("community %s does not exist in communities directory", communityID)
+	}
+
+	return m.clusterManager.TransferLeadership(communityID, nodeID)
+}
+
+// ExportSnapshot returns a snapshot of a community's state, which can be imported on another node
+func (m *Manager) ExportSnapshot(communityID string) ([]byte, error) {
+	if !m.checkCommunityExists(communityID) {
+		return nil, fmt.Errorf("community %s does not exist in communities directory", communityID)
+	}
+
+	return m.clusterManager.ExportSnapshot(communityID)
+}
+
+// ImportSnapshot starts running a community on this node from an exported snapshot. The
+// community must not already be on this node. If standalone is set, this node becomes the
+// only node in the community's cluster.
+func (m *Manager) ImportSnapshot(snapshot []byte, standalone bool) (*community.CommunityState, error) {
+	_, commStateBytes, err := state.ReadSnapshot(bytes.NewReader(snapshot))
+	if err != nil {
+		return nil, fmt.Errorf("invalid snapshot: %s", err)
+	}
+
+	var commState community.CommunityState
+	err = json.Unmarshal(commStateBytes, &commState)
+	if err != nil {
+		return nil, fmt.Errorf("invalid snapshot: %s", err)
+	}
+	communityID := commState.CommunityID
+	if communityID == "" {
+		return nil, errors.New("snapshot is of an uninitialized community")
+	}
+
+	commExists, err := m.setupCommunity(communityID)
+	if commExists {
+		return nil, fmt.Errorf("can't import community %s, it is already on this node", communityID)
+	} else if err != nil {
+		return nil, err
+	}
+
+	updateChan, err := m.clusterManager.ImportSnapshot(communityID, snapshot, standalone)
+	if err != nil {
+		return nil, err
+	}
+
+	stateMachine, err := state.NewCommunityStateMachine(&commState, updateChan, &ClusterDispatcher{
+		communityID:    communityID,
+		clusterManager: m.clusterManager,
+	}, m.executors, m.nodeIdentity)
+	if err != nil {
+		return nil, err
+	}
+
+	err = m.addCommunity(communityID, stateMachine)
+	if err != nil {
+		return nil, err
+	}
+
+	// a node rejoining its cluster leaves migrating to the rest of the cluster
+	if standalone {
+		return m.migrateRestoredCommunity(stateMachine, &commState), nil
+	}
+	return &commState, nil
+}
+
+// migrateRestoredCommunity brings a community that this node restarted from a snapshot up to the
+// latest schema version. The migration is committed to the log like any other transition, rather
+// than applied to the snapshot, so that every replica migrates at the same index. The community is
+// left at its version if this node's member isn't allowed to migrate it.
+func (m *Manager) migrateRestoredCommunity(stateMachine *state.CommunityStateMachine, commState *community.CommunityState) *community.CommunityState {
+	if commState.GetSchemaVersion() >= community.LatestSchemaVersion {
+		return commState
+	}
+
+	migrated, err := stateMachine.ProposeTransitions([]state.CommunityStateTransition{
+		&state.MigrateSchemaTransition{
+			ToVersion: community.LatestSchemaVersion,
+		},
+	})
+	if err != nil {
+		log.Error().Err(err).Msgf("error migrating community %s from schema version %d", commState.CommunityID, commState.GetSchemaVersion())
+		return commState
+	}
+	return migrated
+}
+
 func (m *Manager) GetState(communityID string) (*community.CommunityState, error) {
 	if !m.checkCommunityExists(communityID) {
 		return nil, fmt.Errorf("community %s does not exist in communities directory", communityID)
@@ -243,25 +706,25 @@ func (m *Manager) GetState(communityID string) (*community.CommunityState, error
 
 func (m *Manager) addCommunity(communityID string, communityState *state.CommunityStateMachine) error {
 	m.communitiesLock.Lock()
+	defer m.communitiesLock.Unlock()
 	if _, ok := m.communities[communityID]; !ok {
 		m.communities[communityID] = communityState
 		communityState.StartListening()
 	} else {
 		return fmt.Errorf("community %s is already running", communityID)
 	}
-	m.communitiesLock.Unlock()
 	return nil
 }
 
-//nolint
 func (m *Manager) removeCommunity(communityID string) error {
 	m.communitiesLock.Lock()
-	if _, ok := m.communities[communityID]; ok {
+	defer m.communitiesLock.Unlock()
+	if communityState, ok := m.communities[communityID]; ok {
+		communityState.StopListening()
 		delete(m.communities, communityID)
 	} else {
 		return fmt.Errorf("community %s is not running", communityID)
 	}
-	m.communitiesLock.Unlock()
 	return nil
 }
 
@@ -0,0 +1,130 @@
+package community
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/pem"
+	"testing"
+	"time"
+
+	"github.com/eagraf/habitat/cmd/habitat/community/consensus/cluster"
+	"github.com/eagraf/habitat/cmd/habitat/community/state"
+	"github.com/eagraf/habitat/cmd/habitat/node"
+	"github.com/eagraf/habitat/pkg/identity"
+	"github.com/eagraf/habitat/structs/community"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestManager returns a manager running communities on the local cluster backend, along with
+// the member and node it creates communities as
+func newTestManager(t *testing.T, path string) (*Manager, *community.Member, *community.Node) {
+	user, err := identity.GenerateNewUserCert("alice", "alice_id")
+	require.Nil(t, err)
+
+	_, privKey, err := identity.GenerateMemberNodeKeypair()
+	require.Nil(t, err)
+
+	certBytes, err := identity.GenerateMemberNodeCertificate("alice_node", user, &privKey.PublicKey)
+	require.Nil(t, err)
+
+	certPEM := new(bytes.Buffer)
+	err = pem.Encode(certPEM, &pem.Block{
+		Type:  "CERTIFICATE",
+		Bytes: certBytes,
+	})
+	require.Nil(t, err)
+
+	member := &community.Member{
+		ID:          user.UUID,
+		Username:    "alice",
+		Certificate: user.CertBytes,
+	}
+	commNode := &community.Node{
+		ID:          "alice_node",
+		MemberID:    user.UUID,
+		Certificate: certPEM.Bytes(),
+	}
+
+	m, err := NewManagerWithClusterManager(path, &node.Node{ID: "alice_node"}, cluster.NewLocalClusterManager(path), &identity.MemberNodeIdentity{
+		NodeID:  "alice_node",
+		PrivKey: privKey,
+	})
+	require.Nil(t, err)
+
+	return m, member, commNode
+}
+
+func TestManagerLocalBackend(t *testing.T) {
+	path := t.TempDir()
+	m, member, commNode := newTestManager(t, path)
+
+	created, err := m.CreateCommunity("test", false, cluster.BackendLocal, member, commNode)
+	require.Nil(t, err)
+	communityID := created.CommunityID
+	assert.NotEqual(t, "", communityID)
+	assert.Equal(t, community.LatestSchemaVersion, created.SchemaVersion)
+	assert.Equal(t, community.RoleAdmin, created.GetMember(member.ID).Role)
+	assert.NotNil(t, created.GetNode(commNode.ID))
+
+	// the state machine receives the update in the background
+	require.Eventually(t, func() bool {
+		current, err := m.GetState(communityID)
+		return err == nil && current.Version == created.Version
+	}, time.Second, 10*time.Millisecond)
+
+	entries, _, err := m.GetHistory(communityID, 0, 0, "")
+	require.Nil(t, err)
+	assert.Equal(t, 4, len(entries))
+	assert.Equal(t, state.TransitionTypeAddNode, entries[0].Type)
+
+	status, err := m.ClusterStatus(communityID)
+	require.Nil(t, err)
+	assert.Equal(t, created.Version, status.CommitIndex)
+
+	// the local backend only supports a single node
+	assert.NotNil(t, m.clusterManager.AddNode(communityID, "bob_node", "/ip4/127.0.0.1/tcp/6000"))
+
+	// a new manager restarts the community from its persisted state
+	restarted, _, _ := newTestManager(t, path)
+	restored, err := restarted.GetState(communityID)
+	require.Nil(t, err)
+	assert.Equal(t, created, restored)
+
+	entries, _, err = restarted.GetHistory(communityID, 0, 0, "")
+	require.Nil(t, err)
+	require.Equal(t, 1, len(entries))
+	assert.Equal(t, state.HistoryTypeSnapshot, entries[0].Type)
+	assert.Equal(t, created.Version, entries[0].Index)
+}
+
+func TestManagerImportMigrates(t *testing.T) {
+	m, member, commNode := newTestManager(t, t.TempDir())
+
+	// a community exported before it was migrated
+	commState := &community.CommunityState{
+		CommunityID:      "abc",
+		Version:          3,
+		Members:          []*community.Member{member},
+		Nodes:            []*community.Node{commNode},
+		Processes:        []*community.Process{},
+		ProcessInstances: []*community.ProcessInstance{},
+	}
+	commStateBytes, err := json.Marshal(commState)
+	require.Nil(t, err)
+	header, err := state.NewSnapshotHeader(commStateBytes)
+	require.Nil(t, err)
+	var snapshot bytes.Buffer
+	err = state.WriteSnapshot(&snapshot, header, commStateBytes)
+	require.Nil(t, err)
+
+	imported, err := m.ImportSnapshot(snapshot.Bytes(), true)
+	require.Nil(t, err)
+	assert.Equal(t, community.LatestSchemaVersion, imported.SchemaVersion)
+	assert.Equal(t, community.RoleAdmin, imported.GetMember(member.ID).Role)
+
+	require.Eventually(t, func() bool {
+		current, err := m.GetState("abc")
+		return err == nil && current.Version == imported.Version
+	}, time.Second, 10*time.Millisecond)
+}
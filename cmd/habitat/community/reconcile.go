@@ -0,0 +1,231 @@
+package community
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/eagraf/habitat/cmd/habitat/procs"
+	"github.com/eagraf/habitat/structs/community"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// reconcileInterval is how often the process instances running on this node are checked
+	// against the instances assigned to it
+	reconcileInterval = 30 * time.Second
+
+	// An instance the reconciler restarts isn't restarted again for minRestartBackoff, and the
+	// wait doubles with each further restart up to maxRestartBackoff. This keeps an instance that
+	// keeps crashing from being restarted, and its restart reported, on every pass. Instances
+	// that stay up for maxRestartBackoff are restarted right away again the next time.
+	minRestartBackoff = reconcileInterval
+	maxRestartBackoff = 10 * time.Minute
+)
+
+// restartBackoff holds when the reconciler last restarted an instance, and how long it waits
+// after that before restarting it again
+type restartBackoff struct {
+	last  time.Time
+	delay time.Duration
+}
+
+// StartReconciling reconciles this node's process instances right away, and then again every
+// interval until the manager is stopped. This heals instances that weren't started because the
+// node was down when they were assigned to it, or that have since crashed.
+func (m *Manager) StartReconciling(interval time.Duration) {
+	m.communitiesLock.Lock()
+	if m.stopReconciling != nil {
+		m.communitiesLock.Unlock()
+		return
+	}
+	stop := make(chan struct{})
+	m.stopReconciling = stop
+	m.communitiesLock.Unlock()
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			m.Reconcile()
+
+			select {
+			case <-ticker.C:
+			case <-stop:
+				return
+			}
+		}
+	}()
+}
+
+// Reconcile starts the process instances that communities have assigned to this node but that
+// aren't running, and stops the ones running that are no longer assigned to it. Instances that
+// are running with outdated settings are left to the executor, which updates them in turn.
+func (m *Manager) Reconcile() {
+	m.communitiesLock.Lock()
+	communityIDs := make([]string, 0, len(m.communities))
+	for communityID := range m.communities {
+		communityIDs = append(communityIDs, communityID)
+	}
+	m.communitiesLock.Unlock()
+
+	for _, communityID := range communityIDs {
+		err := m.reconcileCommunity(communityID)
+		if err != nil {
+			log.Error().Err(err).Msgf("error reconciling process instances of community %s", communityID)
+		}
+	}
+}
+
+func (m *Manager) reconcileCommunity(communityID string) error {
+	curState, err := m.GetState(communityID)
+	if err != nil {
+		return err
+	}
+
+	processIDs, err := m.node.ProcessManager.CommunityProcessIDs(communityID)
+	if err != nil {
+		return err
+	}
+	running := make(map[string]bool)
+	for _, processID := range processIDs {
+		running[processID] = true
+	}
+
+	var errs []error
+	now := time.Now()
+	assigned := make(map[string]bool)
+	for _, i := range curState.ProcessInstances {
+		if i.NodeID != m.node.ID {
+			continue
+		}
+		assigned[i.ProcessID] = true
+
+		process := curState.GetProcess(i.ProcessID)
+		if process == nil {
+			continue
+		}
+
+		processInstanceID, err := procs.GetProcessInstanceID(communityID, m.node.ID, process.ID)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("error getting instance ID of process %s: %s", process.ID, err))
+			continue
+		}
+		if running[i.ProcessID] {
+			m.resetRestartBackoff(processInstanceID, now)
+			continue
+		}
+		if !m.restartDue(processInstanceID, now) {
+			continue
+		}
+		m.recordRestart(processInstanceID, now)
+
+		log.Info().Msgf("starting missing instance of process %s in community %s", process.ID, communityID)
+		_, err = m.node.ProcessManager.StartProcessInstance(communityID, process.ID, process.AppName, process.Args, process.Env, process.Flags, process.Config)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("error starting instance of process %s: %s", process.ID, err))
+			m.reportReconciledInstance(communityID, process.ID, community.InstanceStatusFailed, err)
+			continue
+		}
+		m.reportReconciledInstance(communityID, process.ID, community.InstanceStatusRunning, nil)
+	}
+
+	for _, processID := range processIDs {
+		if assigned[processID] {
+			continue
+		}
+
+		log.Info().Msgf("stopping instance of process %s, which community %s no longer assigns to this node", processID, communityID)
+		processInstanceID, err := procs.GetProcessInstanceID(communityID, m.node.ID, processID)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("error getting instance ID of process %s: %s", processID, err))
+			continue
+		}
+		m.forgetRestarts(processInstanceID)
+		err = m.node.ProcessManager.StopProcessInstance(processInstanceID)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("error stopping instance of process %s: %s", processID, err))
+		}
+	}
+
+	if len(errs) != 0 {
+		return fmt.Errorf("%d process instances could not be reconciled, first error: %s", len(errs), errs[0])
+	}
+	return nil
+}
+
+// reportReconciledInstance reports the status of an instance the reconciler started, counting it
+// as a restart
+func (m *Manager) reportReconciledInstance(communityID, processID, status string, instanceErr error) {
+	err := m.ReportInstanceStatus(communityID, processID, status, instanceErr, true)
+	if err != nil {
+		log.Error().Err(err).Msgf("error reporting status of process %s", processID)
+	}
+}
+
+// restartDue returns true if the reconciler may restart an instance that isn't running
+func (m *Manager) restartDue(processInstanceID string, now time.Time) bool {
+	m.restartsLock.Lock()
+	defer m.restartsLock.Unlock()
+
+	backoff, ok := m.restarts[processInstanceID]
+	return !ok || !now.Before(backoff.last.Add(backoff.delay))
+}
+
+// recordRestart backs off the next restart of an instance the reconciler is restarting
+func (m *Manager) recordRestart(processInstanceID string, now time.Time) {
+	m.restartsLock.Lock()
+	defer m.restartsLock.Unlock()
+
+	backoff, ok := m.restarts[processInstanceID]
+	if !ok {
+		m.restarts[processInstanceID] = &restartBackoff{
+			last:  now,
+			delay: minRestartBackoff,
+		}
+		return
+	}
+
+	backoff.last = now
+	backoff.delay *= 2
+	if backoff.delay > maxRestartBackoff {
+		backoff.delay = maxRestartBackoff
+	}
+}
+
+// resetRestartBackoff forgets the restarts of a running instance once it has stayed up for
+// maxRestartBackoff since the reconciler last restarted it
+func (m *Manager) resetRestartBackoff(processInstanceID string, now time.Time) {
+	m.restartsLock.Lock()
+	defer m.restartsLock.Unlock()
+
+	backoff, ok := m.restarts[processInstanceID]
+	if ok && now.Sub(backoff.last) >= maxRestartBackoff {
+		delete(m.restarts, processInstanceID)
+	}
+}
+
+// forgetRestarts forgets the restarts of an instance that is no longer assigned to this node
+func (m *Manager) forgetRestarts(processInstanceID string) {
+	m.restartsLock.Lock()
+	defer m.restartsLock.Unlock()
+
+	delete(m.restarts, processInstanceID)
+}
+
+// forgetCommunityRestarts forgets the restarts of every instance a community assigns to this
+// node, once this node has left it
+func (m *Manager) forgetCommunityRestarts(communityID string, curState *community.CommunityState) {
+	for _, i := range curState.ProcessInstances {
+		if i.NodeID != m.node.ID {
+			continue
+		}
+
+		processInstanceID, err := procs.GetProcessInstanceID(communityID, m.node.ID, i.ProcessID)
+		if err != nil {
+			log.Error().Err(err).Msgf("error getting instance ID of process %s", i.ProcessID)
+			continue
+		}
+		m.forgetRestarts(processInstanceID)
+	}
+}
@@ -0,0 +1,113 @@
+package community
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/eagraf/habitat/cmd/habitat/procs"
+	"github.com/eagraf/habitat/cmd/habitat/proxy"
+	"github.com/eagraf/habitat/structs/community"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestApp installs an app that runs until it is stopped, and returns its name
+func newTestApp(t *testing.T) string {
+	appsPath := t.TempDir()
+	appPath := filepath.Join(appsPath, "sleeper")
+	require.Nil(t, os.MkdirAll(filepath.Join(appPath, "bin"), 0700))
+	require.Nil(t, os.WriteFile(filepath.Join(appPath, "habitat.yaml"), []byte("name: sleeper\nbin: sleeper\n"), 0600))
+	require.Nil(t, os.WriteFile(filepath.Join(appPath, "bin", "sleeper"), []byte("#!/bin/sh\nexec sleep 60\n"), 0700))
+	t.Setenv("HABITAT_APP_PATH", appsPath)
+
+	return "sleeper"
+}
+
+func TestReconcile(t *testing.T) {
+	habitatPath := t.TempDir()
+	t.Setenv("HABITAT_PATH", habitatPath)
+	require.Nil(t, os.WriteFile(filepath.Join(habitatPath, "node_id"), []byte("alice_node"), 0600))
+	app := newTestApp(t)
+
+	m, member, commNode := newTestManager(t, t.TempDir())
+	pm := procs.NewManager(filepath.Join(habitatPath, "procs"), proxy.NewRuleSet())
+	m.node.ProcessManager = pm
+	t.Cleanup(pm.StopAllProcesses)
+
+	created, err := m.CreateCommunity("test", false, "", member, commNode)
+	require.Nil(t, err)
+	communityID := created.CommunityID
+
+	_, err = m.StartProcess(communityID, &community.Process{
+		ID:      "proc1",
+		AppName: app,
+		Args:    []string{},
+		Env:     []string{},
+		Flags:   []string{},
+	}, []string{commNode.ID})
+	require.Nil(t, err)
+
+	instanceID, err := procs.GetProcessInstanceID(communityID, commNode.ID, "proc1")
+	require.Nil(t, err)
+	require.Eventually(t, func() bool {
+		return pm.IsRunning(instanceID)
+	}, 5*time.Second, 10*time.Millisecond)
+	instanceStatus := func() *community.ProcessInstance {
+		curState, err := m.GetState(communityID)
+		require.Nil(t, err)
+		return curState.GetProcessInstance("proc1", commNode.ID)
+	}
+	require.Eventually(t, func() bool {
+		return instanceStatus().Status == community.InstanceStatusRunning
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// an instance that isn't running, such as after a restart, is started again
+	require.Nil(t, pm.StopProcessInstance(instanceID))
+	m.Reconcile()
+	assert.True(t, pm.IsRunning(instanceID))
+	require.Eventually(t, func() bool {
+		return instanceStatus().RestartCount == 1
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, community.InstanceStatusRunning, instanceStatus().Status)
+
+	// an instance that stops again straight away isn't restarted until its backoff has passed
+	require.Nil(t, pm.StopProcessInstance(instanceID))
+	m.Reconcile()
+	assert.False(t, pm.IsRunning(instanceID))
+	assert.Equal(t, 1, instanceStatus().RestartCount)
+
+	m.restarts[instanceID].last = time.Now().Add(-minRestartBackoff)
+	m.Reconcile()
+	assert.True(t, pm.IsRunning(instanceID))
+	require.Eventually(t, func() bool {
+		return instanceStatus().RestartCount == 2
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, 2*minRestartBackoff, m.restarts[instanceID].delay)
+
+	// the backoff is forgotten once the instance has stayed up
+	m.restarts[instanceID].last = time.Now().Add(-maxRestartBackoff)
+	m.Reconcile()
+	assert.NotContains(t, m.restarts, instanceID)
+
+	// and an instance that isn't assigned to this node is stopped
+	strayID, err := pm.StartProcessInstance(communityID, "stray", app, []string{}, []string{}, []string{}, nil)
+	require.Nil(t, err)
+	m.Reconcile()
+	assert.False(t, pm.IsRunning(strayID))
+	assert.True(t, pm.IsRunning(instanceID))
+
+	processIDs, err := pm.CommunityProcessIDs(communityID)
+	require.Nil(t, err)
+	assert.Equal(t, []string{"proc1"}, processIDs)
+
+	// the backoff of a community's instances is forgotten once this node leaves it
+	require.Nil(t, pm.StopProcessInstance(instanceID))
+	m.Reconcile()
+	require.Contains(t, m.restarts, instanceID)
+	curState, err := m.GetState(communityID)
+	require.Nil(t, err)
+	m.forgetCommunityRestarts(communityID, curState)
+	assert.NotContains(t, m.restarts, instanceID)
+}
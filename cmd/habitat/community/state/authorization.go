@@ -0,0 +1,73 @@
+package state
+
+import (
+	"fmt"
+
+	"github.com/eagraf/habitat/structs/community"
+)
+
+// authorizeTransition checks that the member owning the proposing node holds the role required
+// to make the transition.
+func authorizeTransition(t CommunityStateTransition, state *community.CommunityState, proposerNodeID string) error {
+	node := state.GetNode(proposerNodeID)
+	if node == nil {
+		return fmt.Errorf("proposing node %s is not in the community", proposerNodeID)
+	}
+
+	member := state.GetMember(node.MemberID)
+	if member == nil {
+		return fmt.Errorf("member %s owning node %s is not in the community", node.MemberID, node.ID)
+	}
+
+	requiredRole := t.RequiredRole()
+	if _, ok := t.(*MigrateSchemaTransition); ok && !hasAdmin(state) {
+		// communities from before roles existed have no admins, and are migrated by any member
+		requiredRole = community.RoleMember
+	}
+	if scoped, ok := t.(memberScopedTransition); ok {
+		if scoped.OwnerMemberID(state) != member.ID {
+			requiredRole = community.RoleAdmin
+		}
+	}
+
+	if !member.HasRole(requiredRole) {
+		return fmt.Errorf("member %s has role %s, but role %s is required", member.ID, member.GetRole(), requiredRole)
+	}
+	return nil
+}
+
+func hasAdmin(state *community.CommunityState) bool {
+	for _, m := range state.Members {
+		if m.HasRole(community.RoleAdmin) {
+			return true
+		}
+	}
+	return false
+}
+
+// authorizationState returns the state that a batch of transitions should be authorized against.
+// This is normally the state before the batch, but a brand new community has no members yet. Its
+// first batch adds the creating member as an admin, so that batch is checked against the state it
+// produces. That state is built by validating and applying the transitions, rather than trusting
+// the patches that came with them.
+func authorizationState(jsonState *JSONState, transitions []CommunityStateTransition) (*community.CommunityState, error) {
+	var authState community.CommunityState
+	err := jsonState.Unmarshal(&authState)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(authState.Members) != 0 {
+		return &authState, nil
+	}
+
+	branch, _, err := applyBatch(jsonState, transitions, authState.Version)
+	if err != nil {
+		return nil, err
+	}
+	err = branch.Unmarshal(&authState)
+	if err != nil {
+		return nil, err
+	}
+	return &authState, nil
+}
@@ -0,0 +1,102 @@
+package state
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/eagraf/habitat/structs/community"
+	"github.com/hashicorp/raft"
+)
+
+// ClusterStatus describes this node's view of a community's consensus cluster. The fields are named
+// after Raft's, and backends that don't run Raft fill them in as a single node cluster would.
+type ClusterStatus struct {
+	CommunityID   string
+	State         string // Leader, Follower, Candidate or Shutdown
+	Term          uint64
+	LeaderID      string
+	LeaderAddress string
+	CommitIndex   uint64
+	AppliedIndex  uint64
+	LastLogIndex  uint64
+	Servers       []*ServerStatus
+	Stats         map[string]string // backend specific, such as everything reported by raft.Stats()
+}
+
+// ServerStatus describes one server in a cluster's configuration
+type ServerStatus struct {
+	ID       string
+	Address  string
+	Suffrage string
+	Leader   bool
+
+	// LastContact is when the server last responded to this node. It is only tracked by the
+	// leader, except for the leader itself, which followers track instead.
+	LastContact time.Time
+}
+
+// NewRaftConfig returns Raft's default configuration, with a community's settings applied on top.
+// settings may be nil, in which case the defaults are returned unchanged.
+func NewRaftConfig(settings *community.RaftConfig) *raft.Config {
+	config := raft.DefaultConfig()
+	if settings == nil {
+		return config
+	}
+
+	if settings.HeartbeatTimeoutMs != 0 {
+		config.HeartbeatTimeout = time.Duration(settings.HeartbeatTimeoutMs) * time.Millisecond
+	}
+	if settings.ElectionTimeoutMs != 0 {
+		config.ElectionTimeout = time.Duration(settings.ElectionTimeoutMs) * time.Millisecond
+	}
+	if settings.CommitTimeoutMs != 0 {
+		config.CommitTimeout = time.Duration(settings.CommitTimeoutMs) * time.Millisecond
+	}
+	if settings.SnapshotIntervalMs != 0 {
+		config.SnapshotInterval = time.Duration(settings.SnapshotIntervalMs) * time.Millisecond
+	}
+	if settings.SnapshotThreshold != 0 {
+		config.SnapshotThreshold = settings.SnapshotThreshold
+	}
+	if settings.TrailingLogs != 0 {
+		config.TrailingLogs = settings.TrailingLogs
+	}
+
+	return config
+}
+
+// NewReloadableRaftConfig returns the part of a community's Raft configuration that can be changed
+// while its Raft instance is running. The commit timeout is only picked up when the instance is
+// next started.
+func NewReloadableRaftConfig(settings *community.RaftConfig) raft.ReloadableConfig {
+	config := NewRaftConfig(settings)
+	return raft.ReloadableConfig{
+		TrailingLogs:      config.TrailingLogs,
+		SnapshotInterval:  config.SnapshotInterval,
+		SnapshotThreshold: config.SnapshotThreshold,
+		HeartbeatTimeout:  config.HeartbeatTimeout,
+		ElectionTimeout:   config.ElectionTimeout,
+	}
+}
+
+// ValidateRaftConfig checks that Raft would accept a community's settings. The leader lease
+// timeout is not configurable, so the heartbeat timeout can't be set below it.
+func ValidateRaftConfig(settings *community.RaftConfig) error {
+	if settings == nil {
+		return errors.New("no raft config supplied")
+	}
+	if settings.HeartbeatTimeoutMs < 0 || settings.ElectionTimeoutMs < 0 || settings.CommitTimeoutMs < 0 || settings.SnapshotIntervalMs < 0 {
+		return errors.New("raft timeouts and intervals can not be negative")
+	}
+
+	config := NewRaftConfig(settings)
+	// ValidateConfig requires an ID, which every node sets for itself
+	config.LocalID = "validation"
+
+	err := raft.ValidateConfig(config)
+	if err != nil {
+		return fmt.Errorf("invalid raft config: %s", err)
+	}
+	return nil
+}
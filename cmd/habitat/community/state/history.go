@@ -0,0 +1,62 @@
+package state
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/hashicorp/raft"
+)
+
+// HistoryTypeSnapshot marks the point in a community's history where older log entries were
+// compacted into a snapshot, and are no longer available individually.
+const HistoryTypeSnapshot = "snapshot"
+
+// DefaultHistoryLimit is how many transitions a page of history holds if no limit is given
+const DefaultHistoryLimit = 50
+
+// HistoryEntry describes a single committed transition
+type HistoryEntry struct {
+	Index      uint64          `json:"index"`
+	Term       uint64          `json:"term"`
+	AppendedAt time.Time       `json:"appended_at"`
+	Type       string          `json:"type"`
+	Transition json.RawMessage `json:"transition,omitempty"`
+	Proposer   string          `json:"proposer,omitempty"` // ID of the node that proposed the transition
+}
+
+// RejectedEntryKey is the stable store key under which the FSM records that it rejected the log
+// entry at index. Rejected entries are left out of history, since their transitions never applied
+// and their proposers were never verified.
+func RejectedEntryKey(index uint64) []byte {
+	return []byte(fmt.Sprintf("rejected_entry_%d", index))
+}
+
+// HistoryEntriesFromLog decodes the transitions committed in a Raft log entry. It must only be
+// called for entries the state machine applied, since the proposers of rejected entries are not
+// verified.
+func HistoryEntriesFromLog(entry *raft.Log) ([]*HistoryEntry, error) {
+	buf, err := base64.StdEncoding.DecodeString(string(entry.Data))
+	if err != nil {
+		return nil, fmt.Errorf("error decoding log entry %d: %s", entry.Index, err)
+	}
+
+	batch, err := DecodeTransitionBatch(buf)
+	if err != nil {
+		return nil, fmt.Errorf("error decoding transitions in log entry %d: %s", entry.Index, err)
+	}
+
+	entries := make([]*HistoryEntry, len(batch.Transitions))
+	for i, w := range batch.Transitions {
+		entries[i] = &HistoryEntry{
+			Index:      entry.Index,
+			Term:       entry.Term,
+			AppendedAt: entry.AppendedAt,
+			Type:       w.Type,
+			Transition: json.RawMessage(w.Transition),
+			Proposer:   w.NodeID,
+		}
+	}
+	return entries, nil
+}
@@ -0,0 +1,83 @@
+package state
+
+import (
+	"testing"
+
+	"github.com/eagraf/habitat/structs/community"
+	"github.com/hashicorp/raft"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHistoryEntriesFromLog(t *testing.T) {
+	alice := newTestMemberNode(t, "alice", "alice_node")
+	alice.member.Role = community.RoleAdmin
+
+	fsm := newTestFSM(t)
+	entry := testRaftLog(t, fsm, alice.nodeIdentity, []CommunityStateTransition{
+		&InitializeCommunityTransition{
+			CommunityID: "abc",
+		},
+		&AddMemberTransition{
+			Member: alice.member,
+		},
+	})
+	entry.Term = 2
+
+	entries, err := HistoryEntriesFromLog(entry)
+	require.Nil(t, err)
+	require.Equal(t, 2, len(entries))
+	assert.Equal(t, TransitionTypeInitializeCommunity, entries[0].Type)
+	assert.Equal(t, TransitionTypeAddMember, entries[1].Type)
+	assert.Equal(t, uint64(1), entries[1].Index)
+	assert.Equal(t, uint64(2), entries[1].Term)
+	assert.Equal(t, "alice_node", entries[1].Proposer)
+	assert.JSONEq(t, `{"CommunityID": "abc"}`, string(entries[0].Transition))
+
+	_, err = HistoryEntriesFromLog(&raft.Log{
+		Data: []byte("not base64!"),
+	})
+	assert.NotNil(t, err)
+}
+
+func TestFSMRecordsRejectedEntries(t *testing.T) {
+	alice := newTestMemberNode(t, "alice", "alice_node")
+	mallory := newTestMemberNode(t, "mallory", "mallory_node")
+	alice.member.Role = community.RoleAdmin
+
+	store := raft.NewInmemStore()
+	fsm := newTestFSM(t)
+	fsm.SetRejectionStore(store)
+
+	res := fsm.Apply(testRaftLog(t, fsm, alice.nodeIdentity, []CommunityStateTransition{
+		&InitializeCommunityTransition{
+			CommunityID: "abc",
+		},
+		&AddMemberTransition{
+			Member: alice.member,
+		},
+		&AddNodeTransition{
+			Node: alice.node,
+		},
+	}))
+	_, ok := res.(*community.CommunityState)
+	require.True(t, ok, "expected state, got %v", res)
+
+	recorded, err := store.GetUint64(RejectedEntryKey(1))
+	require.Nil(t, err)
+	assert.Equal(t, uint64(0), recorded)
+
+	// mallory isn't in the community, so her entry is rejected
+	rejected := testRaftLog(t, fsm, mallory.nodeIdentity, []CommunityStateTransition{
+		&AddMemberTransition{
+			Member: mallory.member,
+		},
+	})
+	res = fsm.Apply(rejected)
+	_, ok = res.(error)
+	require.True(t, ok, "expected error, got %v", res)
+
+	recorded, err = store.GetUint64(RejectedEntryKey(rejected.Index))
+	require.Nil(t, err)
+	assert.Equal(t, rejected.Index, recorded)
+}
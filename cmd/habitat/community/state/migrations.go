@@ -0,0 +1,213 @@
+package state
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/eagraf/habitat/structs/community"
+	jsonpatch "github.com/evanphx/json-patch"
+	"github.com/qri-io/jsonschema"
+)
+
+// SchemaMigration returns the JSON patch that upgrades a JSON encoded community state from one
+// schema version to the next. Migrations are replayed by every node when a migrate_schema
+// transition is applied, possibly by different builds of this package, so they must be
+// deterministic, and must only touch the fields they change.
+type SchemaMigration func(oldState []byte) ([]byte, error)
+
+// schemaMigrations maps each schema version to the migration that upgrades a state from it
+var schemaMigrations = map[int]SchemaMigration{
+	1: migrateV1ToV2,
+	2: migrateV2ToV3,
+	3: migrateV3ToV4,
+	4: migrateV4ToV5,
+	5: migrateV5ToV6,
+}
+
+// NewCommunityJSONState returns a JSONState for a community state, validated against the schema
+// for the state's own schema version.
+func NewCommunityJSONState(initState []byte) (*JSONState, error) {
+	schemaVersion, err := community.GetSchemaVersion(initState)
+	if err != nil {
+		return nil, fmt.Errorf("error reading schema version: %s", err)
+	}
+
+	schema, ok := community.CommunityStateSchemas[schemaVersion]
+	if !ok {
+		return nil, unsupportedSchemaVersion(schemaVersion)
+	}
+
+	jsonState, err := NewJSONState(schema, initState)
+	if err != nil {
+		return nil, err
+	}
+
+	jsonState.versioned = true
+	jsonState.schemaVersion = schemaVersion
+	return jsonState, nil
+}
+
+func communitySchema(schemaVersion int) (*jsonschema.Schema, error) {
+	schemaBytes, ok := community.CommunityStateSchemas[schemaVersion]
+	if !ok {
+		return nil, unsupportedSchemaVersion(schemaVersion)
+	}
+
+	schema := &jsonschema.Schema{}
+	err := json.Unmarshal(schemaBytes, schema)
+	if err != nil {
+		return nil, fmt.Errorf("invalid JSON schema for version %d: %s", schemaVersion, err)
+	}
+	return schema, nil
+}
+
+func unsupportedSchemaVersion(schemaVersion int) error {
+	if schemaVersion > community.LatestSchemaVersion {
+		return fmt.Errorf("community state schema version %d is newer than the latest supported version %d, this node must be upgraded", schemaVersion, community.LatestSchemaVersion)
+	}
+	return fmt.Errorf("unknown community state schema version %d", schemaVersion)
+}
+
+// MigrateState runs every migration needed to bring a JSON encoded community state up to toVersion
+func MigrateState(state []byte, toVersion int) ([]byte, error) {
+	migrated, _, err := migrate(state, toVersion)
+	return migrated, err
+}
+
+// MigrationPatch returns a single JSON patch bringing a JSON encoded community state up to toVersion
+func MigrationPatch(state []byte, toVersion int) ([]byte, error) {
+	_, ops, err := migrate(state, toVersion)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(ops)
+}
+
+// migrate applies every migration needed to bring a state up to toVersion, and returns the
+// migrated state along with the operations of every migration's patch
+func migrate(state []byte, toVersion int) ([]byte, []json.RawMessage, error) {
+	fromVersion, err := community.GetSchemaVersion(state)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if toVersion > community.LatestSchemaVersion {
+		return nil, nil, unsupportedSchemaVersion(toVersion)
+	}
+	if toVersion < fromVersion {
+		return nil, nil, fmt.Errorf("can't migrate state from schema version %d back to version %d", fromVersion, toVersion)
+	}
+
+	ops := make([]json.RawMessage, 0)
+	for v := fromVersion; v < toVersion; v++ {
+		migration, ok := schemaMigrations[v]
+		if !ok {
+			return nil, nil, fmt.Errorf("no migration from schema version %d", v)
+		}
+
+		patchJSON, err := migration(state)
+		if err != nil {
+			return nil, nil, fmt.Errorf("error migrating from schema version %d: %s", v, err)
+		}
+
+		patch, err := jsonpatch.DecodePatch(patchJSON)
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid patch migrating from schema version %d: %s", v, err)
+		}
+		state, err = patch.Apply(state)
+		if err != nil {
+			return nil, nil, fmt.Errorf("error migrating from schema version %d: %s", v, err)
+		}
+
+		var patchOps []json.RawMessage
+		err = json.Unmarshal(patchJSON, &patchOps)
+		if err != nil {
+			return nil, nil, err
+		}
+		ops = append(ops, patchOps...)
+	}
+
+	return state, ops, nil
+}
+
+// setSchemaVersionOp is the patch operation every migration ends with
+func setSchemaVersionOp(schemaVersion int) string {
+	return fmt.Sprintf(`{
+		"op": "add",
+		"path": "/%s",
+		"value": %d
+	}`, community.SchemaVersionKey, schemaVersion)
+}
+
+// migrateV1ToV2 sets schema_version, and gives every member a role. Members without one become
+// regular members, and if that leaves the community without an admin, the first member is made one.
+func migrateV1ToV2(oldState []byte) ([]byte, error) {
+	// only the members' roles are read, everything else is left as it is
+	var state struct {
+		Members []struct {
+			Role string `json:"role"`
+		} `json:"members"`
+	}
+	err := json.Unmarshal(oldState, &state)
+	if err != nil {
+		return nil, err
+	}
+
+	roles := make([]string, len(state.Members))
+	hasAdmin := false
+	for i, m := range state.Members {
+		roles[i] = m.Role
+		if roles[i] == "" {
+			roles[i] = community.RoleMember
+		}
+		if roles[i] == community.RoleAdmin {
+			hasAdmin = true
+		}
+	}
+	if !hasAdmin && len(roles) > 0 {
+		roles[0] = community.RoleAdmin
+	}
+
+	ops := make([]string, 0, len(roles)+1)
+	for i, role := range roles {
+		if role == state.Members[i].Role {
+			continue
+		}
+		marshaledRole, err := json.Marshal(role)
+		if err != nil {
+			return nil, err
+		}
+		ops = append(ops, fmt.Sprintf(`{
+			"op": "add",
+			"path": "/members/%d/role",
+			"value": %s
+		}`, i, string(marshaledRole)))
+	}
+	ops = append(ops, setSchemaVersionOp(2))
+
+	return []byte(fmt.Sprintf("[%s]", strings.Join(ops, ","))), nil
+}
+
+// migrateV2ToV3 only sets schema_version, since raft_config is optional
+func migrateV2ToV3(oldState []byte) ([]byte, error) {
+	return []byte(fmt.Sprintf("[%s]", setSchemaVersionOp(3))), nil
+}
+
+// migrateV3ToV4 only sets schema_version. Processes and instances without a revision are at
+// revision 0.
+func migrateV3ToV4(oldState []byte) ([]byte, error) {
+	return []byte(fmt.Sprintf("[%s]", setSchemaVersionOp(4))), nil
+}
+
+// migrateV4ToV5 only sets schema_version, since nodes without labels and processes without a
+// placement are still valid
+func migrateV4ToV5(oldState []byte) ([]byte, error) {
+	return []byte(fmt.Sprintf("[%s]", setSchemaVersionOp(5))), nil
+}
+
+// migrateV5ToV6 only sets schema_version. Instances without a status are pending until their
+// node next reports on them.
+func migrateV5ToV6(oldState []byte) ([]byte, error) {
+	return []byte(fmt.Sprintf("[%s]", setSchemaVersionOp(6))), nil
+}
@@ -0,0 +1,100 @@
+package state
+
+import (
+	"testing"
+
+	"github.com/eagraf/habitat/structs/community"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMigrateState(t *testing.T) {
+	v1 := []byte(`{
+		"community_id": "abc",
+		"version": 3,
+		"members": [
+			{"id": "jorts", "username": "jorts", "certificate": "bXljZXJ0"},
+			{"id": "jean", "username": "jean", "certificate": "bXljZXJ0", "role": "guest"}
+		],
+		"nodes": [],
+		"processes": [],
+		"process_instances": []
+	}`)
+
+	// the unmigrated state is still valid
+	_, err := NewCommunityJSONState(v1)
+	require.Nil(t, err)
+
+	migrated, err := MigrateState(v1, 2)
+	require.Nil(t, err)
+
+	jsonState, err := NewCommunityJSONState(migrated)
+	require.Nil(t, err)
+
+	var state community.CommunityState
+	err = jsonState.Unmarshal(&state)
+	require.Nil(t, err)
+	assert.Equal(t, 2, state.SchemaVersion)
+	assert.Equal(t, uint64(3), state.Version)
+	assert.Equal(t, community.RoleAdmin, state.GetMember("jorts").Role)
+	assert.Equal(t, community.RoleGuest, state.GetMember("jean").Role)
+
+	// a version 2 state must give every member a role
+	err = jsonState.ApplyPatch([]byte(`[{
+		"op": "remove",
+		"path": "/members/1/role"
+	}]`))
+	assert.NotNil(t, err)
+
+	// migrations only go forwards, and only up to the latest version
+	_, err = MigrateState(migrated, 1)
+	assert.NotNil(t, err)
+	_, err = MigrateState(v1, community.LatestSchemaVersion+1)
+	assert.NotNil(t, err)
+
+	_, err = NewCommunityJSONState([]byte(`{
+		"community_id": "abc",
+		"schema_version": 100,
+		"members": [],
+		"nodes": [],
+		"processes": [],
+		"process_instances": []
+	}`))
+	assert.NotNil(t, err)
+}
+
+func TestMigrationsKeepUnknownFields(t *testing.T) {
+	// fields added by newer builds of a node must survive migrations made by older ones
+	v1 := []byte(`{
+		"community_id": "abc",
+		"members": [
+			{"id": "jorts", "username": "jorts", "certificate": "bXljZXJ0", "nickname": "jorts"}
+		],
+		"nodes": [],
+		"processes": [],
+		"process_instances": [],
+		"future_field": {"a": 1}
+	}`)
+
+	migrated, err := MigrateState(v1, 2)
+	require.Nil(t, err)
+	assert.JSONEq(t, `{
+		"community_id": "abc",
+		"schema_version": 2,
+		"members": [
+			{"id": "jorts", "username": "jorts", "certificate": "bXljZXJ0", "nickname": "jorts", "role": "admin"}
+		],
+		"nodes": [],
+		"processes": [],
+		"process_instances": [],
+		"future_field": {"a": 1}
+	}`, string(migrated))
+
+	// the patch only touches the fields the migration changes
+	patch, err := MigrationPatch(v1, 2)
+	require.Nil(t, err)
+	assert.JSONEq(t, `[
+		{"op": "add", "path": "/members/0/role", "value": "admin"},
+		{"op": "add", "path": "/schema_version", "value": 2}
+	]`, string(patch))
+}
@@ -2,23 +2,44 @@ package state
 
 import (
 	"encoding/base64"
-	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
-	"io/ioutil"
+	"sync"
 
 	"github.com/eagraf/habitat/structs/community"
 	"github.com/hashicorp/raft"
 	"github.com/rs/zerolog/log"
 )
 
+// ErrVersionConflict is returned when a batch was proposed against a state version that is no
+// longer current. The proposer can fetch the latest state and try again.
+var ErrVersionConflict = errors.New("community state version conflict")
+
 // TODO refactor this into the raft package
 type RaftFSMAdapter struct {
 	jsonState  *JSONState
 	updateChan chan StateUpdate
+
+	// nonces holds the nonces of recently verified batches, so that they can't be replayed
+	nonces appliedNonces
+
+	// rejections records the indices of rejected entries, if set
+	rejections raft.StableStore
+
+	// restoreHook is called with the restored state every time a snapshot is restored
+	restoreHook     func(commState []byte)
+	restoreHookLock sync.Mutex
 }
 
 func NewRaftFSMAdapter(commState []byte) (*RaftFSMAdapter, error) {
-	jsonState, err := NewJSONState(community.CommunityStateSchema, commState)
+	return NewRaftFSMAdapterFromSnapshot(nil, commState)
+}
+
+// NewRaftFSMAdapterFromSnapshot returns an FSM starting from a snapshot read with ReadSnapshot.
+// The header may be nil if the state didn't come from a snapshot.
+func NewRaftFSMAdapterFromSnapshot(header *SnapshotHeader, commState []byte) (*RaftFSMAdapter, error) {
+	jsonState, err := NewCommunityJSONState(commState)
 	if err != nil {
 		return nil, err
 	}
@@ -26,6 +47,21 @@ func NewRaftFSMAdapter(commState []byte) (*RaftFSMAdapter, error) {
 	return &RaftFSMAdapter{
 		jsonState:  jsonState,
 		updateChan: make(chan StateUpdate),
+		nonces:     header.appliedNonces(),
+	}, nil
+}
+
+// NewRecoveryFSM returns an FSM that doesn't publish state updates. It is used to replay a
+// community's log while its cluster is recovered, before anything is listening for updates.
+func NewRecoveryFSM() (*RaftFSMAdapter, error) {
+	jsonState, err := NewCommunityJSONState(community.NewCommunityStateBytes())
+	if err != nil {
+		return nil, err
+	}
+
+	return &RaftFSMAdapter{
+		jsonState: jsonState,
+		nonces:    make(appliedNonces),
 	}, nil
 }
 
@@ -37,44 +73,210 @@ func (sm *RaftFSMAdapter) UpdateChan() <-chan StateUpdate {
 	return sm.updateChan
 }
 
+// SetRestoreHook registers a function to call after a snapshot is restored. Restoring a snapshot
+// doesn't publish any state updates, so this is the only way to find out the state was replaced.
+func (sm *RaftFSMAdapter) SetRestoreHook(hook func(commState []byte)) {
+	sm.restoreHookLock.Lock()
+	defer sm.restoreHookLock.Unlock()
+
+	sm.restoreHook = hook
+}
+
+// SetRejectionStore sets the store that the indices of rejected entries are recorded in, so
+// that they can be left out of the community's history. It must be set before any entries are
+// applied.
+func (sm *RaftFSMAdapter) SetRejectionStore(store raft.StableStore) {
+	sm.rejections = store
+}
+
 // Apply log is invoked once a log entry is committed.
 // It returns a value which will be made available in the
 // ApplyFuture returned by Raft.Apply method if that
 // method was called on the same Raft node as the FSM.
+// The value is either the updated *community.CommunityState, or an error if the
+// entry was rejected. A rejected entry leaves the state untouched.
 func (sm *RaftFSMAdapter) Apply(entry *raft.Log) interface{} {
+	res := sm.apply(entry)
+	if _, ok := res.(error); ok && sm.rejections != nil {
+		err := sm.rejections.SetUint64(RejectedEntryKey(entry.Index), entry.Index)
+		if err != nil {
+			log.Error().Msgf("error recording rejected entry %d: %s", entry.Index, err)
+		}
+	}
+	return res
+}
+
+func (sm *RaftFSMAdapter) apply(entry *raft.Log) interface{} {
 	buf, err := base64.StdEncoding.DecodeString(string(entry.Data))
 	if err != nil {
 		log.Error().Msgf("error decoding log entry data: %s", err)
+		return err
 	}
 
-	var wrappers []*TransitionWrapper
-	err = json.Unmarshal(buf, &wrappers)
+	batch, err := DecodeTransitionBatch(buf)
 	if err != nil {
 		log.Error().Msgf("error unmarshaling transition wrapper: %s", err)
+		return err
 	}
+	wrappers := batch.Transitions
 
-	for _, w := range wrappers {
-		err = sm.jsonState.ApplyPatch(w.Patch)
+	transitions := make([]CommunityStateTransition, len(wrappers))
+	for i, w := range wrappers {
+		transitions[i], err = DecodeTransition(w.Type, w.Transition)
 		if err != nil {
-			log.Error().Msgf("error applying patch: %s", err)
+			log.Error().Msgf("error decoding transition: %s", err)
+			return err
 		}
+	}
 
-		sm.updateChan <- StateUpdate{
-			TransitionType: w.Type,
-			Transition:     w.Transition,
-			NewState:       sm.jsonState.Bytes(),
+	var oldState community.CommunityState
+	err = sm.jsonState.Unmarshal(&oldState)
+	if err != nil {
+		log.Error().Msgf("error unmarshaling state: %s", err)
+		return err
+	}
+
+	if isUnsignedLegacyBatch(batch, &oldState, sm.nonces) {
+		log.Warn().Msgf("applying unsigned transitions at index %d to community %s", entry.Index, oldState.CommunityID)
+	} else {
+		// Every transition must be signed by a node belonging to a current member
+		err = sm.verifyBatch(batch, transitions, entry.Index)
+		if err != nil {
+			log.Error().Msgf("error verifying transitions: %s", err)
+			return err
 		}
 	}
 
+	err = checkVersion(sm.jsonState, batch.ExpectedVersion)
+	if err != nil {
+		log.Info().Msgf("rejecting transitions: %s", err)
+		return err
+	}
+
+	newState, intermediateStates, err := applyBatch(sm.jsonState, transitions, entry.Index)
+	if err != nil {
+		log.Error().Msgf("rejecting transitions: %s", err)
+		return err
+	}
+
 	var state community.CommunityState
-	err = json.Unmarshal(sm.jsonState.Bytes(), &state)
+	err = newState.Unmarshal(&state)
 	if err != nil {
 		log.Error().Msgf("error unmarshaling state after applying transitions: %s", err)
+		return err
+	}
+
+	sm.jsonState = newState
+
+	for i, w := range wrappers {
+		if sm.updateChan == nil {
+			break
+		}
+		sm.updateChan <- StateUpdate{
+			Index:          entry.Index,
+			TransitionType: w.Type,
+			Transition:     w.Transition,
+			NewState:       intermediateStates[i],
+			Proposer:       w.NodeID,
+		}
 	}
 
 	return &state
 }
 
+// verifyBatch checks that a batch was signed by nodes in the community, that it is not a replay,
+// and that the members behind the proposing nodes may make its transitions. The batch's nonce is
+// used up once its signatures check out, even if it is rejected later on, so that a batch that
+// was rejected can't be replayed once the state has changed to allow it.
+func (sm *RaftFSMAdapter) verifyBatch(batch *TransitionBatch, transitions []CommunityStateTransition, index uint64) error {
+	authState, err := authorizationState(sm.jsonState, transitions)
+	if err != nil {
+		return err
+	}
+
+	err = verifyBatchSignatures(batch, authState)
+	if err != nil {
+		return err
+	}
+
+	err = sm.nonces.check(batch, index)
+	if err != nil {
+		return err
+	}
+	sm.nonces.add(batch.Nonce, index)
+
+	return authorizeBatch(batch, transitions, authState)
+}
+
+// checkVersion makes sure the state has not changed since a batch was proposed. No check is done
+// if the proposer did not give an expected version.
+func checkVersion(jsonState *JSONState, expectedVersion uint64) error {
+	if expectedVersion == 0 {
+		return nil
+	}
+
+	var current community.CommunityState
+	err := jsonState.Unmarshal(&current)
+	if err != nil {
+		return err
+	}
+
+	if current.Version != expectedVersion {
+		return fmt.Errorf("%w: expected version %d, but state is at version %d", ErrVersionConflict, expectedVersion, current.Version)
+	}
+	return nil
+}
+
+// applyBatch validates and applies the transitions one after another on a copy of the committed
+// state. The proposer validated the transitions against its own view of the state, which may be
+// stale, so validation is repeated here and the patches are regenerated from the committed state.
+// Either every transition is applied, or the batch is rejected and the committed state is unchanged.
+// The state after each transition is returned alongside the final state. Every one of these states
+// is stamped with the new version.
+func applyBatch(jsonState *JSONState, transitions []CommunityStateTransition, version uint64) (*JSONState, [][]byte, error) {
+	branch, err := jsonState.Copy()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	err = branch.ApplyPatch([]byte(fmt.Sprintf(`[{
+		"op": "add",
+		"path": "/version",
+		"value": %d
+	}]`, version)))
+	if err != nil {
+		return nil, nil, fmt.Errorf("error setting state version: %s", err)
+	}
+
+	intermediateStates := make([][]byte, 0, len(transitions))
+	for _, t := range transitions {
+		var oldState community.CommunityState
+		err = branch.Unmarshal(&oldState)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		err = t.Validate(&oldState)
+		if err != nil {
+			return nil, nil, fmt.Errorf("%s transition validation failed: %s", t.Type(), err)
+		}
+
+		patch, err := t.Patch(&oldState)
+		if err != nil {
+			return nil, nil, fmt.Errorf("error generating patch for %s transition: %s", t.Type(), err)
+		}
+
+		err = branch.ApplyPatch(patch)
+		if err != nil {
+			return nil, nil, fmt.Errorf("error applying patch for %s transition: %s", t.Type(), err)
+		}
+
+		intermediateStates = append(intermediateStates, branch.Bytes())
+	}
+
+	return branch, intermediateStates, nil
+}
+
 // Snapshot is used to support log compaction. This call should
 // return an FSMSnapshot which can be used to save a point-in-time
 // snapshot of the FSM. Apply and Snapshot are not called in multiple
@@ -83,7 +285,8 @@ func (sm *RaftFSMAdapter) Apply(entry *raft.Log) interface{} {
 // updates while a snapshot is happening.
 func (sm *RaftFSMAdapter) Snapshot() (raft.FSMSnapshot, error) {
 	return &FSMSnapshot{
-		state: sm.jsonState.Bytes(),
+		state:  sm.jsonState.Bytes(),
+		nonces: sm.nonces.copy(),
 	}, nil
 }
 
@@ -91,24 +294,31 @@ func (sm *RaftFSMAdapter) Snapshot() (raft.FSMSnapshot, error) {
 // concurrently with any other command. The FSM must discard all previous
 // state.
 func (sm *RaftFSMAdapter) Restore(reader io.ReadCloser) error {
-	/*newLog := make([]string, 0)
-	scanner := bufio.NewScanner(reader)
-	for scanner.Scan() {
-		newLog = append(newLog, scanner.Text())
-	}
-	sm.Log = newLog
-	return scanner.Err()*/
-	buf, err := ioutil.ReadAll(reader)
+	header, buf, err := ReadSnapshot(reader)
 	if err != nil {
-		return err
+		return fmt.Errorf("error restoring snapshot: %s", err)
 	}
 
-	state, err := NewJSONState(community.CommunityStateSchema, buf)
+	// Snapshots from nodes running a newer schema version can't be restored until this node is
+	// upgraded. Older ones are restored as they are, since every other replica at the snapshot's
+	// index holds the same state. Communities are only migrated by migrate_schema transitions.
+	state, err := NewCommunityJSONState(buf)
 	if err != nil {
-		return err
+		return fmt.Errorf("error restoring snapshot: %s", err)
 	}
 
+	log.Info().Msgf("restored community state snapshot at index %d", header.Index)
+
 	sm.jsonState = state
+	sm.nonces = header.appliedNonces()
+
+	sm.restoreHookLock.Lock()
+	hook := sm.restoreHook
+	sm.restoreHookLock.Unlock()
+	if hook != nil {
+		hook(state.Bytes())
+	}
+
 	return nil
 }
 
@@ -116,20 +326,34 @@ func (sm *RaftFSMAdapter) State() ([]byte, error) {
 	return sm.jsonState.Bytes(), nil
 }
 
+// SnapshotHeader returns the header for a snapshot of the FSM's current state
+func (sm *RaftFSMAdapter) SnapshotHeader() (*SnapshotHeader, error) {
+	header, err := NewSnapshotHeader(sm.jsonState.Bytes())
+	if err != nil {
+		return nil, err
+	}
+	header.AppliedNonces = sm.nonces.copy()
+	return header, nil
+}
+
 type FSMSnapshot struct {
-	state []byte
+	state  []byte
+	nonces appliedNonces
 }
 
 // Persist should dump all necessary state to the WriteCloser 'sink',
 // and call sink.Close() when finished or call sink.Cancel() on error.
 func (s *FSMSnapshot) Persist(sink raft.SnapshotSink) error {
-	/*for _, entry := range s.Log {
-		_, err := sink.Write([]byte(entry + "\n"))
-		if err != nil {
-			return err
-		}
-	}*/
-	sink.Write(s.state)
+	header, err := NewSnapshotHeader(s.state)
+	if err == nil {
+		header.AppliedNonces = s.nonces
+		err = WriteSnapshot(sink, header, s.state)
+	}
+	if err != nil {
+		sink.Cancel()
+		return fmt.Errorf("error persisting snapshot: %s", err)
+	}
+
 	return sink.Close()
 }
 
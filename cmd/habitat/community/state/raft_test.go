@@ -0,0 +1,885 @@
+package state
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"io"
+	"testing"
+
+	"github.com/eagraf/habitat/pkg/identity"
+	"github.com/eagraf/habitat/structs/community"
+	"github.com/hashicorp/raft"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type testMemberNode struct {
+	member       *community.Member
+	node         *community.Node
+	nodeIdentity *identity.MemberNodeIdentity
+}
+
+func newTestMemberNode(t *testing.T, username, nodeID string) *testMemberNode {
+	user, err := identity.GenerateNewUserCert(username, username+"_id")
+	require.Nil(t, err)
+
+	_, privKey, err := identity.GenerateMemberNodeKeypair()
+	require.Nil(t, err)
+
+	certBytes, err := identity.GenerateMemberNodeCertificate(nodeID, user, &privKey.PublicKey)
+	require.Nil(t, err)
+
+	certPEM := new(bytes.Buffer)
+	err = pem.Encode(certPEM, &pem.Block{
+		Type:  "CERTIFICATE",
+		Bytes: certBytes,
+	})
+	require.Nil(t, err)
+
+	return &testMemberNode{
+		member: &community.Member{
+			ID:          user.UUID,
+			Username:    username,
+			Certificate: user.CertBytes,
+		},
+		node: &community.Node{
+			ID:          nodeID,
+			MemberID:    user.UUID,
+			Certificate: certPEM.Bytes(),
+		},
+		nodeIdentity: &identity.MemberNodeIdentity{
+			NodeID:  nodeID,
+			PrivKey: privKey,
+		},
+	}
+}
+
+// testRaftLog wraps and signs the transitions the same way CommunityStateMachine does,
+// and packages them as a Raft log entry
+func testRaftLog(t *testing.T, fsm *RaftFSMAdapter, signer *identity.MemberNodeIdentity, transitions []CommunityStateTransition) *raft.Log {
+	return testRaftLogAtVersion(t, fsm, signer, transitions, 0)
+}
+
+// testRaftLogAtVersion builds a log entry for a batch proposed against expectedVersion. The entry
+// is given the index following the FSM's current version.
+func testRaftLogAtVersion(t *testing.T, fsm *RaftFSMAdapter, signer *identity.MemberNodeIdentity, transitions []CommunityStateTransition, expectedVersion uint64) *raft.Log {
+	var currentState community.CommunityState
+	err := fsm.JSONState().Unmarshal(&currentState)
+	require.Nil(t, err)
+	index := currentState.Version + 1
+	baseVersion := currentState.Version
+
+	branch, err := fsm.JSONState().Copy()
+	require.Nil(t, err)
+
+	wrappers := make([]*TransitionWrapper, 0)
+	for _, tr := range transitions {
+		wrapped, err := wrapTransition(tr, &currentState)
+		require.Nil(t, err)
+		wrappers = append(wrappers, wrapped)
+
+		err = branch.ApplyPatch(wrapped.Patch)
+		require.Nil(t, err)
+		err = branch.Unmarshal(&currentState)
+		require.Nil(t, err)
+	}
+
+	batch := &TransitionBatch{
+		ExpectedVersion: expectedVersion,
+		Transitions:     wrappers,
+		CommunityID:     currentState.CommunityID,
+		BaseVersion:     baseVersion,
+	}
+	err = signBatch(batch, signer)
+	require.Nil(t, err)
+
+	marshaled, err := json.Marshal(batch)
+	require.Nil(t, err)
+
+	return &raft.Log{
+		Index: index,
+		Data:  []byte(base64.StdEncoding.EncodeToString(marshaled)),
+	}
+}
+
+func newTestFSM(t *testing.T) *RaftFSMAdapter {
+	fsm, err := NewRaftFSMAdapter(community.NewCommunityStateBytes())
+	require.Nil(t, err)
+
+	// drain state updates
+	go func() {
+		for range fsm.UpdateChan() {
+		}
+	}()
+	return fsm
+}
+
+// testSnapshotSink keeps a persisted snapshot in memory
+type testSnapshotSink struct {
+	bytes.Buffer
+}
+
+func (s *testSnapshotSink) ID() string    { return "test" }
+func (s *testSnapshotSink) Cancel() error { return nil }
+func (s *testSnapshotSink) Close() error  { return nil }
+
+func TestFSMSignatureVerification(t *testing.T) {
+	alice := newTestMemberNode(t, "alice", "alice_node")
+	mallory := newTestMemberNode(t, "mallory", "mallory_node")
+	alice.member.Role = community.RoleAdmin
+
+	fsm := newTestFSM(t)
+
+	// the first batch is verified against the state it creates
+	res := fsm.Apply(testRaftLog(t, fsm, alice.nodeIdentity, []CommunityStateTransition{
+		&InitializeCommunityTransition{
+			CommunityID: "abc",
+		},
+		&AddMemberTransition{
+			Member: alice.member,
+		},
+		&AddNodeTransition{
+			Node: alice.node,
+		},
+	}))
+	state, ok := res.(*community.CommunityState)
+	require.True(t, ok, "expected state, got %v", res)
+	assert.Equal(t, 1, len(state.Members))
+
+	// a node outside the community can't propose transitions
+	res = fsm.Apply(testRaftLog(t, fsm, mallory.nodeIdentity, []CommunityStateTransition{
+		&AddMemberTransition{
+			Member: mallory.member,
+		},
+	}))
+	_, ok = res.(error)
+	assert.True(t, ok)
+
+	// a node can't claim to be another node
+	forged := testRaftLog(t, fsm, &identity.MemberNodeIdentity{
+		NodeID:  alice.node.ID,
+		PrivKey: mallory.nodeIdentity.PrivKey,
+	}, []CommunityStateTransition{
+		&AddMemberTransition{
+			Member: mallory.member,
+		},
+	})
+	res = fsm.Apply(forged)
+	_, ok = res.(error)
+	assert.True(t, ok)
+
+	// alice can add mallory
+	res = fsm.Apply(testRaftLog(t, fsm, alice.nodeIdentity, []CommunityStateTransition{
+		&AddMemberTransition{
+			Member: mallory.member,
+		},
+		&AddNodeTransition{
+			Node: mallory.node,
+		},
+	}))
+	state, ok = res.(*community.CommunityState)
+	require.True(t, ok, "expected state, got %v", res)
+	assert.Equal(t, 2, len(state.Members))
+	assert.Equal(t, 2, len(state.Nodes))
+}
+
+func TestFSMBootstrapUsesRegeneratedPatches(t *testing.T) {
+	alice := newTestMemberNode(t, "alice", "alice_node")
+	mallory := newTestMemberNode(t, "mallory", "mallory_node")
+
+	fsm := newTestFSM(t)
+
+	// mallory's patches add her own node, but the transitions she signs add alice's
+	forged := []CommunityStateTransition{
+		&InitializeCommunityTransition{CommunityID: "abc"},
+		&AddMemberTransition{Member: mallory.member},
+		&AddNodeTransition{Node: mallory.node},
+	}
+	claimed := []CommunityStateTransition{
+		&InitializeCommunityTransition{CommunityID: "abc"},
+		&AddMemberTransition{Member: alice.member},
+		&AddNodeTransition{Node: alice.node},
+	}
+
+	var currentState community.CommunityState
+	require.Nil(t, fsm.JSONState().Unmarshal(&currentState))
+	branch, err := fsm.JSONState().Copy()
+	require.Nil(t, err)
+
+	wrappers := make([]*TransitionWrapper, 0)
+	for i, tr := range forged {
+		patch, err := tr.Patch(&currentState)
+		require.Nil(t, err)
+		wrapped, err := wrapTransition(claimed[i], &currentState)
+		require.Nil(t, err)
+		wrapped.Patch = patch
+		wrappers = append(wrappers, wrapped)
+
+		require.Nil(t, branch.ApplyPatch(patch))
+		require.Nil(t, branch.Unmarshal(&currentState))
+	}
+
+	batch := &TransitionBatch{
+		Transitions: wrappers,
+		CommunityID: "abc",
+	}
+	require.Nil(t, signBatch(batch, mallory.nodeIdentity))
+	marshaled, err := json.Marshal(batch)
+	require.Nil(t, err)
+
+	res := fsm.Apply(&raft.Log{
+		Index: 1,
+		Data:  []byte(base64.StdEncoding.EncodeToString(marshaled)),
+	})
+	_, ok := res.(error)
+	assert.True(t, ok, "expected error, got %v", res)
+}
+
+func TestFSMReplayedBatches(t *testing.T) {
+	alice := newTestMemberNode(t, "alice", "alice_node")
+	bob := newTestMemberNode(t, "bob", "bob_node")
+	alice.member.Role = community.RoleAdmin
+
+	bootstrap := func(communityID string) *RaftFSMAdapter {
+		fsm := newTestFSM(t)
+		res := fsm.Apply(testRaftLog(t, fsm, alice.nodeIdentity, []CommunityStateTransition{
+			&InitializeCommunityTransition{
+				CommunityID: communityID,
+			},
+			&AddMemberTransition{
+				Member: alice.member,
+			},
+			&AddNodeTransition{
+				Node: alice.node,
+			},
+		}))
+		_, ok := res.(*community.CommunityState)
+		require.True(t, ok, "expected state, got %v", res)
+		return fsm
+	}
+
+	fsm := bootstrap("abc")
+	addBob := testRaftLog(t, fsm, alice.nodeIdentity, []CommunityStateTransition{
+		&AddMemberTransition{
+			Member: bob.member,
+		},
+	})
+	res := fsm.Apply(addBob)
+	_, ok := res.(*community.CommunityState)
+	require.True(t, ok, "expected state, got %v", res)
+
+	res = fsm.Apply(testRaftLog(t, fsm, alice.nodeIdentity, []CommunityStateTransition{
+		&RemoveMemberTransition{
+			MemberID: bob.member.ID,
+		},
+	}))
+	_, ok = res.(*community.CommunityState)
+	require.True(t, ok, "expected state, got %v", res)
+
+	// the batch adding bob can't be committed again
+	replayed := *addBob
+	replayed.Index = addBob.Index + 2
+	res = fsm.Apply(&replayed)
+	err, ok := res.(error)
+	require.True(t, ok, "expected error, got %v", res)
+	assert.True(t, errors.Is(err, ErrReplayedBatch))
+
+	// not even after a restart from a snapshot
+	snapshot, err := fsm.Snapshot()
+	require.Nil(t, err)
+	sink := &testSnapshotSink{}
+	require.Nil(t, snapshot.Persist(sink))
+	restored := newTestFSM(t)
+	require.Nil(t, restored.Restore(io.NopCloser(&sink.Buffer)))
+	res = restored.Apply(&replayed)
+	err, ok = res.(error)
+	require.True(t, ok, "expected error, got %v", res)
+	assert.True(t, errors.Is(err, ErrReplayedBatch))
+
+	// batches built on states that are too old are rejected
+	old := *addBob
+	old.Index = addBob.Index + ReplayWindow + 1
+	res = fsm.Apply(&old)
+	err, ok = res.(error)
+	require.True(t, ok, "expected error, got %v", res)
+	assert.True(t, errors.Is(err, ErrReplayedBatch))
+
+	// nor can it be committed to another community alice is in
+	other := bootstrap("def")
+	replayed.Index = 2
+	res = other.Apply(&replayed)
+	_, ok = res.(error)
+	assert.True(t, ok, "expected error, got %v", res)
+}
+
+func TestFSMUnsignedLegacyBatches(t *testing.T) {
+	alice := newTestMemberNode(t, "alice", "alice_node")
+	alice.member.Role = community.RoleAdmin
+
+	// entries committed before transitions were signed are still applied to version 1 communities
+	unsigned := func(fsm *RaftFSMAdapter, transitions []CommunityStateTransition) *raft.Log {
+		var currentState community.CommunityState
+		require.Nil(t, fsm.JSONState().Unmarshal(&currentState))
+		branch, err := fsm.JSONState().Copy()
+		require.Nil(t, err)
+
+		wrappers := make([]*TransitionWrapper, 0)
+		for _, tr := range transitions {
+			wrapped, err := wrapTransition(tr, &currentState)
+			require.Nil(t, err)
+			wrappers = append(wrappers, wrapped)
+
+			require.Nil(t, branch.ApplyPatch(wrapped.Patch))
+			require.Nil(t, branch.Unmarshal(&currentState))
+		}
+
+		marshaled, err := json.Marshal(wrappers)
+		require.Nil(t, err)
+		return &raft.Log{
+			Index: currentState.Version + 1,
+			Data:  []byte(base64.StdEncoding.EncodeToString(marshaled)),
+		}
+	}
+	initialize := func() *RaftFSMAdapter {
+		fsm := newTestFSM(t)
+		res := fsm.Apply(unsigned(fsm, []CommunityStateTransition{
+			&InitializeCommunityTransition{
+				CommunityID: "abc",
+			},
+			&AddMemberTransition{
+				Member: alice.member,
+			},
+			&AddNodeTransition{
+				Node: alice.node,
+			},
+		}))
+		state, ok := res.(*community.CommunityState)
+		require.True(t, ok, "expected state, got %v", res)
+		assert.Equal(t, 1, state.GetSchemaVersion())
+		return fsm
+	}
+
+	// once the community is migrated, every batch must be signed
+	fsm := initialize()
+	res := fsm.Apply(unsigned(fsm, []CommunityStateTransition{
+		&MigrateSchemaTransition{
+			ToVersion: 2,
+		},
+	}))
+	_, ok := res.(*community.CommunityState)
+	require.True(t, ok, "expected state, got %v", res)
+
+	res = fsm.Apply(unsigned(fsm, []CommunityStateTransition{
+		&IncrementCounterTransition{},
+	}))
+	_, ok = res.(error)
+	assert.True(t, ok, "expected error, got %v", res)
+
+	// and once a signed batch has been committed, the community's nodes have been upgraded, so
+	// unsigned batches are rejected even though it is still at version 1
+	fsm = initialize()
+	res = fsm.Apply(testRaftLog(t, fsm, alice.nodeIdentity, []CommunityStateTransition{
+		&IncrementCounterTransition{},
+	}))
+	_, ok = res.(*community.CommunityState)
+	require.True(t, ok, "expected state, got %v", res)
+
+	res = fsm.Apply(unsigned(fsm, []CommunityStateTransition{
+		&IncrementCounterTransition{},
+	}))
+	_, ok = res.(error)
+	assert.True(t, ok, "expected error, got %v", res)
+
+	// which holds after a restart from a snapshot too
+	restored := newTestFSM(t)
+	snapshot, err := fsm.Snapshot()
+	require.Nil(t, err)
+	sink := &testSnapshotSink{}
+	require.Nil(t, snapshot.Persist(sink))
+	require.Nil(t, restored.Restore(io.NopCloser(&sink.Buffer)))
+
+	res = restored.Apply(unsigned(restored, []CommunityStateTransition{
+		&IncrementCounterTransition{},
+	}))
+	_, ok = res.(error)
+	assert.True(t, ok, "expected error, got %v", res)
+}
+
+func TestFSMRoleAuthorization(t *testing.T) {
+	alice := newTestMemberNode(t, "alice", "alice_node")
+	bob := newTestMemberNode(t, "bob", "bob_node")
+	carol := newTestMemberNode(t, "carol", "carol_node")
+	alice.member.Role = community.RoleAdmin
+	bob.member.Role = community.RoleMember
+
+	fsm := newTestFSM(t)
+
+	res := fsm.Apply(testRaftLog(t, fsm, alice.nodeIdentity, []CommunityStateTransition{
+		&InitializeCommunityTransition{
+			CommunityID: "abc",
+		},
+		&AddMemberTransition{
+			Member: alice.member,
+		},
+		&AddNodeTransition{
+			Node: alice.node,
+		},
+		&AddMemberTransition{
+			Member: bob.member,
+		},
+		&AddNodeTransition{
+			Node: bob.node,
+		},
+		&StartProcessTransition{
+			Process: &community.Process{
+				ID:      "proc1",
+				AppName: "app1",
+				Args:    []string{},
+				Env:     []string{},
+				Flags:   []string{},
+			},
+		},
+	}))
+	_, ok := res.(*community.CommunityState)
+	require.True(t, ok, "expected state, got %v", res)
+
+	// regular members can't add members
+	res = fsm.Apply(testRaftLog(t, fsm, bob.nodeIdentity, []CommunityStateTransition{
+		&AddMemberTransition{
+			Member: carol.member,
+		},
+	}))
+	_, ok = res.(error)
+	assert.True(t, ok)
+
+	// members can start processes on their own nodes, but not on anyone else's
+	res = fsm.Apply(testRaftLog(t, fsm, bob.nodeIdentity, []CommunityStateTransition{
+		&StartProcessInstanceTransition{
+			ProcessInstance: &community.ProcessInstance{
+				ProcessID: "proc1",
+				NodeID:    alice.node.ID,
+			},
+		},
+	}))
+	_, ok = res.(error)
+	assert.True(t, ok)
+
+	res = fsm.Apply(testRaftLog(t, fsm, bob.nodeIdentity, []CommunityStateTransition{
+		&StartProcessInstanceTransition{
+			ProcessInstance: &community.ProcessInstance{
+				ProcessID: "proc1",
+				NodeID:    bob.node.ID,
+			},
+		},
+	}))
+	_, ok = res.(*community.CommunityState)
+	require.True(t, ok, "expected state, got %v", res)
+
+	// once bob is made a guest, he can't start processes at all
+	res = fsm.Apply(testRaftLog(t, fsm, alice.nodeIdentity, []CommunityStateTransition{
+		&RevokeRoleTransition{
+			MemberID: bob.member.ID,
+			Role:     community.RoleMember,
+		},
+	}))
+	state, ok := res.(*community.CommunityState)
+	require.True(t, ok, "expected state, got %v", res)
+	assert.Equal(t, community.RoleGuest, state.GetMember(bob.member.ID).GetRole())
+
+	res = fsm.Apply(testRaftLog(t, fsm, bob.nodeIdentity, []CommunityStateTransition{
+		&StopProcessInstanceTransition{
+			ProcessID: "proc1",
+			NodeID:    bob.node.ID,
+		},
+	}))
+	_, ok = res.(error)
+	assert.True(t, ok)
+
+	// admins can act on anyone's nodes
+	res = fsm.Apply(testRaftLog(t, fsm, alice.nodeIdentity, []CommunityStateTransition{
+		&StopProcessInstanceTransition{
+			ProcessID: "proc1",
+			NodeID:    bob.node.ID,
+		},
+	}))
+	_, ok = res.(*community.CommunityState)
+	require.True(t, ok, "expected state, got %v", res)
+}
+
+func TestFSMProcessScope(t *testing.T) {
+	alice := newTestMemberNode(t, "alice", "alice_node")
+	bob := newTestMemberNode(t, "bob", "bob_node")
+	carol := newTestMemberNode(t, "carol", "carol_node")
+	alice.member.Role = community.RoleAdmin
+	bob.member.Role = community.RoleMember
+	carol.member.Role = community.RoleMember
+
+	fsm := newTestFSM(t)
+
+	startProcess := func(id string) *StartProcessTransition {
+		return &StartProcessTransition{
+			Process: &community.Process{
+				ID:      id,
+				AppName: id,
+				Args:    []string{},
+				Env:     []string{},
+				Flags:   []string{},
+			},
+		}
+	}
+	startInstance := func(processID, nodeID string) *StartProcessInstanceTransition {
+		return &StartProcessInstanceTransition{
+			ProcessInstance: &community.ProcessInstance{
+				ProcessID: processID,
+				NodeID:    nodeID,
+			},
+		}
+	}
+
+	res := fsm.Apply(testRaftLog(t, fsm, alice.nodeIdentity, []CommunityStateTransition{
+		&InitializeCommunityTransition{CommunityID: "abc"},
+		&AddMemberTransition{Member: alice.member},
+		&AddNodeTransition{Node: alice.node},
+		&AddMemberTransition{Member: bob.member},
+		&AddNodeTransition{Node: bob.node},
+		&AddMemberTransition{Member: carol.member},
+		&AddNodeTransition{Node: carol.node},
+		startProcess("proc1"),
+		startInstance("proc1", bob.node.ID),
+		startProcess("proc2"),
+		startInstance("proc2", bob.node.ID),
+		startInstance("proc2", carol.node.ID),
+		&MigrateSchemaTransition{ToVersion: 4},
+	}))
+	_, ok := res.(*community.CommunityState)
+	require.True(t, ok, "expected state, got %v", res)
+
+	// carol can't update a process that only runs on bob's node, or one that also runs on hers
+	for _, processID := range []string{"proc1", "proc2"} {
+		res = fsm.Apply(testRaftLog(t, fsm, carol.nodeIdentity, []CommunityStateTransition{
+			&UpdateProcessTransition{Process: startProcess(processID).Process},
+		}))
+		_, ok = res.(error)
+		assert.True(t, ok, "expected error, got %v", res)
+	}
+
+	// bob can update their own, and an admin can update anyone's
+	res = fsm.Apply(testRaftLog(t, fsm, bob.nodeIdentity, []CommunityStateTransition{
+		&UpdateProcessTransition{Process: startProcess("proc1").Process},
+	}))
+	_, ok = res.(*community.CommunityState)
+	require.True(t, ok, "expected state, got %v", res)
+	res = fsm.Apply(testRaftLog(t, fsm, alice.nodeIdentity, []CommunityStateTransition{
+		&UpdateProcessTransition{Process: startProcess("proc2").Process},
+	}))
+	_, ok = res.(*community.CommunityState)
+	require.True(t, ok, "expected state, got %v", res)
+
+	// carol can't stop a process that only runs on bob's node
+	res = fsm.Apply(testRaftLog(t, fsm, carol.nodeIdentity, []CommunityStateTransition{
+		&StopProcessTransition{ProcessID: "proc1"},
+	}))
+	_, ok = res.(error)
+	assert.True(t, ok, "expected error, got %v", res)
+
+	// bob can't stop a process that also runs on carol's node
+	res = fsm.Apply(testRaftLog(t, fsm, bob.nodeIdentity, []CommunityStateTransition{
+		&StopProcessInstanceTransition{ProcessID: "proc2", NodeID: bob.node.ID},
+		&StopProcessInstanceTransition{ProcessID: "proc2", NodeID: carol.node.ID},
+		&StopProcessTransition{ProcessID: "proc2"},
+	}))
+	_, ok = res.(error)
+	assert.True(t, ok, "expected error, got %v", res)
+
+	// but they can stop their own
+	res = fsm.Apply(testRaftLog(t, fsm, bob.nodeIdentity, []CommunityStateTransition{
+		&StopProcessInstanceTransition{ProcessID: "proc1", NodeID: bob.node.ID},
+		&StopProcessTransition{ProcessID: "proc1"},
+	}))
+	_, ok = res.(*community.CommunityState)
+	require.True(t, ok, "expected state, got %v", res)
+
+	// the last admin can't be removed
+	res = fsm.Apply(testRaftLog(t, fsm, alice.nodeIdentity, []CommunityStateTransition{
+		&RemoveNodeTransition{Node: alice.node},
+		&RemoveMemberTransition{MemberID: alice.member.ID},
+	}))
+	_, ok = res.(error)
+	assert.True(t, ok, "expected error, got %v", res)
+}
+
+func TestFSMMissingPayloads(t *testing.T) {
+	alice := newTestMemberNode(t, "alice", "alice_node")
+	alice.member.Role = community.RoleAdmin
+
+	fsm := newTestFSM(t)
+	res := fsm.Apply(testRaftLog(t, fsm, alice.nodeIdentity, []CommunityStateTransition{
+		&InitializeCommunityTransition{CommunityID: "abc"},
+		&AddMemberTransition{Member: alice.member},
+		&AddNodeTransition{Node: alice.node},
+	}))
+	state, ok := res.(*community.CommunityState)
+	require.True(t, ok, "expected state, got %v", res)
+
+	for _, transitionType := range []string{
+		TransitionTypeInitializeIPFSSwarm,
+		TransitionTypeSetRaftConfig,
+		TransitionTypeAddMember,
+		TransitionTypeAddNode,
+		TransitionTypeRemoveNode,
+		TransitionTypeStartProcess,
+		TransitionTypeUpdateProcess,
+		TransitionTypeStartProcessInstance,
+	} {
+		batch := &TransitionBatch{
+			Transitions: []*TransitionWrapper{
+				{
+					Type:       transitionType,
+					Patch:      []byte("[]"),
+					Transition: []byte("{}"),
+				},
+			},
+			CommunityID: "abc",
+			BaseVersion: state.Version,
+		}
+		require.Nil(t, signBatch(batch, alice.nodeIdentity))
+		marshaled, err := json.Marshal(batch)
+		require.Nil(t, err)
+
+		res = fsm.Apply(&raft.Log{
+			Index: state.Version + 1,
+			Data:  []byte(base64.StdEncoding.EncodeToString(marshaled)),
+		})
+		_, ok = res.(error)
+		assert.True(t, ok, "expected error for %s, got %v", transitionType, res)
+	}
+
+	// a new community's first batch is applied to work out who may sign it, before anything is
+	// verified, so anyone could send one with a null payload
+	batch := &TransitionBatch{
+		Transitions: []*TransitionWrapper{
+			{
+				Type:       TransitionTypeInitializeCommunity,
+				Patch:      []byte("[]"),
+				Transition: []byte(`{"CommunityID": "abc"}`),
+			},
+			{
+				Type:       TransitionTypeInitializeIPFSSwarm,
+				Patch:      []byte("[]"),
+				Transition: []byte(`{"IPFSConfig": null}`),
+			},
+		},
+		CommunityID: "abc",
+	}
+	marshaled, err := json.Marshal(batch)
+	require.Nil(t, err)
+
+	fsm = newTestFSM(t)
+	res = fsm.Apply(&raft.Log{
+		Index: 1,
+		Data:  []byte(base64.StdEncoding.EncodeToString(marshaled)),
+	})
+	_, ok = res.(error)
+	assert.True(t, ok, "expected error, got %v", res)
+}
+
+func TestFSMAtomicBatches(t *testing.T) {
+	alice := newTestMemberNode(t, "alice", "alice_node")
+	bob := newTestMemberNode(t, "bob", "bob_node")
+	alice.member.Role = community.RoleAdmin
+
+	fsm := newTestFSM(t)
+
+	res := fsm.Apply(testRaftLog(t, fsm, alice.nodeIdentity, []CommunityStateTransition{
+		&InitializeCommunityTransition{
+			CommunityID: "abc",
+		},
+		&AddMemberTransition{
+			Member: alice.member,
+		},
+		&AddNodeTransition{
+			Node: alice.node,
+		},
+	}))
+	_, ok := res.(*community.CommunityState)
+	require.True(t, ok, "expected state, got %v", res)
+	before := fsm.JSONState().Bytes()
+
+	// the second transition fails validation against the committed state, so the first must not
+	// be applied either
+	res = fsm.Apply(testRaftLog(t, fsm, alice.nodeIdentity, []CommunityStateTransition{
+		&AddMemberTransition{
+			Member: bob.member,
+		},
+		&AddMemberTransition{
+			Member: alice.member,
+		},
+	}))
+	_, ok = res.(error)
+	assert.True(t, ok)
+	assert.Equal(t, before, fsm.JSONState().Bytes())
+
+	// a proposal built from a stale view of the state is validated again when applied
+	stale := testRaftLog(t, fsm, alice.nodeIdentity, []CommunityStateTransition{
+		&AddMemberTransition{
+			Member: bob.member,
+		},
+	})
+	res = fsm.Apply(testRaftLog(t, fsm, alice.nodeIdentity, []CommunityStateTransition{
+		&AddMemberTransition{
+			Member: bob.member,
+		},
+	}))
+	state, ok := res.(*community.CommunityState)
+	require.True(t, ok, "expected state, got %v", res)
+	assert.Equal(t, 2, len(state.Members))
+
+	res = fsm.Apply(stale)
+	_, ok = res.(error)
+	assert.True(t, ok)
+
+	var current community.CommunityState
+	err := fsm.JSONState().Unmarshal(&current)
+	require.Nil(t, err)
+	assert.Equal(t, 2, len(current.Members))
+}
+
+func TestFSMVersionConflicts(t *testing.T) {
+	alice := newTestMemberNode(t, "alice", "alice_node")
+	alice.member.Role = community.RoleAdmin
+
+	fsm := newTestFSM(t)
+
+	res := fsm.Apply(testRaftLog(t, fsm, alice.nodeIdentity, []CommunityStateTransition{
+		&InitializeCommunityTransition{
+			CommunityID: "abc",
+		},
+		&AddMemberTransition{
+			Member: alice.member,
+		},
+		&AddNodeTransition{
+			Node: alice.node,
+		},
+		&InitializeCounterTransition{},
+	}))
+	state, ok := res.(*community.CommunityState)
+	require.True(t, ok, "expected state, got %v", res)
+	assert.Equal(t, uint64(1), state.Version)
+
+	// two proposals built against the same version race, and only the first one wins
+	first := testRaftLogAtVersion(t, fsm, alice.nodeIdentity, []CommunityStateTransition{
+		&IncrementCounterTransition{},
+	}, 1)
+	second := testRaftLogAtVersion(t, fsm, alice.nodeIdentity, []CommunityStateTransition{
+		&IncrementCounterTransition{},
+	}, 1)
+	second.Index = first.Index + 1
+
+	res = fsm.Apply(first)
+	state, ok = res.(*community.CommunityState)
+	require.True(t, ok, "expected state, got %v", res)
+	assert.Equal(t, uint64(2), state.Version)
+	assert.Equal(t, 1, state.Counter)
+
+	res = fsm.Apply(second)
+	err, ok := res.(error)
+	require.True(t, ok)
+	assert.True(t, errors.Is(err, ErrVersionConflict))
+
+	// retrying against the new version succeeds
+	res = fsm.Apply(testRaftLogAtVersion(t, fsm, alice.nodeIdentity, []CommunityStateTransition{
+		&IncrementCounterTransition{},
+	}, 2))
+	state, ok = res.(*community.CommunityState)
+	require.True(t, ok, "expected state, got %v", res)
+	assert.Equal(t, 2, state.Counter)
+}
+
+func TestDecodeLegacyTransitionBatch(t *testing.T) {
+	batch, err := DecodeTransitionBatch([]byte(`[{"type": "increment_counter", "transition": "e30="}]`))
+	require.Nil(t, err)
+	assert.Equal(t, uint64(0), batch.ExpectedVersion)
+	require.Equal(t, 1, len(batch.Transitions))
+	assert.Equal(t, TransitionTypeIncrementCounter, batch.Transitions[0].Type)
+
+	batch, err = DecodeTransitionBatch([]byte(`{"expected_version": 4, "transitions": []}`))
+	require.Nil(t, err)
+	assert.Equal(t, uint64(4), batch.ExpectedVersion)
+}
+
+func TestFSMSchemaMigration(t *testing.T) {
+	alice := newTestMemberNode(t, "alice", "alice_node")
+	bob := newTestMemberNode(t, "bob", "bob_node")
+	alice.member.Role = community.RoleAdmin
+
+	fsm := newTestFSM(t)
+
+	// a version 1 community, where bob is added without a role
+	res := fsm.Apply(testRaftLog(t, fsm, alice.nodeIdentity, []CommunityStateTransition{
+		&InitializeCommunityTransition{
+			CommunityID: "abc",
+		},
+		&AddMemberTransition{
+			Member: alice.member,
+		},
+		&AddNodeTransition{
+			Node: alice.node,
+		},
+	}))
+	state, ok := res.(*community.CommunityState)
+	require.True(t, ok, "expected state, got %v", res)
+	assert.Equal(t, 1, state.GetSchemaVersion())
+
+	res = fsm.Apply(testRaftLog(t, fsm, alice.nodeIdentity, []CommunityStateTransition{
+		&AddMemberTransition{
+			Member: bob.member,
+		},
+	}))
+	state, ok = res.(*community.CommunityState)
+	require.True(t, ok, "expected state, got %v", res)
+
+	// nodes can't migrate to a version they don't support
+	err := (&MigrateSchemaTransition{ToVersion: community.LatestSchemaVersion + 1}).Validate(state)
+	assert.NotNil(t, err)
+
+	res = fsm.Apply(testRaftLog(t, fsm, alice.nodeIdentity, []CommunityStateTransition{
+		&MigrateSchemaTransition{
+			ToVersion: 2,
+		},
+	}))
+	state, ok = res.(*community.CommunityState)
+	require.True(t, ok, "expected state, got %v", res)
+	assert.Equal(t, 2, state.SchemaVersion)
+	assert.Equal(t, community.RoleAdmin, state.GetMember(alice.member.ID).Role)
+	assert.Equal(t, community.RoleMember, state.GetMember(bob.member.ID).Role)
+
+	// migrating to the current version again is rejected
+	err = (&MigrateSchemaTransition{ToVersion: 2}).Validate(state)
+	assert.NotNil(t, err)
+
+	// members added after the migration get the default role
+	carol := newTestMemberNode(t, "carol", "carol_node")
+	res = fsm.Apply(testRaftLog(t, fsm, alice.nodeIdentity, []CommunityStateTransition{
+		&AddMemberTransition{
+			Member: carol.member,
+		},
+	}))
+	state, ok = res.(*community.CommunityState)
+	require.True(t, ok, "expected state, got %v", res)
+	assert.Equal(t, community.RoleMember, state.GetMember(carol.member.ID).Role)
+
+	// snapshots at an unsupported version can't be restored
+	var raw map[string]interface{}
+	require.Nil(t, json.Unmarshal(fsm.JSONState().Bytes(), &raw))
+	raw[community.SchemaVersionKey] = community.LatestSchemaVersion + 1
+	snapshot, err := json.Marshal(raw)
+	require.Nil(t, err)
+	assert.NotNil(t, fsm.Restore(io.NopCloser(bytes.NewReader(snapshot))))
+
+	// while snapshots at a supported version can
+	snapshot = fsm.JSONState().Bytes()
+	assert.Nil(t, fsm.Restore(io.NopCloser(bytes.NewReader(snapshot))))
+}
@@ -0,0 +1,401 @@
+package state
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/eagraf/habitat/structs/community"
+	"github.com/qri-io/jsonschema"
+	"github.com/rs/zerolog/log"
+)
+
+// TransitionType describes a kind of transition that can be committed to a community's state
+type TransitionType struct {
+	Name string
+
+	// New returns an empty transition of this type to decode into
+	New func() CommunityStateTransition
+
+	// Schema is the JSON schema an encoded transition of this type must match when it is proposed
+	// from outside of this node. Its Validate method is still what decides whether it applies.
+	Schema []byte
+
+	schema *jsonschema.Schema
+}
+
+var (
+	transitionTypes     = make(map[string]*TransitionType)
+	transitionTypesLock = &sync.RWMutex{}
+)
+
+// RegisterTransitionType makes a transition type available to every community. It panics if the
+// type is already registered, or if its schema is invalid, so it should be called from init.
+func RegisterTransitionType(transitionType *TransitionType) {
+	transitionTypesLock.Lock()
+	defer transitionTypesLock.Unlock()
+
+	if _, ok := transitionTypes[transitionType.Name]; ok {
+		panic(fmt.Sprintf("transition type %s is already registered", transitionType.Name))
+	}
+
+	schema := &jsonschema.Schema{}
+	err := json.Unmarshal(transitionType.Schema, schema)
+	if err != nil {
+		panic(fmt.Sprintf("invalid JSON schema for transition type %s: %s", transitionType.Name, err))
+	}
+	transitionType.schema = schema
+
+	transitionTypes[transitionType.Name] = transitionType
+}
+
+// GetTransitionType returns the registered transition type with the given name
+func GetTransitionType(name string) (*TransitionType, error) {
+	transitionTypesLock.RLock()
+	defer transitionTypesLock.RUnlock()
+
+	t, ok := transitionTypes[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown transition type %s", name)
+	}
+	return t, nil
+}
+
+// TransitionTypes lists the names of every registered transition type
+func TransitionTypes() []string {
+	transitionTypesLock.RLock()
+	defer transitionTypesLock.RUnlock()
+
+	names := make([]string, 0, len(transitionTypes))
+	for name := range transitionTypes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// DecodeTransition unmarshals a transition that was encoded into a TransitionWrapper. It doesn't
+// check the transition against its type's schema, since entries committed before a schema was
+// tightened must still be replayed the same way.
+func DecodeTransition(transitionType string, transition []byte) (CommunityStateTransition, error) {
+	t, err := GetTransitionType(transitionType)
+	if err != nil {
+		return nil, err
+	}
+
+	decoded := t.New()
+	err = json.Unmarshal(transition, decoded)
+	if err != nil {
+		return nil, fmt.Errorf("error decoding %s transition: %s", transitionType, err)
+	}
+
+	err = checkTransitionPayload(decoded)
+	if err != nil {
+		return nil, err
+	}
+	return decoded, nil
+}
+
+// ParseTransition checks a transition from an untrusted source against its type's schema, and
+// then decodes it
+func ParseTransition(transitionType string, transition []byte) (CommunityStateTransition, error) {
+	t, err := GetTransitionType(transitionType)
+	if err != nil {
+		return nil, err
+	}
+
+	keyErrs, err := t.schema.ValidateBytes(context.Background(), transition)
+	if err != nil {
+		return nil, fmt.Errorf("error decoding %s transition: %s", transitionType, err)
+	}
+	if len(keyErrs) != 0 {
+		return nil, fmt.Errorf("invalid %s transition: %s", transitionType, keyError(keyErrs))
+	}
+
+	return DecodeTransition(transitionType, transition)
+}
+
+// TransitionExecutor carries out a committed transition on this node. The transition has
+// already been decoded from the update.
+type TransitionExecutor func(update *StateUpdate, transition CommunityStateTransition) error
+
+// TransitionExecutors runs the executors subscribed to each transition type. It implements
+// Executor, and a single one can be shared by every community on a node.
+type TransitionExecutors struct {
+	executors map[string][]TransitionExecutor
+	lock      *sync.RWMutex
+}
+
+func NewTransitionExecutors() *TransitionExecutors {
+	return &TransitionExecutors{
+		executors: make(map[string][]TransitionExecutor),
+		lock:      &sync.RWMutex{},
+	}
+}
+
+// Subscribe runs executor for every transition of the given type committed from now on.
+// Executors for the same type run in the order they subscribed.
+func (e *TransitionExecutors) Subscribe(transitionType string, executor TransitionExecutor) error {
+	_, err := GetTransitionType(transitionType)
+	if err != nil {
+		return err
+	}
+
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	e.executors[transitionType] = append(e.executors[transitionType], executor)
+	return nil
+}
+
+// Execute decodes the update's transition, and runs every executor subscribed to its type.
+// Errors are logged, and don't stop the remaining executors from running.
+func (e *TransitionExecutors) Execute(update *StateUpdate) {
+	e.lock.RLock()
+	executors := e.executors[update.TransitionType]
+	e.lock.RUnlock()
+
+	if len(executors) == 0 {
+		return
+	}
+
+	log.Info().Msgf("executing %s state transition", update.TransitionType)
+
+	transition, err := DecodeTransition(update.TransitionType, update.Transition)
+	if err != nil {
+		log.Error().Err(err).Msgf("error executing %s", update.TransitionType)
+		return
+	}
+
+	for _, executor := range executors {
+		err = executor(update, transition)
+		if err != nil {
+			log.Error().Err(err).Msgf("error executing %s", update.TransitionType)
+		}
+	}
+}
+
+// transitionSchema builds the schema for an encoded transition, given the schemas of its fields.
+// Fields holding part of the community state can refer to the latest state schema's definitions,
+// such as #/$defs/placement. Members are the exception: add_member gives them a role if they don't
+// have one, so they are checked against the original definition, which doesn't require it.
+func transitionSchema(properties string, required ...string) []byte {
+	var stateSchema, originalSchema struct {
+		Defs map[string]json.RawMessage `json:"$defs"`
+	}
+	err := json.Unmarshal(community.CommunityStateSchemas[community.LatestSchemaVersion], &stateSchema)
+	if err != nil {
+		panic(fmt.Sprintf("invalid community state schema: %s", err))
+	}
+	err = json.Unmarshal(community.CommunityStateSchemas[1], &originalSchema)
+	if err != nil {
+		panic(fmt.Sprintf("invalid community state schema: %s", err))
+	}
+	stateSchema.Defs["member"] = originalSchema.Defs["member"]
+	marshaledDefs, err := json.Marshal(stateSchema.Defs)
+	if err != nil {
+		panic(fmt.Sprintf("invalid community state schema: %s", err))
+	}
+
+	if required == nil {
+		required = []string{}
+	}
+	marshaledRequired, err := json.Marshal(required)
+	if err != nil {
+		panic(fmt.Sprintf("invalid transition schema: %s", err))
+	}
+
+	return []byte(fmt.Sprintf(`{
+		"$defs": %s,
+		"type": "object",
+		"properties": %s,
+		"required": %s
+	}`, string(marshaledDefs), properties, string(marshaledRequired)))
+}
+
+func init() {
+	builtin := []*TransitionType{
+		{
+			Name: TransitionTypeInitializeCommunity,
+			New:  func() CommunityStateTransition { return &InitializeCommunityTransition{} },
+			Schema: transitionSchema(`{
+				"CommunityID": { "type": "string", "minLength": 1 }
+			}`, "CommunityID"),
+		},
+		{
+			Name: TransitionTypeAddMember,
+			New:  func() CommunityStateTransition { return &AddMemberTransition{} },
+			Schema: transitionSchema(`{
+				"Member": { "$ref": "#/$defs/member" }
+			}`, "Member"),
+		},
+		{
+			Name: TransitionTypeAddNode,
+			New:  func() CommunityStateTransition { return &AddNodeTransition{} },
+			Schema: transitionSchema(`{
+				"Node": { "$ref": "#/$defs/node" }
+			}`, "Node"),
+		},
+		{
+			Name: TransitionTypeRemoveMember,
+			New:  func() CommunityStateTransition { return &RemoveMemberTransition{} },
+			Schema: transitionSchema(`{
+				"MemberID": { "type": "string" }
+			}`, "MemberID"),
+		},
+		{
+			Name: TransitionTypeRemoveNode,
+			New:  func() CommunityStateTransition { return &RemoveNodeTransition{} },
+			Schema: transitionSchema(`{
+				"Node": {
+					"type": "object",
+					"properties": {
+						"id": { "type": "string" }
+					},
+					"required": [ "id" ]
+				}
+			}`, "Node"),
+		},
+		{
+			Name: TransitionTypeSetNodeLabels,
+			New:  func() CommunityStateTransition { return &SetNodeLabelsTransition{} },
+			Schema: transitionSchema(`{
+				"NodeID": { "type": "string" },
+				"Labels": { "$ref": "#/$defs/labels" }
+			}`, "NodeID", "Labels"),
+		},
+		{
+			Name: TransitionTypeGrantRole,
+			New:  func() CommunityStateTransition { return &GrantRoleTransition{} },
+			Schema: transitionSchema(`{
+				"MemberID": { "type": "string" },
+				"Role": { "type": "string", "enum": [ "admin", "member", "guest" ] }
+			}`, "MemberID", "Role"),
+		},
+		{
+			Name: TransitionTypeRevokeRole,
+			New:  func() CommunityStateTransition { return &RevokeRoleTransition{} },
+			Schema: transitionSchema(`{
+				"MemberID": { "type": "string" },
+				"Role": { "type": "string", "enum": [ "admin", "member" ] }
+			}`, "MemberID", "Role"),
+		},
+		{
+			Name: TransitionTypeMigrateSchema,
+			New:  func() CommunityStateTransition { return &MigrateSchemaTransition{} },
+			Schema: transitionSchema(`{
+				"ToVersion": { "type": "integer", "minimum": 2 }
+			}`, "ToVersion"),
+		},
+		{
+			Name: TransitionTypeSetRaftConfig,
+			New:  func() CommunityStateTransition { return &SetRaftConfigTransition{} },
+			Schema: transitionSchema(`{
+				"RaftConfig": {
+					"type": "object",
+					"properties": {
+						"heartbeat_timeout_ms": { "type": "integer", "minimum": 0 },
+						"election_timeout_ms": { "type": "integer", "minimum": 0 },
+						"commit_timeout_ms": { "type": "integer", "minimum": 0 },
+						"snapshot_interval_ms": { "type": "integer", "minimum": 0 },
+						"snapshot_threshold": { "type": "integer", "minimum": 0 },
+						"trailing_logs": { "type": "integer", "minimum": 0 }
+					}
+				}
+			}`, "RaftConfig"),
+		},
+		{
+			Name: TransitionTypeStartProcess,
+			New:  func() CommunityStateTransition { return &StartProcessTransition{} },
+			Schema: transitionSchema(`{
+				"Process": { "$ref": "#/$defs/process" }
+			}`, "Process"),
+		},
+		{
+			Name: TransitionTypeStopProcess,
+			New:  func() CommunityStateTransition { return &StopProcessTransition{} },
+			Schema: transitionSchema(`{
+				"ProcessID": { "type": "string" }
+			}`, "ProcessID"),
+		},
+		{
+			Name: TransitionTypeUpdateProcess,
+			New:  func() CommunityStateTransition { return &UpdateProcessTransition{} },
+			Schema: transitionSchema(`{
+				"Process": { "$ref": "#/$defs/process" },
+				"Rolling": { "type": "boolean" }
+			}`, "Process"),
+		},
+		{
+			Name: TransitionTypeStartProcessInstance,
+			New:  func() CommunityStateTransition { return &StartProcessInstanceTransition{} },
+			Schema: transitionSchema(`{
+				"ProcessInstance": { "$ref": "#/$defs/process_instance" }
+			}`, "ProcessInstance"),
+		},
+		{
+			Name: TransitionTypeStopProcessInstance,
+			New:  func() CommunityStateTransition { return &StopProcessInstanceTransition{} },
+			Schema: transitionSchema(`{
+				"ProcessID": { "type": "string" },
+				"NodeID": { "type": "string" }
+			}`, "ProcessID", "NodeID"),
+		},
+		{
+			Name: TransitionTypeUpdateProcessInstance,
+			New:  func() CommunityStateTransition { return &UpdateProcessInstanceTransition{} },
+			Schema: transitionSchema(`{
+				"ProcessID": { "type": "string" },
+				"NodeID": { "type": "string" },
+				"Revision": { "type": "integer", "minimum": 1 }
+			}`, "ProcessID", "NodeID", "Revision"),
+		},
+		{
+			Name: TransitionTypeReportInstanceStatus,
+			New:  func() CommunityStateTransition { return &ReportInstanceStatusTransition{} },
+			Schema: transitionSchema(`{
+				"ProcessID": { "type": "string" },
+				"NodeID": { "type": "string" },
+				"Status": { "type": "string", "enum": [ "pending", "running", "failed" ] },
+				"Error": { "type": "string" },
+				"Restarted": { "type": "boolean" },
+				"UpdatedAt": { "type": "integer", "minimum": 0 }
+			}`, "ProcessID", "NodeID", "Status"),
+		},
+		{
+			Name: TransitionTypeInitializeCounter,
+			New:  func() CommunityStateTransition { return &InitializeCounterTransition{} },
+			Schema: transitionSchema(`{
+				"InitialCount": { "type": "integer" }
+			}`),
+		},
+		{
+			Name:   TransitionTypeIncrementCounter,
+			New:    func() CommunityStateTransition { return &IncrementCounterTransition{} },
+			Schema: transitionSchema(`{}`),
+		},
+		{
+			Name: TransitionTypeInitializeIPFSSwarm,
+			New:  func() CommunityStateTransition { return &InitializeIPFSSwarmTransition{} },
+			Schema: transitionSchema(`{
+				"IPFSConfig": {
+					"type": "object",
+					"properties": {
+						"swarm_key": { "type": "string" },
+						"bootstrap_addresses": {
+							"type": "array",
+							"items": { "type": "string" }
+						}
+					},
+					"required": [ "bootstrap_addresses" ]
+				}
+			}`, "IPFSConfig"),
+		},
+	}
+
+	for _, t := range builtin {
+		RegisterTransitionType(t)
+	}
+}
@@ -0,0 +1,99 @@
+package state
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/eagraf/habitat/structs/community"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTransitionRegistry(t *testing.T) {
+	for _, name := range TransitionTypes() {
+		transitionType, err := GetTransitionType(name)
+		require.Nil(t, err)
+		assert.Equal(t, name, transitionType.New().Type())
+	}
+
+	_, err := GetTransitionType("launch_rocket")
+	assert.NotNil(t, err)
+	_, err = DecodeTransition("launch_rocket", []byte(`{}`))
+	assert.NotNil(t, err)
+
+	assert.Panics(t, func() {
+		RegisterTransitionType(&TransitionType{
+			Name:   TransitionTypeAddMember,
+			New:    func() CommunityStateTransition { return &AddMemberTransition{} },
+			Schema: transitionSchema(`{}`),
+		})
+	})
+
+	marshaled, err := json.Marshal(&AddMemberTransition{
+		Member: &community.Member{
+			ID:          "jorts",
+			Username:    "jorts",
+			Certificate: []byte("mycert"),
+		},
+	})
+	require.Nil(t, err)
+
+	parsed, err := ParseTransition(TransitionTypeAddMember, marshaled)
+	require.Nil(t, err)
+	addMember, ok := parsed.(*AddMemberTransition)
+	require.True(t, ok)
+	assert.Equal(t, "jorts", addMember.Member.Username)
+
+	// transitions from untrusted sources have to match their schema
+	invalid := map[string]string{
+		TransitionTypeAddMember:            `{"Member": {"id": "jorts"}}`,
+		TransitionTypeGrantRole:            `{"MemberID": "jorts", "Role": "superuser"}`,
+		TransitionTypeStartProcessInstance: `{"ProcessInstance": null}`,
+		TransitionTypeMigrateSchema:        `{"ToVersion": "2"}`,
+		TransitionTypeStopProcess:          `[]`,
+		TransitionTypeSetNodeLabels:        `{"NodeID": "node1", "Labels": {"region": 1}}`,
+		TransitionTypeStartProcess:         `{"Process": {"id": "proc1", "app_name": "app1", "env": [], "flags": [], "args": [], "placement": {"replicas": -1}}}`,
+	}
+	for transitionType, transition := range invalid {
+		_, err = ParseTransition(transitionType, []byte(transition))
+		assert.NotNil(t, err, transitionType)
+	}
+
+	// but committed transitions are decoded as they are
+	decoded, err := DecodeTransition(TransitionTypeAddMember, []byte(`{"Member": {"id": "jorts"}}`))
+	require.Nil(t, err)
+	assert.Equal(t, "jorts", decoded.(*AddMemberTransition).Member.ID)
+}
+
+func TestTransitionExecutors(t *testing.T) {
+	executors := NewTransitionExecutors()
+
+	assert.NotNil(t, executors.Subscribe("launch_rocket", func(update *StateUpdate, transition CommunityStateTransition) error {
+		return nil
+	}))
+
+	executed := make([]string, 0)
+	err := executors.Subscribe(TransitionTypeGrantRole, func(update *StateUpdate, transition CommunityStateTransition) error {
+		executed = append(executed, "first:"+transition.(*GrantRoleTransition).MemberID)
+		return errors.New("failed")
+	})
+	require.Nil(t, err)
+	err = executors.Subscribe(TransitionTypeGrantRole, func(update *StateUpdate, transition CommunityStateTransition) error {
+		executed = append(executed, "second:"+transition.(*GrantRoleTransition).Role)
+		return nil
+	})
+	require.Nil(t, err)
+
+	executors.Execute(&StateUpdate{
+		TransitionType: TransitionTypeGrantRole,
+		Transition:     []byte(`{"MemberID": "jorts", "Role": "admin"}`),
+	})
+	executors.Execute(&StateUpdate{
+		TransitionType: TransitionTypeRevokeRole,
+		Transition:     []byte(`{"MemberID": "jorts", "Role": "admin"}`),
+	})
+
+	// an executor failing doesn't stop the next one from running
+	assert.Equal(t, []string{"first:jorts", "second:admin"}, executed)
+}
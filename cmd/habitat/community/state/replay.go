@@ -0,0 +1,55 @@
+package state
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ReplayWindow is how many log indices a signed batch can be applied within, counted from the
+// state version it was built on. The nonce of every batch verified within the window is
+// remembered, so no batch can be applied twice.
+const ReplayWindow = 1000
+
+// ErrReplayedBatch is returned for a batch that has already been committed once, or that is too
+// old to tell
+var ErrReplayedBatch = errors.New("replayed transition batch")
+
+// appliedNonces maps the nonces of recently verified batches to the version they were verified at.
+// It is part of the FSM's state, so it is kept in snapshots alongside the community state.
+type appliedNonces map[string]uint64
+
+// check returns an error if a batch can't be applied at version because it is a replay
+func (n appliedNonces) check(batch *TransitionBatch, version uint64) error {
+	if batch.Nonce == "" {
+		return fmt.Errorf("%w: batch has no nonce", ErrReplayedBatch)
+	}
+	if batch.BaseVersion >= version {
+		return fmt.Errorf("batch was built on state version %d, which is not committed yet", batch.BaseVersion)
+	}
+	if version-batch.BaseVersion > ReplayWindow {
+		return fmt.Errorf("%w: batch was built on state version %d, which is more than %d entries old", ErrReplayedBatch, batch.BaseVersion, ReplayWindow)
+	}
+	if _, ok := n[batch.Nonce]; ok {
+		return fmt.Errorf("%w: nonce %s was already used", ErrReplayedBatch, batch.Nonce)
+	}
+	return nil
+}
+
+// add remembers the nonce of a batch verified at version, and forgets nonces that fell out of
+// the window. Batches using those nonces are too old to pass check anyway.
+func (n appliedNonces) add(nonce string, version uint64) {
+	n[nonce] = version
+	for k, v := range n {
+		if version-v > ReplayWindow {
+			delete(n, k)
+		}
+	}
+}
+
+func (n appliedNonces) copy() appliedNonces {
+	res := make(appliedNonces, len(n))
+	for k, v := range n {
+		res[k] = v
+	}
+	return res
+}
@@ -0,0 +1,125 @@
+package state
+
+import (
+	"sort"
+
+	"github.com/eagraf/habitat/structs/community"
+)
+
+// Schedule picks nodes for the instances a process is missing, following its placement. It
+// returns the instances to start in the order they were picked, along with the number of
+// replicas that couldn't be placed on any node. The same state always gives the same placement.
+//
+// Among the nodes an instance may run on, the scheduler prefers nodes in the spread domain with
+// the fewest instances of the process, then nodes running the fewest instances overall.
+func Schedule(s *community.CommunityState, process *community.Process) ([]*community.ProcessInstance, int) {
+	placement := process.Placement
+	if placement == nil {
+		return nil, 0
+	}
+
+	// nodes that left the community keep no instances, so only count the ones still around
+	nodes := make(map[string]*community.Node)
+	for _, n := range s.Nodes {
+		nodes[n.ID] = n
+	}
+
+	hosting := make(map[string]bool)
+	members := make(map[string]bool)
+	load := make(map[string]int)
+	spread := make(map[string]int)
+	running := 0
+	for _, i := range s.ProcessInstances {
+		n, ok := nodes[i.NodeID]
+		if !ok {
+			continue
+		}
+
+		load[n.ID]++
+		if i.ProcessID != process.ID {
+			continue
+		}
+
+		running++
+		hosting[n.ID] = true
+		members[n.MemberID] = true
+		spread[spreadDomain(n, placement)]++
+	}
+
+	avoid := make(map[string]bool)
+	for _, nodeID := range placement.AvoidNodes {
+		avoid[nodeID] = true
+	}
+
+	candidates := make([]*community.Node, 0)
+	for _, n := range s.Nodes {
+		if !avoid[n.ID] && !hosting[n.ID] && matchesLabels(n, placement.NodeLabels) {
+			candidates = append(candidates, n)
+		}
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].ID < candidates[j].ID
+	})
+
+	placed := make([]*community.ProcessInstance, 0)
+	missing := placement.Replicas - running
+	for ; missing > 0; missing-- {
+		var best *community.Node
+		for _, n := range candidates {
+			if hosting[n.ID] || (placement.OnePerMember && members[n.MemberID]) {
+				continue
+			}
+			if best == nil || preferNode(n, best, placement, spread, load) {
+				best = n
+			}
+		}
+		if best == nil {
+			break
+		}
+
+		placed = append(placed, &community.ProcessInstance{
+			ProcessID: process.ID,
+			NodeID:    best.ID,
+		})
+		hosting[best.ID] = true
+		members[best.MemberID] = true
+		load[best.ID]++
+		spread[spreadDomain(best, placement)]++
+	}
+
+	if missing < 0 {
+		missing = 0
+	}
+	return placed, missing
+}
+
+// preferNode returns true if an instance should rather go on node a than on node b. Candidates
+// are visited in order of node ID, so ties go to the lowest ID.
+func preferNode(a, b *community.Node, placement *community.Placement, spread, load map[string]int) bool {
+	if placement.Spread != "" {
+		spreadA, spreadB := spread[spreadDomain(a, placement)], spread[spreadDomain(b, placement)]
+		if spreadA != spreadB {
+			return spreadA < spreadB
+		}
+	}
+	return load[a.ID] < load[b.ID]
+}
+
+// spreadDomain returns the value of the node's spread label. Nodes without the label all share
+// the empty domain.
+func spreadDomain(n *community.Node, placement *community.Placement) string {
+	if placement.Spread == "" {
+		return ""
+	}
+	return n.Labels[placement.Spread]
+}
+
+// matchesLabels returns true if the node has every one of the labels
+func matchesLabels(n *community.Node, labels map[string]string) bool {
+	for k, v := range labels {
+		if value, ok := n.Labels[k]; !ok || value != v {
+			return false
+		}
+	}
+	return true
+}
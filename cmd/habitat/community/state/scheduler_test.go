@@ -0,0 +1,106 @@
+package state
+
+import (
+	"testing"
+
+	"github.com/eagraf/habitat/structs/community"
+	"github.com/stretchr/testify/assert"
+)
+
+func scheduledNodes(instances []*community.ProcessInstance) []string {
+	nodes := make([]string, 0, len(instances))
+	for _, i := range instances {
+		nodes = append(nodes, i.NodeID)
+	}
+	return nodes
+}
+
+func TestSchedule(t *testing.T) {
+	s := &community.CommunityState{
+		Nodes: []*community.Node{
+			{ID: "node4", MemberID: "bob", Labels: map[string]string{"region": "eu"}},
+			{ID: "node1", MemberID: "alice", Labels: map[string]string{"region": "us", "gpu": "true"}},
+			{ID: "node2", MemberID: "alice", Labels: map[string]string{"region": "us"}},
+			{ID: "node3", MemberID: "bob", Labels: map[string]string{"region": "eu", "gpu": "true"}},
+		},
+		ProcessInstances: []*community.ProcessInstance{
+			{ProcessID: "other", NodeID: "node1"},
+		},
+	}
+
+	// processes started by hand aren't scheduled
+	placed, missing := Schedule(s, &community.Process{ID: "proc1"})
+	assert.Equal(t, 0, len(placed))
+	assert.Equal(t, 0, missing)
+
+	// busy nodes are picked last, and ties go to the lowest node ID
+	placed, missing = Schedule(s, &community.Process{
+		ID:        "proc1",
+		Placement: &community.Placement{Replicas: 3},
+	})
+	assert.Equal(t, []string{"node2", "node3", "node4"}, scheduledNodes(placed))
+	assert.Equal(t, 0, missing)
+
+	placed, missing = Schedule(s, &community.Process{
+		ID: "proc1",
+		Placement: &community.Placement{
+			Replicas:   2,
+			NodeLabels: map[string]string{"gpu": "true"},
+		},
+	})
+	assert.Equal(t, []string{"node3", "node1"}, scheduledNodes(placed))
+	assert.Equal(t, 0, missing)
+
+	placed, missing = Schedule(s, &community.Process{
+		ID: "proc1",
+		Placement: &community.Placement{
+			Replicas:     3,
+			OnePerMember: true,
+		},
+	})
+	assert.Equal(t, []string{"node2", "node3"}, scheduledNodes(placed))
+	assert.Equal(t, 1, missing)
+
+	placed, missing = Schedule(s, &community.Process{
+		ID: "proc1",
+		Placement: &community.Placement{
+			Replicas:   4,
+			AvoidNodes: []string{"node2", "node4"},
+		},
+	})
+	assert.Equal(t, []string{"node3", "node1"}, scheduledNodes(placed))
+	assert.Equal(t, 2, missing)
+
+	// spreading across regions wins over the load on each node
+	placed, missing = Schedule(s, &community.Process{
+		ID: "proc1",
+		Placement: &community.Placement{
+			Replicas: 4,
+			Spread:   "region",
+		},
+	})
+	assert.Equal(t, []string{"node2", "node3", "node4", "node1"}, scheduledNodes(placed))
+	assert.Equal(t, 0, missing)
+
+	// running instances count towards the replicas, and only missing ones are placed
+	s.ProcessInstances = append(s.ProcessInstances,
+		&community.ProcessInstance{ProcessID: "proc1", NodeID: "node3"},
+		&community.ProcessInstance{ProcessID: "proc1", NodeID: "removed_node"},
+	)
+	placed, missing = Schedule(s, &community.Process{
+		ID: "proc1",
+		Placement: &community.Placement{
+			Replicas: 2,
+			Spread:   "region",
+		},
+	})
+	assert.Equal(t, []string{"node2"}, scheduledNodes(placed))
+	assert.Equal(t, 0, missing)
+
+	placed, missing = Schedule(s, &community.Process{
+		ID:        "proc1",
+		Placement: &community.Placement{Replicas: 1},
+	})
+	assert.Equal(t, 0, len(placed))
+	assert.Equal(t, 0, missing)
+}
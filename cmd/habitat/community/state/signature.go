@@ -0,0 +1,141 @@
+package state
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/eagraf/habitat/pkg/identity"
+	"github.com/eagraf/habitat/structs/community"
+	"github.com/google/uuid"
+)
+
+// signingPayload is the canonical encoding of a wrapper that the proposing node signs. It covers
+// the batch the wrapper was proposed in, so that it can't be moved to another batch or community,
+// and its position in the batch, so that the batch can't be split up or reordered.
+func (w *TransitionWrapper) signingPayload(batch *TransitionBatch, position int) ([]byte, error) {
+	return json.Marshal(&struct {
+		Type            string `json:"type"`
+		Patch           []byte `json:"patch"`
+		Transition      []byte `json:"transition"`
+		NodeID          string `json:"node_id"`
+		CommunityID     string `json:"community_id"`
+		ExpectedVersion uint64 `json:"expected_version"`
+		BaseVersion     uint64 `json:"base_version"`
+		Nonce           string `json:"nonce"`
+		Position        int    `json:"position"`
+		BatchSize       int    `json:"batch_size"`
+	}{
+		Type:            w.Type,
+		Patch:           w.Patch,
+		Transition:      w.Transition,
+		NodeID:          w.NodeID,
+		CommunityID:     batch.CommunityID,
+		ExpectedVersion: batch.ExpectedVersion,
+		BaseVersion:     batch.BaseVersion,
+		Nonce:           batch.Nonce,
+		Position:        position,
+		BatchSize:       len(batch.Transitions),
+	})
+}
+
+// signBatch gives the batch a fresh nonce, and signs every wrapper in it with the node's key
+func signBatch(batch *TransitionBatch, nodeIdentity *identity.MemberNodeIdentity) error {
+	if nodeIdentity == nil {
+		return errors.New("no node identity to sign transitions with")
+	}
+
+	batch.Nonce = uuid.New().String()
+	for i, w := range batch.Transitions {
+		w.NodeID = nodeIdentity.NodeID
+		payload, err := w.signingPayload(batch, i)
+		if err != nil {
+			return err
+		}
+
+		sig, err := nodeIdentity.Sign(payload)
+		if err != nil {
+			return err
+		}
+		w.Signature = sig
+	}
+	return nil
+}
+
+// verify checks that the wrapper at the given position in a batch was signed by a node in the
+// community, using a key certified by the member that owns the node.
+func (w *TransitionWrapper) verify(state *community.CommunityState, batch *TransitionBatch, position int) error {
+	node := state.GetNode(w.NodeID)
+	if node == nil {
+		return fmt.Errorf("proposing node %s is not in the community", w.NodeID)
+	}
+
+	member := state.GetMember(node.MemberID)
+	if member == nil {
+		return fmt.Errorf("member %s owning node %s is not in the community", node.MemberID, node.ID)
+	}
+
+	nodeCert, err := identity.GetCertFromPEM(node.Certificate)
+	if err != nil {
+		return fmt.Errorf("invalid certificate for node %s: %s", node.ID, err)
+	}
+
+	memberCert, err := identity.GetCertFromPEM(member.Certificate)
+	if err != nil {
+		return fmt.Errorf("invalid certificate for member %s: %s", member.ID, err)
+	}
+
+	payload, err := w.signingPayload(batch, position)
+	if err != nil {
+		return err
+	}
+
+	return identity.VerifyMemberNodeSignature(nodeCert, memberCert, payload, w.Signature)
+}
+
+// verifyBatchSignatures checks the signature on every wrapper in a batch against verifyState,
+// which must be the state returned by authorizationState. The batch must be for the community
+// in that state.
+func verifyBatchSignatures(batch *TransitionBatch, verifyState *community.CommunityState) error {
+	if batch.CommunityID != verifyState.CommunityID {
+		return fmt.Errorf("batch was proposed to community %s, not %s", batch.CommunityID, verifyState.CommunityID)
+	}
+
+	for i, w := range batch.Transitions {
+		err := w.verify(verifyState, batch, i)
+		if err != nil {
+			return fmt.Errorf("rejecting %s transition: %s", w.Type, err)
+		}
+	}
+	return nil
+}
+
+// authorizeBatch checks that the member behind each proposing node is allowed to make the
+// decoded transition
+func authorizeBatch(batch *TransitionBatch, transitions []CommunityStateTransition, authState *community.CommunityState) error {
+	for i, w := range batch.Transitions {
+		err := authorizeTransition(transitions[i], authState, w.NodeID)
+		if err != nil {
+			return fmt.Errorf("rejecting %s transition: %s", w.Type, err)
+		}
+	}
+	return nil
+}
+
+// isUnsignedLegacyBatch returns true for batches committed before transitions were signed. The
+// logs of communities from back then are full of them, so they are still applied to communities
+// at schema version 1, which are the only ones that can be that old. They stop being accepted
+// once the first signed batch is applied, since its node had been upgraded, and nonces is empty
+// until then: only signed batches have one, and the latest is never forgotten. Migrating a
+// community to a newer schema version also stops unsigned batches from being accepted.
+func isUnsignedLegacyBatch(batch *TransitionBatch, oldState *community.CommunityState, nonces appliedNonces) bool {
+	if oldState.GetSchemaVersion() != 1 || len(nonces) != 0 || batch.Nonce != "" {
+		return false
+	}
+	for _, w := range batch.Transitions {
+		if w.NodeID != "" || len(w.Signature) != 0 {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,182 @@
+package state
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	"github.com/eagraf/habitat/structs/community"
+	"github.com/hashicorp/raft"
+)
+
+// SnapshotFormatVersion is the version of the snapshot layout written by WriteSnapshot. Snapshots
+// are gzip compressed, and hold a JSON encoded SnapshotHeader on the first line, followed by the
+// community state. The checksum of format 1 snapshots only covers the state, while from format 2
+// on it covers the header too.
+const SnapshotFormatVersion = 2
+
+// SnapshotHeader describes the community state stored in a snapshot
+type SnapshotHeader struct {
+	FormatVersion int    `json:"format_version"`
+	SchemaVersion int    `json:"schema_version"`
+	Index         uint64 `json:"index"`    // Raft index the state was captured at
+	Checksum      string `json:"checksum"` // hex encoded SHA-256 of the header and the state, set by WriteSnapshot
+
+	// These are only set on exported snapshots, so that they can be installed in the
+	// Raft snapshot store of another node
+	Term               uint64              `json:"term,omitempty"`
+	Configuration      *raft.Configuration `json:"configuration,omitempty"`
+	ConfigurationIndex uint64              `json:"configuration_index,omitempty"`
+
+	// AppliedNonces are the nonces of recently verified batches, which the FSM keeps to reject
+	// replayed batches
+	AppliedNonces map[string]uint64 `json:"applied_nonces,omitempty"`
+}
+
+// appliedNonces returns the nonces recorded in the header, which may be nil
+func (h *SnapshotHeader) appliedNonces() appliedNonces {
+	if h == nil || h.AppliedNonces == nil {
+		return make(appliedNonces)
+	}
+	return appliedNonces(h.AppliedNonces).copy()
+}
+
+// NewSnapshotHeader builds the header for a JSON encoded community state
+func NewSnapshotHeader(state []byte) (*SnapshotHeader, error) {
+	var commState community.CommunityState
+	err := json.Unmarshal(state, &commState)
+	if err != nil {
+		return nil, fmt.Errorf("error decoding community state: %s", err)
+	}
+
+	return &SnapshotHeader{
+		FormatVersion: SnapshotFormatVersion,
+		SchemaVersion: commState.GetSchemaVersion(),
+		Index:         commState.Version,
+	}, nil
+}
+
+func checksum(state []byte) string {
+	sum := sha256.Sum256(state)
+	return hex.EncodeToString(sum[:])
+}
+
+// snapshotChecksum returns the checksum of a header and the state it describes. The header is
+// encoded without its own checksum.
+func snapshotChecksum(header *SnapshotHeader, state []byte) (string, error) {
+	unsealed := *header
+	unsealed.Checksum = ""
+	marshaledHeader, err := json.Marshal(&unsealed)
+	if err != nil {
+		return "", err
+	}
+
+	hash := sha256.New()
+	hash.Write(marshaledHeader)
+	hash.Write([]byte{'\n'})
+	hash.Write(state)
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// WriteSnapshot writes a compressed snapshot of the state to w. The header is updated to the
+// current format version, and given the checksum of the snapshot.
+func WriteSnapshot(w io.Writer, header *SnapshotHeader, state []byte) error {
+	header.FormatVersion = SnapshotFormatVersion
+	sum, err := snapshotChecksum(header, state)
+	if err != nil {
+		return err
+	}
+	header.Checksum = sum
+
+	marshaledHeader, err := json.Marshal(header)
+	if err != nil {
+		return err
+	}
+
+	zw := gzip.NewWriter(w)
+	_, err = zw.Write(append(marshaledHeader, '\n'))
+	if err != nil {
+		return err
+	}
+	_, err = zw.Write(state)
+	if err != nil {
+		return err
+	}
+	return zw.Close()
+}
+
+// ReadSnapshot reads a snapshot written by WriteSnapshot, and makes sure the state it holds
+// matches its header. Snapshots taken before the header was added are plain JSON, and are
+// read as well.
+func ReadSnapshot(r io.Reader) (*SnapshotHeader, []byte, error) {
+	br := bufio.NewReader(r)
+	magic, err := br.Peek(2)
+	if err != nil && err != io.EOF {
+		return nil, nil, fmt.Errorf("error reading snapshot: %s", err)
+	}
+
+	if !bytes.Equal(magic, []byte{0x1f, 0x8b}) {
+		state, err := ioutil.ReadAll(br)
+		if err != nil {
+			return nil, nil, fmt.Errorf("error reading snapshot: %s", err)
+		}
+		header, err := NewSnapshotHeader(state)
+		if err != nil {
+			return nil, nil, err
+		}
+		return header, state, nil
+	}
+
+	zr, err := gzip.NewReader(br)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error decompressing snapshot: %s", err)
+	}
+	defer zr.Close()
+
+	content := bufio.NewReader(zr)
+	headerLine, err := content.ReadBytes('\n')
+	if err != nil {
+		return nil, nil, fmt.Errorf("error reading snapshot header: %s", err)
+	}
+
+	var header SnapshotHeader
+	err = json.Unmarshal(headerLine, &header)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error decoding snapshot header: %s", err)
+	}
+	if header.FormatVersion > SnapshotFormatVersion {
+		return nil, nil, fmt.Errorf("snapshot format version %d is not supported", header.FormatVersion)
+	}
+
+	state, err := ioutil.ReadAll(content)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error reading snapshot: %s", err)
+	}
+
+	expectedChecksum := checksum(state)
+	if header.FormatVersion >= 2 {
+		expectedChecksum, err = snapshotChecksum(&header, state)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	if expectedChecksum != header.Checksum {
+		return nil, nil, fmt.Errorf("snapshot checksum mismatch, the snapshot is corrupted")
+	}
+
+	schemaVersion, err := community.GetSchemaVersion(state)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error reading schema version of snapshot: %s", err)
+	}
+	if schemaVersion != header.SchemaVersion {
+		return nil, nil, fmt.Errorf("snapshot header has schema version %d, but state has version %d", header.SchemaVersion, schemaVersion)
+	}
+
+	return &header, state, nil
+}
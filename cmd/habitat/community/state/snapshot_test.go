@@ -0,0 +1,82 @@
+package state
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"testing"
+
+	"github.com/eagraf/habitat/structs/community"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSnapshotReadWrite(t *testing.T) {
+	commState := []byte(`{"community_id":"abc","version":7,"members":[],"nodes":[],"processes":[],"process_instances":[]}`)
+
+	header, err := NewSnapshotHeader(commState)
+	require.Nil(t, err)
+	assert.Equal(t, uint64(7), header.Index)
+	assert.Equal(t, 1, header.SchemaVersion)
+
+	var buf bytes.Buffer
+	err = WriteSnapshot(&buf, header, commState)
+	require.Nil(t, err)
+
+	readHeader, readState, err := ReadSnapshot(bytes.NewReader(buf.Bytes()))
+	require.Nil(t, err)
+	assert.Equal(t, header, readHeader)
+	assert.Equal(t, commState, readState)
+
+	// snapshots from before the header was added are plain JSON
+	readHeader, readState, err = ReadSnapshot(bytes.NewReader(commState))
+	require.Nil(t, err)
+	assert.Equal(t, header.Index, readHeader.Index)
+	assert.Equal(t, header.SchemaVersion, readHeader.SchemaVersion)
+	assert.Equal(t, commState, readState)
+
+	// a state that doesn't match its checksum is rejected
+	_, _, err = ReadSnapshot(bytes.NewReader(writeRawSnapshot(t, header, []byte(`{"community_id":"def"}`))))
+	assert.NotNil(t, err)
+
+	// and so is a header that doesn't
+	tampered := *header
+	tampered.Index = 8
+	_, _, err = ReadSnapshot(bytes.NewReader(writeRawSnapshot(t, &tampered, commState)))
+	assert.NotNil(t, err)
+
+	// the checksum of format 1 snapshots only covers the state
+	v1Header := *header
+	v1Header.FormatVersion = 1
+	v1Header.Checksum = checksum(commState)
+	readHeader, readState, err = ReadSnapshot(bytes.NewReader(writeRawSnapshot(t, &v1Header, commState)))
+	require.Nil(t, err)
+	assert.Equal(t, &v1Header, readHeader)
+	assert.Equal(t, commState, readState)
+
+	// as is a header with the wrong schema version
+	header, err = NewSnapshotHeader(commState)
+	require.Nil(t, err)
+	header.SchemaVersion = community.LatestSchemaVersion
+	buf.Reset()
+	err = WriteSnapshot(&buf, header, commState)
+	require.Nil(t, err)
+	_, _, err = ReadSnapshot(bytes.NewReader(buf.Bytes()))
+	assert.NotNil(t, err)
+}
+
+// writeRawSnapshot writes a snapshot without updating the header, the way older or corrupted
+// snapshots may look
+func writeRawSnapshot(t *testing.T, header *SnapshotHeader, state []byte) []byte {
+	marshaledHeader, err := json.Marshal(header)
+	require.Nil(t, err)
+
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	_, err = zw.Write(append(marshaledHeader, '\n'))
+	require.Nil(t, err)
+	_, err = zw.Write(state)
+	require.Nil(t, err)
+	require.Nil(t, zw.Close())
+	return buf.Bytes()
+}
@@ -8,6 +8,7 @@ import (
 	"strings"
 	"sync"
 
+	"github.com/eagraf/habitat/pkg/identity"
 	"github.com/eagraf/habitat/structs/community"
 	jsonpatch "github.com/evanphx/json-patch"
 	"github.com/qri-io/jsonschema"
@@ -33,9 +34,11 @@ func (e *NOOPExecutor) Execute(update *StateUpdate) {
 }
 
 type StateUpdate struct {
+	Index          uint64 // Raft index of the log entry the update was committed in
 	NewState       []byte
 	Transition     []byte
 	TransitionType string
+	Proposer       string // ID of the node that proposed the transition
 }
 
 func (s *StateUpdate) State() (*community.CommunityState, error) {
@@ -55,14 +58,19 @@ type CommunityStateMachine struct {
 	//transitionChan <-chan *CommunityStateTransition
 	updateChan <-chan StateUpdate
 	doneChan   chan bool
+
+	// nodeIdentity is used to sign proposed transitions
+	nodeIdentity *identity.MemberNodeIdentity
+
+	watchers *updateWatchers
 }
 
-func NewCommunityStateMachine(initState *community.CommunityState, updateChan <-chan StateUpdate, dispatcher Dispatcher, executor Executor) (*CommunityStateMachine, error) {
+func NewCommunityStateMachine(initState *community.CommunityState, updateChan <-chan StateUpdate, dispatcher Dispatcher, executor Executor, nodeIdentity *identity.MemberNodeIdentity) (*CommunityStateMachine, error) {
 	marshaled, err := json.Marshal(initState)
 	if err != nil {
 		return nil, err
 	}
-	jsonState, err := NewJSONState(community.CommunityStateSchema, marshaled)
+	jsonState, err := NewCommunityJSONState(marshaled)
 	if err != nil {
 		return nil, err
 	}
@@ -72,6 +80,9 @@ func NewCommunityStateMachine(initState *community.CommunityState, updateChan <-
 		dispatcher: dispatcher,
 		doneChan:   make(chan bool),
 		executor:   executor,
+
+		nodeIdentity: nodeIdentity,
+		watchers:     newUpdateWatchers(),
 	}, nil
 }
 
@@ -81,11 +92,12 @@ func (csm *CommunityStateMachine) StartListening() {
 			select {
 			case stateUpdate := <-csm.updateChan:
 				// execute state update
-				jsonState, err := NewJSONState(community.CommunityStateSchema, stateUpdate.NewState)
+				jsonState, err := NewCommunityJSONState(stateUpdate.NewState)
 				if err != nil {
 					log.Error().Err(err).Msgf("error getting new state from state update chan")
 				}
 				csm.jsonState = jsonState
+				csm.watchers.publish(stateUpdate)
 				csm.executor.Execute(&stateUpdate)
 			case <-csm.doneChan:
 				return
@@ -96,36 +108,114 @@ func (csm *CommunityStateMachine) StartListening() {
 
 func (csm *CommunityStateMachine) StopListening() {
 	csm.doneChan <- true
+	csm.watchers.closeAll()
 }
 
-func (csm *CommunityStateMachine) ProposeTransitions(transitions []CommunityStateTransition) (*community.CommunityState, error) {
+// Watch returns a channel that receives every state update applied from now on. If fromIndex is
+// set, recent updates with at least that index are sent first, so a watcher can pick up where it
+// left off. The channel is closed if the watcher falls too far behind, or when cancel is called.
+func (csm *CommunityStateMachine) Watch(fromIndex uint64) (<-chan StateUpdate, func(), error) {
 	currentState, err := csm.State()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return csm.watchers.watch(fromIndex, currentState.Version)
+}
+
+func (csm *CommunityStateMachine) ProposeTransitions(transitions []CommunityStateTransition) (*community.CommunityState, error) {
+	return csm.ProposeTransitionsAtVersion(transitions, 0)
+}
+
+// ProposeTransitionsAtVersion only commits the transitions if the community state is still at
+// expectedVersion when they are applied, and otherwise returns ErrVersionConflict. An
+// expectedVersion of 0 skips the check.
+func (csm *CommunityStateMachine) ProposeTransitionsAtVersion(transitions []CommunityStateTransition, expectedVersion uint64) (*community.CommunityState, error) {
+	batch, _, err := csm.prepareBatch(transitions, expectedVersion)
 	if err != nil {
 		return nil, err
 	}
 
-	jsonStateBranch, err := csm.jsonState.Copy()
+	transitionsJSON, err := json.Marshal(batch)
 	if err != nil {
 		return nil, err
 	}
 
+	state, err := csm.dispatcher.Dispatch(transitionsJSON)
+	if err != nil {
+		return nil, err
+	}
+
+	return state, nil
+}
+
+// DryRunTransitions checks the transitions the same way ProposeTransitionsAtVersion does, but
+// doesn't commit them. It returns the state they would produce from this node's current state,
+// along with a JSON patch holding every change they would make.
+func (csm *CommunityStateMachine) DryRunTransitions(transitions []CommunityStateTransition, expectedVersion uint64) (*community.CommunityState, []byte, error) {
+	batch, newState, err := csm.prepareBatch(transitions, expectedVersion)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	ops := make([]json.RawMessage, 0)
+	for _, w := range batch.Transitions {
+		var patchOps []json.RawMessage
+		err = json.Unmarshal(w.Patch, &patchOps)
+		if err != nil {
+			return nil, nil, fmt.Errorf("error decoding patch for %s transition: %s", w.Type, err)
+		}
+		ops = append(ops, patchOps...)
+	}
+
+	diff, err := json.Marshal(ops)
+	if err != nil {
+		return nil, nil, err
+	}
+	return newState, diff, nil
+}
+
+// prepareBatch validates, signs and authorizes transitions against this node's current state, and
+// returns them as a batch ready to be proposed, along with the state they produce
+func (csm *CommunityStateMachine) prepareBatch(transitions []CommunityStateTransition, expectedVersion uint64) (*TransitionBatch, *community.CommunityState, error) {
+	currentState, err := csm.State()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// our local state may lag behind the committed state, but it never runs ahead of it
+	if expectedVersion != 0 && currentState.Version > expectedVersion {
+		return nil, nil, fmt.Errorf("%w: expected version %d, but state is at version %d", ErrVersionConflict, expectedVersion, currentState.Version)
+	}
+
+	baseVersion := currentState.Version
+
+	jsonStateBranch, err := csm.jsonState.Copy()
+	if err != nil {
+		return nil, nil, err
+	}
+
 	wrappers := make([]*TransitionWrapper, 0)
 
 	for _, t := range transitions {
+		err = checkTransitionPayload(t)
+		if err != nil {
+			return nil, nil, err
+		}
 
 		err = t.Validate(currentState)
 		if err != nil {
-			return nil, fmt.Errorf("transition validation failed: %s", err)
+			return nil, nil, fmt.Errorf("transition validation failed: %s", err)
 		}
 
 		patch, err := t.Patch(currentState)
 		if err != nil {
-			return nil, err
+			return nil, nil, err
 		}
 
 		err = jsonStateBranch.ApplyPatch(patch)
 		if err != nil {
-			return nil, err
+			return nil, nil, err
 		}
 
 		newStateBytes := jsonStateBranch.state
@@ -133,12 +223,12 @@ func (csm *CommunityStateMachine) ProposeTransitions(transitions []CommunityStat
 		var newState community.CommunityState
 		err = json.Unmarshal(newStateBytes, &newState)
 		if err != nil {
-			return nil, err
+			return nil, nil, err
 		}
 
 		wrapped, err := wrapTransition(t, currentState)
 		if err != nil {
-			return nil, err
+			return nil, nil, err
 		}
 
 		wrappers = append(wrappers, wrapped)
@@ -146,17 +236,31 @@ func (csm *CommunityStateMachine) ProposeTransitions(transitions []CommunityStat
 		currentState = &newState
 	}
 
-	transitionsJSON, err := json.Marshal(wrappers)
+	// a batch creating a community is signed for the community it creates
+	batch := &TransitionBatch{
+		ExpectedVersion: expectedVersion,
+		Transitions:     wrappers,
+		CommunityID:     currentState.CommunityID,
+		BaseVersion:     baseVersion,
+	}
+	err = signBatch(batch, csm.nodeIdentity)
 	if err != nil {
-		return nil, err
+		return nil, nil, fmt.Errorf("error signing transitions: %s", err)
 	}
 
-	state, err := csm.dispatcher.Dispatch(transitionsJSON)
+	// check permissions here as well as in the FSM, so that unauthorized proposals fail fast
+	authState, err := authorizationState(csm.jsonState, transitions)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
+	}
+	for _, t := range transitions {
+		err = authorizeTransition(t, authState, csm.nodeIdentity.NodeID)
+		if err != nil {
+			return nil, nil, fmt.Errorf("transition authorization failed: %s", err)
+		}
 	}
 
-	return state, nil
+	return batch, currentState, nil
 }
 
 func (csm *CommunityStateMachine) State() (*community.CommunityState, error) {
@@ -172,6 +276,11 @@ type JSONState struct {
 	schema *jsonschema.Schema
 	state  []byte
 
+	// versioned is set for community states, which are validated against the schema
+	// matching their own schema version rather than a fixed schema
+	versioned     bool
+	schemaVersion int
+
 	*sync.Mutex
 }
 
@@ -197,7 +306,7 @@ func NewJSONState(jsonSchema []byte, initState []byte) (*JSONState, error) {
 }
 
 func (s *JSONState) ApplyPatch(patchJSON []byte) error {
-	updated, err := s.applyImpl(patchJSON)
+	updated, schema, schemaVersion, err := s.applyImpl(patchJSON)
 	if err != nil {
 		return err
 	}
@@ -207,12 +316,14 @@ func (s *JSONState) ApplyPatch(patchJSON []byte) error {
 	defer s.Unlock()
 
 	s.state = updated
+	s.schema = schema
+	s.schemaVersion = schemaVersion
 
 	return nil
 }
 
 func (s *JSONState) ValidatePatch(patchJSON []byte) ([]byte, error) {
-	updated, err := s.applyImpl(patchJSON)
+	updated, _, _, err := s.applyImpl(patchJSON)
 	if err != nil {
 		return nil, err
 	}
@@ -220,24 +331,41 @@ func (s *JSONState) ValidatePatch(patchJSON []byte) ([]byte, error) {
 	return updated, err
 }
 
-func (s *JSONState) applyImpl(patchJSON []byte) ([]byte, error) {
+// applyImpl returns the patched state, along with the schema and schema version it was validated
+// against. These only change when a patch migrates a community state to a new schema version.
+func (s *JSONState) applyImpl(patchJSON []byte) ([]byte, *jsonschema.Schema, int, error) {
 	patch, err := jsonpatch.DecodePatch(patchJSON)
 	if err != nil {
-		return nil, fmt.Errorf("invalid JSON patch: %s", err)
+		return nil, nil, 0, fmt.Errorf("invalid JSON patch: %s", err)
 	}
 	updated, err := patch.Apply(s.state)
 	if err != nil {
-		return nil, fmt.Errorf("error applying patch to current state")
+		return nil, nil, 0, fmt.Errorf("error applying patch to current state")
+	}
+
+	schema, schemaVersion := s.schema, s.schemaVersion
+	if s.versioned {
+		schemaVersion, err = community.GetSchemaVersion(updated)
+		if err != nil {
+			return nil, nil, 0, fmt.Errorf("error reading schema version of updated state: %s", err)
+		}
+		if schemaVersion != s.schemaVersion {
+			schema, err = communitySchema(schemaVersion)
+			if err != nil {
+				return nil, nil, 0, err
+			}
+		}
 	}
+
 	// check that updated state still fulfills the schema
-	keyErrs, err := s.schema.ValidateBytes(context.Background(), updated)
+	keyErrs, err := schema.ValidateBytes(context.Background(), updated)
 	if err != nil {
-		return nil, fmt.Errorf("error validating updated state: %s", err)
+		return nil, nil, 0, fmt.Errorf("error validating updated state: %s", err)
 	}
 	if len(keyErrs) != 0 {
-		return nil, keyError(keyErrs)
+		return nil, nil, 0, keyError(keyErrs)
 	}
-	return updated, nil
+	return updated, schema, schemaVersion, nil
 }
 
 func (s *JSONState) Unmarshal(dest interface{}) error {
@@ -249,6 +377,10 @@ func (s *JSONState) Bytes() []byte {
 }
 
 func (s *JSONState) Copy() (*JSONState, error) {
+	if s.versioned {
+		return NewCommunityJSONState(s.state)
+	}
+
 	schema, err := json.Marshal(s.schema)
 	if err != nil {
 		return nil, err
@@ -1,9 +1,11 @@
 package state
 
 import (
+	"bytes"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"strings"
 
 	"github.com/eagraf/habitat/structs/community"
 )
@@ -12,11 +14,21 @@ const (
 	TransitionTypeInitializeCommunity = "initialize_community"
 	TransitionTypeAddMember           = "add_member"
 	TransitionTypeAddNode             = "add_node"
-
-	TransitionTypeStartProcess         = "start_process"
-	TransitionTypeStopProcess          = "stop_process"
-	TransitionTypeStartProcessInstance = "start_process_instance"
-	TransitionTypeStopProcessInstance  = "stop_process_instance"
+	TransitionTypeRemoveMember        = "remove_member"
+	TransitionTypeRemoveNode          = "remove_node"
+	TransitionTypeSetNodeLabels       = "set_node_labels"
+	TransitionTypeGrantRole           = "grant_role"
+	TransitionTypeRevokeRole          = "revoke_role"
+	TransitionTypeMigrateSchema       = "migrate_schema"
+	TransitionTypeSetRaftConfig       = "set_raft_config"
+
+	TransitionTypeStartProcess          = "start_process"
+	TransitionTypeStopProcess           = "stop_process"
+	TransitionTypeUpdateProcess         = "update_process"
+	TransitionTypeStartProcessInstance  = "start_process_instance"
+	TransitionTypeStopProcessInstance   = "stop_process_instance"
+	TransitionTypeUpdateProcessInstance = "update_process_instance"
+	TransitionTypeReportInstanceStatus  = "report_instance_status"
 
 	TransitionTypeInitializeCounter = "initialize_counter"
 	TransitionTypeIncrementCounter  = "increment_counter"
@@ -28,12 +40,63 @@ type TransitionWrapper struct {
 	Type       string `json:"type"`
 	Patch      []byte `json:"patch"`      // The JSON patch generated from the transition struct
 	Transition []byte `json:"transition"` // JSON encoded transition struct
+
+	NodeID    string `json:"node_id"`   // ID of the node that proposed the transition
+	Signature []byte `json:"signature"` // Signature over the above fields and the batch, made with the proposing node's key
+}
+
+// TransitionBatch is a group of transitions that are committed to the Raft log together
+type TransitionBatch struct {
+	// ExpectedVersion is the state version the batch was built against. If it is set, the batch
+	// is only applied if the committed state is still at that version.
+	ExpectedVersion uint64               `json:"expected_version,omitempty"`
+	Transitions     []*TransitionWrapper `json:"transitions"`
+
+	// Every transition is signed together with these, so that a batch can't be replayed into
+	// another community, or into the same one once it has been committed. BaseVersion is the
+	// version of the proposer's state when it built the batch, and Nonce is unique to the batch.
+	CommunityID string `json:"community_id,omitempty"`
+	BaseVersion uint64 `json:"base_version,omitempty"`
+	Nonce       string `json:"nonce,omitempty"`
+}
+
+// DecodeTransitionBatch unmarshals a batch of transitions. Older log entries are a bare list of
+// wrappers, so those are accepted too.
+func DecodeTransitionBatch(buf []byte) (*TransitionBatch, error) {
+	trimmed := bytes.TrimSpace(buf)
+	if len(trimmed) > 0 && trimmed[0] == '[' {
+		var wrappers []*TransitionWrapper
+		err := json.Unmarshal(trimmed, &wrappers)
+		if err != nil {
+			return nil, err
+		}
+		return &TransitionBatch{
+			Transitions: wrappers,
+		}, nil
+	}
+
+	var batch TransitionBatch
+	err := json.Unmarshal(trimmed, &batch)
+	if err != nil {
+		return nil, err
+	}
+	return &batch, nil
 }
 
 type CommunityStateTransition interface {
 	Type() string
 	Patch(oldState *community.CommunityState) ([]byte, error)
 	Validate(oldState *community.CommunityState) error
+
+	// RequiredRole is the least privileged role a member must hold to propose the transition
+	RequiredRole() string
+}
+
+// memberScopedTransition is implemented by transitions that only affect resources owned by a
+// single member. That member may propose the transition with the role given by RequiredRole,
+// while anyone else needs to be an admin.
+type memberScopedTransition interface {
+	OwnerMemberID(oldState *community.CommunityState) string
 }
 
 func wrapTransition(t CommunityStateTransition, oldState *community.CommunityState) (*TransitionWrapper, error) {
@@ -62,6 +125,10 @@ func (t *InitializeCounterTransition) Type() string {
 	return TransitionTypeInitializeCounter
 }
 
+func (t *InitializeCounterTransition) RequiredRole() string {
+	return community.RoleMember
+}
+
 func (t *InitializeCounterTransition) Patch(oldState *community.CommunityState) ([]byte, error) {
 	return []byte(fmt.Sprintf(`[{
 		"op": "add",
@@ -83,6 +150,10 @@ func (t *IncrementCounterTransition) Type() string {
 	return TransitionTypeIncrementCounter
 }
 
+func (t *IncrementCounterTransition) RequiredRole() string {
+	return community.RoleMember
+}
+
 func (t *IncrementCounterTransition) Patch(oldState *community.CommunityState) ([]byte, error) {
 	return []byte(fmt.Sprintf(`[{
 		"op": "replace",
@@ -103,6 +174,10 @@ func (t *InitializeCommunityTransition) Type() string {
 	return TransitionTypeInitializeCommunity
 }
 
+func (t *InitializeCommunityTransition) RequiredRole() string {
+	return community.RoleAdmin
+}
+
 func (t *InitializeCommunityTransition) Patch(oldState *community.CommunityState) ([]byte, error) {
 	return []byte(fmt.Sprintf(`[{
 		"op": "add",
@@ -126,6 +201,10 @@ func (t *InitializeIPFSSwarmTransition) Type() string {
 	return TransitionTypeInitializeIPFSSwarm
 }
 
+func (t *InitializeIPFSSwarmTransition) RequiredRole() string {
+	return community.RoleAdmin
+}
+
 func (t *InitializeIPFSSwarmTransition) Patch(oldState *community.CommunityState) ([]byte, error) {
 	configBytes, err := json.Marshal(t.IPFSConfig)
 	if err != nil {
@@ -157,8 +236,20 @@ func (t *AddMemberTransition) Type() string {
 	return TransitionTypeAddMember
 }
 
+func (t *AddMemberTransition) RequiredRole() string {
+	return community.RoleAdmin
+}
+
 func (t *AddMemberTransition) Patch(oldState *community.CommunityState) ([]byte, error) {
-	marshaledMember, err := json.Marshal(t.Member)
+	member := t.Member
+	if oldState.SchemaVersion >= 2 && member.Role == "" {
+		// roles are required from schema version 2 on
+		withRole := *member
+		withRole.Role = member.GetRole()
+		member = &withRole
+	}
+
+	marshaledMember, err := json.Marshal(member)
 	if err != nil {
 		return nil, err
 	}
@@ -190,6 +281,17 @@ func (t *AddNodeTransition) Type() string {
 	return TransitionTypeAddNode
 }
 
+func (t *AddNodeTransition) RequiredRole() string {
+	return community.RoleMember
+}
+
+func (t *AddNodeTransition) OwnerMemberID(oldState *community.CommunityState) string {
+	if t.Node == nil {
+		return ""
+	}
+	return t.Node.MemberID
+}
+
 func (t *AddNodeTransition) Patch(oldState *community.CommunityState) ([]byte, error) {
 	marshaledNode, err := json.Marshal(t.Node)
 	if err != nil {
@@ -224,6 +326,463 @@ func (t *AddNodeTransition) Validate(oldState *community.CommunityState) error {
 	return nil
 }
 
+type RemoveMemberTransition struct {
+	MemberID string
+}
+
+func (t *RemoveMemberTransition) Type() string {
+	return TransitionTypeRemoveMember
+}
+
+func (t *RemoveMemberTransition) RequiredRole() string {
+	return community.RoleAdmin
+}
+
+func (t *RemoveMemberTransition) Patch(oldState *community.CommunityState) ([]byte, error) {
+	for i, m := range oldState.Members {
+		if m.ID == t.MemberID {
+			return []byte(fmt.Sprintf(`[{
+				"op": "remove",
+				"path": "/members/%d"
+			}]`, i)), nil
+		}
+	}
+
+	return nil, fmt.Errorf("member ID %s not found in members list", t.MemberID)
+}
+
+func (t *RemoveMemberTransition) Validate(oldState *community.CommunityState) error {
+	// ensure all of the member's nodes have been removed first
+	for _, n := range oldState.Nodes {
+		if n.MemberID == t.MemberID {
+			return fmt.Errorf("member %s still has node %s in the community", t.MemberID, n.ID)
+		}
+	}
+
+	member := oldState.GetMember(t.MemberID)
+	if member == nil {
+		return fmt.Errorf("member ID %s not found in members list", t.MemberID)
+	}
+
+	if member.GetRole() == community.RoleAdmin {
+		return checkNotLastAdmin(oldState, t.MemberID)
+	}
+	return nil
+}
+
+// RemoveNodeTransition removes a node from the community, along with all of the process
+// instances that were assigned to it. The full node is carried in the transition so that
+// executors can still reach its addresses after it is gone from the state.
+type RemoveNodeTransition struct {
+	Node *community.Node
+}
+
+func (t *RemoveNodeTransition) Type() string {
+	return TransitionTypeRemoveNode
+}
+
+func (t *RemoveNodeTransition) RequiredRole() string {
+	return community.RoleMember
+}
+
+func (t *RemoveNodeTransition) OwnerMemberID(oldState *community.CommunityState) string {
+	if t.Node == nil {
+		return ""
+	}
+	// look the owner up in the state, rather than trusting the node carried in the transition
+	return nodeOwner(oldState, t.Node.ID)
+}
+
+func (t *RemoveNodeTransition) Patch(oldState *community.CommunityState) ([]byte, error) {
+	nodeIndex := -1
+	for i, n := range oldState.Nodes {
+		if n.ID == t.Node.ID {
+			nodeIndex = i
+			break
+		}
+	}
+	if nodeIndex == -1 {
+		return nil, fmt.Errorf("node ID %s not found in nodes list", t.Node.ID)
+	}
+
+	// remove process instances back to front so that earlier indices stay valid
+	ops := make([]string, 0)
+	for i := len(oldState.ProcessInstances) - 1; i >= 0; i-- {
+		if oldState.ProcessInstances[i].NodeID == t.Node.ID {
+			ops = append(ops, fmt.Sprintf(`{
+				"op": "remove",
+				"path": "/process_instances/%d"
+			}`, i))
+		}
+	}
+	ops = append(ops, fmt.Sprintf(`{
+		"op": "remove",
+		"path": "/nodes/%d"
+	}`, nodeIndex))
+
+	replacements, err := t.reschedule(oldState)
+	if err != nil {
+		return nil, err
+	}
+	ops = append(ops, replacements...)
+
+	return []byte(fmt.Sprintf("[%s]", strings.Join(ops, ","))), nil
+}
+
+// reschedule returns the operations adding replacements for the instances of scheduled processes
+// that ran on the removed node. Placing them here, rather than in a later batch, means that every
+// removal reschedules no matter who proposes it, and that a member removing their own node may
+// place instances on nodes they don't own. The scheduler only depends on the state, so every
+// node computes the same placement.
+func (t *RemoveNodeTransition) reschedule(oldState *community.CommunityState) ([]string, error) {
+	remaining := *oldState
+	remaining.Nodes = make([]*community.Node, 0, len(oldState.Nodes))
+	for _, n := range oldState.Nodes {
+		if n.ID != t.Node.ID {
+			remaining.Nodes = append(remaining.Nodes, n)
+		}
+	}
+	remaining.ProcessInstances = make([]*community.ProcessInstance, 0, len(oldState.ProcessInstances))
+	for _, i := range oldState.ProcessInstances {
+		if i.NodeID != t.Node.ID {
+			remaining.ProcessInstances = append(remaining.ProcessInstances, i)
+		}
+	}
+
+	ops := make([]string, 0)
+	for _, p := range remaining.Processes {
+		placed, _ := Schedule(&remaining, p)
+		for _, i := range placed {
+			instance := newProcessInstance(&remaining, i.ProcessID, i.NodeID)
+			remaining.ProcessInstances = append(remaining.ProcessInstances, instance)
+
+			marshaledInstance, err := json.Marshal(instance)
+			if err != nil {
+				return nil, err
+			}
+			ops = append(ops, fmt.Sprintf(`{
+				"op": "add",
+				"path": "/process_instances/-",
+				"value": %s
+			}`, string(marshaledInstance)))
+		}
+	}
+	return ops, nil
+}
+
+func (t *RemoveNodeTransition) Validate(oldState *community.CommunityState) error {
+	if t.Node == nil {
+		return errors.New("no node supplied")
+	}
+
+	for _, n := range oldState.Nodes {
+		if n.ID == t.Node.ID {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("node ID %s not found in nodes list", t.Node.ID)
+}
+
+// SetNodeLabelsTransition replaces the labels the scheduler matches a node against. It doesn't
+// move instances that are already running.
+type SetNodeLabelsTransition struct {
+	NodeID string
+	Labels map[string]string
+}
+
+func (t *SetNodeLabelsTransition) Type() string {
+	return TransitionTypeSetNodeLabels
+}
+
+func (t *SetNodeLabelsTransition) RequiredRole() string {
+	return community.RoleMember
+}
+
+func (t *SetNodeLabelsTransition) OwnerMemberID(oldState *community.CommunityState) string {
+	return nodeOwner(oldState, t.NodeID)
+}
+
+func (t *SetNodeLabelsTransition) Patch(oldState *community.CommunityState) ([]byte, error) {
+	for i, n := range oldState.Nodes {
+		if n.ID == t.NodeID {
+			marshaledLabels, err := json.Marshal(t.Labels)
+			if err != nil {
+				return nil, err
+			}
+
+			return []byte(fmt.Sprintf(`[{
+				"op": "add",
+				"path": "/nodes/%d/labels",
+				"value": %s
+			}]`, i, string(marshaledLabels))), nil
+		}
+	}
+
+	return nil, fmt.Errorf("node ID %s not found in nodes list", t.NodeID)
+}
+
+func (t *SetNodeLabelsTransition) Validate(oldState *community.CommunityState) error {
+	err := checkSchemaVersion(oldState, 5, "node labels")
+	if err != nil {
+		return err
+	}
+
+	if oldState.GetNode(t.NodeID) == nil {
+		return fmt.Errorf("node ID %s not found in nodes list", t.NodeID)
+	}
+	return nil
+}
+
+// GrantRoleTransition gives a member a new role, which may be more or less privileged than
+// their current one
+type GrantRoleTransition struct {
+	MemberID string
+	Role     string
+}
+
+func (t *GrantRoleTransition) Type() string {
+	return TransitionTypeGrantRole
+}
+
+func (t *GrantRoleTransition) RequiredRole() string {
+	return community.RoleAdmin
+}
+
+func (t *GrantRoleTransition) Patch(oldState *community.CommunityState) ([]byte, error) {
+	return setMemberRolePatch(oldState, t.MemberID, t.Role)
+}
+
+func (t *GrantRoleTransition) Validate(oldState *community.CommunityState) error {
+	if !community.ValidRole(t.Role) {
+		return fmt.Errorf("invalid role %s", t.Role)
+	}
+
+	member := oldState.GetMember(t.MemberID)
+	if member == nil {
+		return fmt.Errorf("member ID %s not found in members list", t.MemberID)
+	}
+
+	if member.GetRole() == community.RoleAdmin && t.Role != community.RoleAdmin {
+		return checkNotLastAdmin(oldState, t.MemberID)
+	}
+	return nil
+}
+
+// RevokeRoleTransition takes a role away from a member, leaving them with the next least
+// privileged role.
+type RevokeRoleTransition struct {
+	MemberID string
+	Role     string
+}
+
+func (t *RevokeRoleTransition) Type() string {
+	return TransitionTypeRevokeRole
+}
+
+func (t *RevokeRoleTransition) RequiredRole() string {
+	return community.RoleAdmin
+}
+
+func (t *RevokeRoleTransition) Patch(oldState *community.CommunityState) ([]byte, error) {
+	switch t.Role {
+	case community.RoleAdmin:
+		return setMemberRolePatch(oldState, t.MemberID, community.RoleMember)
+	case community.RoleMember:
+		return setMemberRolePatch(oldState, t.MemberID, community.RoleGuest)
+	default:
+		return nil, fmt.Errorf("role %s can not be revoked", t.Role)
+	}
+}
+
+func (t *RevokeRoleTransition) Validate(oldState *community.CommunityState) error {
+	member := oldState.GetMember(t.MemberID)
+	if member == nil {
+		return fmt.Errorf("member ID %s not found in members list", t.MemberID)
+	}
+
+	if member.GetRole() != t.Role {
+		return fmt.Errorf("member %s does not have role %s", t.MemberID, t.Role)
+	}
+
+	if t.Role == community.RoleAdmin {
+		return checkNotLastAdmin(oldState, t.MemberID)
+	}
+	return nil
+}
+
+// MigrateSchemaTransition upgrades the community state to a newer schema version. Every node in
+// the community must support ToVersion before this is proposed, otherwise nodes that don't will fail
+// to apply it.
+type MigrateSchemaTransition struct {
+	ToVersion int
+}
+
+func (t *MigrateSchemaTransition) Type() string {
+	return TransitionTypeMigrateSchema
+}
+
+func (t *MigrateSchemaTransition) RequiredRole() string {
+	return community.RoleAdmin
+}
+
+// Patch is made of the migrations' own patch operations. The state is only encoded to read the
+// fields the migrations change, so fields unknown to this node are left untouched.
+func (t *MigrateSchemaTransition) Patch(oldState *community.CommunityState) ([]byte, error) {
+	marshaled, err := json.Marshal(oldState)
+	if err != nil {
+		return nil, err
+	}
+
+	return MigrationPatch(marshaled, t.ToVersion)
+}
+
+func (t *MigrateSchemaTransition) Validate(oldState *community.CommunityState) error {
+	currentVersion := oldState.GetSchemaVersion()
+	if t.ToVersion <= currentVersion {
+		return fmt.Errorf("community state is already at schema version %d", currentVersion)
+	}
+	if t.ToVersion > community.LatestSchemaVersion {
+		return unsupportedSchemaVersion(t.ToVersion)
+	}
+
+	for v := currentVersion; v < t.ToVersion; v++ {
+		if _, ok := schemaMigrations[v]; !ok {
+			return fmt.Errorf("no migration from schema version %d", v)
+		}
+	}
+
+	return nil
+}
+
+// SetRaftConfigTransition replaces the settings of the community's Raft cluster. Each node
+// reloads its Raft instance with the new settings once it applies the transition.
+type SetRaftConfigTransition struct {
+	RaftConfig *community.RaftConfig
+}
+
+func (t *SetRaftConfigTransition) Type() string {
+	return TransitionTypeSetRaftConfig
+}
+
+func (t *SetRaftConfigTransition) RequiredRole() string {
+	return community.RoleAdmin
+}
+
+func (t *SetRaftConfigTransition) Patch(oldState *community.CommunityState) ([]byte, error) {
+	marshaledConfig, err := json.Marshal(t.RaftConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	return []byte(fmt.Sprintf(`[{
+		"op": "add",
+		"path": "/raft_config",
+		"value": %s
+	}]`, string(marshaledConfig))), nil
+}
+
+func (t *SetRaftConfigTransition) Validate(oldState *community.CommunityState) error {
+	err := checkSchemaVersion(oldState, 3, "raft_config")
+	if err != nil {
+		return err
+	}
+	return ValidateRaftConfig(t.RaftConfig)
+}
+
+func setMemberRolePatch(oldState *community.CommunityState, memberID, role string) ([]byte, error) {
+	for i, m := range oldState.Members {
+		if m.ID == memberID {
+			// add replaces the value if the member already has a role
+			return []byte(fmt.Sprintf(`[{
+				"op": "add",
+				"path": "/members/%d/role",
+				"value": "%s"
+			}]`, i, role)), nil
+		}
+	}
+
+	return nil, fmt.Errorf("member ID %s not found in members list", memberID)
+}
+
+// checkSchemaVersion makes sure the community state is at a schema version that has a field a
+// transition sets. Older states must be migrated first.
+func checkSchemaVersion(oldState *community.CommunityState, minVersion int, field string) error {
+	schemaVersion := oldState.GetSchemaVersion()
+	if schemaVersion < minVersion {
+		return fmt.Errorf("community state schema version %d has no %s, it must be migrated to version %d first", schemaVersion, field, minVersion)
+	}
+	return nil
+}
+
+// checkNotLastAdmin makes sure a community is never left without anyone able to administer it
+func checkNotLastAdmin(oldState *community.CommunityState, memberID string) error {
+	for _, m := range oldState.Members {
+		if m.ID != memberID && m.HasRole(community.RoleAdmin) {
+			return nil
+		}
+	}
+	return fmt.Errorf("member %s is the last admin of community %s", memberID, oldState.CommunityID)
+}
+
+// nodeOwner returns the ID of the member owning the node, or an empty string if there is no such node
+func nodeOwner(oldState *community.CommunityState, nodeID string) string {
+	node := oldState.GetNode(nodeID)
+	if node == nil {
+		return ""
+	}
+	return node.MemberID
+}
+
+// processOwner returns the ID of the member owning every node running an instance of the process.
+// Processes don't belong to anyone, so an empty string is returned if the process has no
+// instances, or if they run on nodes of different members.
+func processOwner(oldState *community.CommunityState, processID string) string {
+	owner := ""
+	for _, i := range oldState.ProcessInstances {
+		if i.ProcessID != processID {
+			continue
+		}
+
+		memberID := nodeOwner(oldState, i.NodeID)
+		if memberID == "" || (owner != "" && owner != memberID) {
+			return ""
+		}
+		owner = memberID
+	}
+	return owner
+}
+
+// checkTransitionPayload rejects transitions that are missing the struct they carry. Transitions
+// decoded from the log are checked before they are authorized, since authorization and validation
+// both assume the payload is there.
+func checkTransitionPayload(t CommunityStateTransition) error {
+	missing := false
+	switch transition := t.(type) {
+	case *InitializeIPFSSwarmTransition:
+		missing = transition.IPFSConfig == nil
+	case *SetRaftConfigTransition:
+		missing = transition.RaftConfig == nil
+	case *AddMemberTransition:
+		missing = transition.Member == nil
+	case *AddNodeTransition:
+		missing = transition.Node == nil
+	case *RemoveNodeTransition:
+		missing = transition.Node == nil
+	case *StartProcessTransition:
+		missing = transition.Process == nil
+	case *UpdateProcessTransition:
+		missing = transition.Process == nil
+	case *StartProcessInstanceTransition:
+		missing = transition.ProcessInstance == nil
+	}
+
+	if missing {
+		return fmt.Errorf("%s transition has no payload", t.Type())
+	}
+	return nil
+}
+
 type StartProcessTransition struct {
 	Process *community.Process
 }
@@ -232,6 +791,10 @@ func (t *StartProcessTransition) Type() string {
 	return TransitionTypeStartProcess
 }
 
+func (t *StartProcessTransition) RequiredRole() string {
+	return community.RoleMember
+}
+
 func (t *StartProcessTransition) Patch(oldState *community.CommunityState) ([]byte, error) {
 	marshaledProcess, err := json.Marshal(t.Process)
 	if err != nil {
@@ -246,6 +809,13 @@ func (t *StartProcessTransition) Patch(oldState *community.CommunityState) ([]by
 }
 
 func (t *StartProcessTransition) Validate(oldState *community.CommunityState) error {
+	if t.Process.Placement != nil {
+		err := checkSchemaVersion(oldState, 5, "process placements")
+		if err != nil {
+			return err
+		}
+	}
+
 	// make sure no process with same process id and app name is already started
 	for _, p := range oldState.Processes {
 		if p.ID == t.Process.ID {
@@ -267,6 +837,16 @@ func (t *StopProcessTransition) Type() string {
 	return TransitionTypeStopProcess
 }
 
+func (t *StopProcessTransition) RequiredRole() string {
+	return community.RoleMember
+}
+
+// OwnerMemberID lets a member stop a process that only runs on their own nodes. The process's
+// instances are stopped in the same batch, so this is checked against the state before the batch.
+func (t *StopProcessTransition) OwnerMemberID(oldState *community.CommunityState) string {
+	return processOwner(oldState, t.ProcessID)
+}
+
 func (t *StopProcessTransition) Patch(oldState *community.CommunityState) ([]byte, error) {
 	for i, p := range oldState.Processes {
 		if p.ID == t.ProcessID {
@@ -297,6 +877,71 @@ func (t *StopProcessTransition) Validate(oldState *community.CommunityState) err
 	return fmt.Errorf("process ID %s not found in processes list", t.ProcessID)
 }
 
+// UpdateProcessTransition replaces the settings of a running process. Its app can't be changed.
+// Every instance is restarted with the new settings, either all at once, or one node at a time
+// if Rolling is set.
+type UpdateProcessTransition struct {
+	Process *community.Process
+	Rolling bool
+}
+
+func (t *UpdateProcessTransition) Type() string {
+	return TransitionTypeUpdateProcess
+}
+
+func (t *UpdateProcessTransition) RequiredRole() string {
+	return community.RoleMember
+}
+
+// OwnerMemberID lets a member update a process that only runs on their own nodes, since every
+// instance of it is restarted. Updating anyone else's process takes an admin.
+func (t *UpdateProcessTransition) OwnerMemberID(oldState *community.CommunityState) string {
+	if t.Process == nil {
+		return ""
+	}
+	return processOwner(oldState, t.Process.ID)
+}
+
+func (t *UpdateProcessTransition) Patch(oldState *community.CommunityState) ([]byte, error) {
+	for i, p := range oldState.Processes {
+		if p.ID == t.Process.ID {
+			updated := *t.Process
+			updated.Revision = p.Revision + 1
+			updated.RollingUpdate = t.Rolling
+
+			marshaledProcess, err := json.Marshal(&updated)
+			if err != nil {
+				return nil, err
+			}
+
+			return []byte(fmt.Sprintf(`[{
+				"op": "replace",
+				"path": "/processes/%d",
+				"value": %s
+			}]`, i, string(marshaledProcess))), nil
+		}
+	}
+
+	return nil, fmt.Errorf("process ID %s not found in processes list", t.Process.ID)
+}
+
+func (t *UpdateProcessTransition) Validate(oldState *community.CommunityState) error {
+	err := checkSchemaVersion(oldState, 4, "process revisions")
+	if err != nil {
+		return err
+	}
+
+	process := oldState.GetProcess(t.Process.ID)
+	if process == nil {
+		return fmt.Errorf("process ID %s not found in processes list", t.Process.ID)
+	}
+	if process.AppName != t.Process.AppName {
+		return fmt.Errorf("process %s runs app %s, which can't be changed to %s", process.ID, process.AppName, t.Process.AppName)
+	}
+
+	return nil
+}
+
 type StartProcessInstanceTransition struct {
 	ProcessInstance *community.ProcessInstance
 }
@@ -305,8 +950,20 @@ func (t *StartProcessInstanceTransition) Type() string {
 	return TransitionTypeStartProcessInstance
 }
 
+func (t *StartProcessInstanceTransition) RequiredRole() string {
+	return community.RoleMember
+}
+
+func (t *StartProcessInstanceTransition) OwnerMemberID(oldState *community.CommunityState) string {
+	if t.ProcessInstance == nil {
+		return ""
+	}
+	return nodeOwner(oldState, t.ProcessInstance.NodeID)
+}
+
 func (t *StartProcessInstanceTransition) Patch(oldState *community.CommunityState) ([]byte, error) {
-	marshaledProcessInstance, err := json.Marshal(t.ProcessInstance)
+	instance := newProcessInstance(oldState, t.ProcessInstance.ProcessID, t.ProcessInstance.NodeID)
+	marshaledProcessInstance, err := json.Marshal(instance)
 	if err != nil {
 		return nil, err
 	}
@@ -318,6 +975,22 @@ func (t *StartProcessInstanceTransition) Patch(oldState *community.CommunityStat
 	}]`, string(marshaledProcessInstance))), nil
 }
 
+// newProcessInstance returns a new instance of a process. It starts with the process's current
+// settings, and is pending until its node reports on it.
+func newProcessInstance(oldState *community.CommunityState, processID, nodeID string) *community.ProcessInstance {
+	instance := &community.ProcessInstance{
+		ProcessID: processID,
+		NodeID:    nodeID,
+	}
+	if process := oldState.GetProcess(processID); process != nil && oldState.GetSchemaVersion() >= 4 {
+		instance.Revision = process.Revision
+	}
+	if oldState.GetSchemaVersion() >= 6 {
+		instance.Status = community.InstanceStatusPending
+	}
+	return instance
+}
+
 func (t *StartProcessInstanceTransition) Validate(oldState *community.CommunityState) error {
 	found := false
 	for _, p := range oldState.Processes {
@@ -356,6 +1029,14 @@ func (t *StopProcessInstanceTransition) Type() string {
 	return TransitionTypeStopProcessInstance
 }
 
+func (t *StopProcessInstanceTransition) RequiredRole() string {
+	return community.RoleMember
+}
+
+func (t *StopProcessInstanceTransition) OwnerMemberID(oldState *community.CommunityState) string {
+	return nodeOwner(oldState, t.NodeID)
+}
+
 func (t *StopProcessInstanceTransition) Patch(oldState *community.CommunityState) ([]byte, error) {
 	for i, p := range oldState.ProcessInstances {
 		if p.ProcessID == t.ProcessID && p.NodeID == t.NodeID {
@@ -378,3 +1059,130 @@ func (t *StopProcessInstanceTransition) Validate(oldState *community.CommunitySt
 
 	return fmt.Errorf("process instance with matching process and node IDs not found")
 }
+
+// UpdateProcessInstanceTransition is proposed by a node once it has restarted its instance of a
+// process with a newer revision of the process's settings
+type UpdateProcessInstanceTransition struct {
+	ProcessID string
+	NodeID    string
+	Revision  uint64
+}
+
+func (t *UpdateProcessInstanceTransition) Type() string {
+	return TransitionTypeUpdateProcessInstance
+}
+
+// RequiredRole lets any member report on their own nodes' instances
+func (t *UpdateProcessInstanceTransition) RequiredRole() string {
+	return community.RoleGuest
+}
+
+func (t *UpdateProcessInstanceTransition) OwnerMemberID(oldState *community.CommunityState) string {
+	return nodeOwner(oldState, t.NodeID)
+}
+
+func (t *UpdateProcessInstanceTransition) Patch(oldState *community.CommunityState) ([]byte, error) {
+	for i, p := range oldState.ProcessInstances {
+		if p.ProcessID == t.ProcessID && p.NodeID == t.NodeID {
+			return []byte(fmt.Sprintf(`[{
+				"op": "add",
+				"path": "/process_instances/%d/revision",
+				"value": %d
+			}]`, i, t.Revision)), nil
+		}
+	}
+
+	return nil, fmt.Errorf("process instance with matching process and node IDs not found")
+}
+
+func (t *UpdateProcessInstanceTransition) Validate(oldState *community.CommunityState) error {
+	err := checkSchemaVersion(oldState, 4, "process revisions")
+	if err != nil {
+		return err
+	}
+
+	instance := oldState.GetProcessInstance(t.ProcessID, t.NodeID)
+	if instance == nil {
+		return fmt.Errorf("process instance with matching process and node IDs not found")
+	}
+
+	process := oldState.GetProcess(t.ProcessID)
+	if process == nil {
+		return fmt.Errorf("process ID %s not found in processes list", t.ProcessID)
+	}
+	if t.Revision > process.Revision {
+		return fmt.Errorf("process %s is only at revision %d", t.ProcessID, process.Revision)
+	}
+	if t.Revision <= instance.Revision {
+		return fmt.Errorf("instance of process %s on node %s is already at revision %d", t.ProcessID, t.NodeID, instance.Revision)
+	}
+
+	return nil
+}
+
+// ReportInstanceStatusTransition is proposed by a node when one of its process instances starts,
+// fails, or is restarted
+type ReportInstanceStatusTransition struct {
+	ProcessID string
+	NodeID    string
+	Status    string
+	Error     string
+	Restarted bool  // counts towards the instance's restarts
+	UpdatedAt int64 // seconds since the Unix epoch
+}
+
+func (t *ReportInstanceStatusTransition) Type() string {
+	return TransitionTypeReportInstanceStatus
+}
+
+// RequiredRole lets any member report on their own nodes' instances
+func (t *ReportInstanceStatusTransition) RequiredRole() string {
+	return community.RoleGuest
+}
+
+func (t *ReportInstanceStatusTransition) OwnerMemberID(oldState *community.CommunityState) string {
+	return nodeOwner(oldState, t.NodeID)
+}
+
+func (t *ReportInstanceStatusTransition) Patch(oldState *community.CommunityState) ([]byte, error) {
+	for i, p := range oldState.ProcessInstances {
+		if p.ProcessID == t.ProcessID && p.NodeID == t.NodeID {
+			reported := *p
+			reported.Status = t.Status
+			reported.LastError = t.Error
+			reported.UpdatedAt = t.UpdatedAt
+			if t.Restarted {
+				reported.RestartCount++
+			}
+
+			marshaledInstance, err := json.Marshal(&reported)
+			if err != nil {
+				return nil, err
+			}
+
+			return []byte(fmt.Sprintf(`[{
+				"op": "replace",
+				"path": "/process_instances/%d",
+				"value": %s
+			}]`, i, string(marshaledInstance))), nil
+		}
+	}
+
+	return nil, fmt.Errorf("process instance with matching process and node IDs not found")
+}
+
+func (t *ReportInstanceStatusTransition) Validate(oldState *community.CommunityState) error {
+	err := checkSchemaVersion(oldState, 6, "process instance statuses")
+	if err != nil {
+		return err
+	}
+
+	if !community.ValidInstanceStatus(t.Status) {
+		return fmt.Errorf("%s is not a valid process instance status", t.Status)
+	}
+
+	if oldState.GetProcessInstance(t.ProcessID, t.NodeID) == nil {
+		return fmt.Errorf("process instance with matching process and node IDs not found")
+	}
+	return nil
+}
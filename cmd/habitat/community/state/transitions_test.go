@@ -33,7 +33,7 @@ func testTransitions(oldState *community.CommunityState, transitions []Community
 			return nil, err
 		}
 
-		jsonState, err := NewJSONState(community.CommunityStateSchema, marshaledState)
+		jsonState, err := NewCommunityJSONState(marshaledState)
 		if err != nil {
 			return nil, err
 		}
@@ -272,3 +272,618 @@ func TestProcessManagement(t *testing.T) {
 	assert.Nil(t, err)
 	assert.Equal(t, 1, len(state.Processes))
 }
+
+func TestMemberNodeRemoval(t *testing.T) {
+	node1 := &community.Node{
+		ID:          "node1",
+		MemberID:    "jorts",
+		Certificate: []byte("mycert"),
+	}
+	node2 := &community.Node{
+		ID:          "node2",
+		MemberID:    "jorts",
+		Certificate: []byte("mycert"),
+	}
+	transitions := []CommunityStateTransition{
+		&InitializeCommunityTransition{
+			CommunityID: "abc",
+		},
+		&AddMemberTransition{
+			Member: &community.Member{
+				ID:          "jorts",
+				Certificate: []byte("mycert"),
+			},
+		},
+		&AddNodeTransition{
+			Node: node1,
+		},
+		&AddNodeTransition{
+			Node: node2,
+		},
+		&StartProcessTransition{
+			Process: &community.Process{
+				ID:      "proc1",
+				AppName: "app1",
+				Args:    []string{},
+				Env:     []string{},
+				Flags:   []string{},
+			},
+		},
+		&StartProcessTransition{
+			Process: &community.Process{
+				ID:      "proc2",
+				AppName: "app2",
+				Args:    []string{},
+				Env:     []string{},
+				Flags:   []string{},
+			},
+		},
+		&StartProcessInstanceTransition{
+			ProcessInstance: &community.ProcessInstance{
+				ProcessID: "proc1",
+				NodeID:    "node1",
+			},
+		},
+		&StartProcessInstanceTransition{
+			ProcessInstance: &community.ProcessInstance{
+				ProcessID: "proc1",
+				NodeID:    "node2",
+			},
+		},
+		&StartProcessInstanceTransition{
+			ProcessInstance: &community.ProcessInstance{
+				ProcessID: "proc2",
+				NodeID:    "node1",
+			},
+		},
+	}
+	state, err := testTransitions(nil, transitions)
+	assert.Nil(t, err)
+	assert.Equal(t, 3, len(state.ProcessInstances))
+
+	// try removing a member that still has nodes
+	_, err = testTransitionsOnCopy(state, []CommunityStateTransition{
+		&RemoveMemberTransition{
+			MemberID: "jorts",
+		},
+	})
+	assert.NotNil(t, err)
+
+	// try removing a node that does not exist
+	_, err = testTransitionsOnCopy(state, []CommunityStateTransition{
+		&RemoveNodeTransition{
+			Node: &community.Node{
+				ID: "node3",
+			},
+		},
+	})
+	assert.NotNil(t, err)
+
+	// removing node1 should also remove both of its process instances
+	state, err = testTransitions(state, []CommunityStateTransition{
+		&RemoveNodeTransition{
+			Node: node1,
+		},
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(state.Nodes))
+	assert.Equal(t, 1, len(state.ProcessInstances))
+	assert.Equal(t, "node2", state.ProcessInstances[0].NodeID)
+	assert.Equal(t, 2, len(state.Processes))
+
+	state, err = testTransitions(state, []CommunityStateTransition{
+		&RemoveNodeTransition{
+			Node: node2,
+		},
+		&RemoveMemberTransition{
+			MemberID: "jorts",
+		},
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(state.Members))
+	assert.Equal(t, 0, len(state.Nodes))
+	assert.Equal(t, 0, len(state.ProcessInstances))
+}
+
+func TestRoleTransitions(t *testing.T) {
+	transitions := []CommunityStateTransition{
+		&InitializeCommunityTransition{
+			CommunityID: "abc",
+		},
+		&AddMemberTransition{
+			Member: &community.Member{
+				ID:          "jorts",
+				Username:    "jorts",
+				Certificate: []byte("mycert"),
+				Role:        community.RoleAdmin,
+			},
+		},
+		&AddMemberTransition{
+			Member: &community.Member{
+				ID:          "jean",
+				Username:    "jean",
+				Certificate: []byte("mycert"),
+			},
+		},
+	}
+	state, err := testTransitions(nil, transitions)
+	assert.Nil(t, err)
+
+	// invalid roles are rejected
+	_, err = testTransitionsOnCopy(state, []CommunityStateTransition{
+		&GrantRoleTransition{
+			MemberID: "jean",
+			Role:     "superuser",
+		},
+	})
+	assert.NotNil(t, err)
+
+	// the last admin can't be demoted
+	_, err = testTransitionsOnCopy(state, []CommunityStateTransition{
+		&RevokeRoleTransition{
+			MemberID: "jorts",
+			Role:     community.RoleAdmin,
+		},
+	})
+	assert.NotNil(t, err)
+
+	// a role the member doesn't have can't be revoked
+	_, err = testTransitionsOnCopy(state, []CommunityStateTransition{
+		&RevokeRoleTransition{
+			MemberID: "jean",
+			Role:     community.RoleAdmin,
+		},
+	})
+	assert.NotNil(t, err)
+
+	state, err = testTransitions(state, []CommunityStateTransition{
+		&GrantRoleTransition{
+			MemberID: "jean",
+			Role:     community.RoleAdmin,
+		},
+		&RevokeRoleTransition{
+			MemberID: "jorts",
+			Role:     community.RoleAdmin,
+		},
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, community.RoleAdmin, state.GetMember("jean").GetRole())
+	assert.Equal(t, community.RoleMember, state.GetMember("jorts").GetRole())
+}
+
+func TestSetRaftConfig(t *testing.T) {
+	state, err := testTransitions(nil, []CommunityStateTransition{
+		&InitializeCommunityTransition{
+			CommunityID: "abc",
+		},
+	})
+	assert.Nil(t, err)
+	assert.Nil(t, state.RaftConfig)
+
+	// raft_config was added in schema version 3
+	_, err = testTransitionsOnCopy(state, []CommunityStateTransition{
+		&SetRaftConfigTransition{
+			RaftConfig: &community.RaftConfig{},
+		},
+	})
+	assert.NotNil(t, err)
+
+	state, err = testTransitions(state, []CommunityStateTransition{
+		&MigrateSchemaTransition{
+			ToVersion: 3,
+		},
+		&SetRaftConfigTransition{
+			RaftConfig: &community.RaftConfig{
+				HeartbeatTimeoutMs: 2000,
+				ElectionTimeoutMs:  2000,
+				TrailingLogs:       64,
+			},
+		},
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, int64(2000), state.RaftConfig.HeartbeatTimeoutMs)
+	assert.Equal(t, uint64(64), state.RaftConfig.TrailingLogs)
+
+	// the settings are replaced as a whole
+	state, err = testTransitions(state, []CommunityStateTransition{
+		&SetRaftConfigTransition{
+			RaftConfig: &community.RaftConfig{
+				SnapshotThreshold: 16,
+			},
+		},
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, &community.RaftConfig{SnapshotThreshold: 16}, state.RaftConfig)
+
+	invalid := []*community.RaftConfig{
+		nil,
+		{HeartbeatTimeoutMs: -1},
+		{HeartbeatTimeoutMs: 100}, // below the leader lease timeout
+		{HeartbeatTimeoutMs: 2000, ElectionTimeoutMs: 1500}, // elections must not time out before heartbeats
+		{SnapshotIntervalMs: 1},
+	}
+	for _, c := range invalid {
+		_, err = testTransitionsOnCopy(state, []CommunityStateTransition{
+			&SetRaftConfigTransition{
+				RaftConfig: c,
+			},
+		})
+		assert.NotNil(t, err)
+	}
+
+	assert.Equal(t, community.RoleAdmin, (&SetRaftConfigTransition{}).RequiredRole())
+}
+
+func TestUpdateProcess(t *testing.T) {
+	state, err := testTransitions(nil, []CommunityStateTransition{
+		&InitializeCommunityTransition{
+			CommunityID: "abc",
+		},
+		&AddMemberTransition{
+			Member: &community.Member{
+				ID:          "jorts",
+				Certificate: []byte("mycert"),
+			},
+		},
+		&AddNodeTransition{
+			Node: &community.Node{
+				ID:          "node1",
+				MemberID:    "jorts",
+				Certificate: []byte("mycert"),
+			},
+		},
+		&AddNodeTransition{
+			Node: &community.Node{
+				ID:          "node2",
+				MemberID:    "jorts",
+				Certificate: []byte("mycert"),
+			},
+		},
+		&StartProcessTransition{
+			Process: &community.Process{
+				ID:      "proc1",
+				AppName: "app1",
+				Args:    []string{},
+				Env:     []string{},
+				Flags:   []string{},
+			},
+		},
+		&StartProcessInstanceTransition{
+			ProcessInstance: &community.ProcessInstance{
+				ProcessID: "proc1",
+				NodeID:    "node1",
+			},
+		},
+	})
+	assert.Nil(t, err)
+
+	// revisions were added in schema version 4
+	update := &UpdateProcessTransition{
+		Process: &community.Process{
+			ID:      "proc1",
+			AppName: "app1",
+			Args:    []string{"serve"},
+			Env:     []string{"PORT=8080"},
+			Flags:   []string{},
+		},
+		Rolling: true,
+	}
+	_, err = testTransitionsOnCopy(state, []CommunityStateTransition{update})
+	assert.NotNil(t, err)
+
+	state, err = testTransitions(state, []CommunityStateTransition{
+		&MigrateSchemaTransition{
+			ToVersion: 4,
+		},
+		&UpdateProcessTransition{
+			Process: &community.Process{
+				ID:      "proc1",
+				AppName: "app1",
+				Args:    []string{"serve"},
+				Env:     []string{"PORT=8080"},
+				Flags:   []string{},
+			},
+			Rolling: true,
+		},
+	})
+	assert.Nil(t, err)
+	process := state.GetProcess("proc1")
+	assert.Equal(t, []string{"serve"}, process.Args)
+	assert.Equal(t, uint64(1), process.Revision)
+	assert.True(t, process.RollingUpdate)
+	assert.Equal(t, uint64(0), state.GetProcessInstance("proc1", "node1").Revision)
+
+	// instances started after an update run the latest revision
+	state, err = testTransitions(state, []CommunityStateTransition{
+		&StartProcessInstanceTransition{
+			ProcessInstance: &community.ProcessInstance{
+				ProcessID: "proc1",
+				NodeID:    "node2",
+			},
+		},
+		&UpdateProcessInstanceTransition{
+			ProcessID: "proc1",
+			NodeID:    "node1",
+			Revision:  1,
+		},
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(1), state.GetProcessInstance("proc1", "node1").Revision)
+	assert.Equal(t, uint64(1), state.GetProcessInstance("proc1", "node2").Revision)
+
+	invalid := []CommunityStateTransition{
+		// the app can't be changed
+		&UpdateProcessTransition{
+			Process: &community.Process{
+				ID:      "proc1",
+				AppName: "app2",
+			},
+		},
+		&UpdateProcessTransition{
+			Process: &community.Process{
+				ID:      "proc2",
+				AppName: "app1",
+			},
+		},
+		// instances can't move past the process's revision, or back to one they already ran
+		&UpdateProcessInstanceTransition{
+			ProcessID: "proc1",
+			NodeID:    "node1",
+			Revision:  2,
+		},
+		&UpdateProcessInstanceTransition{
+			ProcessID: "proc1",
+			NodeID:    "node1",
+			Revision:  1,
+		},
+		&UpdateProcessInstanceTransition{
+			ProcessID: "proc1",
+			NodeID:    "node3",
+			Revision:  1,
+		},
+	}
+	for _, transition := range invalid {
+		_, err = testTransitionsOnCopy(state, []CommunityStateTransition{transition})
+		assert.NotNil(t, err)
+	}
+}
+
+func TestReportInstanceStatus(t *testing.T) {
+	state, err := testTransitions(nil, []CommunityStateTransition{
+		&InitializeCommunityTransition{
+			CommunityID: "abc",
+		},
+		&AddMemberTransition{
+			Member: &community.Member{
+				ID:          "jorts",
+				Certificate: []byte("mycert"),
+			},
+		},
+		&AddNodeTransition{
+			Node: &community.Node{
+				ID:          "node1",
+				MemberID:    "jorts",
+				Certificate: []byte("mycert"),
+			},
+		},
+		&StartProcessTransition{
+			Process: &community.Process{
+				ID:      "proc1",
+				AppName: "app1",
+				Args:    []string{},
+				Env:     []string{},
+				Flags:   []string{},
+			},
+		},
+		&StartProcessInstanceTransition{
+			ProcessInstance: &community.ProcessInstance{
+				ProcessID: "proc1",
+				NodeID:    "node1",
+			},
+		},
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, community.InstanceStatusPending, state.GetProcessInstance("proc1", "node1").GetStatus())
+
+	report := &ReportInstanceStatusTransition{
+		ProcessID: "proc1",
+		NodeID:    "node1",
+		Status:    community.InstanceStatusFailed,
+		Error:     "exit status 1",
+		UpdatedAt: 100,
+	}
+
+	// statuses were added in schema version 6
+	_, err = testTransitionsOnCopy(state, []CommunityStateTransition{report})
+	assert.NotNil(t, err)
+
+	state, err = testTransitions(state, []CommunityStateTransition{
+		&MigrateSchemaTransition{
+			ToVersion: 6,
+		},
+		report,
+	})
+	assert.Nil(t, err)
+	instance := state.GetProcessInstance("proc1", "node1")
+	assert.Equal(t, community.InstanceStatusFailed, instance.Status)
+	assert.Equal(t, "exit status 1", instance.LastError)
+	assert.Equal(t, int64(100), instance.UpdatedAt)
+	assert.Equal(t, 0, instance.RestartCount)
+
+	// restarts are counted, and the error is cleared once the instance is running again
+	state, err = testTransitions(state, []CommunityStateTransition{
+		&ReportInstanceStatusTransition{
+			ProcessID: "proc1",
+			NodeID:    "node1",
+			Status:    community.InstanceStatusRunning,
+			Restarted: true,
+			UpdatedAt: 130,
+		},
+	})
+	assert.Nil(t, err)
+	instance = state.GetProcessInstance("proc1", "node1")
+	assert.Equal(t, community.InstanceStatusRunning, instance.Status)
+	assert.Equal(t, "", instance.LastError)
+	assert.Equal(t, int64(130), instance.UpdatedAt)
+	assert.Equal(t, 1, instance.RestartCount)
+	assert.Equal(t, "app1", state.GetProcess("proc1").AppName)
+
+	invalid := []CommunityStateTransition{
+		&ReportInstanceStatusTransition{
+			ProcessID: "proc1",
+			NodeID:    "node1",
+			Status:    "crashed",
+		},
+		&ReportInstanceStatusTransition{
+			ProcessID: "proc1",
+			NodeID:    "node2",
+			Status:    community.InstanceStatusRunning,
+		},
+		&ReportInstanceStatusTransition{
+			ProcessID: "proc2",
+			NodeID:    "node1",
+			Status:    community.InstanceStatusRunning,
+		},
+	}
+	for _, transition := range invalid {
+		_, err = testTransitionsOnCopy(state, []CommunityStateTransition{transition})
+		assert.NotNil(t, err)
+	}
+}
+
+func TestSetNodeLabels(t *testing.T) {
+	state, err := testTransitions(nil, []CommunityStateTransition{
+		&InitializeCommunityTransition{
+			CommunityID: "abc",
+		},
+		&AddMemberTransition{
+			Member: &community.Member{
+				ID:          "jorts",
+				Certificate: []byte("mycert"),
+			},
+		},
+		&AddNodeTransition{
+			Node: &community.Node{
+				ID:          "node1",
+				MemberID:    "jorts",
+				Certificate: []byte("mycert"),
+			},
+		},
+	})
+	assert.Nil(t, err)
+
+	// labels were added in schema version 5
+	_, err = testTransitionsOnCopy(state, []CommunityStateTransition{
+		&SetNodeLabelsTransition{
+			NodeID: "node1",
+			Labels: map[string]string{"region": "eu"},
+		},
+	})
+	assert.NotNil(t, err)
+
+	state, err = testTransitions(state, []CommunityStateTransition{
+		&MigrateSchemaTransition{
+			ToVersion: 5,
+		},
+		&SetNodeLabelsTransition{
+			NodeID: "node1",
+			Labels: map[string]string{"region": "eu"},
+		},
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]string{"region": "eu"}, state.GetNode("node1").Labels)
+
+	// labels are replaced as a whole
+	state, err = testTransitions(state, []CommunityStateTransition{
+		&SetNodeLabelsTransition{
+			NodeID: "node1",
+			Labels: map[string]string{"gpu": "true"},
+		},
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]string{"gpu": "true"}, state.GetNode("node1").Labels)
+
+	_, err = testTransitionsOnCopy(state, []CommunityStateTransition{
+		&SetNodeLabelsTransition{
+			NodeID: "node2",
+			Labels: map[string]string{},
+		},
+	})
+	assert.NotNil(t, err)
+}
+
+func TestRemoveNodeReschedules(t *testing.T) {
+	node := func(id, memberID string) *community.Node {
+		return &community.Node{
+			ID:          id,
+			MemberID:    memberID,
+			Certificate: []byte("mycert"),
+		}
+	}
+	process := func(id string, placement *community.Placement) *community.Process {
+		return &community.Process{
+			ID:        id,
+			AppName:   id,
+			Args:      []string{},
+			Env:       []string{},
+			Flags:     []string{},
+			Placement: placement,
+		}
+	}
+
+	state, err := testTransitions(nil, []CommunityStateTransition{
+		&InitializeCommunityTransition{
+			CommunityID: "abc",
+		},
+		&AddMemberTransition{
+			Member: &community.Member{
+				ID:          "alice",
+				Certificate: []byte("mycert"),
+			},
+		},
+		&AddMemberTransition{
+			Member: &community.Member{
+				ID:          "bob",
+				Certificate: []byte("mycert"),
+			},
+		},
+		&AddNodeTransition{Node: node("node1", "alice")},
+		&AddNodeTransition{Node: node("node2", "bob")},
+		&AddNodeTransition{Node: node("node3", "bob")},
+	})
+	assert.Nil(t, err)
+
+	// placements were added in schema version 5
+	_, err = testTransitionsOnCopy(state, []CommunityStateTransition{
+		&StartProcessTransition{Process: process("proc1", &community.Placement{Replicas: 2})},
+	})
+	assert.NotNil(t, err)
+
+	state, err = testTransitions(state, []CommunityStateTransition{
+		&MigrateSchemaTransition{ToVersion: 5},
+		&StartProcessTransition{Process: process("proc1", &community.Placement{Replicas: 2})},
+		&StartProcessInstanceTransition{ProcessInstance: &community.ProcessInstance{ProcessID: "proc1", NodeID: "node1"}},
+		&StartProcessInstanceTransition{ProcessInstance: &community.ProcessInstance{ProcessID: "proc1", NodeID: "node2"}},
+		&StartProcessTransition{Process: process("proc2", nil)},
+		&StartProcessInstanceTransition{ProcessInstance: &community.ProcessInstance{ProcessID: "proc2", NodeID: "node1"}},
+	})
+	assert.Nil(t, err)
+
+	// the scheduled process gets a replacement instance, but the unscheduled one doesn't
+	state, err = testTransitions(state, []CommunityStateTransition{
+		&RemoveNodeTransition{Node: node("node1", "alice")},
+	})
+	assert.Nil(t, err)
+	assert.Len(t, state.ProcessInstances, 2)
+	assert.NotNil(t, state.GetProcessInstance("proc1", "node2"))
+	assert.NotNil(t, state.GetProcessInstance("proc1", "node3"))
+	assert.Equal(t, community.InstanceStatusPending, state.GetProcessInstance("proc1", "node3").GetStatus())
+
+	// replicas that can't be placed anywhere are left missing
+	state, err = testTransitions(state, []CommunityStateTransition{
+		&RemoveNodeTransition{Node: node("node2", "bob")},
+	})
+	assert.Nil(t, err)
+	assert.Len(t, state.ProcessInstances, 1)
+	assert.NotNil(t, state.GetProcessInstance("proc1", "node3"))
+}
@@ -0,0 +1,112 @@
+package state
+
+import (
+	"errors"
+	"sync"
+)
+
+const (
+	// MaxRecentUpdates is how many state updates are kept in memory for watchers to resume from
+	MaxRecentUpdates = 1000
+
+	// watcherBufferSize is how many updates a watcher can fall behind by before it is dropped
+	watcherBufferSize = 64
+)
+
+// ErrResumeIndexTooOld is returned when a watcher asks to resume from an index whose updates
+// are no longer kept. The watcher should fetch the current state and watch from its version.
+var ErrResumeIndexTooOld = errors.New("state updates from the requested index are no longer available")
+
+// updateWatchers fans state updates out to any number of watchers
+type updateWatchers struct {
+	recent   []StateUpdate
+	watchers map[chan StateUpdate]bool
+
+	*sync.Mutex
+}
+
+func newUpdateWatchers() *updateWatchers {
+	return &updateWatchers{
+		recent:   make([]StateUpdate, 0),
+		watchers: make(map[chan StateUpdate]bool),
+		Mutex:    &sync.Mutex{},
+	}
+}
+
+// publish sends an update to every watcher without blocking. Watchers that have fallen too far
+// behind are dropped by closing their channel, and can resume from the last index they received.
+func (w *updateWatchers) publish(update StateUpdate) {
+	w.Lock()
+	defer w.Unlock()
+
+	w.recent = append(w.recent, update)
+	if len(w.recent) > MaxRecentUpdates {
+		// trim whole batches, so that resuming from an index always gets all of its updates
+		trim := len(w.recent) - MaxRecentUpdates
+		for trim < len(w.recent) && w.recent[trim].Index == w.recent[trim-1].Index {
+			trim++
+		}
+		w.recent = append([]StateUpdate{}, w.recent[trim:]...)
+	}
+
+	for ch := range w.watchers {
+		select {
+		case ch <- update:
+		default:
+			delete(w.watchers, ch)
+			close(ch)
+		}
+	}
+}
+
+// watch registers a new watcher, which first receives the kept updates with an index of at least
+// fromIndex. A fromIndex of 0 only watches for new updates. currentIndex is the index of the
+// latest update applied to the state.
+func (w *updateWatchers) watch(fromIndex, currentIndex uint64) (<-chan StateUpdate, func(), error) {
+	w.Lock()
+	defer w.Unlock()
+
+	replay := make([]StateUpdate, 0)
+	if fromIndex != 0 {
+		if len(w.recent) == 0 && fromIndex <= currentIndex {
+			return nil, nil, ErrResumeIndexTooOld
+		} else if len(w.recent) != 0 && w.recent[0].Index > fromIndex {
+			return nil, nil, ErrResumeIndexTooOld
+		}
+
+		for _, u := range w.recent {
+			if u.Index >= fromIndex {
+				replay = append(replay, u)
+			}
+		}
+	}
+
+	ch := make(chan StateUpdate, len(replay)+watcherBufferSize)
+	for _, u := range replay {
+		ch <- u
+	}
+	w.watchers[ch] = true
+
+	cancel := func() {
+		w.Lock()
+		defer w.Unlock()
+
+		if _, ok := w.watchers[ch]; ok {
+			delete(w.watchers, ch)
+			close(ch)
+		}
+	}
+
+	return ch, cancel, nil
+}
+
+// closeAll drops every watcher
+func (w *updateWatchers) closeAll() {
+	w.Lock()
+	defer w.Unlock()
+
+	for ch := range w.watchers {
+		delete(w.watchers, ch)
+		close(ch)
+	}
+}
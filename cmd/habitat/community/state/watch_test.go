@@ -0,0 +1,52 @@
+package state
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUpdateWatchers(t *testing.T) {
+	w := newUpdateWatchers()
+
+	live, cancel, err := w.watch(0, 0)
+	require.Nil(t, err)
+
+	w.publish(StateUpdate{Index: 3, TransitionType: TransitionTypeInitializeCommunity})
+	w.publish(StateUpdate{Index: 3, TransitionType: TransitionTypeAddMember})
+	w.publish(StateUpdate{Index: 5, TransitionType: TransitionTypeStartProcess})
+
+	assert.Equal(t, uint64(3), (<-live).Index)
+	assert.Equal(t, uint64(3), (<-live).Index)
+	assert.Equal(t, uint64(5), (<-live).Index)
+
+	cancel()
+	_, ok := <-live
+	assert.False(t, ok)
+
+	// resuming replays every update from the index on
+	resumed, cancel, err := w.watch(4, 5)
+	require.Nil(t, err)
+	defer cancel()
+	u := <-resumed
+	assert.Equal(t, TransitionTypeStartProcess, u.TransitionType)
+
+	// updates older than what is kept can't be resumed from
+	_, _, err = w.watch(2, 5)
+	assert.Equal(t, ErrResumeIndexTooOld, err)
+	_, _, err = newUpdateWatchers().watch(2, 5)
+	assert.Equal(t, ErrResumeIndexTooOld, err)
+
+	// slow watchers are dropped instead of blocking the state machine
+	slow, _, err := w.watch(0, 5)
+	require.Nil(t, err)
+	for i := 0; i < watcherBufferSize+1; i++ {
+		w.publish(StateUpdate{Index: uint64(6 + i)})
+	}
+	count := 0
+	for range slow {
+		count++
+	}
+	assert.Equal(t, watcherBufferSize, count)
+}
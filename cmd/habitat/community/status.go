@@ -0,0 +1,70 @@
+package community
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/eagraf/habitat/cmd/habitat/community/state"
+	"github.com/eagraf/habitat/cmd/habitat/procs"
+	"github.com/eagraf/habitat/structs/community"
+	"github.com/rs/zerolog/log"
+)
+
+// ReportInstanceStatus proposes the status of this node's instance of a process, so that the rest
+// of the community can see whether it is running. Nothing is proposed if the instance isn't
+// assigned to this node, if its status and error haven't changed and it wasn't restarted, or if
+// the community hasn't been migrated to a schema version with instance statuses.
+func (m *Manager) ReportInstanceStatus(communityID, processID, status string, instanceErr error, restarted bool) error {
+	m.communitiesLock.Lock()
+	stateMachine, ok := m.communities[communityID]
+	m.communitiesLock.Unlock()
+	if !ok {
+		return fmt.Errorf("community %s is not on this instance", communityID)
+	}
+
+	curState, err := stateMachine.State()
+	if err != nil {
+		return err
+	}
+
+	instance := curState.GetProcessInstance(processID, m.node.ID)
+	if instance == nil || curState.GetSchemaVersion() < 6 {
+		return nil
+	}
+
+	lastError := ""
+	if instanceErr != nil {
+		lastError = instanceErr.Error()
+	}
+	if instance.Status == status && instance.LastError == lastError && !restarted {
+		return nil
+	}
+
+	transitions := []state.CommunityStateTransition{
+		&state.ReportInstanceStatusTransition{
+			ProcessID: processID,
+			NodeID:    m.node.ID,
+			Status:    status,
+			Error:     lastError,
+			Restarted: restarted,
+			UpdatedAt: time.Now().Unix(),
+		},
+	}
+	_, err = stateMachine.ProposeTransitions(transitions)
+	return err
+}
+
+// reportProcessExit reports a community process instance that exited with an error as failed.
+// The reconciler restarts it later.
+func (m *Manager) reportProcessExit(proc *procs.Proc, err error) {
+	if proc.CommunityID == "" {
+		return
+	}
+
+	go func() {
+		reportErr := m.ReportInstanceStatus(proc.CommunityID, proc.ProcessID, community.InstanceStatusFailed, err, false)
+		if reportErr != nil {
+			log.Error().Err(reportErr).Msgf("error reporting exit of process %s", proc.Name)
+		}
+	}()
+}
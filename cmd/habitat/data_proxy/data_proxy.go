@@ -272,6 +272,18 @@ func (s *DataProxy) AddPeerNode(maddr string) error {
 	return nil
 }
 
+func (s *DataProxy) RemovePeerNode(maddr string) error {
+	id, _, err := compass.DecomposeNodeMultiaddr(maddr)
+	if err != nil {
+		return err
+	}
+	if _, ok := s.peers[id.String()]; !ok {
+		return fmt.Errorf("data proxy peer node %s not found", id.Pretty())
+	}
+	delete(s.peers, id.String())
+	return nil
+}
+
 func (s *DataProxy) Serve(ctx context.Context, addr string) {
 
 	r := mux.NewRouter()
@@ -0,0 +1,370 @@
+// Package harness runs several full habitat node stacks in one process, connected over a libp2p
+// mock network, so that multi-node community behaviour can be tested without docker.
+package harness
+
+import (
+	"bytes"
+	"context"
+	"encoding/pem"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/eagraf/habitat/cmd/habitat/community"
+	"github.com/eagraf/habitat/cmd/habitat/community/consensus/cluster"
+	"github.com/eagraf/habitat/cmd/habitat/community/consensus/local"
+	"github.com/eagraf/habitat/cmd/habitat/community/consensus/raft"
+	dataproxy "github.com/eagraf/habitat/cmd/habitat/data_proxy"
+	"github.com/eagraf/habitat/cmd/habitat/node"
+	"github.com/eagraf/habitat/cmd/habitat/procs"
+	"github.com/eagraf/habitat/cmd/habitat/proxy"
+	"github.com/eagraf/habitat/pkg/compass"
+	"github.com/eagraf/habitat/pkg/identity"
+	"github.com/eagraf/habitat/pkg/ipfs"
+	"github.com/eagraf/habitat/pkg/p2p"
+	commstructs "github.com/eagraf/habitat/structs/community"
+	"github.com/libp2p/go-libp2p/core/host"
+	mocknet "github.com/libp2p/go-libp2p/p2p/net/mock"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	// unreachableIPFSAPIURL stands in for the IPFS daemon every node would normally run
+	unreachableIPFSAPIURL = "http://127.0.0.1:1/api/v0"
+
+	// DefaultWaitTimeout is how long the harness waits for a cluster to converge
+	DefaultWaitTimeout = 15 * time.Second
+	waitInterval       = 50 * time.Millisecond
+)
+
+// Node is a single habitat node stack running in the harness
+type Node struct {
+	Index int
+	Path  string
+
+	Host    host.Host
+	Node    *node.Node
+	Manager *community.Manager
+
+	// Member and CommunityNode identify this node when it creates or joins a community
+	Member        *commstructs.Member
+	CommunityNode *commstructs.Node
+}
+
+// P2PID returns the node's libp2p peer ID, which is also its Raft server ID
+func (n *Node) P2PID() string {
+	return n.Host.ID().Pretty()
+}
+
+// Cluster is a set of nodes that can all reach each other over a mock network
+type Cluster struct {
+	Nodes []*Node
+
+	t   testing.TB
+	net mocknet.Mocknet
+}
+
+// New starts size nodes under a temporary HABITAT_PATH, and connects them to each other. Every
+// node is stopped when the test finishes.
+func New(t testing.TB, size int) *Cluster {
+	root := t.TempDir()
+	t.Setenv("HABITAT_PATH", root)
+
+	// nothing should reach out to the real network
+	prevResolver := compass.SetIPResolver(&compass.StaticIPResolver{
+		Local:  net.ParseIP("127.0.0.1"),
+		Public: net.ParseIP("127.0.0.1"),
+	})
+	t.Cleanup(func() {
+		compass.SetIPResolver(prevResolver)
+	})
+
+	c := &Cluster{
+		Nodes: make([]*Node, 0, size),
+		t:     t,
+		net:   mocknet.New(),
+	}
+	t.Cleanup(c.Close)
+
+	hosts := make([]host.Host, size)
+	for i := range hosts {
+		h, err := c.net.GenPeer()
+		require.Nil(t, err)
+		hosts[i] = h
+	}
+
+	require.Nil(t, c.net.LinkAll())
+	require.Nil(t, c.net.ConnectAllButSelf())
+
+	// generating node keys is slow, so do it for every node at once
+	identities := make([]*nodeIdentity, size)
+	errs := make([]error, size)
+	var wg sync.WaitGroup
+	for i := range identities {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			identities[i], errs[i] = newNodeIdentity(fmt.Sprintf("user%d", i), fmt.Sprintf("node%d", i))
+		}(i)
+	}
+	wg.Wait()
+
+	for i, h := range hosts {
+		require.Nil(t, errs[i])
+		c.Nodes = append(c.Nodes, c.startNode(i, h, identities[i], filepath.Join(root, "nodes", fmt.Sprintf("node%d", i))))
+	}
+
+	return c
+}
+
+// startNode builds a full node stack around a host on the mock network
+func (c *Cluster) startNode(index int, h host.Host, ident *nodeIdentity, path string) *Node {
+	t := c.t
+
+	communitiesPath := filepath.Join(path, "communities")
+	procsPath := filepath.Join(path, "procs")
+	for _, dir := range []string{communitiesPath, procsPath} {
+		require.Nil(t, os.MkdirAll(dir, 0700))
+	}
+
+	nodeID := ident.node.ID
+	commNode := ident.node
+
+	p2pNode := p2p.NewNodeFromHost(h)
+	commNode.P2PID = h.ID().Pretty()
+	commNode.Address = p2pNode.ConstructMultiAddr()
+
+	ipfsClient, err := ipfs.NewClient(unreachableIPFSAPIURL)
+	require.Nil(t, err)
+
+	reverseProxy := proxy.NewServer()
+	habitatNode := &node.Node{
+		ID:             nodeID,
+		P2PNode:        p2pNode,
+		ReverseProxy:   reverseProxy,
+		DataProxy:      dataproxy.NewDataProxy(context.Background(), p2pNode, map[string]*dataproxy.DataServerNode{}),
+		ProcessManager: procs.NewManager(procsPath, reverseProxy.Rules),
+		IPFSClient:     ipfsClient,
+	}
+
+	raftService := raft.NewClusterServiceWithConfig(&raft.ClusterServiceConfig{
+		Host:            h,
+		NodeID:          nodeID,
+		CommunitiesPath: communitiesPath,
+		PublicAddr:      p2pNode.Addr(),
+	})
+	clusterManager := cluster.NewClusterManagerWithBackends(cluster.BackendRaft, map[string]cluster.ClusterService{
+		cluster.BackendRaft:  raftService,
+		cluster.BackendLocal: local.NewClusterService(communitiesPath),
+	})
+	require.Nil(t, clusterManager.Start(reverseProxy.Rules))
+
+	manager, err := community.NewManagerWithClusterManager(communitiesPath, habitatNode, clusterManager, ident.identity)
+	require.Nil(t, err)
+
+	return &Node{
+		Index:         index,
+		Path:          path,
+		Host:          h,
+		Node:          habitatNode,
+		Manager:       manager,
+		Member:        ident.member,
+		CommunityNode: commNode,
+	}
+}
+
+// nodeIdentity is a member with a single node, and the identity the node signs with
+type nodeIdentity struct {
+	member   *commstructs.Member
+	node     *commstructs.Node
+	identity *identity.MemberNodeIdentity
+}
+
+func newNodeIdentity(username, nodeID string) (*nodeIdentity, error) {
+	user, err := identity.GenerateNewUserCert(username, username+"_id")
+	if err != nil {
+		return nil, err
+	}
+
+	_, privKey, err := identity.GenerateMemberNodeKeypair()
+	if err != nil {
+		return nil, err
+	}
+
+	certBytes, err := identity.GenerateMemberNodeCertificate(nodeID, user, &privKey.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+
+	certPEM := new(bytes.Buffer)
+	err = pem.Encode(certPEM, &pem.Block{
+		Type:  "CERTIFICATE",
+		Bytes: certBytes,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &nodeIdentity{
+		member: &commstructs.Member{
+			ID:          user.UUID,
+			Username:    username,
+			Certificate: user.CertBytes,
+		},
+		node: &commstructs.Node{
+			ID:          nodeID,
+			MemberID:    user.UUID,
+			Certificate: certPEM.Bytes(),
+		},
+		identity: &identity.MemberNodeIdentity{
+			NodeID:  nodeID,
+			PrivKey: privKey,
+		},
+	}, nil
+}
+
+// CreateCommunity creates a community on the Raft backend, with the given node as its only node
+func (c *Cluster) CreateCommunity(creator int, name string) string {
+	n := c.Nodes[creator]
+
+	created, err := n.Manager.CreateCommunity(name, false, cluster.BackendRaft, n.Member, n.CommunityNode)
+	require.Nil(c.t, err)
+
+	return created.CommunityID
+}
+
+// Join adds a node to a community through a sponsoring node that is already part of it, the same
+// way the join handlers do over the network. It returns once the joining node has caught up with
+// the community's state.
+func (c *Cluster) Join(communityID string, sponsor, joiner int) {
+	s := c.Nodes[sponsor]
+	j := c.Nodes[joiner]
+
+	_, err := j.Manager.JoinCommunity("", "", nil, "", communityID)
+	require.Nil(c.t, err)
+
+	joined, err := s.Manager.AddJoiningNode(communityID, j.P2PID(), j.CommunityNode.Address, j.Member, j.CommunityNode)
+	require.Nil(c.t, err)
+
+	c.WaitForVersion(communityID, joined.Version, joiner)
+}
+
+// WaitForVersion waits until each of the given nodes, or every node if none are given,
+// has applied the community's state up to at least version
+func (c *Cluster) WaitForVersion(communityID string, version uint64, nodes ...int) {
+	if len(nodes) == 0 {
+		for _, n := range c.Nodes {
+			nodes = append(nodes, n.Index)
+		}
+	}
+
+	for _, i := range nodes {
+		require.Eventually(c.t, func() bool {
+			s, err := c.Nodes[i].Manager.GetState(communityID)
+			return err == nil && s.Version >= version
+		}, DefaultWaitTimeout, waitInterval, "node %d did not reach version %d of community %s", i, version, communityID)
+	}
+}
+
+// Leader returns the index of the node that the given node believes is the community's leader
+func (c *Cluster) Leader(communityID string, observer int) (int, bool) {
+	status, err := c.Nodes[observer].Manager.ClusterStatus(communityID)
+	if err != nil || status.LeaderID == "" {
+		return 0, false
+	}
+
+	for _, n := range c.Nodes {
+		if n.P2PID() == status.LeaderID {
+			return n.Index, true
+		}
+	}
+	return 0, false
+}
+
+// WaitForLeader waits until all of the given nodes agree on a leader for the community that is
+// not excluded, and returns it
+func (c *Cluster) WaitForLeader(communityID string, observers []int, excluded ...int) int {
+	leader := -1
+	require.Eventually(c.t, func() bool {
+		agreed := -1
+		for _, i := range observers {
+			l, ok := c.Leader(communityID, i)
+			if !ok || (agreed != -1 && l != agreed) {
+				return false
+			}
+			agreed = l
+		}
+		for _, e := range excluded {
+			if agreed == e {
+				return false
+			}
+		}
+
+		leader = agreed
+		return leader != -1
+	}, DefaultWaitTimeout, waitInterval, "nodes %v did not agree on a leader for community %s", observers, communityID)
+
+	return leader
+}
+
+// WaitForVoters waits until the given node sees count voters in the community's cluster
+func (c *Cluster) WaitForVoters(communityID string, observer, count int) {
+	require.Eventually(c.t, func() bool {
+		status, err := c.Nodes[observer].Manager.ClusterStatus(communityID)
+		if err != nil {
+			return false
+		}
+
+		voters := 0
+		for _, srv := range status.Servers {
+			if srv.Suffrage == "Voter" {
+				voters++
+			}
+		}
+		return voters == count
+	}, DefaultWaitTimeout, waitInterval, "community %s did not reach %d voters", communityID, count)
+}
+
+// Disconnect cuts a node off from every other node, as if it had lost its network connection
+func (c *Cluster) Disconnect(i int) {
+	for _, other := range c.Nodes {
+		if other.Index == i {
+			continue
+		}
+
+		id, otherID := c.Nodes[i].Host.ID(), other.Host.ID()
+		require.Nil(c.t, c.net.UnlinkPeers(id, otherID))
+		require.Nil(c.t, c.net.DisconnectPeers(id, otherID))
+	}
+}
+
+// Reconnect restores a disconnected node's links to every other node
+func (c *Cluster) Reconnect(i int) {
+	for _, other := range c.Nodes {
+		if other.Index == i {
+			continue
+		}
+
+		id, otherID := c.Nodes[i].Host.ID(), other.Host.ID()
+		_, err := c.net.LinkPeers(id, otherID)
+		require.Nil(c.t, err)
+		_, err = c.net.ConnectPeers(id, otherID)
+		require.Nil(c.t, err)
+	}
+}
+
+// Close stops every node's communities, and shuts down the mock network
+func (c *Cluster) Close() {
+	for _, n := range c.Nodes {
+		err := n.Manager.Stop()
+		if err != nil {
+			c.t.Logf("error stopping node %d: %s", n.Index, err)
+		}
+	}
+
+	c.net.Close()
+}
@@ -0,0 +1,130 @@
+package harness
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/eagraf/habitat/cmd/habitat/community/consensus/raft"
+	"github.com/eagraf/habitat/structs/community"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMultiNodeJoin(t *testing.T) {
+	c := New(t, 3)
+
+	communityID := c.CreateCommunity(0, "test")
+	c.Join(communityID, 0, 1)
+	c.Join(communityID, 0, 2)
+
+	// a third node is enough to promote every node to a voter
+	c.WaitForVoters(communityID, 0, 3)
+
+	// node 2's member schedules a process with an instance on their own node
+	started, err := c.Nodes[2].Manager.StartProcess(communityID, &community.Process{
+		ID:      "proc1",
+		AppName: "app",
+		Args:    []string{},
+		Env:     []string{},
+		Flags:   []string{},
+	}, []string{c.Nodes[2].Node.ID})
+	require.Nil(t, err)
+	c.WaitForVersion(communityID, started.Version)
+
+	for _, n := range c.Nodes {
+		s, err := n.Manager.GetState(communityID)
+		require.Nil(t, err)
+
+		assert.Equal(t, 3, len(s.Members))
+		assert.Equal(t, 3, len(s.Nodes))
+		require.Equal(t, 1, len(s.ProcessInstances))
+		assert.Equal(t, c.Nodes[2].Node.ID, s.ProcessInstances[0].NodeID)
+	}
+}
+
+func TestLeaderFailover(t *testing.T) {
+	c := New(t, 3)
+
+	communityID := c.CreateCommunity(0, "test")
+	c.Join(communityID, 0, 1)
+	c.Join(communityID, 0, 2)
+	c.WaitForVoters(communityID, 0, 3)
+
+	leader, ok := c.Leader(communityID, 0)
+	require.True(t, ok)
+	assert.Equal(t, 0, leader)
+
+	// the remaining nodes elect a new leader among themselves
+	c.Disconnect(0)
+	newLeader := c.WaitForLeader(communityID, []int{1, 2}, 0)
+
+	// proposals keep being committed, from the leader and from followers
+	follower := 3 - newLeader
+	started, err := c.Nodes[follower].Manager.StartProcess(communityID, &community.Process{
+		ID:      "proc1",
+		AppName: "app",
+		Args:    []string{},
+		Env:     []string{},
+		Flags:   []string{},
+	}, []string{c.Nodes[follower].Node.ID})
+	require.Nil(t, err)
+	c.WaitForVersion(communityID, started.Version, 1, 2)
+
+	// the old leader steps down and catches up once it is back
+	c.Reconnect(0)
+	c.WaitForLeader(communityID, []int{0, 1, 2})
+	c.WaitForVersion(communityID, started.Version, 0)
+}
+
+func TestLeaderRemovesItself(t *testing.T) {
+	c := New(t, 3)
+
+	communityID := c.CreateCommunity(0, "test")
+	c.Join(communityID, 0, 1)
+	c.Join(communityID, 0, 2)
+	c.WaitForVoters(communityID, 0, 3)
+
+	removed, err := c.Nodes[0].Manager.RemoveNode(communityID, c.Nodes[0].Node.ID)
+	require.Nil(t, err)
+	c.WaitForVersion(communityID, removed.Version, 1, 2)
+
+	// the old leader takes itself out of the cluster, and the rest carry on without it
+	c.WaitForLeader(communityID, []int{1, 2}, 0)
+	require.Eventually(t, func() bool {
+		status, err := c.Nodes[1].Manager.ClusterStatus(communityID)
+		if err != nil {
+			return false
+		}
+		for _, srv := range status.Servers {
+			if srv.ID == c.Nodes[0].P2PID() {
+				return false
+			}
+		}
+		return len(status.Servers) == 2
+	}, DefaultWaitTimeout, waitInterval)
+}
+
+func TestForwardFromOutsideCluster(t *testing.T) {
+	c := New(t, 2)
+
+	communityID := c.CreateCommunity(0, "test")
+
+	// node 1 never joined, so the leader refuses to propose anything on its behalf
+	stream, err := c.Nodes[1].Host.NewStream(context.Background(), c.Nodes[0].Host.ID(), raft.ForwardProtocol)
+	require.Nil(t, err)
+	defer stream.Close()
+
+	err = json.NewEncoder(stream).Encode(map[string]interface{}{
+		"community_id": communityID,
+		"transitions":  []byte("[]"),
+	})
+	require.Nil(t, err)
+
+	var res struct {
+		Error string `json:"error"`
+	}
+	err = json.NewDecoder(stream).Decode(&res)
+	require.Nil(t, err)
+	assert.Contains(t, res.Error, "is not in the cluster")
+}
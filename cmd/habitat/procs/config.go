@@ -0,0 +1,56 @@
+package procs
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// AppConfigEnvVar holds the path to a process instance's config file in its environment
+const AppConfigEnvVar = "HABITAT_APP_CONFIG"
+
+// instanceDir returns the directory holding files this node manages for a process instance
+func (m *Manager) instanceDir(processInstanceID string) string {
+	return filepath.Join(m.ProcDir, "instances", processInstanceID)
+}
+
+// writeInstanceConfig renders a process's config into a JSON file at path. A process without a
+// config gets an empty object. The file is replaced in one step, so an app reloading it never
+// reads a partially written config.
+func writeInstanceConfig(path string, config interface{}) error {
+	if config == nil {
+		config = map[string]interface{}{}
+	}
+
+	marshaled, err := json.MarshalIndent(config, "", "    ")
+	if err != nil {
+		return fmt.Errorf("error encoding app config: %s", err)
+	}
+
+	err = os.MkdirAll(filepath.Dir(path), 0700)
+	if err != nil {
+		return err
+	}
+
+	tmpPath := path + ".tmp"
+	err = os.WriteFile(tmpPath, marshaled, 0600)
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmpPath, path)
+}
+
+// equalSettings returns true if two lists of args, env vars or flags are the same
+func equalSettings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
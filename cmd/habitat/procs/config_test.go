@@ -0,0 +1,60 @@
+package procs
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/eagraf/habitat/structs/configuration"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWriteInstanceConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "instances", "inst1", "config.json")
+
+	// processes without a config still get a file
+	require.Nil(t, writeInstanceConfig(path, nil))
+	written, err := os.ReadFile(path)
+	require.Nil(t, err)
+	assert.JSONEq(t, `{}`, string(written))
+
+	require.Nil(t, writeInstanceConfig(path, map[string]interface{}{"port": 8080}))
+	written, err = os.ReadFile(path)
+	require.Nil(t, err)
+	assert.JSONEq(t, `{"port": 8080}`, string(written))
+
+	_, err = os.Stat(path + ".tmp")
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestProcReload(t *testing.T) {
+	dir := t.TempDir()
+	configPath := filepath.Join(dir, "config.json")
+	reloadedPath := filepath.Join(dir, "reloaded.json")
+	require.Nil(t, writeInstanceConfig(configPath, map[string]interface{}{"version": 1}))
+
+	// the process copies its config file each time it is told to reload it
+	script := `trap 'cp "$HABITAT_APP_CONFIG" "$RELOADED"' HUP; while true; do sleep 0.05; done`
+	proc := NewProc("reload", "/bin/sh", make(chan ProcError, 1), []string{"RELOADED=" + reloadedPath}, []string{}, []string{"-c", script}, &configuration.App{})
+	proc.ConfigPath = configPath
+	require.Nil(t, proc.Start())
+	defer proc.Stop()
+
+	// give the shell time to set up its trap
+	time.Sleep(200 * time.Millisecond)
+
+	require.Nil(t, writeInstanceConfig(configPath, map[string]interface{}{"version": 2}))
+	require.Nil(t, proc.Reload())
+
+	require.Eventually(t, func() bool {
+		reloaded, err := os.ReadFile(reloadedPath)
+		if err != nil {
+			return false
+		}
+		var config map[string]interface{}
+		return json.Unmarshal(reloaded, &config) == nil && config["version"] == float64(2)
+	}, 2*time.Second, 50*time.Millisecond)
+}
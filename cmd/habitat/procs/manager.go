@@ -2,8 +2,12 @@ package procs
 
 import (
 	"fmt"
+	"os"
 	"path/filepath"
+	"sort"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/eagraf/habitat/cmd/habitat/proxy"
 	"github.com/eagraf/habitat/pkg/compass"
@@ -12,18 +16,26 @@ import (
 	"github.com/rs/zerolog/log"
 )
 
+// stopTimeout is how long a process instance being restarted is given to exit before its
+// replacement is started anyway
+const stopTimeout = 10 * time.Second
+
+// ExitHandler is called with a process that exited with an error, after it has been cleaned up
+type ExitHandler func(proc *Proc, err error)
+
 type Manager struct {
 	ProcDir    string
 	Procs      map[string]*Proc
 	ProxyRules *proxy.RuleSet
 
-	errChan chan ProcError
-	lock    *sync.Mutex
+	errChan     chan ProcError
+	exitHandler ExitHandler
+	lock        *sync.Mutex
 }
 
 func NewManager(procDir string, rules *proxy.RuleSet) *Manager {
 	return &Manager{
-		ProcDir:    compass.ProcsPath(),
+		ProcDir:    procDir,
 		Procs:      make(map[string]*Proc),
 		ProxyRules: rules,
 
@@ -32,10 +44,17 @@ func NewManager(procDir string, rules *proxy.RuleSet) *Manager {
 	}
 }
 
-func (m *Manager) StartProcessInstance(communityID, processID, app string, args, env, flags []string) (string, error) {
+// StartProcessInstance starts a process instance on this node. Its config is written to a file in
+// the instance's directory, which the process finds through the HABITAT_APP_CONFIG env var.
+func (m *Manager) StartProcessInstance(communityID, processID, app string, args, env, flags []string, config interface{}) (string, error) {
 	m.lock.Lock()
 	defer m.lock.Unlock()
 
+	return m.startProcessInstance(communityID, processID, app, args, env, flags, config)
+}
+
+// startProcessInstance starts a process instance. The manager's lock must be held.
+func (m *Manager) startProcessInstance(communityID, processID, app string, args, env, flags []string, config interface{}) (string, error) {
 	processInstanceID, err := GetProcessInstanceID(communityID, compass.NodeID(), processID)
 	if err != nil {
 		return "", err
@@ -53,6 +72,14 @@ func (m *Manager) StartProcessInstance(communityID, processID, app string, args,
 	}
 
 	proc := NewProc(processInstanceID, binPath, m.errChan, env, flags, args, appConfig)
+	proc.ConfigPath = filepath.Join(m.instanceDir(processInstanceID), "config.json")
+	proc.CommunityID = communityID
+	proc.ProcessID = processID
+	err = writeInstanceConfig(proc.ConfigPath, config)
+	if err != nil {
+		return "", err
+	}
+
 	err = proc.Start()
 	if err != nil {
 		return "", err
@@ -111,12 +138,157 @@ func (m *Manager) StopProcessInstance(procID string) error {
 	if err != nil {
 		return err
 	}
+	m.removeProcessInstance(procID, proc)
+
+	return nil
+}
+
+// removeProcessInstance cleans up after a stopped process instance. The manager's lock must be
+// held.
+func (m *Manager) removeProcessInstance(procID string, proc *Proc) {
 	delete(m.Procs, procID)
 
+	err := os.RemoveAll(m.instanceDir(procID))
+	if err != nil {
+		log.Error().Err(err).Msgf("error removing directory of process %s", procID)
+	}
+
 	// Remove from proxy ruleset
 	for _, rule := range proc.config.ProxyRules {
 		m.ProxyRules.Remove(rule.Hash())
 	}
+}
+
+// UpdateProcessInstance applies new settings to a community's process instance on this node. If
+// only its config changed, the config file is rewritten and the process is sent SIGHUP to reload
+// it. Otherwise the instance is restarted.
+func (m *Manager) UpdateProcessInstance(communityID, processID, app string, args, env, flags []string, config interface{}) (string, error) {
+	processInstanceID, err := GetProcessInstanceID(communityID, compass.NodeID(), processID)
+	if err != nil {
+		return "", err
+	}
+
+	m.lock.Lock()
+	proc, ok := m.Procs[processInstanceID]
+	m.lock.Unlock()
+
+	if !ok || proc.ConfigPath == "" || !equalSettings(proc.Args, args) || !equalSettings(proc.Env, env) || !equalSettings(proc.Flags, flags) {
+		return m.RestartProcessInstance(communityID, processID, app, args, env, flags, config)
+	}
+
+	err = writeInstanceConfig(proc.ConfigPath, config)
+	if err != nil {
+		return "", err
+	}
+
+	err = proc.Reload()
+	if err != nil {
+		return "", fmt.Errorf("error signalling process %s to reload its config: %s", processInstanceID, err)
+	}
+	return processInstanceID, nil
+}
+
+// RestartProcessInstance stops a community's process instance if it is running on this node, and
+// starts it again with the given settings. The instance stays listed while the old process exits,
+// so nothing else starts it in the meantime.
+func (m *Manager) RestartProcessInstance(communityID, processID, app string, args, env, flags []string, config interface{}) (string, error) {
+	processInstanceID, err := GetProcessInstanceID(communityID, compass.NodeID(), processID)
+	if err != nil {
+		return "", err
+	}
+
+	m.lock.Lock()
+	proc, ok := m.Procs[processInstanceID]
+	if ok {
+		err = proc.Stop()
+	}
+	m.lock.Unlock()
+	if err != nil {
+		return "", err
+	}
+
+	if ok {
+		select {
+		case <-proc.exited:
+		case <-time.After(stopTimeout):
+			log.Error().Msgf("process %s did not exit within %s of being stopped", processInstanceID, stopTimeout)
+		}
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if ok {
+		if m.Procs[processInstanceID] != proc {
+			return "", fmt.Errorf("process %s was stopped while it was restarting", processInstanceID)
+		}
+		m.removeProcessInstance(processInstanceID, proc)
+	}
+
+	return m.startProcessInstance(communityID, processID, app, args, env, flags, config)
+}
+
+// CommunityProcessIDs returns the IDs of the community's processes that have an instance on this
+// node, whether or not it is still running
+func (m *Manager) CommunityProcessIDs(communityID string) ([]string, error) {
+	prefix, err := GetProcessInstanceID(communityID, compass.NodeID(), "")
+	if err != nil {
+		return nil, err
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	processIDs := make([]string, 0)
+	for id := range m.Procs {
+		if strings.HasPrefix(id, prefix) {
+			processIDs = append(processIDs, strings.TrimPrefix(id, prefix))
+		}
+	}
+	sort.Strings(processIDs)
+	return processIDs, nil
+}
+
+// IsRunning returns true if the process instance was started, and hasn't exited since
+func (m *Manager) IsRunning(processInstanceID string) bool {
+	m.lock.Lock()
+	proc, ok := m.Procs[processInstanceID]
+	m.lock.Unlock()
+	if !ok {
+		return false
+	}
+
+	select {
+	case <-proc.exited:
+		return false
+	default:
+		return true
+	}
+}
+
+// StopCommunityProcessInstances stops every process instance running on this node on
+// behalf of the given community.
+func (m *Manager) StopCommunityProcessInstances(communityID string) error {
+	prefix, err := GetProcessInstanceID(communityID, compass.NodeID(), "")
+	if err != nil {
+		return err
+	}
+
+	m.lock.Lock()
+	procIDs := make([]string, 0)
+	for id := range m.Procs {
+		if strings.HasPrefix(id, prefix) {
+			procIDs = append(procIDs, id)
+		}
+	}
+	m.lock.Unlock()
+
+	for _, id := range procIDs {
+		err := m.StopProcessInstance(id)
+		if err != nil {
+			return err
+		}
+	}
 
 	return nil
 }
@@ -138,6 +310,14 @@ func (m *Manager) listProcessInstances() ([]*Proc, error) {
 	return res, nil
 }
 
+// SetExitHandler sets the handler called when a process exits with an error
+func (m *Manager) SetExitHandler(handler ExitHandler) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.exitHandler = handler
+}
+
 func (m *Manager) ListenForErrors() {
 	for {
 		procErr := <-m.errChan
@@ -145,6 +325,13 @@ func (m *Manager) ListenForErrors() {
 
 		// try stop command in case it has any clean up, don't worry too much about errors
 		m.StopProcessInstance(procErr.proc.Name)
+
+		m.lock.Lock()
+		handler := m.exitHandler
+		m.lock.Unlock()
+		if handler != nil {
+			handler(procErr.proc, procErr)
+		}
 	}
 }
 
@@ -17,8 +17,16 @@ type Proc struct {
 	Flags   []string
 	Args    []string
 
+	// ConfigPath is the file the process reads its config from, if it has one
+	ConfigPath string
+
+	// CommunityID and ProcessID identify the community process this is an instance of, if any
+	CommunityID string
+	ProcessID   string
+
 	cmd     *exec.Cmd
 	errChan chan ProcError
+	exited  chan struct{} // closed once the command has exited
 
 	config  *configuration.App
 	stopped bool
@@ -33,6 +41,7 @@ func NewProc(name, cmdPath string, errChan chan ProcError, env []string, flags [
 		Args:    args,
 
 		errChan: errChan,
+		exited:  make(chan struct{}),
 		config:  config,
 	}
 }
@@ -44,6 +53,9 @@ func (p *Proc) Start() error {
 	}
 	cmd.Env = os.Environ()
 	cmd.Env = append(cmd.Env, p.Env...)
+	if p.ConfigPath != "" {
+		cmd.Env = append(cmd.Env, AppConfigEnvVar+"="+p.ConfigPath)
+	}
 
 	// start this process with a groupd id equal to its pid. this allows for all of its subprocesses to be killed
 	// at once by passing in the negative pid to syscall.Kill
@@ -61,6 +73,7 @@ func (p *Proc) Start() error {
 
 	go func() {
 		err := cmd.Wait()
+		close(p.exited)
 		if err != nil && !p.stopped {
 			if _, ok := err.(*exec.ExitError); ok {
 				procErr := ProcError{
@@ -91,3 +104,8 @@ func (p *Proc) Stop() error {
 
 	return nil
 }
+
+// Reload signals the process to reload its config file
+func (p *Proc) Reload() error {
+	return p.cmd.Process.Signal(syscall.SIGHUP)
+}
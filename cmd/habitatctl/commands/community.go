@@ -16,12 +16,19 @@ limitations under the License.
 package commands
 
 import (
+	"bytes"
 	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
 
+	"github.com/eagraf/habitat/cmd/habitat/community/state"
 	client "github.com/eagraf/habitat/pkg/habitat_client"
+	"github.com/eagraf/habitat/structs/community"
 	"github.com/eagraf/habitat/structs/ctl"
 	"github.com/spf13/cobra"
 )
@@ -34,7 +41,21 @@ var communityCmd = &cobra.Command{
 	create <name>
 	join <name>
 	<community_id> add  <member_id>
-	<community_id> propose <data>
+	propose -c <community_id> [--dry-run] <transitions_json>
+	remove-node -c <community_id> <node_id>
+	remove-member -c <community_id> <member_id>
+	label -c <community_id> <node_id> [key=value...]
+	leave -c <community_id>
+	log -c <community_id>
+	watch -c <community_id>
+	snapshot export -c <community_id> -o <file>
+	snapshot import <file>
+	backup -c <community_id> -o <file>
+	restore <file>
+	cluster -c <community_id>
+	cluster transfer-leadership -c <community_id> [node_id]
+	cluster config -c <community_id> [--heartbeat-timeout <duration>] [--snapshot-threshold <n>] ...
+	update -c <community_id> [--rolling] [--arg <arg>...] [--env <env>...] [--flag <flag>...] [--app-config <json>] <process_id>
 `,
 	Run: func(cmd *cobra.Command, args []string) {
 		fmt.Println(cmd.Usage())
@@ -59,6 +80,11 @@ var communityCreateCmd = &cobra.Command{
 
 		ipfs, _ := cmd.Flags().GetBool("ipfs")
 
+		backend, err := cmd.Flags().GetString("backend")
+		if err != nil {
+			printError(err)
+		}
+
 		conn, err := getWebsocketConn(ctl.CommandCommunityCreate)
 		if err != nil {
 			printError(fmt.Errorf("error establishing websocket connection: %s", err))
@@ -73,6 +99,7 @@ var communityCreateCmd = &cobra.Command{
 		req := &ctl.CommunityCreateRequest{
 			CommunityName:     name.Value.String(),
 			CreateIPFSCluster: ipfs,
+			Backend:           backend,
 		}
 
 		err = conn.WriteJSON(req)
@@ -168,9 +195,552 @@ var communityJoinCmd = &cobra.Command{
 	},
 }
 
+var communityRemoveNodeCmd = &cobra.Command{
+	Use:   "remove-node -c <community_id> <node_id>",
+	Short: "remove a node from the community, stopping all of its process instances",
+	Run: func(cmd *cobra.Command, args []string) {
+		communityID := cmd.Flags().Lookup("community")
+		if communityID == nil {
+			printError(fmt.Errorf("community flag needs to be set"))
+			return
+		}
+
+		if len(args) < 1 {
+			printError(fmt.Errorf("must supply a node ID to remove"))
+			return
+		}
+
+		req := &ctl.CommunityRemoveNodeRequest{
+			CommunityID: communityID.Value.String(),
+			NodeID:      args[0],
+		}
+
+		var res ctl.CommunityRemoveNodeResponse
+		postRequest(ctl.CommandCommunityRemoveNode, req, &res)
+	},
+}
+
+var communityLabelNodeCmd = &cobra.Command{
+	Use:   "label -c <community_id> <node_id> [key=value...]",
+	Short: "replace the labels of a node, which scheduled processes are placed by",
+	Run: func(cmd *cobra.Command, args []string) {
+		communityID := cmd.Flags().Lookup("community")
+		if communityID == nil {
+			printError(fmt.Errorf("community flag needs to be set"))
+			return
+		}
+
+		if len(args) < 1 {
+			printError(fmt.Errorf("must supply a node ID to label"))
+			return
+		}
+
+		labels := make(map[string]string)
+		for _, label := range args[1:] {
+			parts := strings.SplitN(label, "=", 2)
+			if len(parts) != 2 || parts[0] == "" {
+				printError(fmt.Errorf("label %s is not of the form key=value", label))
+				return
+			}
+			labels[parts[0]] = parts[1]
+		}
+
+		req := &ctl.CommunitySetNodeLabelsRequest{
+			CommunityID: communityID.Value.String(),
+			NodeID:      args[0],
+			Labels:      labels,
+		}
+
+		var res ctl.CommunitySetNodeLabelsResponse
+		postRequest(ctl.CommandCommunitySetNodeLabels, req, &res)
+	},
+}
+
+var communityRemoveMemberCmd = &cobra.Command{
+	Use:   "remove-member -c <community_id> <member_id>",
+	Short: "remove a member and all of their nodes from the community",
+	Run: func(cmd *cobra.Command, args []string) {
+		communityID := cmd.Flags().Lookup("community")
+		if communityID == nil {
+			printError(fmt.Errorf("community flag needs to be set"))
+			return
+		}
+
+		if len(args) < 1 {
+			printError(fmt.Errorf("must supply a member ID to remove"))
+			return
+		}
+
+		req := &ctl.CommunityRemoveMemberRequest{
+			CommunityID: communityID.Value.String(),
+			MemberID:    args[0],
+		}
+
+		var res ctl.CommunityRemoveMemberResponse
+		postRequest(ctl.CommandCommunityRemoveMember, req, &res)
+	},
+}
+
+var communityLeaveCmd = &cobra.Command{
+	Use:   "leave -c <community_id>",
+	Short: "remove this node from the community and stop everything it runs for the community",
+	Run: func(cmd *cobra.Command, args []string) {
+		communityID := cmd.Flags().Lookup("community")
+		if communityID == nil {
+			printError(fmt.Errorf("community flag needs to be set"))
+			return
+		}
+
+		deleteData, err := cmd.Flags().GetBool("delete")
+		if err != nil {
+			printError(err)
+			return
+		}
+
+		req := &ctl.CommunityLeaveRequest{
+			CommunityID: communityID.Value.String(),
+			Delete:      deleteData,
+		}
+
+		var res ctl.CommunityLeaveResponse
+		postRequest(ctl.CommandCommunityLeave, req, &res)
+	},
+}
+
+var communityLogCmd = &cobra.Command{
+	Use:   "log -c <community_id>",
+	Short: "list the transitions committed to the community, newest first",
+	Run: func(cmd *cobra.Command, args []string) {
+		communityID := cmd.Flags().Lookup("community")
+		if communityID == nil {
+			printError(fmt.Errorf("community flag needs to be set"))
+			return
+		}
+
+		transitionType, err := cmd.Flags().GetString("type")
+		if err != nil {
+			printError(err)
+			return
+		}
+
+		before, err := cmd.Flags().GetUint64("before")
+		if err != nil {
+			printError(err)
+			return
+		}
+
+		limit, err := cmd.Flags().GetInt("limit")
+		if err != nil {
+			printError(err)
+			return
+		}
+
+		req := &ctl.CommunityHistoryRequest{
+			CommunityID: communityID.Value.String(),
+			Type:        transitionType,
+			Before:      before,
+			Limit:       limit,
+		}
+
+		var res ctl.CommunityHistoryResponse
+		postRequest(ctl.CommandCommunityHistory, req, &res)
+
+		for _, e := range res.Entries {
+			if e.Type == state.HistoryTypeSnapshot {
+				fmt.Printf("index %d (term %d): earlier history was compacted into a snapshot\n", e.Index, e.Term)
+				continue
+			}
+
+			fmt.Printf("index %d (term %d) %s %s", e.Index, e.Term, e.AppendedAt.Format(time.RFC3339), e.Type)
+			if e.Proposer != "" {
+				fmt.Printf(" proposed by node %s", e.Proposer)
+			}
+			fmt.Printf("\n    %s\n", string(e.Transition))
+		}
+
+		if res.NextBefore != 0 {
+			fmt.Printf("more entries available with --before %d\n", res.NextBefore)
+		}
+	},
+}
+
+var communityWatchCmd = &cobra.Command{
+	Use:   "watch -c <community_id>",
+	Short: "print updates to the community's state as they happen",
+	Run: func(cmd *cobra.Command, args []string) {
+		communityID := cmd.Flags().Lookup("community")
+		if communityID == nil {
+			printError(fmt.Errorf("community flag needs to be set"))
+			return
+		}
+
+		fromIndex, err := cmd.Flags().GetUint64("from")
+		if err != nil {
+			printError(err)
+			return
+		}
+
+		includeState, err := cmd.Flags().GetBool("state")
+		if err != nil {
+			printError(err)
+			return
+		}
+
+		conn, err := getWebsocketConn(ctl.CommandCommunityWatch)
+		if err != nil {
+			printError(fmt.Errorf("error establishing websocket connection: %s", err))
+		}
+		defer conn.Close()
+
+		req := &ctl.CommunityWatchRequest{
+			CommunityID:  communityID.Value.String(),
+			FromIndex:    fromIndex,
+			IncludeState: includeState,
+		}
+		err = conn.WriteJSON(req)
+		if err != nil {
+			printError(err)
+		}
+
+		for {
+			var msg ctl.CommunityWatchMessage
+			err = conn.ReadJSON(&msg)
+			if err != nil {
+				printError(err)
+			}
+			if werr := msg.GetError(); werr != nil {
+				printError(werr)
+			}
+
+			marshaled, err := json.Marshal(&msg)
+			if err != nil {
+				printError(err)
+			}
+			fmt.Println(string(marshaled))
+		}
+	},
+}
+
+var communitySnapshotCmd = &cobra.Command{
+	Use:   "snapshot",
+	Short: "export a community's state to a file, or start running a community from one",
+	Run: func(cmd *cobra.Command, args []string) {
+		fmt.Println(cmd.Usage())
+	},
+}
+
+var communitySnapshotExportCmd = &cobra.Command{
+	Use:   "export -c <community_id> -o <file>",
+	Short: "write a snapshot of the community's state to a file",
+	Run: func(cmd *cobra.Command, args []string) {
+		communityID := cmd.Flags().Lookup("community")
+		if communityID == nil {
+			printError(fmt.Errorf("community flag needs to be set"))
+			return
+		}
+
+		output, err := cmd.Flags().GetString("output")
+		if err != nil {
+			printError(err)
+			return
+		}
+		if output == "" {
+			printError(fmt.Errorf("output flag needs to be set"))
+			return
+		}
+
+		req := &ctl.CommunitySnapshotExportRequest{
+			CommunityID: communityID.Value.String(),
+		}
+
+		var res ctl.CommunitySnapshotExportResponse
+		postRequest(ctl.CommandCommunitySnapshotExport, req, &res)
+
+		err = os.WriteFile(output, res.Snapshot, 0600)
+		if err != nil {
+			printError(fmt.Errorf("error writing snapshot: %s", err))
+		}
+		fmt.Printf("wrote snapshot of community %s to %s\n", communityID.Value.String(), output)
+	},
+}
+
+var communitySnapshotImportCmd = &cobra.Command{
+	Use:   "import <file>",
+	Short: "start running a community on this node from an exported snapshot",
+	Run: func(cmd *cobra.Command, args []string) {
+		if len(args) < 1 {
+			printError(fmt.Errorf("no snapshot file specified"))
+		}
+
+		standalone, err := cmd.Flags().GetBool("standalone")
+		if err != nil {
+			printError(err)
+			return
+		}
+
+		snapshot, err := os.ReadFile(args[0])
+		if err != nil {
+			printError(fmt.Errorf("error reading snapshot: %s", err))
+		}
+
+		req := &ctl.CommunitySnapshotImportRequest{
+			Snapshot:   snapshot,
+			Standalone: standalone,
+		}
+
+		var res ctl.CommunitySnapshotImportResponse
+		postRequest(ctl.CommandCommunitySnapshotImport, req, &res)
+
+		fmt.Printf("imported community %s at version %d\n", res.CommunityID, res.Version)
+	},
+}
+
+var communityBackupCmd = &cobra.Command{
+	Use:   "backup -c <community_id> -o <file>",
+	Short: "write an encrypted archive with everything needed to restore the community if all of its nodes are lost",
+	Run: func(cmd *cobra.Command, args []string) {
+		communityID := cmd.Flags().Lookup("community")
+		if communityID == nil {
+			printError(fmt.Errorf("community flag needs to be set"))
+			return
+		}
+
+		output, err := cmd.Flags().GetString("output")
+		if err != nil {
+			printError(err)
+			return
+		}
+		if output == "" {
+			printError(fmt.Errorf("output flag needs to be set"))
+			return
+		}
+
+		passphrase, err := cmd.Flags().GetString("passphrase")
+		if err != nil {
+			printError(err)
+			return
+		}
+
+		req := &ctl.CommunityBackupRequest{
+			CommunityID: communityID.Value.String(),
+			Password:    passphrase,
+		}
+
+		var res ctl.CommunityBackupResponse
+		postRequest(ctl.CommandCommunityBackup, req, &res)
+
+		err = os.WriteFile(output, res.Archive, 0600)
+		if err != nil {
+			printError(fmt.Errorf("error writing backup: %s", err))
+		}
+		fmt.Printf("wrote backup of community %s to %s\n", communityID.Value.String(), output)
+	},
+}
+
+var communityRestoreCmd = &cobra.Command{
+	Use:   "restore <file>",
+	Short: "restore a community from a backup, with this node as the only node in its cluster",
+	Run: func(cmd *cobra.Command, args []string) {
+		if len(args) < 1 {
+			printError(fmt.Errorf("no backup file specified"))
+		}
+
+		passphrase, err := cmd.Flags().GetString("passphrase")
+		if err != nil {
+			printError(err)
+			return
+		}
+
+		archive, err := os.ReadFile(args[0])
+		if err != nil {
+			printError(fmt.Errorf("error reading backup: %s", err))
+		}
+
+		req := &ctl.CommunityRestoreRequest{
+			Archive:  archive,
+			Password: passphrase,
+		}
+
+		var res ctl.CommunityRestoreResponse
+		postRequest(ctl.CommandCommunityRestore, req, &res)
+
+		fmt.Printf("restored community %s at version %d\n", res.CommunityID, res.Version)
+	},
+}
+
+var communityClusterCmd = &cobra.Command{
+	Use:   "cluster -c <community_id>",
+	Short: "show the community's consensus cluster as seen by this node",
+	Run: func(cmd *cobra.Command, args []string) {
+		communityID := cmd.Flags().Lookup("community")
+		if communityID == nil {
+			printError(fmt.Errorf("community flag needs to be set"))
+			return
+		}
+
+		showStats, err := cmd.Flags().GetBool("stats")
+		if err != nil {
+			printError(err)
+			return
+		}
+
+		req := &ctl.CommunityClusterStatusRequest{
+			CommunityID: communityID.Value.String(),
+		}
+
+		var res ctl.CommunityClusterStatusResponse
+		postRequest(ctl.CommandCommunityClusterStatus, req, &res)
+
+		fmt.Printf("state: %s (term %d)\n", res.State, res.Term)
+		if res.LeaderID != "" {
+			fmt.Printf("leader: %s at %s\n", res.LeaderID, res.LeaderAddress)
+		} else {
+			fmt.Println("leader: unknown")
+		}
+		fmt.Printf("indexes: last log %d, commit %d, applied %d\n", res.LastLogIndex, res.CommitIndex, res.AppliedIndex)
+
+		fmt.Println("servers:")
+		for _, srv := range res.Servers {
+			fmt.Printf("    %s %s at %s", srv.ID, srv.Suffrage, srv.Address)
+			if srv.Leader {
+				fmt.Printf(" (leader)")
+			}
+			if !srv.LastContact.IsZero() {
+				fmt.Printf(", last contact %s ago", time.Since(srv.LastContact).Round(time.Millisecond))
+			}
+			fmt.Println()
+		}
+
+		if showStats {
+			pretty, err := json.MarshalIndent(res.Stats, "", "    ")
+			if err != nil {
+				printError(fmt.Errorf("error prettifying JSON response: %s", err))
+			}
+			fmt.Println(string(pretty))
+		}
+	},
+}
+
+var communityTransferLeadershipCmd = &cobra.Command{
+	Use:   "transfer-leadership -c <community_id> [node_id]",
+	Short: "hand leadership of the community's cluster to another voter, run on the current leader",
+	Long:  "If no node is given, the most up to date voter becomes the leader.",
+	Run: func(cmd *cobra.Command, args []string) {
+		communityID := cmd.Flags().Lookup("community")
+		if communityID == nil {
+			printError(fmt.Errorf("community flag needs to be set"))
+			return
+		}
+
+		nodeID := ""
+		if len(args) > 0 {
+			nodeID = args[0]
+		}
+
+		req := &ctl.CommunityTransferLeadershipRequest{
+			CommunityID: communityID.Value.String(),
+			NodeID:      nodeID,
+		}
+
+		var res ctl.CommunityTransferLeadershipResponse
+		postRequest(ctl.CommandCommunityTransferLeadership, req, &res)
+
+		fmt.Printf("transferred leadership of community %s\n", communityID.Value.String())
+	},
+}
+
+var communityRaftConfigCmd = &cobra.Command{
+	Use:   "config -c <community_id>",
+	Short: "show or change the settings of the community's Raft cluster",
+	Long: `Without any settings, the current ones are printed. Settings that are not given keep their
+current value, and setting one to 0 restores Raft's default.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		communityID := cmd.Flags().Lookup("community")
+		if communityID == nil {
+			printError(fmt.Errorf("community flag needs to be set"))
+			return
+		}
+
+		stateReq := &ctl.CommunityStateRequest{
+			CommunityID: communityID.Value.String(),
+		}
+		var stateRes ctl.CommunityStateResponse
+		postRequest(ctl.CommandCommunityState, stateReq, &stateRes)
+
+		var commState community.CommunityState
+		err := json.Unmarshal(stateRes.State, &commState)
+		if err != nil {
+			printError(fmt.Errorf("error decoding community state: %s", err))
+			return
+		}
+
+		config := &community.RaftConfig{}
+		if commState.RaftConfig != nil {
+			config = commState.RaftConfig
+		}
+
+		changed := false
+		durations := map[string]*int64{
+			"heartbeat-timeout": &config.HeartbeatTimeoutMs,
+			"election-timeout":  &config.ElectionTimeoutMs,
+			"commit-timeout":    &config.CommitTimeoutMs,
+			"snapshot-interval": &config.SnapshotIntervalMs,
+		}
+		for flag, field := range durations {
+			if !cmd.Flags().Changed(flag) {
+				continue
+			}
+			d, err := cmd.Flags().GetDuration(flag)
+			if err != nil {
+				printError(err)
+				return
+			}
+			*field = d.Milliseconds()
+			changed = true
+		}
+
+		counts := map[string]*uint64{
+			"snapshot-threshold": &config.SnapshotThreshold,
+			"trailing-logs":      &config.TrailingLogs,
+		}
+		for flag, field := range counts {
+			if !cmd.Flags().Changed(flag) {
+				continue
+			}
+			n, err := cmd.Flags().GetUint64(flag)
+			if err != nil {
+				printError(err)
+				return
+			}
+			*field = n
+			changed = true
+		}
+
+		if changed {
+			req := &ctl.CommunityRaftConfigRequest{
+				CommunityID: communityID.Value.String(),
+				RaftConfig:  config,
+			}
+			var res ctl.CommunityRaftConfigResponse
+			postRequest(ctl.CommandCommunityRaftConfig, req, &res)
+
+			fmt.Printf("updated raft config of community %s at version %d\n", communityID.Value.String(), res.Version)
+		}
+
+		pretty, err := json.MarshalIndent(config, "", "    ")
+		if err != nil {
+			printError(fmt.Errorf("error prettifying JSON response: %s", err))
+		}
+		fmt.Println(string(pretty))
+	},
+}
+
 var communityProposeTransitionsCmd = &cobra.Command{
-	Use:   "propose <json_patch_b64>",
-	Short: "propose a transition to this community's state",
+	Use:   "propose -c <community_id> <transitions_json>",
+	Short: "propose transitions to this community's state",
+	Long: `Transitions are given as a JSON list of {"type": ..., "transition": ...} objects, in the
+same form as the community's log. With --dry-run, the changes they would make are printed
+as a JSON patch instead of being committed.`,
 	Run: func(cmd *cobra.Command, args []string) {
 		communityID := cmd.Flags().Lookup("community")
 		if communityID == nil {
@@ -179,16 +749,50 @@ var communityProposeTransitionsCmd = &cobra.Command{
 		}
 
 		if len(args) < 1 {
-			fmt.Println("must supply a base64 encoded JSON patch as the first argument")
+			fmt.Println("must supply a JSON list of transitions as the first argument")
+			return
+		}
+
+		var transitions []*ctl.ProposedTransition
+		err := json.Unmarshal([]byte(args[0]), &transitions)
+		if err != nil {
+			printError(fmt.Errorf("error decoding transitions: %s", err))
+			return
+		}
+
+		expectedVersion, err := cmd.Flags().GetUint64("expected-version")
+		if err != nil {
+			printError(err)
+			return
+		}
+
+		dryRun, err := cmd.Flags().GetBool("dry-run")
+		if err != nil {
+			printError(err)
 			return
 		}
-		b64Patch := args[0]
 
 		req := &ctl.CommunityProposeRequest{
 			CommunityID:     communityID.Value.String(),
-			StateTransition: []byte(b64Patch),
+			Transitions:     transitions,
+			ExpectedVersion: expectedVersion,
+			DryRun:          dryRun,
 		}
-		postRequest(ctl.CommandCommunityPropose, req, &ctl.CommunityProposeResponse{})
+
+		var res ctl.CommunityProposeResponse
+		postRequest(ctl.CommandCommunityPropose, req, &res)
+
+		if !dryRun {
+			fmt.Printf("committed transitions at version %d\n", res.Version)
+			return
+		}
+
+		var diff bytes.Buffer
+		err = json.Indent(&diff, res.Diff, "", "    ")
+		if err != nil {
+			printError(fmt.Errorf("error prettifying JSON response: %s", err))
+		}
+		fmt.Println(diff.String())
 	},
 }
 
@@ -232,6 +836,8 @@ var communityListCmd = &cobra.Command{
 var communityPSCmd = &cobra.Command{
 	Use:   "ps",
 	Short: "list the processes that are actively running in this community",
+	Long: `Each process is listed with the status its nodes last reported for their instances of it, along
+with how many times each instance was restarted and the last error it hit.`,
 	Run: func(cmd *cobra.Command, args []string) {
 		communityID := cmd.Flags().Lookup("community")
 		if communityID == nil {
@@ -246,17 +852,43 @@ var communityPSCmd = &cobra.Command{
 		var res ctl.CommunityPSResponse
 		postRequest(ctl.CommandCommunityPS, req, &res)
 
-		pretty, err := json.MarshalIndent(&res, "", "    ")
-		if err != nil {
-			printError(fmt.Errorf("error prettifying JSON response: %s", err))
+		if asJSON, _ := cmd.Flags().GetBool("json"); asJSON {
+			pretty, err := json.MarshalIndent(&res, "", "    ")
+			if err != nil {
+				printError(fmt.Errorf("error prettifying JSON response: %s", err))
+			}
+			fmt.Println(string(pretty))
+			return
 		}
-		fmt.Println(string(pretty))
+
+		printProcessTable(&res)
 	},
 }
 
+// printProcessTable prints each process followed by the status of its instance on each node
+func printProcessTable(res *ctl.CommunityPSResponse) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	for _, p := range res.Processes {
+		fmt.Fprintf(w, "%s\t%s\trevision %d\n", p.ID, p.AppName, p.Revision)
+		fmt.Fprintln(w, "  NODE\tSTATUS\tREVISION\tRESTARTS\tUPDATED\tERROR")
+		for _, i := range p.Instances {
+			updated := "-"
+			if i.UpdatedAt != 0 {
+				updated = time.Unix(i.UpdatedAt, 0).Format(time.RFC3339)
+			}
+			fmt.Fprintf(w, "  %s\t%s\t%d\t%d\t%s\t%s\n", i.NodeID, i.GetStatus(), i.Revision, i.RestartCount, updated, i.LastError)
+		}
+	}
+	w.Flush()
+}
+
 var communityStartProcessCmd = &cobra.Command{
-	Use:   "start -c <community_id> -n <node 1> -n <node 2> -- <app_name> [args]",
+	Use:   "start -c <community_id> (-n <node 1> -n <node 2> | --replicas <n>) [--app-config <json>] -- <app_name> [args]",
 	Short: "start process instances on specific nodes in the community",
+	Long: `Instances are either started on the given nodes, or placed by the scheduler when --replicas is
+given. Scheduled instances can be limited to nodes with certain labels, to one per member, or kept
+off specific nodes, and --spread spreads them evenly across the values of a node label. They are
+moved to other nodes when the node they run on is removed.`,
 	Run: func(cmd *cobra.Command, args []string) {
 		communityID := cmd.Flags().Lookup("community")
 		if communityID == nil {
@@ -296,11 +928,70 @@ var communityStartProcessCmd = &cobra.Command{
 			InstancesNodes: instanceNodes,
 		}
 
+		if cmd.Flags().Changed("app-config") {
+			config, err := cmd.Flags().GetString("app-config")
+			if err != nil {
+				printError(err)
+				return
+			}
+			err = json.Unmarshal([]byte(config), &req.Config)
+			if err != nil {
+				printError(fmt.Errorf("error decoding process config: %s", err))
+				return
+			}
+		}
+
+		if cmd.Flags().Changed("replicas") {
+			if len(instanceNodes) != 0 {
+				printError(fmt.Errorf("nodes and replicas can't both be given"))
+				return
+			}
+
+			placement, err := placementFromFlags(cmd)
+			if err != nil {
+				printError(err)
+				return
+			}
+			req.Placement = placement
+		}
+
 		var res ctl.CommunityStartProcessRequest
 		postRequest(ctl.CommandCommunityStartProcess, req, &res)
 	},
 }
 
+// placementFromFlags reads the scheduler's placement settings for a process
+func placementFromFlags(cmd *cobra.Command) (*community.Placement, error) {
+	replicas, err := cmd.Flags().GetInt("replicas")
+	if err != nil {
+		return nil, err
+	}
+	labels, err := cmd.Flags().GetStringToString("label")
+	if err != nil {
+		return nil, err
+	}
+	onePerMember, err := cmd.Flags().GetBool("one-per-member")
+	if err != nil {
+		return nil, err
+	}
+	spread, err := cmd.Flags().GetString("spread")
+	if err != nil {
+		return nil, err
+	}
+	avoid, err := cmd.Flags().GetStringSlice("avoid")
+	if err != nil {
+		return nil, err
+	}
+
+	return &community.Placement{
+		Replicas:     replicas,
+		NodeLabels:   labels,
+		OnePerMember: onePerMember,
+		Spread:       spread,
+		AvoidNodes:   avoid,
+	}, nil
+}
+
 var communityStopProcessCmd = &cobra.Command{
 	Use:   "stop -c <community_id> [-n <node_id>...] <process_id>",
 	Short: "stop a process on a community. if nodes are specified, only their specific process instances will be stopped",
@@ -332,10 +1023,79 @@ var communityStopProcessCmd = &cobra.Command{
 	},
 }
 
+var communityUpdateProcessCmd = &cobra.Command{
+	Use:   "update -c <community_id> [--rolling] [--arg <arg>...] [--env <env>...] [--flag <flag>...] [--app-config <json>] <process_id>",
+	Short: "change the settings of a running process, restarting its instances",
+	Long: `Settings that are not given keep their current value. Every instance of the process is restarted
+with the new settings, or only reloads its config file if the config is all that changed. With
+--rolling, instances are updated one node at a time, and each node waits for the instance before
+it to come back up.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		communityID := cmd.Flags().Lookup("community")
+		if communityID == nil {
+			printError(fmt.Errorf("community flag needs to be set"))
+			return
+		}
+
+		if len(args) < 1 {
+			printError(fmt.Errorf("must supply a process ID to update"))
+			return
+		}
+
+		rolling, err := cmd.Flags().GetBool("rolling")
+		if err != nil {
+			printError(err)
+			return
+		}
+
+		req := &ctl.CommunityUpdateProcessRequest{
+			CommunityID: communityID.Value.String(),
+			ProcessID:   args[0],
+			Rolling:     rolling,
+		}
+
+		settings := map[string]*[]string{
+			"arg":  &req.Args,
+			"env":  &req.Env,
+			"flag": &req.Flags,
+		}
+		for flag, field := range settings {
+			if !cmd.Flags().Changed(flag) {
+				continue
+			}
+			values, err := cmd.Flags().GetStringArray(flag)
+			if err != nil {
+				printError(err)
+				return
+			}
+			*field = values
+		}
+
+		if cmd.Flags().Changed("app-config") {
+			config, err := cmd.Flags().GetString("app-config")
+			if err != nil {
+				printError(err)
+				return
+			}
+			err = json.Unmarshal([]byte(config), &req.Config)
+			if err != nil {
+				printError(fmt.Errorf("error decoding process config: %s", err))
+				return
+			}
+		}
+
+		var res ctl.CommunityUpdateProcessResponse
+		postRequest(ctl.CommandCommunityUpdateProcess, req, &res)
+
+		fmt.Printf("updated process %s to revision %d\n", req.ProcessID, res.Revision)
+	},
+}
+
 func init() {
 	communityCreateCmd.Flags().StringP("address", "a", "", "address that this node can be reached at")
 	communityCreateCmd.Flags().StringP("name", "n", "", "name of the community being created")
 	communityCreateCmd.Flags().Bool("ipfs", false, "create a new IPFS swarm for the community")
+	communityCreateCmd.Flags().String("backend", "", "cluster backend to run the community on, raft or local (single node only)")
 	addUserFlags(communityCreateCmd)
 
 	communityJoinCmd.Flags().StringP("address", "a", "", "address that this node can be reached at")
@@ -344,19 +1104,85 @@ func init() {
 	addUserFlags(communityJoinCmd)
 
 	communityProposeTransitionsCmd.Flags().StringP("community", "c", "", "id of community to be joined")
+	communityProposeTransitionsCmd.Flags().Uint64("expected-version", 0, "only apply the transition if the community state is at this version")
+	communityProposeTransitionsCmd.Flags().Bool("dry-run", false, "print the changes the transitions would make without committing them")
 	addUserFlags(communityProposeTransitionsCmd)
 
 	communityStateCmd.Flags().StringP("community", "c", "", "id of community to be joined")
 	addUserFlags(communityStateCmd)
 
 	communityPSCmd.Flags().StringP("community", "c", "", "id of community to be joined")
+	communityPSCmd.Flags().Bool("json", false, "print the processes and their instances as JSON")
 
 	communityStartProcessCmd.Flags().StringP("community", "c", "", "id of community to be joined")
 	communityStartProcessCmd.Flags().StringSliceP("node", "n", []string{}, "node ID to have a process instance started on")
+	communityStartProcessCmd.Flags().String("app-config", "", "JSON object holding the process's config")
+	communityStartProcessCmd.Flags().Int("replicas", 0, "number of instances for the scheduler to place")
+	communityStartProcessCmd.Flags().StringToString("label", map[string]string{}, "node label that scheduled instances must run on, as key=value")
+	communityStartProcessCmd.Flags().Bool("one-per-member", false, "schedule at most one instance on the nodes of each member")
+	communityStartProcessCmd.Flags().String("spread", "", "node label key to spread scheduled instances across")
+	communityStartProcessCmd.Flags().StringSlice("avoid", []string{}, "node ID to never schedule an instance on")
 
 	communityStopProcessCmd.Flags().StringP("community", "c", "", "id of community to be joined")
 	communityStopProcessCmd.Flags().StringSliceP("node", "n", []string{}, "node ID to have a process instance started on")
 
+	communityUpdateProcessCmd.Flags().StringP("community", "c", "", "id of community the process is running in")
+	communityUpdateProcessCmd.Flags().Bool("rolling", false, "restart instances one node at a time")
+	communityUpdateProcessCmd.Flags().StringArray("arg", []string{}, "argument to run the process with, replacing all current arguments")
+	communityUpdateProcessCmd.Flags().StringArray("env", []string{}, "environment variable to run the process with, replacing all current ones")
+	communityUpdateProcessCmd.Flags().StringArray("flag", []string{}, "flag to run the process with, replacing all current flags")
+	communityUpdateProcessCmd.Flags().String("app-config", "", "JSON object holding the process's new config")
+
+	communityRemoveNodeCmd.Flags().StringP("community", "c", "", "id of community to remove the node from")
+
+	communityRemoveMemberCmd.Flags().StringP("community", "c", "", "id of community to remove the member from")
+
+	communityLabelNodeCmd.Flags().StringP("community", "c", "", "id of community the node is in")
+
+	communityLeaveCmd.Flags().StringP("community", "c", "", "id of community to leave")
+	communityLeaveCmd.Flags().Bool("delete", false, "delete the community's data instead of archiving it")
+
+	communityLogCmd.Flags().StringP("community", "c", "", "id of community to list the history of")
+	communityLogCmd.Flags().StringP("type", "t", "", "only list transitions of this type")
+	communityLogCmd.Flags().Uint64("before", 0, "only list transitions committed before this index")
+	communityLogCmd.Flags().IntP("limit", "n", 0, "maximum number of transitions to list")
+
+	communityWatchCmd.Flags().StringP("community", "c", "", "id of community to watch")
+	communityWatchCmd.Flags().Uint64("from", 0, "replay recent updates starting at this index")
+	communityWatchCmd.Flags().Bool("state", false, "include the full community state with every update")
+
+	communitySnapshotExportCmd.Flags().StringP("community", "c", "", "id of community to export")
+	communitySnapshotExportCmd.Flags().StringP("output", "o", "", "file to write the snapshot to")
+
+	communitySnapshotImportCmd.Flags().Bool("standalone", false, "make this node the only node in the community's cluster, to recover a community with no other nodes left")
+
+	communityBackupCmd.Flags().StringP("community", "c", "", "id of community to back up")
+	communityBackupCmd.Flags().StringP("output", "o", "", "file to write the backup to")
+	communityBackupCmd.Flags().String("passphrase", "", "passphrase to encrypt the backup with")
+	communityBackupCmd.MarkFlagRequired("passphrase")
+
+	communityRestoreCmd.Flags().String("passphrase", "", "passphrase the backup was encrypted with")
+	communityRestoreCmd.MarkFlagRequired("passphrase")
+
+	communityClusterCmd.Flags().StringP("community", "c", "", "id of community to show the cluster of")
+	communityClusterCmd.Flags().Bool("stats", false, "also print all Raft stats")
+
+	communityTransferLeadershipCmd.Flags().StringP("community", "c", "", "id of community to transfer leadership of")
+
+	communityRaftConfigCmd.Flags().StringP("community", "c", "", "id of community to configure")
+	communityRaftConfigCmd.Flags().Duration("heartbeat-timeout", 0, "time without contact from the leader before a follower starts an election")
+	communityRaftConfigCmd.Flags().Duration("election-timeout", 0, "time without a leader before a candidate starts another election")
+	communityRaftConfigCmd.Flags().Duration("commit-timeout", 0, "longest the leader waits before sending a heartbeat, only applied when nodes restart")
+	communityRaftConfigCmd.Flags().Duration("snapshot-interval", 0, "how often nodes check whether to take a snapshot")
+	communityRaftConfigCmd.Flags().Uint64("snapshot-threshold", 0, "number of new log entries needed before a snapshot is taken")
+	communityRaftConfigCmd.Flags().Uint64("trailing-logs", 0, "number of log entries kept after a snapshot")
+
+	communitySnapshotCmd.AddCommand(communitySnapshotExportCmd)
+	communitySnapshotCmd.AddCommand(communitySnapshotImportCmd)
+
+	communityClusterCmd.AddCommand(communityTransferLeadershipCmd)
+	communityClusterCmd.AddCommand(communityRaftConfigCmd)
+
 	communityCmd.AddCommand(communityCreateCmd)
 	communityCmd.AddCommand(communityJoinCmd)
 	communityCmd.AddCommand(communityProposeTransitionsCmd)
@@ -365,6 +1191,17 @@ func init() {
 	communityCmd.AddCommand(communityPSCmd)
 	communityCmd.AddCommand(communityStartProcessCmd)
 	communityCmd.AddCommand(communityStopProcessCmd)
+	communityCmd.AddCommand(communityUpdateProcessCmd)
+	communityCmd.AddCommand(communityRemoveNodeCmd)
+	communityCmd.AddCommand(communityRemoveMemberCmd)
+	communityCmd.AddCommand(communityLabelNodeCmd)
+	communityCmd.AddCommand(communityLeaveCmd)
+	communityCmd.AddCommand(communityLogCmd)
+	communityCmd.AddCommand(communityWatchCmd)
+	communityCmd.AddCommand(communitySnapshotCmd)
+	communityCmd.AddCommand(communityBackupCmd)
+	communityCmd.AddCommand(communityRestoreCmd)
+	communityCmd.AddCommand(communityClusterCmd)
 
 	rootCmd.AddCommand(communityCmd)
 }
@@ -3,9 +3,7 @@ package compass
 import (
 	"errors"
 	"fmt"
-	"io/ioutil"
 	"net"
-	"net/http"
 	"os"
 	"path/filepath"
 	"runtime"
@@ -77,6 +75,11 @@ func CommunitiesPath() string {
 	return filepath.Join(HabitatPath(), "communities")
 }
 
+// ArchivedCommunitiesPath holds the data directories of communities this node has left
+func ArchivedCommunitiesPath() string {
+	return filepath.Join(HabitatPath(), "archived_communities")
+}
+
 func LocalSourcesPath() string {
 	return filepath.Join(HabitatPath(), "sources")
 }
@@ -127,43 +130,6 @@ func Hostname() string {
 	return hostname
 }
 
-func LocalIPv4() (net.IP, error) {
-	// Dial a dummy connection to get the default local IP address
-	// This solution is better than using net.Interfaces() because its possible the device
-	// is using multiple network interfaces with different IP addresses, which would make it
-	// difficult to establish which address it actually uses to communicate with the internet.
-	// Establishing the dummy connection is a good workaround for extracting the default IP address used.
-	conn, err := net.Dial("udp", "1.2.3.4:1")
-	if err != nil {
-		return nil, fmt.Errorf("error getting local IP address: %s", err)
-	}
-	defer conn.Close()
-
-	localAddr := conn.LocalAddr().(*net.UDPAddr)
-
-	return localAddr.IP, nil
-}
-
-func PublicIP() (net.IP, error) {
-	// TODO if we are in dockerland, fake this
-	// TODO use SSL
-	url := "http://api64.ipify.org?format=text"
-	resp, err := http.Get(url)
-	if err != nil {
-		panic(err)
-	}
-	defer resp.Body.Close()
-	body, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		return nil, err
-	}
-	ip := net.ParseIP(string(body))
-	if ip == nil {
-		return nil, errors.New("invalid IP address")
-	}
-	return ip, nil
-}
-
 func IPMultiaddr() (multiaddr.Multiaddr, error) {
 	var ip net.IP
 	if InDockerContainer() {
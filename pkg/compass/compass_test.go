@@ -1,6 +1,7 @@
 package compass
 
 import (
+	"net"
 	"testing"
 )
 
@@ -18,3 +19,24 @@ func TestPublicIP(t *testing.T) {
 		t.Error(err)
 	}
 }
+
+func TestSetIPResolver(t *testing.T) {
+	resolver := &StaticIPResolver{
+		Local: net.ParseIP("10.0.0.2"),
+	}
+	prev := SetIPResolver(resolver)
+	defer SetIPResolver(prev)
+
+	local, err := LocalIPv4()
+	if err != nil {
+		t.Error(err)
+	}
+	if !local.Equal(resolver.Local) {
+		t.Errorf("expected %s, got %s", resolver.Local, local)
+	}
+
+	_, err = PublicIP()
+	if err == nil {
+		t.Error("expected an error without a public IP address")
+	}
+}
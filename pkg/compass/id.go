@@ -19,6 +19,11 @@ func PeerIDPubKeyPath() string {
 	return filepath.Join(HabitatPath(), "libp2p-pub.key")
 }
 
+// MemberNodeKeyPath is where the private key used to sign this node's community transitions is kept
+func MemberNodeKeyPath() string {
+	return filepath.Join(HabitatPath(), "member-node-priv.key")
+}
+
 func PeerID() peer.ID {
 	_, pub := GetPeerIDKeyPair()
 	id, err := peer.IDFromPublicKey(pub)
@@ -0,0 +1,106 @@
+package compass
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"sync"
+)
+
+// IPResolver looks up the IP addresses this node is reachable at. The default resolver asks the
+// network, and tests can swap in their own with SetIPResolver.
+type IPResolver interface {
+	LocalIPv4() (net.IP, error)
+	PublicIP() (net.IP, error)
+}
+
+var (
+	ipResolver     IPResolver = &networkIPResolver{}
+	ipResolverLock sync.RWMutex
+)
+
+// SetIPResolver replaces the resolver used by LocalIPv4 and PublicIP, and returns the previous one
+func SetIPResolver(resolver IPResolver) IPResolver {
+	ipResolverLock.Lock()
+	defer ipResolverLock.Unlock()
+
+	prev := ipResolver
+	ipResolver = resolver
+	return prev
+}
+
+func getIPResolver() IPResolver {
+	ipResolverLock.RLock()
+	defer ipResolverLock.RUnlock()
+
+	return ipResolver
+}
+
+func LocalIPv4() (net.IP, error) {
+	return getIPResolver().LocalIPv4()
+}
+
+func PublicIP() (net.IP, error) {
+	return getIPResolver().PublicIP()
+}
+
+// StaticIPResolver always resolves to the same addresses
+type StaticIPResolver struct {
+	Local  net.IP
+	Public net.IP
+}
+
+func (r *StaticIPResolver) LocalIPv4() (net.IP, error) {
+	if r.Local == nil {
+		return nil, errors.New("no local IP address set")
+	}
+	return r.Local, nil
+}
+
+func (r *StaticIPResolver) PublicIP() (net.IP, error) {
+	if r.Public == nil {
+		return nil, errors.New("no public IP address set")
+	}
+	return r.Public, nil
+}
+
+type networkIPResolver struct{}
+
+func (r *networkIPResolver) LocalIPv4() (net.IP, error) {
+	// Dial a dummy connection to get the default local IP address
+	// This solution is better than using net.Interfaces() because its possible the device
+	// is using multiple network interfaces with different IP addresses, which would make it
+	// difficult to establish which address it actually uses to communicate with the internet.
+	// Establishing the dummy connection is a good workaround for extracting the default IP address used.
+	conn, err := net.Dial("udp", "1.2.3.4:1")
+	if err != nil {
+		return nil, fmt.Errorf("error getting local IP address: %s", err)
+	}
+	defer conn.Close()
+
+	localAddr := conn.LocalAddr().(*net.UDPAddr)
+
+	return localAddr.IP, nil
+}
+
+func (r *networkIPResolver) PublicIP() (net.IP, error) {
+	// TODO if we are in dockerland, fake this
+	// TODO use SSL
+	url := "http://api64.ipify.org?format=text"
+	resp, err := http.Get(url)
+	if err != nil {
+		return nil, fmt.Errorf("error getting public IP address: %s", err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	ip := net.ParseIP(string(body))
+	if ip == nil {
+		return nil, errors.New("invalid IP address")
+	}
+	return ip, nil
+}
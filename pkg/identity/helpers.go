@@ -39,6 +39,9 @@ func generateSerial() (*big.Int, error) {
 
 func GetCertFromPEM(certPEMBytes []byte) (*x509.Certificate, error) {
 	block, _ := pem.Decode(certPEMBytes)
+	if block == nil {
+		return nil, errors.New("no PEM data found in certificate")
+	}
 	certBytes := block.Bytes
 
 	return x509.ParseCertificate(certBytes)
@@ -1,11 +1,18 @@
 package identity
 
 import (
+	"crypto"
 	"crypto/rand"
 	"crypto/rsa"
+	"crypto/sha256"
 	"crypto/x509"
 	"crypto/x509/pkix"
 	"encoding/asn1"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
 	"time"
 )
 
@@ -32,6 +39,80 @@ func GenerateMemberNodeKeypair() ([]byte, *rsa.PrivateKey, error) {
 	return pubKey, privKey, nil
 }
 
+// LoadMemberNodeKey reads the node's private key from the given path, generating and storing
+// a new one if none exists yet. The same key is used for every community the node is a part of.
+func LoadMemberNodeKey(path string) (*rsa.PrivateKey, error) {
+	keyPEMBytes, err := ioutil.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		_, privKey, err := GenerateMemberNodeKeypair()
+		if err != nil {
+			return nil, err
+		}
+
+		keyPEM := pem.EncodeToMemory(&pem.Block{
+			Type:  "RSA PRIVATE KEY",
+			Bytes: x509.MarshalPKCS1PrivateKey(privKey),
+		})
+		err = ioutil.WriteFile(path, keyPEM, 0600)
+		if err != nil {
+			return nil, err
+		}
+
+		return privKey, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(keyPEMBytes)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM data found in %s", path)
+	}
+
+	return x509.ParsePKCS1PrivateKey(block.Bytes)
+}
+
+// PublicKeyBytes returns the PKCS1 encoding of the node's public key, which is what gets sent to
+// the client to be signed.
+func (m *MemberNodeIdentity) PublicKeyBytes() []byte {
+	return x509.MarshalPKCS1PublicKey(&m.PrivKey.PublicKey)
+}
+
+// Sign signs data with the node's private key
+func (m *MemberNodeIdentity) Sign(data []byte) ([]byte, error) {
+	hashed := sha256.Sum256(data)
+	return rsa.SignPKCS1v15(rand.Reader, m.PrivKey, crypto.SHA256, hashed[:])
+}
+
+// VerifyMemberNodeSignature checks that the node certificate was issued by the user certificate,
+// and that the signature over data was made with the node certificate's key.
+func VerifyMemberNodeSignature(nodeCert, userCert *x509.Certificate, data, signature []byte) error {
+	pool := x509.NewCertPool()
+	pool.AddCert(userCert)
+
+	_, err := nodeCert.Verify(x509.VerifyOptions{
+		Roots: pool,
+		KeyUsages: []x509.ExtKeyUsage{
+			x509.ExtKeyUsageAny,
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("node certificate does not chain to member certificate: %s", err)
+	}
+
+	pubKey, ok := nodeCert.PublicKey.(*rsa.PublicKey)
+	if !ok {
+		return errors.New("node certificate does not contain an RSA public key")
+	}
+
+	hashed := sha256.Sum256(data)
+	err = rsa.VerifyPKCS1v15(pubKey, crypto.SHA256, hashed[:], signature)
+	if err != nil {
+		return fmt.Errorf("invalid signature: %s", err)
+	}
+
+	return nil
+}
+
 // GenerateMemberNodeCertificate is called on the client side
 func GenerateMemberNodeCertificate(nodeID string, userIdentity *UserIdentity, publicKey *rsa.PublicKey) ([]byte, error) {
 	serial, err := generateSerial()
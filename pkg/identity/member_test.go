@@ -2,6 +2,7 @@ package identity
 
 import (
 	"crypto/x509"
+	"path/filepath"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -44,3 +45,48 @@ func TestMemberNodeCertVerification(t *testing.T) {
 	assert.Equal(t, 1, len(chains))
 	assert.Equal(t, 2, len(chains[0]))
 }
+
+func TestMemberNodeSignature(t *testing.T) {
+	user, err := GenerateNewUserCert("bob_ross", "uuid")
+	assert.Nil(t, err)
+
+	privKey, err := LoadMemberNodeKey(filepath.Join(t.TempDir(), "node.key"))
+	assert.Nil(t, err)
+
+	node := &MemberNodeIdentity{
+		NodeID:  "bobs_node",
+		PrivKey: privKey,
+	}
+
+	certBytes, err := GenerateMemberNodeCertificate(node.NodeID, user, &privKey.PublicKey)
+	assert.Nil(t, err)
+	cert, err := x509.ParseCertificate(certBytes)
+	assert.Nil(t, err)
+
+	sig, err := node.Sign([]byte("hello"))
+	assert.Nil(t, err)
+
+	err = VerifyMemberNodeSignature(cert, user.Cert, []byte("hello"), sig)
+	assert.Nil(t, err)
+
+	// tampered data
+	err = VerifyMemberNodeSignature(cert, user.Cert, []byte("goodbye"), sig)
+	assert.NotNil(t, err)
+
+	// node cert not issued by this user
+	otherUser, err := GenerateNewUserCert("not_bob", "uuid2")
+	assert.Nil(t, err)
+	err = VerifyMemberNodeSignature(cert, otherUser.Cert, []byte("hello"), sig)
+	assert.NotNil(t, err)
+}
+
+func TestLoadMemberNodeKey(t *testing.T) {
+	keyPath := filepath.Join(t.TempDir(), "node.key")
+
+	privKey, err := LoadMemberNodeKey(keyPath)
+	assert.Nil(t, err)
+
+	reloaded, err := LoadMemberNodeKey(keyPath)
+	assert.Nil(t, err)
+	assert.True(t, privKey.Equal(reloaded))
+}
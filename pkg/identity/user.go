@@ -97,29 +97,11 @@ func StoreUserIdentity(path string, user *UserIdentity, password []byte) error {
 
 	// encrypt the private key using a password, and store it
 
-	key, salt, err := deriveKey(password, nil)
+	ciphertext, err := EncryptWithPassword(user.PrivateKeyBytes, password)
 	if err != nil {
 		return err
 	}
 
-	blockCipher, err := aes.NewCipher(key)
-	if err != nil {
-		return err
-	}
-
-	gcm, err := cipher.NewGCM(blockCipher)
-	if err != nil {
-		return err
-	}
-
-	nonce := make([]byte, gcm.NonceSize())
-	if _, err = rand.Read(nonce); err != nil {
-		return err
-	}
-
-	ciphertext := gcm.Seal(nonce, nonce, user.PrivateKeyBytes, nil)
-	ciphertext = append(ciphertext, salt...)
-
 	certPath, privKeyPath := keyPaths(path, user.Username)
 
 	err = ioutil.WriteFile(privKeyPath, ciphertext, 0600)
@@ -156,10 +138,32 @@ func LoadUserIdentity(path, username string, password []byte) (*UserIdentity, er
 		return nil, err
 	}
 
-	salt := data[len(data)-32:]
-	data = data[:len(data)-32]
+	privKeyBytes, err := DecryptWithPassword(data, password)
+	if err != nil {
+		return nil, err
+	}
 
-	key, _, err := deriveKey([]byte(password), salt)
+	block, _ = pem.Decode(privKeyBytes)
+
+	privKey, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	return &UserIdentity{
+		Username: username,
+		Cert:     cert,
+		PrivKey:  privKey,
+
+		CertBytes:       certPEMBytes,
+		PrivateKeyBytes: privKeyBytes,
+	}, nil
+}
+
+// EncryptWithPassword encrypts plaintext with a key derived from password. The salt used to
+// derive the key is appended to the returned ciphertext.
+func EncryptWithPassword(plaintext, password []byte) ([]byte, error) {
+	key, salt, err := deriveKey(password, nil)
 	if err != nil {
 		return nil, err
 	}
@@ -174,28 +178,44 @@ func LoadUserIdentity(path, username string, password []byte) (*UserIdentity, er
 		return nil, err
 	}
 
-	nonce, ciphertext := data[:gcm.NonceSize()], data[gcm.NonceSize():]
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err = rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	ciphertext := gcm.Seal(nonce, nonce, plaintext, nil)
+	return append(ciphertext, salt...), nil
+}
+
+// DecryptWithPassword decrypts data encrypted by EncryptWithPassword
+func DecryptWithPassword(data, password []byte) ([]byte, error) {
+	if len(data) < 32 {
+		return nil, errors.New("encrypted data is too short")
+	}
+	salt := data[len(data)-32:]
+	data = data[:len(data)-32]
 
-	privKeyBytes, err := gcm.Open(nil, nonce, ciphertext, nil)
+	key, _, err := deriveKey(password, salt)
 	if err != nil {
 		return nil, err
 	}
 
-	block, _ = pem.Decode(privKeyBytes)
+	blockCipher, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
 
-	privKey, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+	gcm, err := cipher.NewGCM(blockCipher)
 	if err != nil {
 		return nil, err
 	}
 
-	return &UserIdentity{
-		Username: username,
-		Cert:     cert,
-		PrivKey:  privKey,
+	if len(data) < gcm.NonceSize() {
+		return nil, errors.New("encrypted data is too short")
+	}
+	nonce, ciphertext := data[:gcm.NonceSize()], data[gcm.NonceSize():]
 
-		CertBytes:       certPEMBytes,
-		PrivateKeyBytes: privKeyBytes,
-	}, nil
+	return gcm.Open(nil, nonce, ciphertext, nil)
 }
 
 func deriveKey(password, salt []byte) ([]byte, []byte, error) {
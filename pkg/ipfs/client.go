@@ -9,7 +9,10 @@ import (
 	"mime/multipart"
 	"net/http"
 	"net/url"
+	"sort"
 	"strings"
+
+	ma "github.com/multiformats/go-multiaddr"
 )
 
 type Client struct {
@@ -220,6 +223,37 @@ func (c *Client) AddPeer(peerAddr string) (*AddPeerResponse, error) {
 	return &res, nil
 }
 
+type RemovePeerResponse struct {
+	ID     string
+	Status string
+}
+
+// RemovePeer stops IPFS from maintaining a peering connection with the node at peerAddr, and
+// disconnects from it.
+func (c *Client) RemovePeer(peerAddr string) (*RemovePeerResponse, error) {
+	addr, err := ma.NewMultiaddr(peerAddr)
+	if err != nil {
+		return nil, err
+	}
+	peerID, err := addr.ValueForProtocol(ma.P_P2P)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't retrieve p2p value in multiaddr: %s", peerAddr)
+	}
+
+	var res RemovePeerResponse
+	err = c.postRequest(fmt.Sprintf("/swarm/peering/rm?arg=%s", peerID), nil, &res)
+	if err != nil {
+		return nil, err
+	}
+
+	var disconnectRes struct{}
+	err = c.postRequest(fmt.Sprintf("/swarm/disconnect?arg=%s", peerAddr), nil, &disconnectRes)
+	if err != nil {
+		return nil, err
+	}
+	return &res, nil
+}
+
 type AddFileResponse struct {
 	Bytes int64
 	Hash  string
@@ -251,3 +285,39 @@ func (c *Client) CatFile(path string) (io.Reader, error) {
 
 	return resp.Body, nil
 }
+
+type ListPinsResponse struct {
+	Keys map[string]struct {
+		Type string
+	}
+}
+
+// ListPins returns the CIDs of all content pinned recursively by this IPFS node
+func (c *Client) ListPins() ([]string, error) {
+	var res ListPinsResponse
+	err := c.postRequest("/pin/ls?type=recursive", nil, &res)
+	if err != nil {
+		return nil, err
+	}
+
+	pins := make([]string, 0, len(res.Keys))
+	for cid := range res.Keys {
+		pins = append(pins, cid)
+	}
+	sort.Strings(pins)
+	return pins, nil
+}
+
+type AddPinResponse struct {
+	Pins []string
+}
+
+// AddPin pins the content at cid. This blocks until the content has been fetched.
+func (c *Client) AddPin(cid string) (*AddPinResponse, error) {
+	var res AddPinResponse
+	err := c.postRequest(fmt.Sprintf("/pin/add?arg=%s", cid), nil, &res)
+	if err != nil {
+		return nil, err
+	}
+	return &res, nil
+}
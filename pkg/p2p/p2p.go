@@ -45,6 +45,20 @@ func NewNode(port string, priv crypto.PrivKey) (*Node, error) {
 	return node, nil
 }
 
+// NewNodeFromHost wraps a host that has already been set up, such as one on a mock network.
+// The node's address is the first one the host listens on.
+func NewNodeFromHost(h host.Host) *Node {
+	var listen ma.Multiaddr
+	if addrs := h.Addrs(); len(addrs) > 0 {
+		listen = addrs[0]
+	}
+
+	return &Node{
+		listenAddr: listen,
+		host:       h,
+	}
+}
+
 func (n *Node) ConstructMultiAddr() string {
 	return n.Addr().String() + "/p2p/" + n.Host().ID().Pretty()
 }
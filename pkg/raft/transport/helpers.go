@@ -1,9 +1,12 @@
 package transport
 
 import (
-	"encoding/json"
+	"bufio"
+	"errors"
 	"fmt"
+	"io"
 
+	"github.com/hashicorp/go-msgpack/codec"
 	"github.com/hashicorp/raft"
 )
 
@@ -19,78 +22,148 @@ const (
 	rpcTimeoutNow
 )
 
-// RaftRequest and RatResponse allow for us to serialize each message type and allow
-// us to figure out the right type to unmarshal into once the message is received.
-type RaftRequest struct {
-	RPCType uint8  `json:"rpc_type"`
-	Args    []byte `json:"args"`
+// RPCs are encoded the same way as in hashicorp's NetworkTransport. A request is a single byte
+// giving the RPC type, followed by the msgpack encoded arguments. InstallSnapshot requests are
+// followed by the snapshot itself, which is exactly InstallSnapshotRequest.Size bytes long.
+// A response is the msgpack encoded error string, which is empty on success, followed by the
+// msgpack encoded response.
+
+// rpcCodec encodes and decodes RPCs on a single stream. Several RPCs can be sent on the same
+// stream one after the other.
+type rpcCodec struct {
+	r   *bufio.Reader
+	w   *bufio.Writer
+	dec *codec.Decoder
+	enc *codec.Encoder
 }
 
-type RaftResponse struct {
-	RPCType uint8  `json:"rpc_type"`
-	Resp    []byte `json:"resp"`
+// newRPCCodec reads RPCs from r and writes them to w. Either of them can be nil if the codec is
+// only used in one direction.
+func newRPCCodec(r io.Reader, w io.Writer) *rpcCodec {
+	c := &rpcCodec{}
+	if r != nil {
+		c.r = bufio.NewReader(r)
+		c.dec = codec.NewDecoder(c.r, &codec.MsgpackHandle{})
+	}
+	if w != nil {
+		c.w = bufio.NewWriter(w)
+		c.enc = codec.NewEncoder(c.w, &codec.MsgpackHandle{})
+	}
+	return c
 }
 
-func unmarshalRPCRequest(rpcType uint8, buf []byte) (interface{}, error) {
-	switch rpcType {
-	case rpcAppendEntries:
-		var res raft.AppendEntriesRequest
-		err := json.Unmarshal(buf, &res)
-		if err != nil {
-			return nil, err
-		}
-		return &res, nil
-	case rpcRequestVote:
-		var res raft.RequestVoteRequest
-		err := json.Unmarshal(buf, &res)
-		if err != nil {
-			return nil, err
-		}
-		return &res, nil
-	case rpcInstallSnapshot:
-		var res raft.InstallSnapshotRequest
-		err := json.Unmarshal(buf, &res)
-		if err != nil {
-			return nil, err
-		}
-		return &res, nil
-	case rpcTimeoutNow:
-		var res raft.TimeoutNowRequest
-		err := json.Unmarshal(buf, &res)
+// writeRequest sends an RPC, along with the snapshot if it is an InstallSnapshot RPC
+func (c *rpcCodec) writeRequest(rpcType uint8, args interface{}, data io.Reader) error {
+	err := c.w.WriteByte(rpcType)
+	if err != nil {
+		return err
+	}
+
+	err = c.enc.Encode(args)
+	if err != nil {
+		return err
+	}
+
+	if data != nil {
+		_, err = io.Copy(c.w, data)
 		if err != nil {
-			return nil, err
+			return fmt.Errorf("error sending snapshot: %s", err)
 		}
-		return &res, nil
-	default:
-		return nil, fmt.Errorf("%d is not a valid rpc type", rpcType)
 	}
+
+	return c.w.Flush()
+}
+
+// readRequest receives an RPC. For InstallSnapshot RPCs, the returned reader yields the
+// snapshot, and it must be read to the end before the next RPC on the stream can be read.
+func (c *rpcCodec) readRequest() (uint8, interface{}, io.Reader, error) {
+	rpcType, err := c.r.ReadByte()
+	if err != nil {
+		return 0, nil, nil, err
+	}
+
+	command, err := newRPCRequest(rpcType)
+	if err != nil {
+		return 0, nil, nil, err
+	}
+
+	err = c.dec.Decode(command)
+	if err != nil {
+		return 0, nil, nil, err
+	}
+
+	var data io.Reader
+	if req, ok := command.(*raft.InstallSnapshotRequest); ok {
+		data = io.LimitReader(c.r, req.Size)
+	}
+
+	return rpcType, command, data, nil
+}
+
+// writeResponse sends the result of an RPC
+func (c *rpcCodec) writeResponse(rpcErr error, resp interface{}) error {
+	errStr := ""
+	if rpcErr != nil {
+		errStr = rpcErr.Error()
+	}
+
+	err := c.enc.Encode(errStr)
+	if err != nil {
+		return err
+	}
+
+	err = c.enc.Encode(resp)
+	if err != nil {
+		return err
+	}
+
+	return c.w.Flush()
+}
+
+// readResponse receives the result of an RPC into resp. If the RPC failed on the receiving
+// node, its error is returned.
+func (c *rpcCodec) readResponse(resp interface{}) error {
+	var rpcErr string
+	err := c.dec.Decode(&rpcErr)
+	if err != nil {
+		return err
+	}
+
+	err = c.dec.Decode(resp)
+	if err != nil {
+		return err
+	}
+
+	if rpcErr != "" {
+		return errors.New(rpcErr)
+	}
+	return nil
 }
 
-func unmarshalRPCResponse(rpcType uint8, buf []byte, resp interface{}) error {
+// newRPCRequest returns an empty request of the given RPC type to decode into
+func newRPCRequest(rpcType uint8) (interface{}, error) {
 	switch rpcType {
 	case rpcAppendEntries:
-		err := json.Unmarshal(buf, resp)
-		if err != nil {
-			return err
-		}
+		return &raft.AppendEntriesRequest{}, nil
 	case rpcRequestVote:
-		err := json.Unmarshal(buf, resp)
-		if err != nil {
-			return err
-		}
+		return &raft.RequestVoteRequest{}, nil
 	case rpcInstallSnapshot:
-		err := json.Unmarshal(buf, resp)
-		if err != nil {
-			return err
-		}
+		return &raft.InstallSnapshotRequest{}, nil
 	case rpcTimeoutNow:
-		err := json.Unmarshal(buf, resp)
-		if err != nil {
-			return err
-		}
+		return &raft.TimeoutNowRequest{}, nil
 	default:
-		return fmt.Errorf("%d is not a valid rpc type", rpcType)
+		return nil, fmt.Errorf("%d is not a valid rpc type", rpcType)
 	}
+}
 
-	return nil
+// isHeartbeat returns true if an RPC is a heartbeat from the leader, which can skip the queue
+func isHeartbeat(command interface{}) bool {
+	req, ok := command.(*raft.AppendEntriesRequest)
+	if !ok {
+		return false
+	}
+
+	return req.Term != 0 && req.Leader != nil &&
+		req.PrevLogEntry == 0 && req.PrevLogTerm == 0 &&
+		len(req.Entries) == 0 && req.LeaderCommitIndex == 0
 }
@@ -1,8 +1,6 @@
 package transport
 
 import (
-	"bytes"
-	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -12,6 +10,10 @@ import (
 	"github.com/hashicorp/raft"
 )
 
+// rpcContentType marks requests encoded with rpcCodec. Nodes from before RPCs were encoded with
+// msgpack send JSON, and their requests are turned away instead of failing to decode.
+const rpcContentType = "application/msgpack"
+
 // The main idea of HTTPTransport is to allow multiple instances of Raft on one machine communicate with peers in their respective clusters
 // through a single port on a single process, while remaining isolated from each other.
 type HTTPTransport struct {
@@ -48,15 +50,16 @@ func (ht *HTTPTransport) AppendEntriesPipeline(id raft.ServerID, target raft.Ser
 }
 
 func (ht *HTTPTransport) AppendEntries(id raft.ServerID, target raft.ServerAddress, args *raft.AppendEntriesRequest, resp *raft.AppendEntriesResponse) error {
-	return ht.genericRPC(id, target, rpcAppendEntries, args, resp)
+	return ht.genericRPC(id, target, rpcAppendEntries, args, nil, resp)
 }
 
 func (ht *HTTPTransport) RequestVote(id raft.ServerID, target raft.ServerAddress, args *raft.RequestVoteRequest, resp *raft.RequestVoteResponse) error {
-	return ht.genericRPC(id, target, rpcRequestVote, args, resp)
+	return ht.genericRPC(id, target, rpcRequestVote, args, nil, resp)
 }
 
+// InstallSnapshot streams the snapshot to the peer in the body of the request
 func (ht *HTTPTransport) InstallSnapshot(id raft.ServerID, target raft.ServerAddress, args *raft.InstallSnapshotRequest, resp *raft.InstallSnapshotResponse, data io.Reader) error {
-	return ht.genericRPC(id, target, rpcInstallSnapshot, args, resp)
+	return ht.genericRPC(id, target, rpcInstallSnapshot, args, io.LimitReader(data, args.Size), resp)
 }
 
 func (ht *HTTPTransport) EncodePeer(id raft.ServerID, addr raft.ServerAddress) []byte {
@@ -74,47 +77,30 @@ func (ht *HTTPTransport) SetHeartbeatHandler(cb func(rpc raft.RPC)) {
 }
 
 func (ht *HTTPTransport) TimeoutNow(id raft.ServerID, target raft.ServerAddress, args *raft.TimeoutNowRequest, resp *raft.TimeoutNowResponse) error {
-	return ht.genericRPC(id, target, rpcTimeoutNow, args, resp)
+	return ht.genericRPC(id, target, rpcTimeoutNow, args, nil, resp)
 }
 
-func (ht *HTTPTransport) genericRPC(id raft.ServerID, target raft.ServerAddress, rpcType uint8, args interface{}, resp interface{}) error {
-
-	buf, err := json.Marshal(args)
-	if err != nil {
-		return err
-	}
-
-	req := &RaftRequest{
-		RPCType: rpcType,
-		Args:    buf,
-	}
-
-	// yolo try to json marshal without using proper serialization format
-	encoded, err := json.Marshal(req)
-	if err != nil {
-		return err
-	}
-
-	postResp, err := http.Post(string(target), "application/json", bytes.NewReader(encoded))
-	if err != nil {
-		return err
-	}
+func (ht *HTTPTransport) genericRPC(id raft.ServerID, target raft.ServerAddress, rpcType uint8, args interface{}, data io.Reader, resp interface{}) error {
+	// The request is encoded as it is sent, so that snapshots don't have to be held in memory.
+	// The client closes the body if the request fails, which stops the encoding as well.
+	body, bodyWriter := io.Pipe()
+	go func() {
+		bodyWriter.CloseWithError(newRPCCodec(nil, bodyWriter).writeRequest(rpcType, args, data))
+	}()
 
-	respBody, err := ioutil.ReadAll(postResp.Body)
+	postResp, err := http.Post(string(target), rpcContentType, body)
 	if err != nil {
 		return err
 	}
+	defer postResp.Body.Close()
 
 	if postResp.StatusCode != http.StatusOK {
+		respBody, err := ioutil.ReadAll(postResp.Body)
+		if err != nil {
+			return err
+		}
 		return fmt.Errorf("error: got status response %d: %s", postResp.StatusCode, string(respBody))
-
-	}
-
-	var htResp RaftResponse
-	err = json.Unmarshal(respBody, &htResp)
-	if err != nil {
-		return err
 	}
 
-	return unmarshalRPCResponse(rpcType, htResp.Resp, resp)
+	return newRPCCodec(postResp.Body, nil).readResponse(resp)
 }
@@ -1,11 +1,16 @@
 package transport
 
 import (
-	"encoding/json"
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
 	"testing"
 
+	"github.com/gorilla/mux"
 	"github.com/hashicorp/raft"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestRPCMarshaling(t *testing.T) {
@@ -21,16 +26,74 @@ func TestRPCMarshaling(t *testing.T) {
 		},
 	}
 
-	aeBuf, err := json.Marshal(appendEntriesReq)
+	var buf bytes.Buffer
+	err := newRPCCodec(nil, &buf).writeRequest(rpcAppendEntries, appendEntriesReq, nil)
 	if err != nil {
 		t.Error(err)
 	}
 
-	res, err := unmarshalRPCRequest(rpcAppendEntries, aeBuf)
+	rpcType, res, data, err := newRPCCodec(&buf, nil).readRequest()
 	if err != nil {
 		t.Error(err)
 	}
+	assert.Equal(t, rpcAppendEntries, rpcType)
+	assert.Nil(t, data)
 	assert.Equal(t, raft.ProtocolVersion(3), res.(*raft.AppendEntriesRequest).RPCHeader.ProtocolVersion)
 	assert.Equal(t, uint64(20), res.(*raft.AppendEntriesRequest).PrevLogEntry)
 	assert.Equal(t, uint64(102), res.(*raft.AppendEntriesRequest).Entries[0].Index)
 }
+
+func TestHTTPInstallSnapshot(t *testing.T) {
+	trans, err := NewHTTPTransport("")
+	require.Nil(t, err)
+
+	multiplexer := NewRaftMultiplexer()
+	require.Nil(t, multiplexer.RegisterListener("abc", trans))
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		multiplexer.handler(w, mux.SetURLVars(r, map[string]string{"community_id": "abc"}))
+	}))
+	defer server.Close()
+
+	snapshot := bytes.Repeat([]byte("snapshot"), 100000)
+	received := make(chan []byte, 1)
+	go func() {
+		rpc := <-trans.Consumer()
+		buf, err := ioutil.ReadAll(rpc.Reader)
+		if err != nil {
+			rpc.Respond(nil, err)
+			return
+		}
+		received <- buf
+		rpc.Respond(&raft.InstallSnapshotResponse{Term: 4, Success: true}, nil)
+	}()
+
+	var resp raft.InstallSnapshotResponse
+	err = trans.InstallSnapshot("peer", raft.ServerAddress(server.URL+"/abc"), &raft.InstallSnapshotRequest{
+		Term: 4,
+		Size: int64(len(snapshot)),
+	}, &resp, bytes.NewReader(snapshot))
+	require.Nil(t, err)
+	assert.True(t, resp.Success)
+	assert.Equal(t, uint64(4), resp.Term)
+	assert.Equal(t, snapshot, <-received)
+}
+
+func TestHTTPRejectsJSONRequests(t *testing.T) {
+	trans, err := NewHTTPTransport("")
+	require.Nil(t, err)
+
+	multiplexer := NewRaftMultiplexer()
+	require.Nil(t, multiplexer.RegisterListener("abc", trans))
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		multiplexer.handler(w, mux.SetURLVars(r, map[string]string{"community_id": "abc"}))
+	}))
+	defer server.Close()
+
+	// requests from nodes that still encode RPCs as JSON are turned away
+	resp, err := http.Post(server.URL+"/abc", "application/json", bytes.NewReader([]byte(`{"RPCType": 0}`)))
+	require.Nil(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusUnsupportedMediaType, resp.StatusCode)
+}
@@ -1,15 +1,13 @@
 package transport
 
 import (
-	"bufio"
 	"context"
-	"encoding/base64"
-	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
 	"sync"
+	"time"
 
-	"github.com/eagraf/habitat/pkg/compass"
 	"github.com/hashicorp/go-hclog"
 	"github.com/hashicorp/raft"
 	"github.com/libp2p/go-libp2p/core/host"
@@ -17,6 +15,7 @@ import (
 	"github.com/libp2p/go-libp2p/core/peer"
 	"github.com/libp2p/go-libp2p/core/peerstore"
 	"github.com/libp2p/go-libp2p/core/protocol"
+	ma "github.com/multiformats/go-multiaddr"
 )
 
 var (
@@ -41,6 +40,10 @@ type LibP2PTransport struct {
 	host       host.Host
 	protocol   protocol.ID
 	publicAddr raft.ServerAddress
+
+	// lastContact is when each peer last responded to an RPC
+	lastContact     map[raft.ServerID]time.Time
+	lastContactLock sync.Mutex
 }
 
 // LibP2PTransportConfig encapsulates configuration for the network transport layer.
@@ -70,6 +73,8 @@ func NewLibP2PTransportWithConfig(
 		host:       config.Host,
 		protocol:   config.Protocol,
 		publicAddr: config.PublicAddr,
+
+		lastContact: make(map[raft.ServerID]time.Time),
 	}
 
 	trans.host.SetStreamHandler(trans.protocol, trans.streamHandler)
@@ -108,14 +113,15 @@ func (t *LibP2PTransport) SetHeartbeatHandler(cb func(rpc raft.RPC)) {
 	t.heartbeatFn = cb
 }
 
-// Close is used to stop the network transport.
+// Close is used to stop the network transport. The host is shared with the rest of the node,
+// so only this transport's protocol handler is removed.
 func (t *LibP2PTransport) Close() error {
 	t.shutdownLock.Lock()
 	defer t.shutdownLock.Unlock()
 
 	if !t.shutdown {
 		close(t.shutdownCh)
-		t.host.Close()
+		t.host.RemoveStreamHandler(t.protocol)
 		t.shutdown = true
 	}
 	return nil
@@ -135,89 +141,93 @@ func (t *LibP2PTransport) LocalAddr() raft.ServerAddress {
 // AppendEntriesPipeline returns an interface that can be used to pipeline
 // AppendEntries requests.
 func (t *LibP2PTransport) AppendEntriesPipeline(id raft.ServerID, target raft.ServerAddress) (raft.AppendPipeline, error) {
-	return nil, raft.ErrPipelineReplicationNotSupported
+	stream, err := t.openStream(id, target)
+	if err != nil {
+		return nil, err
+	}
+
+	return newLibP2PPipeline(t, id, stream), nil
 }
 
 // AppendEntries implements the Transport interface.
 func (t *LibP2PTransport) AppendEntries(id raft.ServerID, target raft.ServerAddress, args *raft.AppendEntriesRequest, resp *raft.AppendEntriesResponse) error {
-	return t.genericRPC(id, target, rpcAppendEntries, args, resp)
+	return t.genericRPC(id, target, rpcAppendEntries, args, nil, resp)
 }
 
 // RequestVote implements the Transport interface.
 func (t *LibP2PTransport) RequestVote(id raft.ServerID, target raft.ServerAddress, args *raft.RequestVoteRequest, resp *raft.RequestVoteResponse) error {
-	return t.genericRPC(id, target, rpcRequestVote, args, resp)
+	return t.genericRPC(id, target, rpcRequestVote, args, nil, resp)
 }
 
-// genericRPC handles a simple request/response RPC.
-func (t *LibP2PTransport) genericRPC(id raft.ServerID, target raft.ServerAddress, rpcType uint8, args interface{}, resp interface{}) error {
-	// Dial a new connection
+// openStream opens a new stream for this transport's protocol to a peer
+func (t *LibP2PTransport) openStream(id raft.ServerID, target raft.ServerAddress) (network.Stream, error) {
 	peerID, err := peer.Decode(string(id))
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	_, addr, err := compass.DecomposeNodeMultiaddr(string(target))
+	// the target may or may not include the peer ID, which is already known from the server ID
+	targetAddr, err := ma.NewMultiaddr(string(target))
 	if err != nil {
-		return err
+		return nil, err
+	}
+	addr, _ := peer.SplitAddr(targetAddr)
+	if addr == nil {
+		return nil, fmt.Errorf("no transport address in %s", target)
 	}
 
 	t.host.Peerstore().AddAddr(peerID, addr, peerstore.PermanentAddrTTL)
 
-	stream, err := t.host.NewStream(context.Background(), peerID, t.protocol)
+	return t.host.NewStream(context.Background(), peerID, t.protocol)
+}
+
+// genericRPC handles a simple request/response RPC. If data is set, it is streamed to the peer
+// after the request.
+func (t *LibP2PTransport) genericRPC(id raft.ServerID, target raft.ServerAddress, rpcType uint8, args interface{}, data io.Reader, resp interface{}) error {
+	stream, err := t.openStream(id, target)
 	if err != nil {
 		return err
 	}
 	defer stream.Close()
-	rw := bufio.NewReadWriter(bufio.NewReader(stream), bufio.NewWriter(stream))
 
-	buf, err := json.Marshal(args)
+	c := newRPCCodec(stream, stream)
+	err = c.writeRequest(rpcType, args, data)
 	if err != nil {
+		stream.Reset()
 		return err
 	}
 
-	req := &RaftRequest{
-		RPCType: rpcType,
-		Args:    buf,
-	}
-
-	// yolo try to json marshal without using proper serialization format
-	marshaled, err := json.Marshal(req)
+	err = c.readResponse(resp)
 	if err != nil {
 		return err
 	}
 
-	encoded := base64.StdEncoding.EncodeToString(marshaled)
-	encoded = encoded + "\n"
+	t.recordContact(id)
 
-	_, err = rw.Write([]byte(encoded))
-	if err != nil {
-		stream.Reset()
-		return err
-	}
-	rw.Flush()
+	return nil
+}
 
-	encodedResp, err := rw.ReadBytes('\n')
-	if err != nil {
-		return err
-	}
+func (t *LibP2PTransport) recordContact(id raft.ServerID) {
+	t.lastContactLock.Lock()
+	defer t.lastContactLock.Unlock()
 
-	marshaledResp, err := base64.StdEncoding.DecodeString(string(encodedResp))
-	if err != nil {
-		return err
-	}
+	t.lastContact[id] = time.Now()
+}
 
-	var htResp RaftResponse
-	err = json.Unmarshal(marshaledResp, &htResp)
-	if err != nil {
-		return err
-	}
+// LastContact returns when the peer last responded to an RPC from this node, or the zero time if
+// it never has. The leader sends heartbeats to every peer, so on the leader this tracks how
+// responsive each peer is.
+func (t *LibP2PTransport) LastContact(id raft.ServerID) time.Time {
+	t.lastContactLock.Lock()
+	defer t.lastContactLock.Unlock()
 
-	return unmarshalRPCResponse(rpcType, htResp.Resp, resp)
+	return t.lastContact[id]
 }
 
-// InstallSnapshot implements the Transport interface.
+// InstallSnapshot implements the Transport interface. The snapshot is streamed to the peer
+// straight from data, rather than being loaded into memory.
 func (t *LibP2PTransport) InstallSnapshot(id raft.ServerID, target raft.ServerAddress, args *raft.InstallSnapshotRequest, resp *raft.InstallSnapshotResponse, data io.Reader) error {
-	return t.genericRPC(id, target, rpcTimeoutNow, args, resp)
+	return t.genericRPC(id, target, rpcInstallSnapshot, args, io.LimitReader(data, args.Size), resp)
 }
 
 // EncodePeer implements the Transport interface.
@@ -232,69 +242,46 @@ func (t *LibP2PTransport) DecodePeer(buf []byte) raft.ServerAddress {
 
 // TimeoutNow implements the Transport interface.
 func (t *LibP2PTransport) TimeoutNow(id raft.ServerID, target raft.ServerAddress, args *raft.TimeoutNowRequest, resp *raft.TimeoutNowResponse) error {
-	return t.genericRPC(id, target, rpcTimeoutNow, args, resp)
+	return t.genericRPC(id, target, rpcTimeoutNow, args, nil, resp)
 }
 
+// streamHandler serves RPCs sent on a stream until the sender closes it. Pipelined
+// AppendEntries requests all arrive on the same stream.
 func (t *LibP2PTransport) streamHandler(s network.Stream) {
 	// add the peer's address to our address book if we don't have it already
 	t.host.Peerstore().AddAddr(s.Conn().RemotePeer(), s.Conn().RemoteMultiaddr(), peerstore.PermanentAddrTTL)
 
 	defer s.Close()
 
-	rw := bufio.NewReadWriter(bufio.NewReader(s), bufio.NewWriter(s))
-
-	if err := t.handleCommand(rw); err != nil {
-		s.Reset()
-		if err != io.EOF {
-			t.logger.Error("failed to decode incoming command", "error", err)
+	c := newRPCCodec(s, s)
+	for {
+		if err := t.handleCommand(c); err != nil {
+			if err != io.EOF {
+				s.Reset()
+				t.logger.Error("failed to decode incoming command", "error", err)
+			}
+			return
 		}
-		return
 	}
 }
 
 // handleCommand is used to decode and dispatch a single command.
-func (t *LibP2PTransport) handleCommand(rw *bufio.ReadWriter) error {
-	encoded, err := rw.ReadBytes('\n')
+func (t *LibP2PTransport) handleCommand(c *rpcCodec) error {
+	_, command, data, err := c.readRequest()
 	if err != nil {
 		return err
 	}
 
-	marshaled, err := base64.StdEncoding.DecodeString(string(encoded))
-	if err != nil {
-		return err
-	}
-
-	var req RaftRequest
-	err = json.Unmarshal(marshaled, &req)
-	if err != nil {
-		return err
-	}
-
-	command, err := unmarshalRPCRequest(req.RPCType, req.Args)
-	if err != nil {
-		return err
-	}
-
-	// If we got an AppendEntriesRequest, check if it is a heartbeat
-	isHeartbeat := false
-	if req.RPCType == rpcAppendEntries {
-		aeReq := command.(*raft.AppendEntriesRequest)
-		if aeReq.Term != 0 && aeReq.Leader != nil &&
-			aeReq.PrevLogEntry == 0 && aeReq.PrevLogTerm == 0 &&
-			len(aeReq.Entries) == 0 && aeReq.LeaderCommitIndex == 0 {
-			isHeartbeat = true
-		}
-	}
-
 	// Create the RPC object
 	respCh := make(chan raft.RPCResponse, 1)
 	rpc := raft.RPC{
 		Command:  command,
+		Reader:   data,
 		RespChan: respCh,
 	}
 
 	// Check for heartbeat fast-path
-	if isHeartbeat {
+	if isHeartbeat(command) {
 		t.heartbeatFnLock.Lock()
 		fn := t.heartbeatFn
 		t.heartbeatFnLock.Unlock()
@@ -313,43 +300,19 @@ func (t *LibP2PTransport) handleCommand(rw *bufio.ReadWriter) error {
 
 	// Wait for response
 RESP:
-	// we will differentiate the heartbeat fast path from normal RPCs with labels
 	select {
 	case resp := <-respCh:
-		// Send the error first
-		var respBody []byte
-		if resp.Error != nil {
-			respBody = []byte(resp.Error.Error())
-		} else {
-			// Serialize raft response and serialize into HTTP response
-			buf, err := json.Marshal(resp.Response)
-			if err != nil {
-				return err
-			}
-			respBody = buf
-		}
-
-		httpRespBody := &RaftResponse{
-			RPCType: req.RPCType,
-			Resp:    []byte(respBody),
-		}
-
-		marshaledBody, err := json.Marshal(httpRespBody)
-		if err != nil {
-			return err
-		}
-
-		encoded := base64.StdEncoding.EncodeToString(marshaledBody)
-		encoded = encoded + "\n"
-
-		_, err = rw.Write([]byte(encoded))
-		if err != nil {
-			return err
-		}
-		rw.Flush()
-
+		err = c.writeResponse(resp.Error, resp.Response)
 	case <-t.shutdownCh:
 		return ErrTransportShutdown
 	}
-	return nil
+	if err != nil {
+		return err
+	}
+
+	// a failed InstallSnapshot may not have read the whole snapshot, so skip the rest of it
+	if data != nil {
+		_, err = io.Copy(io.Discard, data)
+	}
+	return err
 }
@@ -2,20 +2,27 @@ package transport
 
 import (
 	"bufio"
+	"bytes"
 	"context"
+	"errors"
 	"fmt"
+	"io/ioutil"
 	"testing"
 	"time"
 
 	"github.com/eagraf/habitat/pkg/compass"
+	"github.com/hashicorp/raft"
 	"github.com/libp2p/go-libp2p"
 	crypto "github.com/libp2p/go-libp2p/core/crypto"
 	"github.com/libp2p/go-libp2p/core/host"
 	"github.com/libp2p/go-libp2p/core/network"
 	"github.com/libp2p/go-libp2p/core/peer"
 	"github.com/libp2p/go-libp2p/core/peerstore"
+	mocknet "github.com/libp2p/go-libp2p/p2p/net/mock"
 	ma "github.com/multiformats/go-multiaddr"
 	"github.com/rs/zerolog/log"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 // helper method - create a lib-p2p host to listen on a port
@@ -90,3 +97,116 @@ func TestLibP2PConn(t *testing.T) {
 
 	time.Sleep(5 * time.Second)
 }
+
+// newMockTransports returns a pair of transports for the same cluster on a mock network
+func newMockTransports(t *testing.T) (*LibP2PTransport, *LibP2PTransport) {
+	mn, err := mocknet.FullMeshConnected(2)
+	require.Nil(t, err)
+	t.Cleanup(func() {
+		mn.Close()
+	})
+
+	hosts := mn.Hosts()
+	t1 := NewLibP2PTransport(hosts[0], "/test-raft", raft.ServerAddress(hosts[0].Addrs()[0].String()))
+	t2 := NewLibP2PTransport(hosts[1], "/test-raft", raft.ServerAddress(hosts[1].Addrs()[0].String()))
+	t.Cleanup(func() {
+		t1.Close()
+		t2.Close()
+	})
+
+	return t1, t2
+}
+
+func TestLibP2PTransportAppendEntries(t *testing.T) {
+	t1, t2 := newMockTransports(t)
+
+	go func() {
+		for rpc := range t2.Consumer() {
+			req := rpc.Command.(*raft.AppendEntriesRequest)
+			if req.PrevLogEntry == 0 {
+				rpc.Respond(nil, errors.New("rejected"))
+				continue
+			}
+			rpc.Respond(&raft.AppendEntriesResponse{Term: req.Term, LastLog: req.Entries[0].Index, Success: true}, nil)
+		}
+	}()
+
+	id := raft.ServerID(t2.host.ID().Pretty())
+	var resp raft.AppendEntriesResponse
+	err := t1.AppendEntries(id, t2.LocalAddr(), &raft.AppendEntriesRequest{
+		Term:         3,
+		PrevLogEntry: 9,
+		Entries:      []*raft.Log{{Index: 10, Term: 3, Data: []byte("data")}},
+	}, &resp)
+	require.Nil(t, err)
+	assert.True(t, resp.Success)
+	assert.Equal(t, uint64(10), resp.LastLog)
+	assert.False(t, t1.LastContact(id).IsZero())
+
+	// errors from the receiving node are passed back
+	err = t1.AppendEntries(id, t2.LocalAddr(), &raft.AppendEntriesRequest{Term: 3}, &resp)
+	require.NotNil(t, err)
+	assert.Equal(t, "rejected", err.Error())
+}
+
+func TestLibP2PTransportPipeline(t *testing.T) {
+	t1, t2 := newMockTransports(t)
+
+	go func() {
+		for rpc := range t2.Consumer() {
+			req := rpc.Command.(*raft.AppendEntriesRequest)
+			rpc.Respond(&raft.AppendEntriesResponse{LastLog: req.PrevLogEntry + 1, Success: true}, nil)
+		}
+	}()
+
+	pipeline, err := t1.AppendEntriesPipeline(raft.ServerID(t2.host.ID().Pretty()), t2.LocalAddr())
+	require.Nil(t, err)
+	defer pipeline.Close()
+
+	// every request is sent before any response is read
+	for i := uint64(0); i < 10; i++ {
+		_, err := pipeline.AppendEntries(&raft.AppendEntriesRequest{
+			Term:         1,
+			PrevLogEntry: i,
+			Entries:      []*raft.Log{{Index: i + 1, Term: 1}},
+		}, &raft.AppendEntriesResponse{})
+		require.Nil(t, err)
+	}
+
+	for i := uint64(0); i < 10; i++ {
+		select {
+		case future := <-pipeline.Consumer():
+			require.Nil(t, future.Error())
+			assert.Equal(t, i, future.Request().PrevLogEntry)
+			assert.Equal(t, i+1, future.Response().LastLog)
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for pipelined response")
+		}
+	}
+}
+
+func TestLibP2PTransportInstallSnapshot(t *testing.T) {
+	t1, t2 := newMockTransports(t)
+
+	snapshot := bytes.Repeat([]byte("snapshot"), 100000)
+	received := make(chan []byte, 1)
+	go func() {
+		rpc := <-t2.Consumer()
+		buf, err := ioutil.ReadAll(rpc.Reader)
+		if err != nil {
+			rpc.Respond(nil, err)
+			return
+		}
+		received <- buf
+		rpc.Respond(&raft.InstallSnapshotResponse{Term: 2, Success: true}, nil)
+	}()
+
+	var resp raft.InstallSnapshotResponse
+	err := t1.InstallSnapshot(raft.ServerID(t2.host.ID().Pretty()), t2.LocalAddr(), &raft.InstallSnapshotRequest{
+		Term: 2,
+		Size: int64(len(snapshot)),
+	}, &resp, bytes.NewReader(snapshot))
+	require.Nil(t, err)
+	assert.True(t, resp.Success)
+	assert.Equal(t, snapshot, <-received)
+}
@@ -1,9 +1,7 @@
 package transport
 
 import (
-	"encoding/json"
 	"fmt"
-	"io/ioutil"
 	"net/http"
 	"time"
 
@@ -69,47 +67,28 @@ func (rm *RaftMultiplexer) handler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	buf, err := ioutil.ReadAll(r.Body)
-	if err != nil {
-		writeError(w, http.StatusInternalServerError, fmt.Sprintf("unable to read req body: %s", err))
-		return
-	}
-
-	var reqBody RaftRequest
-	err = json.Unmarshal(buf, &reqBody)
-	if err != nil {
-		writeError(w, http.StatusInternalServerError, fmt.Sprintf("unable to unmarshal req body: %s", err))
+	if contentType := r.Header.Get("Content-Type"); contentType != rpcContentType {
+		writeError(w, http.StatusUnsupportedMediaType, fmt.Sprintf("raft requests must be encoded as %s, not %s", rpcContentType, contentType))
 		return
 	}
 
-	command, err := unmarshalRPCRequest(reqBody.RPCType, reqBody.Args)
+	c := newRPCCodec(r.Body, w)
+	_, command, data, err := c.readRequest()
 	if err != nil {
 		writeError(w, http.StatusBadRequest, fmt.Sprintf("error unmarshaling command: %s", err))
 		return
 	}
 
-	// If we got an AppendEntriesRequest, check if it is a heartbeat
-	isHeartbeat := false
-	if reqBody.RPCType == rpcAppendEntries {
-		aeReq := command.(*raft.AppendEntriesRequest)
-		if aeReq.Term != 0 && aeReq.Leader != nil &&
-			aeReq.PrevLogEntry == 0 && aeReq.PrevLogTerm == 0 &&
-			len(aeReq.Entries) == 0 && aeReq.LeaderCommitIndex == 0 {
-			isHeartbeat = true
-
-		}
-	}
-
 	respChan := make(chan raft.RPCResponse, 1)
 	consumeCh := transport.consumeCh
 
 	rpc := &raft.RPC{
-		Command: command,
-		// TODO figure out the reader part
+		Command:  command,
+		Reader:   data,
 		RespChan: respChan,
 	}
 
-	if isHeartbeat {
+	if isHeartbeat(command) {
 		transport.heartbeatFnLock.Lock()
 		fn := transport.heartbeatFn
 		transport.heartbeatFnLock.Unlock()
@@ -125,31 +104,10 @@ RESP:
 	// Wait on response channel to respond to request
 	resp := <-respChan
 
-	if resp.Error != nil {
-		// TODO find a more appropriate error code
-		writeError(w, http.StatusBadRequest, resp.Error.Error())
-		return
-	}
-
-	// Serialize raft response and serialize into HTTP response
-	buf, err = json.Marshal(resp.Response)
-	if err != nil {
-		writeError(w, http.StatusInternalServerError, fmt.Sprintf("error marshaling raft response: %s", err))
-		return
-	}
-
-	httpRespBody := &RaftResponse{
-		RPCType: reqBody.RPCType,
-		Resp:    buf,
-	}
-
-	marshaledBody, err := json.Marshal(httpRespBody)
+	// Errors returned by Raft are sent back in the response body, along with the response
+	w.Header().Set("Content-Type", rpcContentType)
+	err = c.writeResponse(resp.Error, resp.Response)
 	if err != nil {
-		writeError(w, http.StatusInternalServerError, fmt.Sprintf("error marshaling http response body: %s", err))
-		return
+		log.Error().Err(err).Msgf("error writing raft response for community %s", communityID)
 	}
-
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusOK)
-	w.Write([]byte(marshaledBody))
 }
@@ -0,0 +1,147 @@
+package transport
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/raft"
+	"github.com/libp2p/go-libp2p/core/network"
+)
+
+// maxPipelineInFlight is how many AppendEntries requests can be waiting for a response on a
+// pipeline at once, matching hashicorp's NetworkTransport
+const maxPipelineInFlight = 128
+
+// ErrPipelineShutdown is returned when requests are sent on a pipeline after it has been closed
+var ErrPipelineShutdown = errors.New("append pipeline closed")
+
+// libp2pPipeline sends AppendEntries requests to a peer on a single stream without waiting for
+// the previous response. The peer handles requests on a stream in order, so responses come back
+// in the order the requests were sent.
+type libp2pPipeline struct {
+	trans  *LibP2PTransport
+	id     raft.ServerID
+	stream network.Stream
+	codec  *rpcCodec
+
+	doneCh       chan raft.AppendFuture
+	inprogressCh chan *appendFuture
+
+	shutdown     bool
+	shutdownCh   chan struct{}
+	shutdownLock sync.Mutex
+}
+
+func newLibP2PPipeline(trans *LibP2PTransport, id raft.ServerID, stream network.Stream) *libp2pPipeline {
+	p := &libp2pPipeline{
+		trans:        trans,
+		id:           id,
+		stream:       stream,
+		codec:        newRPCCodec(stream, stream),
+		doneCh:       make(chan raft.AppendFuture, maxPipelineInFlight),
+		inprogressCh: make(chan *appendFuture, maxPipelineInFlight),
+		shutdownCh:   make(chan struct{}),
+	}
+	go p.decodeResponses()
+	return p
+}
+
+// decodeResponses reads responses off the stream, and hands back the finished requests
+func (p *libp2pPipeline) decodeResponses() {
+	for {
+		select {
+		case future := <-p.inprogressCh:
+			err := p.codec.readResponse(future.resp)
+			if err == nil {
+				p.trans.recordContact(p.id)
+			}
+			future.respond(err)
+
+			select {
+			case p.doneCh <- future:
+			case <-p.shutdownCh:
+				return
+			}
+		case <-p.shutdownCh:
+			return
+		}
+	}
+}
+
+// AppendEntries sends a request without waiting for its response
+func (p *libp2pPipeline) AppendEntries(args *raft.AppendEntriesRequest, resp *raft.AppendEntriesResponse) (raft.AppendFuture, error) {
+	future := &appendFuture{
+		start: time.Now(),
+		args:  args,
+		resp:  resp,
+		errCh: make(chan error, 1),
+	}
+
+	err := p.codec.writeRequest(rpcAppendEntries, args, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	select {
+	case p.inprogressCh <- future:
+		return future, nil
+	case <-p.shutdownCh:
+		return nil, ErrPipelineShutdown
+	}
+}
+
+// Consumer returns the requests that have received a response
+func (p *libp2pPipeline) Consumer() <-chan raft.AppendFuture {
+	return p.doneCh
+}
+
+// Close stops the pipeline. Requests still waiting for a response are abandoned.
+func (p *libp2pPipeline) Close() error {
+	p.shutdownLock.Lock()
+	defer p.shutdownLock.Unlock()
+
+	if p.shutdown {
+		return nil
+	}
+
+	p.stream.Reset()
+	close(p.shutdownCh)
+	p.shutdown = true
+	return nil
+}
+
+// appendFuture implements raft.AppendFuture for pipelined requests
+type appendFuture struct {
+	start time.Time
+	args  *raft.AppendEntriesRequest
+	resp  *raft.AppendEntriesResponse
+
+	err   error
+	errCh chan error
+	once  sync.Once
+}
+
+func (f *appendFuture) respond(err error) {
+	f.errCh <- err
+}
+
+// Error blocks until the peer has responded
+func (f *appendFuture) Error() error {
+	f.once.Do(func() {
+		f.err = <-f.errCh
+	})
+	return f.err
+}
+
+func (f *appendFuture) Start() time.Time {
+	return f.start
+}
+
+func (f *appendFuture) Request() *raft.AppendEntriesRequest {
+	return f.args
+}
+
+func (f *appendFuture) Response() *raft.AppendEntriesResponse {
+	return f.resp
+}
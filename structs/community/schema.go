@@ -1,7 +1,21 @@
 package community
 
-import "encoding/json"
+import (
+	"encoding/json"
+	"fmt"
+)
 
+const (
+	// LatestSchemaVersion is the newest version of the community state schema this node supports
+	LatestSchemaVersion = 6
+
+	// SchemaVersionKey is the field in the community state holding its schema version. States from
+	// before schemas were versioned don't have it, and are version 1.
+	SchemaVersionKey = "schema_version"
+)
+
+// CommunityStateSchema is the schema for version 1 of the community state, which every community
+// starts out at.
 var CommunityStateSchema = []byte(`{
 	"$defs": {
 		"member": {
@@ -9,7 +23,11 @@ var CommunityStateSchema = []byte(`{
 			"properties": {
 				"id": { "type": "string" },
 				"username": { "type": "string" },
-				"certificate": { "type": "string" }
+				"certificate": { "type": "string" },
+				"role": {
+					"type": "string",
+					"enum": [ "admin", "member", "guest" ]
+				}
 			},
 			"required": [ "username", "certificate" ]
 		},
@@ -63,6 +81,10 @@ var CommunityStateSchema = []byte(`{
 		"community_id": {
 			"type": "string"
 		},
+		"version": {
+			"type": "integer",
+			"minimum": 0
+		},
 		"counter": {
 			"type": "integer",
 			"minmum": 0
@@ -109,13 +131,163 @@ var CommunityStateSchema = []byte(`{
 	"required": [ "community_id", "members", "nodes", "processes", "process_instances" ]
 }`)
 
+// version 2 adds schema_version, and requires every member to have a role
+var communityStateSchemaV2 = deriveSchema(CommunityStateSchema, func(schema map[string]interface{}) {
+	properties := schema["properties"].(map[string]interface{})
+	properties[SchemaVersionKey] = map[string]interface{}{
+		"type":    "integer",
+		"minimum": 2,
+	}
+	schema["required"] = append(schema["required"].([]interface{}), SchemaVersionKey)
+
+	member := schema["$defs"].(map[string]interface{})["member"].(map[string]interface{})
+	member["required"] = append(member["required"].([]interface{}), "role")
+})
+
+// version 3 adds raft_config
+var communityStateSchemaV3 = deriveSchema(communityStateSchemaV2, func(schema map[string]interface{}) {
+	properties := schema["properties"].(map[string]interface{})
+	properties["raft_config"] = map[string]interface{}{
+		"type": []interface{}{"object", "null"},
+		"properties": map[string]interface{}{
+			"heartbeat_timeout_ms": nonNegativeInteger(),
+			"election_timeout_ms":  nonNegativeInteger(),
+			"commit_timeout_ms":    nonNegativeInteger(),
+			"snapshot_interval_ms": nonNegativeInteger(),
+			"snapshot_threshold":   nonNegativeInteger(),
+			"trailing_logs":        nonNegativeInteger(),
+		},
+	}
+})
+
+// version 4 adds process revisions, and whether the latest revision is rolled out one node at a time
+var communityStateSchemaV4 = deriveSchema(communityStateSchemaV3, func(schema map[string]interface{}) {
+	defs := schema["$defs"].(map[string]interface{})
+
+	process := defs["process"].(map[string]interface{})["properties"].(map[string]interface{})
+	process["revision"] = nonNegativeInteger()
+	process["rolling_update"] = map[string]interface{}{
+		"type": "boolean",
+	}
+
+	instance := defs["process_instance"].(map[string]interface{})["properties"].(map[string]interface{})
+	instance["revision"] = nonNegativeInteger()
+})
+
+// version 5 adds node labels, and the placements the scheduler places process instances by
+var communityStateSchemaV5 = deriveSchema(communityStateSchemaV4, func(schema map[string]interface{}) {
+	defs := schema["$defs"].(map[string]interface{})
+	defs["labels"] = map[string]interface{}{
+		"type": []interface{}{"null", "object"},
+		"additionalProperties": map[string]interface{}{
+			"type": "string",
+		},
+	}
+	defs["placement"] = map[string]interface{}{
+		"type": []interface{}{"null", "object"},
+		"properties": map[string]interface{}{
+			"replicas":       nonNegativeInteger(),
+			"node_labels":    schemaRef("labels"),
+			"one_per_member": map[string]interface{}{"type": "boolean"},
+			"spread":         map[string]interface{}{"type": "string"},
+			"avoid_nodes": map[string]interface{}{
+				"type":  []interface{}{"null", "array"},
+				"items": map[string]interface{}{"type": "string"},
+			},
+		},
+		"required": []interface{}{"replicas"},
+	}
+
+	node := defs["node"].(map[string]interface{})["properties"].(map[string]interface{})
+	node["labels"] = schemaRef("labels")
+
+	process := defs["process"].(map[string]interface{})["properties"].(map[string]interface{})
+	process["placement"] = schemaRef("placement")
+})
+
+// version 6 adds the status each node reports for its process instances
+var communityStateSchemaV6 = deriveSchema(communityStateSchemaV5, func(schema map[string]interface{}) {
+	defs := schema["$defs"].(map[string]interface{})
+
+	instance := defs["process_instance"].(map[string]interface{})["properties"].(map[string]interface{})
+	instance["status"] = map[string]interface{}{
+		"type": "string",
+		"enum": []interface{}{InstanceStatusPending, InstanceStatusRunning, InstanceStatusFailed},
+	}
+	instance["last_error"] = map[string]interface{}{
+		"type": "string",
+	}
+	instance["restart_count"] = nonNegativeInteger()
+	instance["updated_at"] = nonNegativeInteger()
+})
+
+// CommunityStateSchemas holds the schema for every supported version of the community state
+var CommunityStateSchemas = map[int][]byte{
+	1: CommunityStateSchema,
+	2: communityStateSchemaV2,
+	3: communityStateSchemaV3,
+	4: communityStateSchemaV4,
+	5: communityStateSchemaV5,
+	6: communityStateSchemaV6,
+}
+
+func nonNegativeInteger() map[string]interface{} {
+	return map[string]interface{}{
+		"type":    "integer",
+		"minimum": 0,
+	}
+}
+
+// schemaRef refers to one of the definitions under $defs
+func schemaRef(def string) map[string]interface{} {
+	return map[string]interface{}{
+		"$ref": "#/$defs/" + def,
+	}
+}
+
+// deriveSchema builds a new version of a schema by modifying a copy of the previous one
+func deriveSchema(base []byte, modify func(schema map[string]interface{})) []byte {
+	var schema map[string]interface{}
+	err := json.Unmarshal(base, &schema)
+	if err != nil {
+		panic(fmt.Sprintf("invalid community state schema: %s", err))
+	}
+
+	modify(schema)
+
+	res, err := json.Marshal(schema)
+	if err != nil {
+		panic(fmt.Sprintf("invalid community state schema: %s", err))
+	}
+	return res
+}
+
+// GetSchemaVersion reads the schema version of a JSON encoded community state
+func GetSchemaVersion(state []byte) (int, error) {
+	var versioned struct {
+		SchemaVersion int `json:"schema_version"`
+	}
+	err := json.Unmarshal(state, &versioned)
+	if err != nil {
+		return 0, err
+	}
+
+	if versioned.SchemaVersion == 0 {
+		return 1, nil
+	}
+	return versioned.SchemaVersion, nil
+}
+
 // CommunityState is a Go struct that correspons to the community state JSON schema
 // TODO look at ways to generate this from the schema or vice versa so there is a single
 // source of truth
 type CommunityState struct {
 	CommunityID      string             `json:"community_id"`
+	SchemaVersion    int                `json:"schema_version,omitempty"`
+	Version          uint64             `json:"version"` // Raft index of the last applied batch of transitions
 	Counter          int                `json:"counter,omitempty"`
 	IPFSConfig       *IPFSConfig        `json:"ipfs_config"`
+	RaftConfig       *RaftConfig        `json:"raft_config,omitempty"`
 	Members          []*Member          `json:"members"`
 	Nodes            []*Node            `json:"nodes"`
 	Processes        []*Process         `json:"processes"`
@@ -127,10 +299,57 @@ type IPFSConfig struct {
 	BootstrapAddresses []string `json:"bootstrap_addresses"`
 }
 
+// RaftConfig tunes the Raft cluster a community runs on. Durations are in milliseconds, and
+// fields left at 0 use Raft's defaults.
+type RaftConfig struct {
+	HeartbeatTimeoutMs int64  `json:"heartbeat_timeout_ms,omitempty"`
+	ElectionTimeoutMs  int64  `json:"election_timeout_ms,omitempty"`
+	CommitTimeoutMs    int64  `json:"commit_timeout_ms,omitempty"`
+	SnapshotIntervalMs int64  `json:"snapshot_interval_ms,omitempty"`
+	SnapshotThreshold  uint64 `json:"snapshot_threshold,omitempty"`
+	TrailingLogs       uint64 `json:"trailing_logs,omitempty"`
+}
+
+const (
+	RoleAdmin  = "admin"
+	RoleMember = "member"
+	RoleGuest  = "guest"
+)
+
+// roleRanks orders roles by privilege. A member holding a role may do anything allowed to lower roles.
+var roleRanks = map[string]int{
+	RoleGuest:  0,
+	RoleMember: 1,
+	RoleAdmin:  2,
+}
+
+func ValidRole(role string) bool {
+	_, ok := roleRanks[role]
+	return ok
+}
+
 type Member struct {
 	ID          string `json:"id"`
 	Username    string `json:"username"`
 	Certificate []byte `json:"certificate"`
+	Role        string `json:"role,omitempty"`
+}
+
+// GetRole returns the member's role. Members from before roles were introduced are regular members.
+func (m *Member) GetRole() string {
+	if m.Role == "" {
+		return RoleMember
+	}
+	return m.Role
+}
+
+// HasRole returns true if the member's role is at least as privileged as the given role
+func (m *Member) HasRole(role string) bool {
+	required, ok := roleRanks[role]
+	if !ok {
+		return false
+	}
+	return roleRanks[m.GetRole()] >= required
 }
 
 type Node struct {
@@ -140,6 +359,9 @@ type Node struct {
 	IPFSSwarmAddress string `json:"ipfs_swarm_address"` // This should be temporary
 	Certificate      []byte `json:"certificate"`
 	MemberID         string `json:"member_id"`
+
+	// Labels describe the node to the process scheduler, such as its region or hardware
+	Labels map[string]string `json:"labels,omitempty"`
 }
 
 type Process struct {
@@ -151,11 +373,118 @@ type Process struct {
 	Args    []string `json:"args"`
 
 	Config interface{} `json:"config"`
+
+	// Revision counts the updates made to the process since it was started. RollingUpdate is set
+	// if the latest update is rolled out to one node at a time.
+	Revision      uint64 `json:"revision,omitempty"`
+	RollingUpdate bool   `json:"rolling_update,omitempty"`
+
+	// Placement is set for processes whose instances are placed by the scheduler
+	Placement *Placement `json:"placement,omitempty"`
+}
+
+// Placement tells the scheduler how many instances of a process to run, and which nodes they
+// may run on
+type Placement struct {
+	Replicas int `json:"replicas"`
+
+	// NodeLabels restricts instances to nodes that have all of these labels
+	NodeLabels map[string]string `json:"node_labels,omitempty"`
+
+	// OnePerMember runs at most one instance on the nodes of each member
+	OnePerMember bool `json:"one_per_member,omitempty"`
+
+	// Spread is a node label key. Instances are spread as evenly as possible across the
+	// label's values, so that for example each region gets its share of them.
+	Spread string `json:"spread,omitempty"`
+
+	// AvoidNodes are never given an instance
+	AvoidNodes []string `json:"avoid_nodes,omitempty"`
 }
 
 type ProcessInstance struct {
 	ProcessID string `json:"process_id"`
 	NodeID    string `json:"node_id"`
+
+	// Revision is the revision of the process the instance is running. It lags behind the
+	// process's revision until the instance has been restarted after an update.
+	Revision uint64 `json:"revision,omitempty"`
+
+	// The node running the instance reports its status, the error that made it fail if it did,
+	// how many times it has been restarted since it was first started, and when it last
+	// reported, in seconds since the Unix epoch
+	Status       string `json:"status,omitempty"`
+	LastError    string `json:"last_error,omitempty"`
+	RestartCount int    `json:"restart_count,omitempty"`
+	UpdatedAt    int64  `json:"updated_at,omitempty"`
+}
+
+const (
+	InstanceStatusPending = "pending"
+	InstanceStatusRunning = "running"
+	InstanceStatusFailed  = "failed"
+)
+
+// ValidInstanceStatus returns true if a node can report its process instance as having the status
+func ValidInstanceStatus(status string) bool {
+	switch status {
+	case InstanceStatusPending, InstanceStatusRunning, InstanceStatusFailed:
+		return true
+	default:
+		return false
+	}
+}
+
+// GetStatus returns the instance's status, which is pending until its node first reports on it
+func (i *ProcessInstance) GetStatus() string {
+	if i.Status == "" {
+		return InstanceStatusPending
+	}
+	return i.Status
+}
+
+func (s *CommunityState) GetMember(memberID string) *Member {
+	for _, m := range s.Members {
+		if m.ID == memberID {
+			return m
+		}
+	}
+	return nil
+}
+
+func (s *CommunityState) GetNode(nodeID string) *Node {
+	for _, n := range s.Nodes {
+		if n.ID == nodeID {
+			return n
+		}
+	}
+	return nil
+}
+
+func (s *CommunityState) GetProcess(processID string) *Process {
+	for _, p := range s.Processes {
+		if p.ID == processID {
+			return p
+		}
+	}
+	return nil
+}
+
+func (s *CommunityState) GetProcessInstance(processID, nodeID string) *ProcessInstance {
+	for _, i := range s.ProcessInstances {
+		if i.ProcessID == processID && i.NodeID == nodeID {
+			return i
+		}
+	}
+	return nil
+}
+
+// GetSchemaVersion returns the schema version of the state, which is 1 if it was never migrated
+func (s *CommunityState) GetSchemaVersion() int {
+	if s.SchemaVersion == 0 {
+		return 1
+	}
+	return s.SchemaVersion
 }
 
 func NewCommunityState() *CommunityState {
@@ -27,3 +27,19 @@ func TestCommunityStateSchema(t *testing.T) {
 		t.Error()
 	}
 }
+
+func TestMemberRoles(t *testing.T) {
+	admin := &Member{ID: "a", Role: RoleAdmin}
+	member := &Member{ID: "b", Role: RoleMember}
+	guest := &Member{ID: "c", Role: RoleGuest}
+	legacy := &Member{ID: "d"}
+
+	assert.True(t, admin.HasRole(RoleAdmin))
+	assert.True(t, admin.HasRole(RoleGuest))
+	assert.False(t, member.HasRole(RoleAdmin))
+	assert.True(t, member.HasRole(RoleMember))
+	assert.False(t, guest.HasRole(RoleMember))
+	assert.True(t, guest.HasRole(RoleGuest))
+	assert.Equal(t, RoleMember, legacy.GetRole())
+	assert.False(t, admin.HasRole("superuser"))
+}
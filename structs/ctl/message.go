@@ -8,21 +8,35 @@ import (
 )
 
 const (
-	CommandInspect               = "inspect"
-	CommandStart                 = "start"
-	CommandStop                  = "stop"
-	CommandListProcesses         = "ps"
-	CommandCommunityCreate       = "community_create"
-	CommandCommunityJoin         = "community_join"
-	CommandCommunityAddMember    = "community_add_member"
-	CommandCommunityPropose      = "community_propose"
-	CommandCommunityState        = "community_state"
-	CommandCommunityList         = "community_list"
-	CommandCommunityPS           = "community_ps"
-	CommandCommunityStartProcess = "community_start_process"
-	CommandCommunityStopProcess  = "community_stop_process"
-	CommandDataServerRead        = "data_read"
-	CommandDataServerWrite       = "data_write"
+	CommandInspect                     = "inspect"
+	CommandStart                       = "start"
+	CommandStop                        = "stop"
+	CommandListProcesses               = "ps"
+	CommandCommunityCreate             = "community_create"
+	CommandCommunityJoin               = "community_join"
+	CommandCommunityAddMember          = "community_add_member"
+	CommandCommunityRemoveNode         = "community_remove_node"
+	CommandCommunitySetNodeLabels      = "community_set_node_labels"
+	CommandCommunityRemoveMember       = "community_remove_member"
+	CommandCommunityLeave              = "community_leave"
+	CommandCommunityPropose            = "community_propose"
+	CommandCommunityState              = "community_state"
+	CommandCommunityHistory            = "community_history"
+	CommandCommunityWatch              = "community_watch"
+	CommandCommunitySnapshotExport     = "community_snapshot_export"
+	CommandCommunitySnapshotImport     = "community_snapshot_import"
+	CommandCommunityBackup             = "community_backup"
+	CommandCommunityRestore            = "community_restore"
+	CommandCommunityClusterStatus      = "community_cluster_status"
+	CommandCommunityTransferLeadership = "community_transfer_leadership"
+	CommandCommunityRaftConfig         = "community_raft_config"
+	CommandCommunityList               = "community_list"
+	CommandCommunityPS                 = "community_ps"
+	CommandCommunityStartProcess       = "community_start_process"
+	CommandCommunityStopProcess        = "community_stop_process"
+	CommandCommunityUpdateProcess      = "community_update_process"
+	CommandDataServerRead              = "data_read"
+	CommandDataServerWrite             = "data_write"
 
 	CommandAddFile = "add_file"
 	CommandGetFile = "get_file"
@@ -54,10 +68,36 @@ func requestType(req interface{}) (string, error) {
 		return CommandCommunityJoin, nil
 	case CommunityAddMemberRequest, *CommunityAddMemberRequest, CommunityAddMemberResponse, *CommunityAddMemberResponse:
 		return CommandCommunityAddMember, nil
+	case CommunityRemoveNodeRequest, *CommunityRemoveNodeRequest, CommunityRemoveNodeResponse, *CommunityRemoveNodeResponse:
+		return CommandCommunityRemoveNode, nil
+	case CommunitySetNodeLabelsRequest, *CommunitySetNodeLabelsRequest, CommunitySetNodeLabelsResponse, *CommunitySetNodeLabelsResponse:
+		return CommandCommunitySetNodeLabels, nil
+	case CommunityRemoveMemberRequest, *CommunityRemoveMemberRequest, CommunityRemoveMemberResponse, *CommunityRemoveMemberResponse:
+		return CommandCommunityRemoveMember, nil
+	case CommunityLeaveRequest, *CommunityLeaveRequest, CommunityLeaveResponse, *CommunityLeaveResponse:
+		return CommandCommunityLeave, nil
 	case CommunityProposeRequest, *CommunityProposeRequest, CommunityProposeResponse, *CommunityProposeResponse:
 		return CommandCommunityPropose, nil
 	case CommunityStateRequest, *CommunityStateRequest, CommunityStateResponse, *CommunityStateResponse:
 		return CommandCommunityState, nil
+	case CommunityHistoryRequest, *CommunityHistoryRequest, CommunityHistoryResponse, *CommunityHistoryResponse:
+		return CommandCommunityHistory, nil
+	case CommunityWatchRequest, *CommunityWatchRequest, CommunityWatchMessage, *CommunityWatchMessage:
+		return CommandCommunityWatch, nil
+	case CommunitySnapshotExportRequest, *CommunitySnapshotExportRequest, CommunitySnapshotExportResponse, *CommunitySnapshotExportResponse:
+		return CommandCommunitySnapshotExport, nil
+	case CommunitySnapshotImportRequest, *CommunitySnapshotImportRequest, CommunitySnapshotImportResponse, *CommunitySnapshotImportResponse:
+		return CommandCommunitySnapshotImport, nil
+	case CommunityBackupRequest, *CommunityBackupRequest, CommunityBackupResponse, *CommunityBackupResponse:
+		return CommandCommunityBackup, nil
+	case CommunityRestoreRequest, *CommunityRestoreRequest, CommunityRestoreResponse, *CommunityRestoreResponse:
+		return CommandCommunityRestore, nil
+	case CommunityClusterStatusRequest, *CommunityClusterStatusRequest, CommunityClusterStatusResponse, *CommunityClusterStatusResponse:
+		return CommandCommunityClusterStatus, nil
+	case CommunityTransferLeadershipRequest, *CommunityTransferLeadershipRequest, CommunityTransferLeadershipResponse, *CommunityTransferLeadershipResponse:
+		return CommandCommunityTransferLeadership, nil
+	case CommunityRaftConfigRequest, *CommunityRaftConfigRequest, CommunityRaftConfigResponse, *CommunityRaftConfigResponse:
+		return CommandCommunityRaftConfig, nil
 	case CommunityListRequest, *CommunityListRequest, CommunityListResponse, *CommunityListResponse:
 		return CommandCommunityList, nil
 	case CommunityPSRequest, *CommunityPSRequest, CommunityPSResponse, *CommunityPSResponse:
@@ -66,6 +106,8 @@ func requestType(req interface{}) (string, error) {
 		return CommandCommunityStartProcess, nil
 	case CommunityStopProcessRequest, *CommunityStopProcessRequest, CommunityStopProcessResponse, *CommunityStopProcessResponse:
 		return CommandCommunityStopProcess, nil
+	case CommunityUpdateProcessRequest, *CommunityUpdateProcessRequest, CommunityUpdateProcessResponse, *CommunityUpdateProcessResponse:
+		return CommandCommunityUpdateProcess, nil
 	case AddFileRequest, *AddFileRequest, AddFileResponse, *AddFileResponse:
 		return CommandAddFile, nil
 	case GetFileRequest, *GetFileRequest, GetFileResponse, *GetFileResponse:
@@ -2,6 +2,7 @@ package ctl
 
 import (
 	"encoding/json"
+	"time"
 
 	"github.com/eagraf/habitat/structs/community"
 	"github.com/qri-io/jsonschema"
@@ -43,6 +44,10 @@ type PSResponse struct {
 type CommunityCreateRequest struct {
 	CommunityName     string `json:"community_name"`
 	CreateIPFSCluster bool   `json:"create_ipfs_cluster"`
+
+	// Backend is the cluster backend the community runs on, either "raft" or "local". Communities
+	// on the local backend can only ever have this node. If empty, Raft is used.
+	Backend string `json:"backend,omitempty"`
 }
 
 type CommunityCreateResponse struct {
@@ -75,12 +80,64 @@ type CommunityAddMemberRequest struct {
 type CommunityAddMemberResponse struct {
 }
 
+type CommunityRemoveNodeRequest struct {
+	CommunityID string `json:"community_id"`
+	NodeID      string `json:"node_id"`
+}
+
+type CommunityRemoveNodeResponse struct {
+}
+
+// CommunitySetNodeLabelsRequest replaces the labels the scheduler places process instances by
+type CommunitySetNodeLabelsRequest struct {
+	CommunityID string            `json:"community_id"`
+	NodeID      string            `json:"node_id"`
+	Labels      map[string]string `json:"labels"`
+}
+
+type CommunitySetNodeLabelsResponse struct {
+}
+
+type CommunityRemoveMemberRequest struct {
+	CommunityID string `json:"community_id"`
+	MemberID    string `json:"member_id"`
+}
+
+type CommunityRemoveMemberResponse struct {
+}
+
+type CommunityLeaveRequest struct {
+	CommunityID string `json:"community_id"`
+	Delete      bool   `json:"delete"`
+}
+
+type CommunityLeaveResponse struct {
+}
+
+// ProposedTransition is a single transition to propose, encoded the same way as the transitions
+// in a community's history
+type ProposedTransition struct {
+	Type       string          `json:"type"`
+	Transition json.RawMessage `json:"transition"`
+}
+
 type CommunityProposeRequest struct {
-	CommunityID     string `json:"community_id"`
-	StateTransition []byte `json:"state_transition"`
+	CommunityID string                `json:"community_id"`
+	Transitions []*ProposedTransition `json:"transitions"`
+
+	// ExpectedVersion is the state version the transition was built against. If the state has
+	// changed since, the proposal is rejected and should be retried. Leave it as 0 to skip the check.
+	ExpectedVersion uint64 `json:"expected_version,omitempty"`
+
+	// DryRun checks the transitions without committing them, and returns the changes they would make
+	DryRun bool `json:"dry_run,omitempty"`
 }
 
 type CommunityProposeResponse struct {
+	Version uint64 `json:"version"` // version the transitions were committed at, or the current version for a dry run
+
+	// Diff is a JSON patch of the changes a dry run would make to the community state
+	Diff json.RawMessage `json:"diff,omitempty"`
 }
 
 type CommunityStateRequest struct {
@@ -88,7 +145,133 @@ type CommunityStateRequest struct {
 }
 
 type CommunityStateResponse struct {
-	State []byte `json:"community_state"`
+	State   []byte `json:"community_state"`
+	Version uint64 `json:"version"`
+}
+
+type CommunityHistoryRequest struct {
+	CommunityID string `json:"community_id"`
+	Type        string `json:"type,omitempty"`   // only return transitions of this type
+	Before      uint64 `json:"before,omitempty"` // only return transitions committed before this Raft index
+	Limit       int    `json:"limit,omitempty"`
+}
+
+type CommunityHistoryEntry struct {
+	Index      uint64          `json:"index"`
+	Term       uint64          `json:"term"`
+	AppendedAt time.Time       `json:"appended_at"`
+	Type       string          `json:"type"`
+	Transition json.RawMessage `json:"transition,omitempty"`
+	Proposer   string          `json:"proposer,omitempty"`
+}
+
+type CommunityHistoryResponse struct {
+	Entries []*CommunityHistoryEntry `json:"entries"`
+
+	// NextBefore should be passed as Before to fetch the next page. It is 0 if there are no more entries.
+	NextBefore uint64 `json:"next_before,omitempty"`
+}
+
+type CommunitySnapshotExportRequest struct {
+	CommunityID string `json:"community_id"`
+}
+
+type CommunitySnapshotExportResponse struct {
+	Snapshot []byte `json:"snapshot"`
+}
+
+type CommunitySnapshotImportRequest struct {
+	Snapshot []byte `json:"snapshot"`
+
+	// Standalone resets the community's cluster to contain only this node. This is used to
+	// recover a community that has no other nodes left.
+	Standalone bool `json:"standalone"`
+}
+
+type CommunitySnapshotImportResponse struct {
+	CommunityID string `json:"community_id"`
+	Version     uint64 `json:"version"`
+}
+
+type CommunityBackupRequest struct {
+	CommunityID string `json:"community_id"`
+	Password    string `json:"password"` // the backup archive is encrypted with this password
+}
+
+type CommunityBackupResponse struct {
+	Archive []byte `json:"archive"`
+}
+
+type CommunityRestoreRequest struct {
+	Archive  []byte `json:"archive"`
+	Password string `json:"password"`
+}
+
+type CommunityRestoreResponse struct {
+	CommunityID string `json:"community_id"`
+	Version     uint64 `json:"version"`
+}
+
+type CommunityClusterStatusRequest struct {
+	CommunityID string `json:"community_id"`
+}
+
+type CommunityClusterStatusResponse struct {
+	State         string                    `json:"state"` // Raft state of the node answering the request
+	Term          uint64                    `json:"term"`
+	LeaderID      string                    `json:"leader_id"`
+	LeaderAddress string                    `json:"leader_address"`
+	CommitIndex   uint64                    `json:"commit_index"`
+	AppliedIndex  uint64                    `json:"applied_index"`
+	LastLogIndex  uint64                    `json:"last_log_index"`
+	Servers       []*CommunityClusterServer `json:"servers"`
+	Stats         map[string]string         `json:"stats"`
+}
+
+type CommunityClusterServer struct {
+	ID          string    `json:"id"`
+	Address     string    `json:"address"`
+	Suffrage    string    `json:"suffrage"`
+	Leader      bool      `json:"leader"`
+	LastContact time.Time `json:"last_contact"` // zero if unknown to the node answering the request
+}
+
+type CommunityTransferLeadershipRequest struct {
+	CommunityID string `json:"community_id"`
+	NodeID      string `json:"node_id"` // if empty, the most up to date voter is picked
+}
+
+type CommunityTransferLeadershipResponse struct{}
+
+// CommunityRaftConfigRequest replaces the settings of a community's Raft cluster
+type CommunityRaftConfigRequest struct {
+	CommunityID string                `json:"community_id"`
+	RaftConfig  *community.RaftConfig `json:"raft_config"`
+}
+
+type CommunityRaftConfigResponse struct {
+	Version uint64 `json:"version"` // version of the community state the settings were applied at
+}
+
+// CommunityWatchRequest is sent by the client after opening a community_watch websocket
+type CommunityWatchRequest struct {
+	CommunityID string `json:"community_id"`
+
+	// FromIndex resumes watching from a Raft index, replaying recent updates from that index on.
+	// If it is 0, only updates applied after the request are sent.
+	FromIndex    uint64 `json:"from_index,omitempty"`
+	IncludeState bool   `json:"include_state,omitempty"`
+}
+
+// CommunityWatchMessage is streamed to the client for every update to the community state
+type CommunityWatchMessage struct {
+	Index          uint64          `json:"index"`
+	TransitionType string          `json:"transition_type"`
+	Transition     json.RawMessage `json:"transition"`
+	Proposer       string          `json:"proposer,omitempty"`
+	State          json.RawMessage `json:"state,omitempty"` // only set if IncludeState was requested
+
+	WebsocketControl
 }
 
 type CommunityListRequest struct {
@@ -115,12 +298,16 @@ type CommunityPSResponse struct {
 type CommunityStartProcessRequest struct {
 	CommunityID string `json:"community_id"`
 
-	App   string   `json:"app"`
-	Args  []string `json:"args"`
-	Env   []string `json:"env"`
-	Flags []string `json:"flags"`
+	App    string      `json:"app"`
+	Args   []string    `json:"args"`
+	Env    []string    `json:"env"`
+	Flags  []string    `json:"flags"`
+	Config interface{} `json:"config"`
 
-	InstancesNodes []string `json:"instance_nodes"`
+	// Either InstancesNodes lists the nodes to start instances on, or Placement has the
+	// scheduler pick them
+	InstancesNodes []string             `json:"instance_nodes"`
+	Placement      *community.Placement `json:"placement,omitempty"`
 }
 
 type CommunityStartProcessResponse struct {
@@ -135,6 +322,26 @@ type CommunityStopProcessRequest struct {
 type CommunityStopProcessResponse struct {
 }
 
+// CommunityUpdateProcessRequest replaces the settings of a running process. Settings left as
+// null keep their current values.
+type CommunityUpdateProcessRequest struct {
+	CommunityID string `json:"community_id"`
+	ProcessID   string `json:"process_id"`
+
+	Args   []string    `json:"args"`
+	Env    []string    `json:"env"`
+	Flags  []string    `json:"flags"`
+	Config interface{} `json:"config"`
+
+	// Rolling restarts the process's instances one node at a time, waiting for each to come
+	// back up before moving on to the next
+	Rolling bool `json:"rolling"`
+}
+
+type CommunityUpdateProcessResponse struct {
+	Revision uint64 `json:"revision"`
+}
+
 // The following message types are for key signing exchanges
 
 type JoinInfo struct {